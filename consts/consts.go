@@ -8,9 +8,6 @@ import (
 // PlatformPublicKey is the Stellar public key of the openx platform
 var PlatformPublicKey string
 
-// PlatformSeed is the Stellar seed corresponding to the above Stellar public key
-var PlatformSeed string
-
 // PlatformEmail is the email of the platform used to send notifications related to openx
 var PlatformEmail string
 
@@ -56,9 +53,39 @@ var DbDir = ""
 // DbName is the name of the openx database
 var DbName = "opensolar.db"
 
-// OpenSolarIssuerDir is the directory where project escrow seeds are stored
+// OpenSolarIssuerDir is the directory where project issuer seeds were stored before the keystore, migrated on startup
 var OpenSolarIssuerDir = ""
 
+// RECIssuerDir is the directory where the seeds of project REC issuers were stored before the keystore, migrated on startup
+var RECIssuerDir = ""
+
+// KeyBackend is the backend that holds the platform's and issuers' keys. One of local, vault or pkcs11
+var KeyBackend = "local"
+
+// KeystoreDir is the directory of the local keystore
+var KeystoreDir = ""
+
+// KeystorePassphrase is the per deployment passphrase the local keystore's keys are encrypted with
+var KeystorePassphrase string
+
+// VaultAddress is the address of the Vault server holding keys when the vault backend is used
+var VaultAddress string
+
+// VaultToken is the token used to authenticate with Vault
+var VaultToken string
+
+// VaultMount is the path the Vault transit engine is mounted at
+var VaultMount = "transit"
+
+// PKCS11Module is the path to the PKCS#11 library of the HSM holding keys when the pkcs11 backend is used
+var PKCS11Module string
+
+// PKCS11TokenLabel is the label of the HSM token holding keys
+var PKCS11TokenLabel string
+
+// PKCS11Pin is the user pin of the HSM token
+var PKCS11Pin string
+
 // PlatformSeedFile is the location where PlatformSeedFile is stored and decrypted each time the platform is started
 var PlatformSeedFile string
 
@@ -74,11 +101,8 @@ var SeedAssetPrefix = "SeedAssets_"
 // PaybackAssetPrefix is the prefix that will be hashed to give a payback AssetID
 var PaybackAssetPrefix = "PaybackAssets_"
 
-// IssuerSeedPwd is the password of the issuer's seed
-var IssuerSeedPwd = "blah"
-
-// EscrowPwd is the password of the project escrows' seed
-var EscrowPwd = "blah"
+// RECAssetPrefix is the prefix that will be hashed to give a project's REC AssetID
+var RECAssetPrefix = "RECAssets_"
 
 // Tlsport is the default SSL port on which openx starts
 var Tlsport = 443
@@ -125,8 +149,149 @@ var TellerMaxLocalStorageSize = 2000
 // TellerPollInterval is the frequency at which we poll the interval
 var TellerPollInterval = time.Duration(3600 * 24 * time.Second)
 
+// TellerQueueBaseBackoff is the delay before the first retry of a failed outbound teller operation
+var TellerQueueBaseBackoff = time.Duration(5 * time.Second)
+
+// TellerQueueMaxBackoff caps the exponential backoff between retries of outbound teller operations
+var TellerQueueMaxBackoff = time.Duration(3600 * time.Second)
+
+// TellerCommandPollInterval is the frequency at which the teller polls the platform for config changes and commands
+var TellerCommandPollInterval = time.Duration(300 * time.Second)
+
+// TellerQueueMaxRejections is the number of times the platform can reject an outbound teller operation before it is dropped
+var TellerQueueMaxRejections = 10
+
+// TellerQueueMaxSendAttempts is the number of times an outbound teller operation that moves funds is tried before it is dropped
+var TellerQueueMaxSendAttempts = 20
+
+// TellerHeartbeatInterval is the frequency at which the teller sends a heartbeat to the platform
+var TellerHeartbeatInterval = time.Duration(300 * time.Second)
+
 // LoginRefreshInterval is the frequency at which the teller's credentials are updated (ie if you change your password, wait 5 minutes for the teller to disconnect)
 var LoginRefreshInterval = time.Duration(1200 * 60 * time.Second)
 
 // ProjectReportThreshold is the threshold above which admins are allowed to flag the project
 var ProjectReportThreshold = 10
+
+// OracleRefreshInterval is the time in seconds after which the price oracle's cached prices are refreshed
+var OracleRefreshInterval = int64(60)
+
+// OraclePriceStaleness is the age in seconds after which a price source is considered stale and ignored
+var OraclePriceStaleness = int64(15 * 60)
+
+// InvestmentMaxAttempts is the number of attempts after which a pending investment is refunded instead of resumed
+var InvestmentMaxAttempts = 3
+
+// InvestmentStuckInterval is the time in seconds after which a pending investment is reported as stuck
+var InvestmentStuckInterval = int64(10 * 60)
+
+// ReconcileInterval is the frequency at which projects are reconciled against the ledger
+var ReconcileInterval = time.Duration(3600 * 24 * time.Second)
+
+// StandingOrderPollInterval is the frequency at which due standing orders are executed
+var StandingOrderPollInterval = time.Duration(3600 * time.Second)
+
+// StandingOrderRetryInterval is the base delay in seconds before a failed standing order payback is retried
+var StandingOrderRetryInterval = int64(3600 * 6)
+
+// StandingOrderMaxRetries is the number of retries after which a standing order skips to the next payback period
+var StandingOrderMaxRetries = 3
+
+// FleetCheckInterval is the frequency at which the health of tellers and IoT hubs is checked
+var FleetCheckInterval = time.Duration(60 * time.Second)
+
+// FleetPingInterval is the frequency at which the platform pings registered teller URLs
+var FleetPingInterval = time.Duration(60 * time.Second)
+
+// FleetHeartbeatTimeout is the time in seconds without a heartbeat after which a device is considered offline
+var FleetHeartbeatTimeout = int64(15 * 60)
+
+// FleetEnergyTimeout is the time in seconds without an energy report after which a device is considered unhealthy
+var FleetEnergyTimeout = int64(2 * 24 * 3600)
+
+// FleetMaxQueueDepth is the number of pending outbound operations above which a teller is considered unhealthy
+var FleetMaxQueueDepth = 100
+
+// FleetAlertGrace is the time in seconds a device has to be unhealthy before admins are alerted
+var FleetAlertGrace = int64(10 * 60)
+
+// FleetAlertDebounce is the minimum time in seconds between two alerts for the same device
+var FleetAlertDebounce = int64(6 * 3600)
+
+// FleetHistoryLength is the number of uptime transitions stored per device
+var FleetHistoryLength = 500
+
+// ProviderPollInterval is the frequency at which IoT providers without a streaming API are polled for energy readings
+var ProviderPollInterval = time.Duration(900 * time.Second)
+
+// ProviderRetryInterval is the delay before a failed IoT provider stream is restarted
+var ProviderRetryInterval = time.Duration(60 * time.Second)
+
+// RECMintInterval is the frequency at which RECs are minted from projects' generation
+var RECMintInterval = time.Duration(3600 * 24 * time.Second)
+
+// RECTrustLimit is the number of RECs of a project that the platform's account can hold
+var RECTrustLimit = float64(1000000)
+
+// DefaultEmissionFactor is the grid emission factor in kgCO2e/kWh used for regions without a configured factor
+var DefaultEmissionFactor = 0.475
+
+// PerformanceCheckInterval is the frequency at which projects' generation is compared with their forecast
+var PerformanceCheckInterval = time.Duration(3600 * 24 * time.Second)
+
+// PerformanceWindow is the number of days of generation compared with the forecast in each check
+var PerformanceWindow = 7
+
+// PerformanceMinDays is the number of days in the window that must have readings for a check to be made
+var PerformanceMinDays = 3
+
+// PerformanceThreshold is the ratio of actual to expected generation below which a project underperforms
+var PerformanceThreshold = 0.8
+
+// PerformanceLosses is the fraction of generation lost to soiling, wiring, inverters and temperature
+var PerformanceLosses = 0.14
+
+// PerformanceAlertDebounce is the minimum time in seconds between two underperformance events of a project
+var PerformanceAlertDebounce = int64(7 * 24 * 3600)
+
+// BillingInterval is the frequency at which invoices are issued and their statuses updated
+var BillingInterval = time.Duration(3600 * 24 * time.Second)
+
+// InvoiceDueDays is the default number of days after issue that invoices are due
+var InvoiceDueDays = 15
+
+// BatteryRatedCycles is the default number of full cycles after which a battery reaches its end of life
+var BatteryRatedCycles = 4000.0
+
+// BatteryEndOfLife is the default state of health at which a battery reaches its end of life
+var BatteryEndOfLife = 0.7
+
+// BatteryMaxFade is the loss of state of health per year above which a battery is degrading too fast
+var BatteryMaxFade = 0.05
+
+// BatteryTelemetryTimeout is the time in seconds after which a battery that hasn't reported is stale
+var BatteryTelemetryTimeout = int64(24 * 3600)
+
+// MaintenanceCheckInterval is the frequency at which warranty reminders and due maintenance are checked
+var MaintenanceCheckInterval = time.Duration(3600 * 24 * time.Second)
+
+// WarrantyReminderDays are the days before a warranty expires at which contractors and developers are reminded
+var WarrantyReminderDays = []int{90, 30, 7}
+
+// WithdrawalExpiry is the time in seconds after which a withdrawal proposal that hasn't been approved expires
+var WithdrawalExpiry = int64(7 * 24 * 3600)
+
+// IntentExpiry is the time in seconds for which a transaction built for a user to sign stays valid
+var IntentExpiry = int64(15 * 60)
+
+// MqttUsername is the username used by the platform to subscribe to project MQTT brokers
+var MqttUsername string
+
+// MqttPassword is the password used by the platform to subscribe to project MQTT brokers
+var MqttPassword string
+
+// MqttConnectBaseBackoff is the delay before retrying a project MQTT broker that couldn't be reached
+var MqttConnectBaseBackoff = time.Duration(5 * time.Second)
+
+// MqttConnectMaxBackoff caps the exponential backoff between connects to a project MQTT broker
+var MqttConnectMaxBackoff = time.Duration(300 * time.Second)
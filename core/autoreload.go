@@ -0,0 +1,177 @@
+package core
+
+import (
+	"log"
+
+	"github.com/pkg/errors"
+
+	utils "github.com/Varunram/essentials/utils"
+	xlm "github.com/Varunram/essentials/xlm"
+	assets "github.com/Varunram/essentials/xlm/assets"
+	wallet "github.com/Varunram/essentials/xlm/wallet"
+
+	consts "github.com/YaleOpenLab/opensolar/consts"
+	keys "github.com/YaleOpenLab/opensolar/keys"
+	notif "github.com/YaleOpenLab/opensolar/notif"
+)
+
+// autoreload tops up a recipient's primary account with stablecoin from their secondary account
+// before a payback so that paybacks don't fail for lack of funds. The recipient unlocks the
+// secondary account once while opting in, and the platform stores its seed encrypted with the
+// platform's seed so that it can sign reloads on the recipient's behalf.
+
+// Autoreload modes
+const (
+	// AutoreloadThresholdMode tops up only when the balance would fall below the recipient's threshold
+	AutoreloadThresholdMode = "threshold"
+	// AutoreloadStandingMode tops up a fixed amount before every payback
+	AutoreloadStandingMode = "standing"
+)
+
+// Reload is a record of a single autoreload
+type Reload struct {
+	// Timestamp is the time at which the reload was performed
+	Timestamp string
+	// Amount is the amount of stablecoin reloaded
+	Amount float64
+	// Mode is the autoreload mode that triggered the reload
+	Mode string
+	// ProjIndex is the index of the project whose payback triggered the reload
+	ProjIndex int
+	// TxHash is the hash of the reload transaction
+	TxHash string
+}
+
+// stablecoinCode returns the code and issuer of the stablecoin used on the current network
+func stablecoinCode() (string, string) {
+	if consts.Mainnet {
+		return consts.AnchorUSDCode, consts.AnchorUSDAddress
+	}
+	return consts.StablecoinCode, consts.StablecoinPublicKey
+}
+
+// SetAutoreload opts a recipient into autoreloads from their secondary account. seedpwd is
+// needed to unlock the secondary account so that the platform can sign reloads from it.
+func (a *Recipient) SetAutoreload(mode string, threshold float64, amount float64, seedpwd string) error {
+	if threshold < 0 || amount < 0 {
+		return errors.New("threshold and amount can't be negative")
+	}
+
+	switch mode {
+	case AutoreloadThresholdMode:
+	case AutoreloadStandingMode:
+		if amount == 0 {
+			return errors.New("standing reloads need a non zero amount")
+		}
+	default:
+		return errors.New("autoreload mode not recognized")
+	}
+
+	if a.U.SecondaryWallet.PublicKey == "" {
+		return errors.New("recipient does not have a secondary account")
+	}
+
+	secSeed, err := wallet.DecryptSeed(a.U.SecondaryWallet.EncryptedSeed, seedpwd)
+	if err != nil {
+		return errors.Wrap(err, "could not unlock secondary account")
+	}
+
+	a.AutoreloadSeed, err = keys.Encrypt(keys.Platform, []byte(secSeed))
+	if err != nil {
+		return errors.Wrap(err, "could not encrypt secondary seed")
+	}
+
+	a.Autoreload = true
+	a.AutoreloadMode = mode
+	a.AutoreloadThreshold = threshold
+	a.AutoreloadAmount = amount
+	return a.Save()
+}
+
+// DisableAutoreload opts a recipient out of autoreloads
+func (a *Recipient) DisableAutoreload() error {
+	a.Autoreload = false
+	a.AutoreloadSeed = nil
+	return a.Save()
+}
+
+// reloadAmount returns the amount that should be reloaded before a payback
+func (a *Recipient) reloadAmount(balance float64, payback float64) float64 {
+	if a.AutoreloadMode == AutoreloadStandingMode {
+		return a.AutoreloadAmount
+	}
+
+	needed := payback + a.AutoreloadThreshold - balance
+	if needed <= 0 {
+		return 0
+	}
+	if a.AutoreloadAmount != 0 && needed > a.AutoreloadAmount {
+		needed = a.AutoreloadAmount
+	}
+	return needed
+}
+
+// AutoreloadRecipient tops up a recipient's primary account before a payback of the given
+// amount towards a project. Does nothing if the recipient hasn't opted in or doesn't need a reload.
+func AutoreloadRecipient(recpIndex int, projIndex int, payback float64) error {
+	recipient, err := RetrieveRecipient(recpIndex)
+	if err != nil {
+		return errors.Wrap(err, "couldn't retrieve recipient")
+	}
+
+	if !recipient.Autoreload {
+		return nil
+	}
+
+	code, issuerPubkey := stablecoinCode()
+	pubkey := recipient.U.StellarWallet.PublicKey
+	amount := recipient.reloadAmount(xlm.GetAssetBalance(pubkey, code), payback)
+	if amount == 0 {
+		return nil
+	}
+
+	secSeed, err := keys.Decrypt(keys.Platform, recipient.AutoreloadSeed)
+	if err != nil {
+		return errors.Wrap(err, "could not decrypt secondary seed, please opt into autoreload again")
+	}
+
+	if xlm.GetAssetBalance(recipient.U.SecondaryWallet.PublicKey, code) < amount {
+		if recipient.U.Notification {
+			notif.SendAlertEmail("Your secondary account does not have enough stablecoin to reload your "+
+				"primary account before your next payback, please refill", recipient.U.Email)
+		}
+		return errors.New("secondary account does not have enough stablecoin to reload")
+	}
+
+	_, txhash, err := assets.SendAsset(code, issuerPubkey, pubkey, amount, string(secSeed), "Opensolar autoreload")
+	if err != nil {
+		return errors.Wrap(err, "could not reload from secondary account")
+	}
+
+	// reload the recipient so that energy ingested while the reload was being sent isn't overwritten
+	unlock := recipientLocks.lock(recpIndex)
+	defer unlock()
+	recipient, err = RetrieveRecipient(recpIndex)
+	if err != nil {
+		return errors.Wrap(err, "couldn't retrieve recipient")
+	}
+
+	recipient.Reloads = append(recipient.Reloads, Reload{
+		Timestamp: utils.Timestamp(),
+		Amount:    amount,
+		Mode:      recipient.AutoreloadMode,
+		ProjIndex: projIndex,
+		TxHash:    txhash,
+	})
+
+	err = recipient.Save()
+	if err != nil {
+		return errors.Wrap(err, "couldn't save recipient")
+	}
+
+	log.Println("reloaded", amount, "for recipient", recpIndex, "with txhash", txhash)
+	if recipient.U.Notification {
+		notif.SendAutoreloadNotifToRecipient(projIndex, recipient.U.Email, amount, txhash)
+	}
+	return nil
+}
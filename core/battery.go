@@ -0,0 +1,400 @@
+package core
+
+import (
+	"encoding/json"
+	"log"
+	"math"
+	"strconv"
+
+	"github.com/pkg/errors"
+
+	edb "github.com/Varunram/essentials/database"
+	utils "github.com/Varunram/essentials/utils"
+
+	consts "github.com/YaleOpenLab/opensolar/consts"
+	notif "github.com/YaleOpenLab/opensolar/notif"
+)
+
+// batteries are attached to projects by their contractors and report their state of charge, cycle
+// count and measured capacity along with the energy they charge and discharge, which is stored on
+// the charge and discharge energy channels. A battery's state of health is its measured capacity
+// relative to its nameplate capacity, or is estimated from its cycles when the battery doesn't
+// measure its capacity. A daily sample of the state of health is kept so that the rate at which
+// the battery degrades can be tracked and fed into the project's health.
+
+// Battery health problems
+const (
+	BatteryDegraded    = "degraded"         // state of health at or below the battery's end of life
+	BatteryFastFade    = "fast degradation" // losing more than consts.BatteryMaxFade of its health a year
+	BatteryNoTelemetry = "no telemetry"     // no telemetry within consts.BatteryTelemetryTimeout
+)
+
+// BatteryTelemetry is the state reported by a battery along with an energy reading
+type BatteryTelemetry struct {
+	// SoC is the state of charge in percent
+	SoC float64
+	// Cycles is the cycle count reported by the battery, 0 if it doesn't count cycles
+	Cycles float64 `json:",omitempty"`
+	// CapacityWh is the full capacity measured by the battery in Wh, 0 if it doesn't measure it
+	CapacityWh uint32 `json:",omitempty"`
+}
+
+// BatterySample is a daily sample of a battery's state of health
+type BatterySample struct {
+	// Timestamp is the unix time of the sample
+	Timestamp int64
+	// StateOfHealth is the battery's state of health at the time
+	StateOfHealth float64
+	// Cycles is the battery's cycle count at the time
+	Cycles float64
+}
+
+// Battery is a storage asset attached to a project
+type Battery struct {
+	// Index is the index of the battery in the database
+	Index int
+	// ProjIndex is the index of the project the battery is attached to
+	ProjIndex int
+	// AssetID is the id of the asset that readings are reported for. Readings without an asset id
+	// are attributed to the project's first battery
+	AssetID string
+	// Manufacturer is the manufacturer of the battery
+	Manufacturer string
+	// Model is the model of the battery
+	Model string
+	// Chemistry is the battery's chemistry (eg LFP)
+	Chemistry string
+	// CapacityKWh is the usable nameplate capacity of the battery
+	CapacityKWh float64
+	// PowerKW is the maximum charge and discharge power of the battery
+	PowerKW float64
+	// RatedCycles is the number of full cycles after which the battery reaches its end of life
+	RatedCycles float64
+	// EndOfLife is the state of health at which the battery reaches its end of life
+	EndOfLife float64
+	// InstalledAt is the unix time at which the battery was installed
+	InstalledAt int64
+	// SoC is the latest state of charge in percent
+	SoC float64
+	// Cycles is the cycle count, reported or counted in equivalent full cycles
+	Cycles float64
+	// ChargedWh is the energy charged into the battery since it was installed
+	ChargedWh uint64
+	// DischargedWh is the energy discharged from the battery since it was installed
+	DischargedWh uint64
+	// MeasuredCapacityWh is the latest full capacity measured by the battery, 0 if never reported
+	MeasuredCapacityWh uint32
+	// LastTelemetry is the unix time of the latest telemetry
+	LastTelemetry int64
+	// StateOfHealth is the latest state of health, 1 for a new battery
+	StateOfHealth float64
+	// History contains a daily sample of the state of health, oldest first
+	History []BatterySample
+	// AlertedAt is the unix time at which the battery was reported as degraded, 0 if it hasn't been
+	AlertedAt int64
+}
+
+// BatteryStatus is the health of a battery
+type BatteryStatus struct {
+	Battery       Battery
+	StateOfHealth float64
+	FadePerYear   float64
+	Problems      []string
+}
+
+// BatteryBucket is the bucket where batteries are stored
+var BatteryBucket = []byte("Batteries")
+
+// Save inserts a passed Battery object into the database
+func (a *Battery) Save() error {
+	return edb.Save(consts.DbDir+consts.DbName, BatteryBucket, a, a.Index)
+}
+
+// RetrieveBattery retrieves a battery from the database
+func RetrieveBattery(key int) (Battery, error) {
+	var x Battery
+	temp, err := edb.Retrieve(consts.DbDir+consts.DbName, BatteryBucket, key)
+	if err != nil {
+		return x, errors.Wrap(err, "error while retrieving key from bucket")
+	}
+
+	err = json.Unmarshal(temp, &x)
+	if err != nil {
+		return x, errors.Wrap(err, "could not unmarshal battery")
+	}
+	if x.Index == 0 {
+		return x, errors.New("battery not found")
+	}
+	return x, nil
+}
+
+// RetrieveBatteries retrieves the batteries of a project. Pass 0 to retrieve all batteries
+func RetrieveBatteries(projIndex int) ([]Battery, error) {
+	var arr []Battery
+	x, err := edb.RetrieveAllKeys(consts.DbDir+consts.DbName, BatteryBucket)
+	if err != nil {
+		return arr, errors.Wrap(err, "error while retrieving all keys")
+	}
+
+	for _, value := range x {
+		var temp Battery
+		err := json.Unmarshal(value, &temp)
+		if err != nil {
+			return arr, errors.Wrap(err, "could not unmarshal battery")
+		}
+		if projIndex == 0 || temp.ProjIndex == projIndex {
+			arr = append(arr, temp)
+		}
+	}
+	return arr, nil
+}
+
+// AddBattery attaches a battery to a project. Only the battery's specification is read from spec
+func AddBattery(projIndex int, spec Battery) (Battery, error) {
+	a := Battery{
+		AssetID:      spec.AssetID,
+		Manufacturer: spec.Manufacturer,
+		Model:        spec.Model,
+		Chemistry:    spec.Chemistry,
+		CapacityKWh:  spec.CapacityKWh,
+		PowerKW:      spec.PowerKW,
+		RatedCycles:  spec.RatedCycles,
+		EndOfLife:    spec.EndOfLife,
+		InstalledAt:  spec.InstalledAt,
+	}
+	if a.CapacityKWh <= 0 {
+		return a, errors.New("battery capacity must be positive")
+	}
+	if a.PowerKW < 0 || a.RatedCycles < 0 {
+		return a, errors.New("battery power and rated cycles can't be negative")
+	}
+	if a.EndOfLife < 0 || a.EndOfLife >= 1 {
+		return a, errors.New("end of life must be a fraction of the battery's capacity")
+	}
+
+	_, err := RetrieveProject(projIndex)
+	if err != nil {
+		return a, errors.Wrap(err, "couldn't retrieve project")
+	}
+
+	all, err := RetrieveBatteries(0)
+	if err != nil {
+		return a, err
+	}
+	for _, battery := range all {
+		if battery.ProjIndex == projIndex && battery.AssetID == a.AssetID {
+			return a, errors.New("project already has a battery with this asset id")
+		}
+	}
+
+	if a.RatedCycles == 0 {
+		a.RatedCycles = consts.BatteryRatedCycles
+	}
+	if a.EndOfLife == 0 {
+		a.EndOfLife = consts.BatteryEndOfLife
+	}
+	if a.InstalledAt == 0 {
+		a.InstalledAt = utils.Unix()
+	}
+
+	a.Index = len(all) + 1
+	a.ProjIndex = projIndex
+	a.StateOfHealth = 1
+	return a, a.Save()
+}
+
+// stateOfHealth returns the battery's measured capacity relative to its nameplate capacity, or
+// estimates it from the battery's cycles if it doesn't measure its capacity
+func (a Battery) stateOfHealth() float64 {
+	if a.MeasuredCapacityWh != 0 {
+		return math.Min(float64(a.MeasuredCapacityWh)/(a.CapacityKWh*1000), 1)
+	}
+	return math.Max(1-(1-a.EndOfLife)*a.Cycles/a.RatedCycles, 0)
+}
+
+// FadePerYear returns the state of health the battery loses a year, measured over its history.
+// Returns 0 until the history spans at least 30 days
+func (a Battery) FadePerYear() float64 {
+	if len(a.History) < 2 {
+		return 0
+	}
+	first, last := a.History[0], a.History[len(a.History)-1]
+	days := float64(last.Timestamp-first.Timestamp) / (24 * 3600)
+	if days < 30 {
+		return 0
+	}
+	return (first.StateOfHealth - last.StateOfHealth) / days * 365
+}
+
+// Problems returns the health problems of a battery at time now
+func (a Battery) Problems(now int64) []string {
+	var problems []string
+	if a.StateOfHealth <= a.EndOfLife {
+		problems = append(problems, BatteryDegraded)
+	}
+	if a.FadePerYear() > consts.BatteryMaxFade {
+		problems = append(problems, BatteryFastFade)
+	}
+
+	last := a.LastTelemetry
+	if last == 0 {
+		last = a.InstalledAt
+	}
+	if now-last > consts.BatteryTelemetryTimeout {
+		problems = append(problems, BatteryNoTelemetry)
+	}
+	return problems
+}
+
+// Status returns the health of a battery at time now
+func (a Battery) Status(now int64) BatteryStatus {
+	return BatteryStatus{
+		Battery:       a,
+		StateOfHealth: a.StateOfHealth,
+		FadePerYear:   a.FadePerYear(),
+		Problems:      a.Problems(now),
+	}
+}
+
+// record updates the battery with a reading reported for it
+func (a *Battery) record(reading EnergyReading) {
+	switch reading.Channel {
+	case EnergyCharge:
+		a.ChargedWh += uint64(reading.Value)
+	case EnergyDischarge:
+		a.DischargedWh += uint64(reading.Value)
+	}
+
+	if reading.Battery != nil {
+		a.SoC = math.Max(0, math.Min(reading.Battery.SoC, 100))
+		if reading.Battery.Cycles > 0 {
+			a.Cycles = reading.Battery.Cycles
+		}
+		if reading.Battery.CapacityWh > 0 {
+			a.MeasuredCapacityWh = reading.Battery.CapacityWh
+		}
+	}
+
+	// batteries that don't count their cycles are counted in equivalent full cycles
+	if reading.Battery == nil || reading.Battery.Cycles == 0 {
+		a.Cycles = math.Max(a.Cycles, float64(a.DischargedWh)/(a.CapacityKWh*1000))
+	}
+
+	if reading.Timestamp > a.LastTelemetry {
+		a.LastTelemetry = reading.Timestamp
+	}
+	a.StateOfHealth = a.stateOfHealth()
+
+	day := periodStart(reading.Timestamp, EnergyDay)
+	if len(a.History) == 0 || periodStart(a.History[len(a.History)-1].Timestamp, EnergyDay) < day {
+		a.History = append(a.History, BatterySample{Timestamp: reading.Timestamp,
+			StateOfHealth: a.StateOfHealth, Cycles: a.Cycles})
+	}
+}
+
+// RecordBatteryTelemetry updates the battery a reading was reported for and notifies the
+// project's contractor and developers the first time the battery reaches its end of life
+func RecordBatteryTelemetry(projIndex int, reading EnergyReading) error {
+	batteries, err := RetrieveBatteries(projIndex)
+	if err != nil {
+		return err
+	}
+	if len(batteries) == 0 {
+		return errors.New("project has no batteries")
+	}
+
+	battery := batteries[0]
+	if reading.AssetID != "" {
+		found := false
+		for _, elem := range batteries {
+			if elem.AssetID == reading.AssetID {
+				battery, found = elem, true
+				break
+			}
+		}
+		if !found {
+			return errors.New("no battery with asset id " + reading.AssetID)
+		}
+	}
+
+	battery.record(reading)
+	if battery.StateOfHealth <= battery.EndOfLife && battery.AlertedAt == 0 {
+		project, err := RetrieveProject(projIndex)
+		if err == nil {
+			for _, email := range performanceContacts(project) {
+				err = notif.SendBatteryDegradedEmail(projIndex, email, battery.StateOfHealth, battery.EndOfLife)
+				if err != nil {
+					log.Println("could not notify", email, "about battery", battery.Index, err)
+				}
+			}
+		}
+		battery.AlertedAt = reading.Timestamp
+	}
+
+	return battery.Save()
+}
+
+// TimeOfUseRate is the price of energy during a range of hours of the day
+type TimeOfUseRate struct {
+	// StartHour is the hour of the day at which the rate starts
+	StartHour int
+	// EndHour is the hour of the day before which the rate ends. Ranges may wrap past midnight
+	EndHour int
+	// Rate is the price of energy in USD/kWh
+	Rate float64
+}
+
+// touRate returns the time of use rate of an hour of the day, or def if no rate covers it
+func touRate(rates []TimeOfUseRate, hour int, def float64) float64 {
+	for _, rate := range rates {
+		if rate.StartHour <= rate.EndHour && hour >= rate.StartHour && hour < rate.EndHour {
+			return rate.Rate
+		}
+		if rate.StartHour > rate.EndHour && (hour >= rate.StartHour || hour < rate.EndHour) {
+			return rate.Rate
+		}
+	}
+	return def
+}
+
+// arbitrageValue returns the value of shifting energy with a battery: the energy discharged
+// priced at the rate of the hour it was discharged in less the energy charged priced at the rate
+// of the hour it was charged in
+func arbitrageValue(plan BillingPlan, charged []EnergyRollup, discharged []EnergyRollup) float64 {
+	hour := func(start int64) int {
+		return ((int(start/3600)+plan.UTCOffset)%24 + 24) % 24
+	}
+
+	var value float64
+	for _, rollup := range discharged {
+		value += float64(rollup.Total) / 1000 * touRate(plan.TimeOfUse, hour(rollup.Start), plan.Tariff)
+	}
+	for _, rollup := range charged {
+		value -= float64(rollup.Total) / 1000 * touRate(plan.TimeOfUse, hour(rollup.Start), plan.Tariff)
+	}
+	return value
+}
+
+// ArbitrageValue returns the time of use arbitrage value of a project's batteries in [from, to)
+// under its billing plan. Returns 0 if the plan has no time of use rates
+func ArbitrageValue(projIndex int, plan BillingPlan, from int64, to int64) (float64, error) {
+	if len(plan.TimeOfUse) == 0 {
+		return 0, nil
+	}
+
+	charged, err := RetrieveChannelRollups(projIndex, EnergyCharge, EnergyHour, from, to)
+	if err != nil {
+		return 0, errors.Wrap(err, "couldn't retrieve charged energy")
+	}
+	discharged, err := RetrieveChannelRollups(projIndex, EnergyDischarge, EnergyHour, from, to)
+	if err != nil {
+		return 0, errors.Wrap(err, "couldn't retrieve discharged energy")
+	}
+
+	return arbitrageValue(plan, charged, discharged), nil
+}
+
+// arbitrageDescription describes the arbitrage line of an invoice
+func arbitrageDescription(share float64) string {
+	return "Storage time-of-use arbitrage (" + strconv.FormatFloat(share*100, 'f', -1, 64) + "% of value)"
+}
@@ -0,0 +1,49 @@
+// +build all travis
+
+package core
+
+import (
+	"testing"
+)
+
+func TestBatteryHealth(t *testing.T) {
+	a := Battery{CapacityKWh: 10, RatedCycles: 4000, EndOfLife: 0.7, StateOfHealth: 1}
+	soc := 80.0
+	a.record(EnergyReading{Timestamp: 86400, Channel: EnergyDischarge, Value: 20000,
+		Battery: &BatteryTelemetry{SoC: soc}})
+	if a.SoC != 80 || a.Cycles != 2 || a.DischargedWh != 20000 {
+		t.Fatal("telemetry not recorded", a.SoC, a.Cycles)
+	}
+	if a.StateOfHealth != 1-0.3*2/4000 {
+		t.Fatal("state of health not estimated from cycles", a.StateOfHealth)
+	}
+
+	a.record(EnergyReading{Timestamp: 86400 * 61, Battery: &BatteryTelemetry{SoC: soc, CapacityWh: 9000}})
+	if a.StateOfHealth != 0.9 || len(a.History) != 2 {
+		t.Fatal("state of health not measured", a.StateOfHealth, len(a.History))
+	}
+	if a.FadePerYear() < 0.5 {
+		t.Fatal("fade not tracked", a.FadePerYear())
+	}
+	problems := a.Problems(86400 * 61)
+	if len(problems) != 1 || problems[0] != BatteryFastFade {
+		t.Fatal("fast degradation not reported", problems)
+	}
+}
+
+func TestArbitrageValue(t *testing.T) {
+	plan := BillingPlan{Tariff: 0.1, UTCOffset: -4,
+		TimeOfUse: []TimeOfUseRate{{StartHour: 17, EndHour: 21, Rate: 0.3}, {StartHour: 22, EndHour: 6, Rate: 0.05}}}
+	if touRate(plan.TimeOfUse, 23, 0.1) != 0.05 || touRate(plan.TimeOfUse, 3, 0.1) != 0.05 ||
+		touRate(plan.TimeOfUse, 12, 0.1) != 0.1 {
+		t.Fatal("time of use rates not applied")
+	}
+
+	// charged at 02:00 and discharged at 18:00 local time
+	charged := []EnergyRollup{{Start: 6 * 3600, Total: 10000}}
+	discharged := []EnergyRollup{{Start: 22 * 3600, Total: 9000}}
+	value := arbitrageValue(plan, charged, discharged)
+	if roundCents(value) != 2.2 {
+		t.Fatal("arbitrage value wrong", value)
+	}
+}
@@ -0,0 +1,721 @@
+package core
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+
+	edb "github.com/Varunram/essentials/database"
+	utils "github.com/Varunram/essentials/utils"
+
+	consts "github.com/YaleOpenLab/opensolar/consts"
+	notif "github.com/YaleOpenLab/opensolar/notif"
+	oracle "github.com/YaleOpenLab/opensolar/oracle"
+)
+
+// funded projects are invoiced once a month for the energy metered in the previous month at the
+// project's tariff, plus its fixed fees. Payments towards a project are applied to its oldest
+// unpaid invoices first and anything left over is kept as a credit against the next invoice.
+// Unpaid balances of earlier invoices are shown on each new invoice as arrears but stay owed on
+// the invoice they were charged on, so they are never counted twice.
+
+// Invoice statuses
+const (
+	InvoiceOpen    = "open"
+	InvoicePaid    = "paid"
+	InvoicePartial = "partial"
+	InvoiceOverdue = "overdue"
+)
+
+// BillingFee is a fixed fee charged on every invoice of a project
+type BillingFee struct {
+	// Description describes the fee on invoices
+	Description string
+	// Amount is the fee in USD
+	Amount float64
+}
+
+// BillingPlan contains the terms a project's recipient is invoiced on
+type BillingPlan struct {
+	// Tariff is the price of energy in USD/kWh. If zero, the oracle's price is used
+	Tariff float64
+	// Fees are the fixed fees charged every month
+	Fees []BillingFee
+	// DueDays is the number of days after issue that invoices are due. Defaults to consts.InvoiceDueDays
+	DueDays int
+	// Credit is the amount in USD paid in excess of invoices, deducted from the next invoice
+	Credit float64
+	// TimeOfUse are the time of use rates of the tariff. Hours they don't cover are priced at Tariff
+	TimeOfUse []TimeOfUseRate `json:",omitempty"`
+	// UTCOffset is the offset in hours of the project's local time, used to apply time of use rates
+	UTCOffset int `json:",omitempty"`
+	// ArbitrageShare is the fraction of the time of use arbitrage value of the project's batteries
+	// that is invoiced
+	ArbitrageShare float64 `json:",omitempty"`
+	// Unapplied are payments that couldn't be applied to invoices yet. They're retried on every
+	// billing run
+	Unapplied []InvoicePayment `json:",omitempty"`
+}
+
+// InvoiceLine is a single charge on an invoice
+type InvoiceLine struct {
+	// Description describes the charge
+	Description string
+	// Quantity is the quantity charged for
+	Quantity float64
+	// Unit is the unit of the quantity
+	Unit string
+	// UnitPrice is the price of a unit in USD
+	UnitPrice float64
+	// Amount is the charge in USD
+	Amount float64
+	// Arrears is true for the line showing unpaid balances of earlier invoices. It is not part of
+	// the invoice's total
+	Arrears bool `json:",omitempty"`
+}
+
+// InvoicePayment is a payment applied to an invoice
+type InvoicePayment struct {
+	// Timestamp is the unix time of the payment
+	Timestamp int64
+	// Amount is the amount in USD applied to the invoice
+	Amount float64
+	// Reference describes where the payment came from
+	Reference string
+}
+
+// Invoice is a monthly bill sent to a project's recipient
+type Invoice struct {
+	// Index is the index of the invoice in the database
+	Index int
+	// Number is the invoice number, unique per project and month
+	Number string
+	// ProjIndex is the index of the project invoiced for
+	ProjIndex int
+	// RecpIndex is the index of the recipient invoiced
+	RecpIndex int
+	// PeriodStart is the unix time at which the billed month starts
+	PeriodStart int64
+	// PeriodEnd is the unix time at which the billed month ends
+	PeriodEnd int64
+	// IssuedAt is the unix time at which the invoice was issued
+	IssuedAt int64
+	// DueDate is the unix time by which the invoice must be paid
+	DueDate int64
+	// Lines are the charges on the invoice
+	Lines []InvoiceLine
+	// Total is the sum of the invoice's charges in USD
+	Total float64
+	// Arrears is the unpaid balance of earlier invoices at the time of issue
+	Arrears float64
+	// Paid is the amount in USD paid towards the invoice
+	Paid float64
+	// Status is one of open, paid, partial or overdue
+	Status string
+	// Payments are the payments applied to the invoice
+	Payments []InvoicePayment
+}
+
+// InvoiceBucket is the bucket where invoices are stored
+var InvoiceBucket = []byte("Invoices")
+
+// Save inserts a passed Invoice object into the database
+func (a *Invoice) Save() error {
+	return edb.Save(consts.DbDir+consts.DbName, InvoiceBucket, a, a.Index)
+}
+
+// RetrieveInvoice retrieves an invoice from the database
+func RetrieveInvoice(key int) (Invoice, error) {
+	var x Invoice
+	temp, err := edb.Retrieve(consts.DbDir+consts.DbName, InvoiceBucket, key)
+	if err != nil {
+		return x, errors.Wrap(err, "error while retrieving key from bucket")
+	}
+
+	err = json.Unmarshal(temp, &x)
+	if err != nil {
+		return x, errors.Wrap(err, "could not unmarshal invoice")
+	}
+	if x.Index == 0 {
+		return x, errors.New("invoice not found")
+	}
+	return x, nil
+}
+
+// RetrieveInvoices retrieves all invoices that match filter sorted by billing period. A nil
+// filter returns all of them
+func RetrieveInvoices(filter func(Invoice) bool) ([]Invoice, error) {
+	var arr []Invoice
+	x, err := edb.RetrieveAllKeys(consts.DbDir+consts.DbName, InvoiceBucket)
+	if err != nil {
+		return arr, errors.Wrap(err, "error while retrieving all keys")
+	}
+
+	for _, value := range x {
+		var temp Invoice
+		err := json.Unmarshal(value, &temp)
+		if err != nil {
+			return arr, errors.Wrap(err, "could not unmarshal invoice")
+		}
+		if filter == nil || filter(temp) {
+			arr = append(arr, temp)
+		}
+	}
+
+	sort.Slice(arr, func(i, j int) bool {
+		if arr[i].PeriodStart != arr[j].PeriodStart {
+			return arr[i].PeriodStart < arr[j].PeriodStart
+		}
+		return arr[i].Index < arr[j].Index
+	})
+	return arr, nil
+}
+
+// RetrieveProjectInvoices retrieves all invoices of a project sorted by billing period
+func RetrieveProjectInvoices(projIndex int) ([]Invoice, error) {
+	return RetrieveInvoices(func(a Invoice) bool {
+		return a.ProjIndex == projIndex
+	})
+}
+
+// roundCents rounds an amount in USD to cents
+func roundCents(amount float64) float64 {
+	return math.Round(amount*100) / 100
+}
+
+// invoiceNumber returns the number of a project's invoice for the month starting at start
+func invoiceNumber(projIndex int, start int64) string {
+	return fmt.Sprintf("OS-%04d-%s", projIndex, time.Unix(start, 0).UTC().Format("200601"))
+}
+
+// Balance returns the amount in USD still owed on the invoice
+func (a Invoice) Balance() float64 {
+	balance := roundCents(a.Total - a.Paid)
+	if balance < 0 {
+		return 0
+	}
+	return balance
+}
+
+// AmountDue returns the invoice's balance plus the arrears shown on it
+func (a Invoice) AmountDue() float64 {
+	return roundCents(a.Balance() + a.Arrears)
+}
+
+// status returns the status of the invoice at now
+func (a Invoice) status(now int64) string {
+	switch {
+	case a.Balance() == 0:
+		return InvoicePaid
+	case now > a.DueDate:
+		return InvoiceOverdue
+	case a.Paid > 0:
+		return InvoicePartial
+	default:
+		return InvoiceOpen
+	}
+}
+
+// billingLocks serializes changes to a project's billing plan, credit and queued payments between
+// paybacks, settlements, the billing monitor and the admin RPCs
+var billingLocks keyedLock
+
+// invoiceIndexLock serializes allocating invoice indices, which are shared by all projects
+var invoiceIndexLock sync.Mutex
+
+// SetBillingPlan updates the terms a project's recipient is invoiced on. update is applied to the
+// stored plan so that terms which aren't passed are kept
+func SetBillingPlan(projIndex int, update func(*BillingPlan)) (Project, error) {
+	unlock := billingLocks.lock(projIndex)
+	defer unlock()
+
+	project, err := RetrieveProject(projIndex)
+	if err != nil {
+		return project, errors.Wrap(err, "couldn't retrieve project")
+	}
+
+	plan := project.Billing
+	update(&plan)
+
+	if plan.Tariff < 0 {
+		return project, errors.New("tariff can't be negative")
+	}
+	if plan.DueDays < 0 {
+		return project, errors.New("due days can't be negative")
+	}
+	for _, fee := range plan.Fees {
+		if fee.Description == "" || fee.Amount < 0 {
+			return project, errors.New("fees need a description and a non negative amount")
+		}
+	}
+
+	for _, rate := range plan.TimeOfUse {
+		if rate.StartHour < 0 || rate.StartHour > 23 || rate.EndHour < 0 || rate.EndHour > 24 ||
+			rate.StartHour == rate.EndHour || rate.Rate < 0 {
+			return project, errors.New("time of use rates need a range of hours and a non negative rate")
+		}
+	}
+	if plan.UTCOffset < -12 || plan.UTCOffset > 14 {
+		return project, errors.New("utc offset out of range")
+	}
+	if plan.ArbitrageShare < 0 || plan.ArbitrageShare > 1 {
+		return project, errors.New("arbitrage share must be between 0 and 1")
+	}
+
+	// credit and unapplied payments are only changed by payments
+	plan.Credit = project.Billing.Credit
+	plan.Unapplied = project.Billing.Unapplied
+	project.Billing = plan
+	return project, project.Save()
+}
+
+// GenerateInvoice invoices a project's recipient for the month starting at start
+func GenerateInvoice(projIndex int, start int64, now int64) (Invoice, error) {
+	var a Invoice
+	start = periodStart(start, EnergyMonth)
+	end := time.Unix(start, 0).UTC().AddDate(0, 1, 0).Unix()
+	if end > now {
+		return a, errors.New("can't invoice a month that hasn't ended")
+	}
+
+	unlock := billingLocks.lock(projIndex)
+	defer unlock()
+
+	project, err := RetrieveProject(projIndex)
+	if err != nil {
+		return a, errors.Wrap(err, "couldn't retrieve project")
+	}
+
+	all, err := RetrieveInvoices(nil)
+	if err != nil {
+		return a, err
+	}
+
+	number := invoiceNumber(projIndex, start)
+	var arrears float64
+	var overdue []string
+	for _, elem := range all {
+		if elem.ProjIndex != projIndex {
+			continue
+		}
+		if elem.Number == number {
+			return a, errors.New("month has already been invoiced")
+		}
+		if elem.Balance() > 0 {
+			arrears += elem.Balance()
+			overdue = append(overdue, elem.Number)
+		}
+	}
+
+	energy, err := TotalEnergy(projIndex, start, end)
+	if err != nil {
+		return a, errors.Wrap(err, "couldn't retrieve project energy")
+	}
+
+	plan := project.Billing
+	tariff := plan.Tariff
+	if tariff == 0 {
+		tariff = oracle.MonthlyBill()
+	}
+	dueDays := plan.DueDays
+	if dueDays == 0 {
+		dueDays = consts.InvoiceDueDays
+	}
+
+	kwh := float64(energy) / 1000
+	a.Lines = append(a.Lines, InvoiceLine{Description: "Energy", Quantity: kwh, Unit: "kWh",
+		UnitPrice: tariff, Amount: roundCents(kwh * tariff)})
+	for _, fee := range plan.Fees {
+		a.Lines = append(a.Lines, InvoiceLine{Description: fee.Description, Quantity: 1,
+			UnitPrice: fee.Amount, Amount: roundCents(fee.Amount)})
+	}
+
+	if plan.ArbitrageShare > 0 {
+		plan.Tariff = tariff
+		value, err := ArbitrageValue(projIndex, plan, start, end)
+		if err != nil {
+			return a, err
+		}
+		if value > 0 {
+			a.Lines = append(a.Lines, InvoiceLine{Description: arbitrageDescription(plan.ArbitrageShare),
+				Quantity: 1, UnitPrice: roundCents(value * plan.ArbitrageShare), Amount: roundCents(value * plan.ArbitrageShare)})
+		}
+	}
+
+	for _, line := range a.Lines {
+		a.Total += line.Amount
+	}
+
+	if plan.Credit > 0 && a.Total > 0 {
+		credit := math.Min(plan.Credit, a.Total)
+		a.Lines = append(a.Lines, InvoiceLine{Description: "Credit", Quantity: 1, UnitPrice: -credit, Amount: -credit})
+		a.Total -= credit
+		project.Billing.Credit = roundCents(plan.Credit - credit)
+	}
+
+	if arrears > 0 {
+		a.Lines = append(a.Lines, InvoiceLine{Description: "Arrears (" + strings.Join(overdue, ", ") + ")",
+			Quantity: 1, UnitPrice: roundCents(arrears), Amount: roundCents(arrears), Arrears: true})
+	}
+
+	a.Number = number
+	a.ProjIndex = projIndex
+	a.RecpIndex = project.RecipientIndex
+	a.PeriodStart = start
+	a.PeriodEnd = end
+	a.IssuedAt = now
+	a.DueDate = now + int64(dueDays)*24*3600
+	a.Total = roundCents(a.Total)
+	a.Arrears = roundCents(arrears)
+	a.Status = a.status(now)
+
+	err = saveNewInvoice(&a)
+	if err != nil {
+		return a, errors.Wrap(err, "could not save invoice")
+	}
+
+	// the credit is only consumed once the invoice is stored
+	err = project.Save()
+	if err != nil {
+		return a, errors.Wrap(err, "couldn't save project")
+	}
+
+	recipient, err := RetrieveRecipient(project.RecipientIndex)
+	if err == nil && recipient.U.Notification {
+		notif.SendInvoiceNotifToRecipient(projIndex, recipient.U.Email, a.Number, a.AmountDue(),
+			time.Unix(a.DueDate, 0).UTC().Format("2006-01-02"))
+	}
+	return a, nil
+}
+
+// saveKeepingBilling saves a project that was retrieved before its billing state may have
+// changed without overwriting the stored billing plan, credit and queued payments
+func (project *Project) saveKeepingBilling() error {
+	unlock := billingLocks.lock(project.Index)
+	defer unlock()
+
+	stored, err := RetrieveProject(project.Index)
+	if err != nil {
+		return errors.Wrap(err, "couldn't retrieve project")
+	}
+	project.Billing = stored.Billing
+	return project.Save()
+}
+
+// saveNewInvoice stores a new invoice under the next free index
+func saveNewInvoice(a *Invoice) error {
+	invoiceIndexLock.Lock()
+	defer invoiceIndexLock.Unlock()
+
+	all, err := RetrieveInvoices(nil)
+	if err != nil {
+		return err
+	}
+	a.Index = len(all) + 1
+	return a.Save()
+}
+
+// connectedStart returns the start of the month in which a project began generating power, or 0
+// if it hasn't yet. Projects connected before DateConnected was recorded start at the month of
+// their first generation reading
+func connectedStart(project Project) (int64, error) {
+	if project.DateConnected != 0 {
+		return periodStart(project.DateConnected, EnergyMonth), nil
+	}
+
+	months, err := RetrieveEnergyRollups(project.Index, EnergyMonth, 0, utils.Unix())
+	if err != nil {
+		return 0, errors.Wrap(err, "couldn't retrieve project energy")
+	}
+	if len(months) == 0 {
+		return 0, nil
+	}
+	return months[0].Start, nil
+}
+
+// GenerateInvoices invoices every funded project for each month that has ended and hasn't been
+// invoiced yet, starting from the month after its latest invoice or the month it was connected
+func GenerateInvoices(now int64) ([]Invoice, error) {
+	var arr []Invoice
+	projects, err := RetrieveAllProjects()
+	if err != nil {
+		return arr, errors.Wrap(err, "couldn't retrieve projects")
+	}
+
+	invoices, err := RetrieveInvoices(nil)
+	if err != nil {
+		return arr, err
+	}
+	latest := make(map[int]int64)
+	for _, invoice := range invoices {
+		if invoice.PeriodStart > latest[invoice.ProjIndex] {
+			latest[invoice.ProjIndex] = invoice.PeriodStart
+		}
+	}
+
+	for _, project := range projects {
+		if project.DateFunded == "" || project.RecipientIndex == 0 || project.Terminated {
+			continue
+		}
+
+		applyUnapplied(project.Index)
+
+		start, exists := latest[project.Index]
+		if exists {
+			start = time.Unix(start, 0).UTC().AddDate(0, 1, 0).Unix()
+		} else {
+			start, err = connectedStart(project)
+			if err != nil {
+				log.Println("could not find when project", project.Index, "was connected", err)
+				continue
+			}
+			if start == 0 {
+				continue // not generating yet
+			}
+		}
+
+		for ; ; start = time.Unix(start, 0).UTC().AddDate(0, 1, 0).Unix() {
+			if time.Unix(start, 0).UTC().AddDate(0, 1, 0).Unix() > now {
+				break
+			}
+
+			invoice, err := GenerateInvoice(project.Index, start, now)
+			if err != nil {
+				log.Println("could not invoice project", project.Index, err)
+				break
+			}
+			arr = append(arr, invoice)
+		}
+	}
+	return arr, nil
+}
+
+// queuePayment records a payment that couldn't be applied to a project's invoices so that the
+// next billing run applies it
+func queuePayment(projIndex int, amount float64, reference string) error {
+	unlock := billingLocks.lock(projIndex)
+	defer unlock()
+
+	project, err := RetrieveProject(projIndex)
+	if err != nil {
+		return errors.Wrap(err, "couldn't retrieve project")
+	}
+
+	project.Billing.Unapplied = append(project.Billing.Unapplied,
+		InvoicePayment{Timestamp: utils.Unix(), Amount: amount, Reference: reference})
+	return project.Save()
+}
+
+// applyUnapplied applies the payments queued on a project to its invoices. Payments that fail
+// again stay queued
+func applyUnapplied(projIndex int) {
+	unlock := billingLocks.lock(projIndex)
+	defer unlock()
+
+	project, err := RetrieveProject(projIndex)
+	if err != nil || len(project.Billing.Unapplied) == 0 {
+		return
+	}
+
+	var failed []InvoicePayment
+	for _, payment := range project.Billing.Unapplied {
+		_, err = applyPayment(projIndex, payment.Amount, payment.Reference)
+		if err != nil {
+			log.Println("could not apply queued payment", payment.Reference, "to project", projIndex, err)
+			failed = append(failed, payment)
+		}
+	}
+
+	// applyPayment saves the project's credit, so retrieve it again
+	project, err = RetrieveProject(projIndex)
+	if err != nil {
+		log.Println("couldn't retrieve project", projIndex, err)
+		return
+	}
+	project.Billing.Unapplied = failed
+	err = project.Save()
+	if err != nil {
+		log.Println("couldn't save project", projIndex, err)
+	}
+}
+
+// ApplyPayment applies a payment towards a project to its unpaid invoices, oldest first. Any
+// amount left over is credited against the project's next invoice. Parts of the payment already
+// applied under the same reference (by an earlier attempt that failed midway) aren't applied again
+func ApplyPayment(projIndex int, amount float64, reference string) ([]Invoice, error) {
+	unlock := billingLocks.lock(projIndex)
+	defer unlock()
+	return applyPayment(projIndex, amount, reference)
+}
+
+// applyPayment applies a payment to a project's invoices, the caller holds the project's billing lock
+func applyPayment(projIndex int, amount float64, reference string) ([]Invoice, error) {
+	var applied []Invoice
+	if amount <= 0 {
+		return applied, errors.New("payment must be positive")
+	}
+
+	invoices, err := RetrieveProjectInvoices(projIndex)
+	if err != nil {
+		return applied, err
+	}
+
+	now := utils.Unix()
+	remaining := roundCents(amount)
+	for _, invoice := range invoices {
+		for _, payment := range invoice.Payments {
+			if payment.Reference == reference {
+				remaining = roundCents(remaining - payment.Amount)
+			}
+		}
+	}
+	for _, invoice := range invoices {
+		if remaining <= 0 {
+			break
+		}
+		balance := invoice.Balance()
+		if balance == 0 {
+			continue
+		}
+
+		pay := math.Min(balance, remaining)
+		invoice.Paid = roundCents(invoice.Paid + pay)
+		invoice.Payments = append(invoice.Payments, InvoicePayment{Timestamp: now, Amount: pay, Reference: reference})
+		invoice.Status = invoice.status(now)
+		err = invoice.Save()
+		if err != nil {
+			return applied, errors.Wrap(err, "could not save invoice")
+		}
+
+		remaining = roundCents(remaining - pay)
+		applied = append(applied, invoice)
+	}
+
+	if remaining > 0 {
+		project, err := RetrieveProject(projIndex)
+		if err != nil {
+			return applied, errors.Wrap(err, "couldn't retrieve project")
+		}
+		project.Billing.Credit = roundCents(project.Billing.Credit + remaining)
+		err = project.Save()
+		if err != nil {
+			return applied, errors.Wrap(err, "couldn't save project")
+		}
+	}
+	return applied, nil
+}
+
+// UpdateInvoiceStatuses marks unpaid invoices that are past their due date as overdue
+func UpdateInvoiceStatuses(now int64) error {
+	invoices, err := RetrieveInvoices(func(a Invoice) bool {
+		return a.Status != InvoicePaid
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, invoice := range invoices {
+		status := invoice.status(now)
+		if status == invoice.Status {
+			continue
+		}
+		invoice.Status = status
+		err = invoice.Save()
+		if err != nil {
+			return errors.Wrap(err, "could not save invoice")
+		}
+	}
+	return nil
+}
+
+// MonitorBilling issues invoices, settles grid exports against them and updates their statuses
+// every consts.BillingInterval
+func MonitorBilling() {
+	for {
+		now := utils.Unix()
+		_, err := GenerateInvoices(now)
+		if err != nil {
+			log.Println("could not generate invoices", err)
+		}
+
+		_, err = SettleAllExports(now)
+		if err != nil {
+			log.Println("could not settle exports", err)
+		}
+
+		err = UpdateInvoiceStatuses(now)
+		if err != nil {
+			log.Println("could not update invoice statuses", err)
+		}
+
+		time.Sleep(consts.BillingInterval)
+	}
+}
+
+// PDF renders the invoice as a PDF document
+func (a Invoice) PDF() []byte {
+	date := func(ts int64) string {
+		return time.Unix(ts, 0).UTC().Format("2006-01-02")
+	}
+	money := func(amount float64) string {
+		return fmt.Sprintf("%.2f", amount)
+	}
+
+	lines := []string{
+		"OPENSOLAR INVOICE",
+		"",
+		"Invoice number:  " + a.Number,
+		fmt.Sprintf("Project:         %d", a.ProjIndex),
+		fmt.Sprintf("Recipient:       %d", a.RecpIndex),
+		"Billing period:  " + date(a.PeriodStart) + " to " + date(a.PeriodEnd-1),
+		"Issued:          " + date(a.IssuedAt),
+		"Due:             " + date(a.DueDate),
+		"Status:          " + strings.ToUpper(a.Status),
+		"",
+		fmt.Sprintf("%-36s %12s %-4s %10s %12s", "Description", "Quantity", "Unit", "Price", "Amount"),
+		strings.Repeat("-", 78),
+	}
+
+	var arrears []string
+	for _, line := range a.Lines {
+		description := line.Description
+		if len(description) > 36 {
+			description = description[:33] + "..."
+		}
+		row := fmt.Sprintf("%-36s %12.3f %-4s %10.4f %12s", description, line.Quantity, line.Unit,
+			line.UnitPrice, money(line.Amount))
+		if line.Arrears {
+			arrears = append(arrears, row)
+			continue
+		}
+		lines = append(lines, row)
+	}
+
+	lines = append(lines, strings.Repeat("-", 78),
+		fmt.Sprintf("%-65s %12s", "Total (USD)", money(a.Total)),
+		fmt.Sprintf("%-65s %12s", "Paid", money(a.Paid)),
+		fmt.Sprintf("%-65s %12s", "Balance", money(a.Balance())))
+
+	if len(arrears) > 0 {
+		lines = append(lines, "", "Unpaid balances of earlier invoices:")
+		lines = append(lines, arrears...)
+		lines = append(lines, fmt.Sprintf("%-65s %12s", "Amount due including arrears", money(a.AmountDue())))
+	}
+
+	if len(a.Payments) > 0 {
+		lines = append(lines, "", "Payments:")
+		for _, payment := range a.Payments {
+			lines = append(lines, fmt.Sprintf("%-12s %-52s %12s", date(payment.Timestamp), payment.Reference,
+				money(payment.Amount)))
+		}
+	}
+
+	return renderPDF(lines)
+}
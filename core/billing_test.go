@@ -0,0 +1,37 @@
+// +build all travis
+
+package core
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestInvoiceStatus(t *testing.T) {
+	a := Invoice{Number: "OS-0001-201901", Total: 10, DueDate: 1000}
+	if a.status(500) != InvoiceOpen {
+		t.Fatal("unpaid invoice before its due date should be open")
+	}
+	a.Paid = 4
+	if a.status(500) != InvoicePartial || a.Balance() != 6 {
+		t.Fatal("partially paid invoice should be partial")
+	}
+	if a.status(1500) != InvoiceOverdue {
+		t.Fatal("unpaid invoice after its due date should be overdue")
+	}
+	a.Paid = 10
+	if a.status(1500) != InvoicePaid {
+		t.Fatal("fully paid invoice should be paid")
+	}
+
+	if invoiceNumber(1, 1546300800) != "OS-0001-201901" {
+		t.Fatal("invoice number wrong", invoiceNumber(1, 1546300800))
+	}
+
+	a.Lines = []InvoiceLine{{Description: "Energy (peak)", Quantity: 50, Unit: "kWh", UnitPrice: 0.2, Amount: 10}}
+	pdf := a.PDF()
+	if !bytes.HasPrefix(pdf, []byte("%PDF-1.4")) || !bytes.HasSuffix(pdf, []byte("%%EOF\n")) ||
+		!bytes.Contains(pdf, []byte(`Energy \(peak\)`)) {
+		t.Fatal("invoice not rendered as a pdf")
+	}
+}
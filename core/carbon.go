@@ -0,0 +1,288 @@
+package core
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+
+	edb "github.com/Varunram/essentials/database"
+	utils "github.com/Varunram/essentials/utils"
+	xlm "github.com/Varunram/essentials/xlm"
+
+	consts "github.com/YaleOpenLab/opensolar/consts"
+)
+
+// the emissions a project avoids are its metered generation multiplied by the emission factor of
+// the grid it displaces. Factors are in kgCO2e/kWh, which is the same as tCO2e/MWh, and are looked
+// up by the project's state and country, falling back to the country and then to
+// consts.DefaultEmissionFactor. Investors are attributed avoided emissions in proportion to their
+// share of the project in InvestorMap.
+
+// EmissionFactor is the emission factor of a region's grid
+type EmissionFactor struct {
+	// Index is the index of the factor in the database
+	Index int
+	// Country is the country the factor applies to
+	Country string
+	// State is the state the factor applies to. Empty if the factor covers the whole country
+	State string
+	// Factor is the emission factor in kgCO2e/kWh
+	Factor float64
+	// Source describes where the factor was taken from
+	Source string
+	// UpdatedAt is the unix time at which the factor was last set
+	UpdatedAt int64
+}
+
+// ProjectCarbon is the emissions avoided by a project's generation over a period
+type ProjectCarbon struct {
+	// ProjIndex is the index of the project
+	ProjIndex int
+	// Name is the name of the project
+	Name string
+	// Region is the region whose emission factor was used
+	Region string
+	// Factor is the emission factor used in kgCO2e/kWh
+	Factor float64
+	// Energy is the project's generation in Wh
+	Energy uint64
+	// Avoided is the avoided emissions in tCO2e
+	Avoided float64
+	// Share is the investor's share of the project. Only set in carbon statements
+	Share float64 `json:",omitempty"`
+}
+
+// CarbonStatement is a statement of the emissions avoided by an investor's projects
+type CarbonStatement struct {
+	// Investor is the public key of the investor
+	Investor string
+	// From is the unix time at which the statement period starts
+	From int64
+	// To is the unix time at which the statement period ends
+	To int64
+	// Projects contains the investor's share of each project's avoided emissions
+	Projects []ProjectCarbon
+	// Avoided is the investor's total avoided emissions in tCO2e
+	Avoided float64
+	// ProjectsAvoided is the emissions avoided by the investor's projects as a whole in tCO2e
+	ProjectsAvoided float64
+	// GeneratedAt is the unix time at which the statement was generated
+	GeneratedAt int64
+}
+
+// EmissionFactorBucket is the bucket where emission factors are stored
+var EmissionFactorBucket = []byte("EmissionFactors")
+
+// Save inserts a passed EmissionFactor object into the database
+func (a *EmissionFactor) Save() error {
+	return edb.Save(consts.DbDir+consts.DbName, EmissionFactorBucket, a, a.Index)
+}
+
+// Region returns the name of the region the factor applies to
+func (a EmissionFactor) Region() string {
+	if a.State == "" {
+		return a.Country
+	}
+	return a.State + ", " + a.Country
+}
+
+// RetrieveEmissionFactors retrieves all configured emission factors
+func RetrieveEmissionFactors() ([]EmissionFactor, error) {
+	var arr []EmissionFactor
+	x, err := edb.RetrieveAllKeys(consts.DbDir+consts.DbName, EmissionFactorBucket)
+	if err != nil {
+		return arr, errors.Wrap(err, "error while retrieving all keys")
+	}
+
+	for _, value := range x {
+		var temp EmissionFactor
+		err := json.Unmarshal(value, &temp)
+		if err != nil {
+			return arr, errors.Wrap(err, "could not unmarshal emission factor")
+		}
+		arr = append(arr, temp)
+	}
+	return arr, nil
+}
+
+// sameRegion compares two region names ignoring case and surrounding whitespace
+func sameRegion(a string, b string) bool {
+	return strings.EqualFold(strings.TrimSpace(a), strings.TrimSpace(b))
+}
+
+// SetEmissionFactor sets the emission factor of a country, or of a state if state is not empty
+func SetEmissionFactor(country string, state string, factor float64, source string) (EmissionFactor, error) {
+	var a EmissionFactor
+	if strings.TrimSpace(country) == "" {
+		return a, errors.New("country can't be empty")
+	}
+	if factor < 0 {
+		return a, errors.New("emission factor can't be negative")
+	}
+
+	factors, err := RetrieveEmissionFactors()
+	if err != nil {
+		return a, err
+	}
+
+	a.Index = len(factors) + 1
+	for _, elem := range factors {
+		if sameRegion(elem.Country, country) && sameRegion(elem.State, state) {
+			a.Index = elem.Index
+			break
+		}
+	}
+
+	a.Country = strings.TrimSpace(country)
+	a.State = strings.TrimSpace(state)
+	a.Factor = factor
+	a.Source = source
+	a.UpdatedAt = utils.Unix()
+	return a, a.Save()
+}
+
+// ProjectEmissionFactor returns the emission factor of the grid a project is located on
+func ProjectEmissionFactor(project Project) (EmissionFactor, error) {
+	factors, err := RetrieveEmissionFactors()
+	if err != nil {
+		return EmissionFactor{}, err
+	}
+
+	var country *EmissionFactor
+	for i, elem := range factors {
+		if !sameRegion(elem.Country, project.Country) {
+			continue
+		}
+		if elem.State == "" {
+			country = &factors[i]
+		} else if sameRegion(elem.State, project.State) {
+			return elem, nil
+		}
+	}
+
+	if country != nil {
+		return *country, nil
+	}
+	return EmissionFactor{Country: "default", Factor: consts.DefaultEmissionFactor, Source: "default"}, nil
+}
+
+// avoidedEmissions returns the emissions in tCO2e avoided by generating energy Wh on a grid
+// with the given factor
+func avoidedEmissions(energy uint64, factor float64) float64 {
+	return float64(energy) / 1000000 * factor
+}
+
+// CarbonAvoided returns the emissions avoided by a project's generation in [from, to)
+func CarbonAvoided(projIndex int, from int64, to int64) (ProjectCarbon, error) {
+	var a ProjectCarbon
+	project, err := RetrieveProject(projIndex)
+	if err != nil {
+		return a, errors.Wrap(err, "couldn't retrieve project")
+	}
+
+	factor, err := ProjectEmissionFactor(project)
+	if err != nil {
+		return a, err
+	}
+
+	energy, err := TotalEnergy(projIndex, from, to)
+	if err != nil {
+		return a, errors.Wrap(err, "couldn't retrieve project energy")
+	}
+
+	a.ProjIndex = projIndex
+	a.Name = project.Name
+	a.Region = factor.Region()
+	a.Factor = factor.Factor
+	a.Energy = energy
+	a.Avoided = avoidedEmissions(energy, factor.Factor)
+	return a, nil
+}
+
+// investorShare returns an investor's share of a project. The InvestorMap counts both the
+// investor and seed assets of everyone who invested, investors missing from it (eg because the
+// map hasn't been updated since) have their share computed from the seed assets they hold
+func investorShare(project Project, pubkey string) float64 {
+	if share, exists := project.InvestorMap[pubkey]; exists {
+		return share
+	}
+	if project.SeedAssetCode == "" || project.TotalValue == 0 {
+		return 0
+	}
+	return xlm.GetAssetBalance(pubkey, project.SeedAssetCode) / project.TotalValue
+}
+
+// InvestorCarbon returns a statement of the emissions avoided in [from, to) by the projects an
+// investor has invested in, attributed to the investor pro rata
+func InvestorCarbon(investor Investor, from int64, to int64) (CarbonStatement, error) {
+	a := CarbonStatement{
+		Investor:    investor.U.StellarWallet.PublicKey,
+		From:        from,
+		To:          to,
+		GeneratedAt: utils.Unix(),
+	}
+
+	indices := uniqueInts(append(investor.InvestedSolarProjectsIndices, investor.SeedInvestedSolarProjectsIndices...))
+	for _, index := range indices {
+		project, err := RetrieveProject(index)
+		if err != nil {
+			return a, errors.Wrap(err, "couldn't retrieve project")
+		}
+
+		carbon, err := CarbonAvoided(index, from, to)
+		if err != nil {
+			return a, err
+		}
+
+		a.ProjectsAvoided += carbon.Avoided
+		carbon.Share = investorShare(project, a.Investor)
+		carbon.Energy = uint64(float64(carbon.Energy) * carbon.Share)
+		carbon.Avoided *= carbon.Share
+		a.Avoided += carbon.Avoided
+		a.Projects = append(a.Projects, carbon)
+	}
+
+	return a, nil
+}
+
+// CSV renders the statement as CSV with one row per project and a final total row
+func (a CarbonStatement) CSV() ([]byte, error) {
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+
+	date := func(ts int64) string {
+		return time.Unix(ts, 0).UTC().Format("2006-01-02")
+	}
+
+	records := [][]string{
+		{"Investor", a.Investor},
+		{"Period", date(a.From), date(a.To)},
+		{"Generated", date(a.GeneratedAt)},
+		{},
+		{"Project", "Name", "Region", "Emission factor (kgCO2e/kWh)", "Share", "Energy (kWh)", "Avoided (tCO2e)"},
+	}
+
+	for _, project := range a.Projects {
+		records = append(records, []string{
+			strconv.Itoa(project.ProjIndex),
+			project.Name,
+			project.Region,
+			strconv.FormatFloat(project.Factor, 'f', -1, 64),
+			strconv.FormatFloat(project.Share, 'f', 4, 64),
+			strconv.FormatFloat(float64(project.Energy)/1000, 'f', 3, 64),
+			strconv.FormatFloat(project.Avoided, 'f', 6, 64),
+		})
+	}
+	records = append(records, []string{"Total", "", "", "", "", "", strconv.FormatFloat(a.Avoided, 'f', 6, 64)})
+
+	err := w.WriteAll(records)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not write carbon statement")
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,22 @@
+// +build all travis
+
+package core
+
+import (
+	"testing"
+)
+
+func TestAvoidedEmissions(t *testing.T) {
+	// 2 MWh on a grid emitting 0.5 kgCO2e/kWh avoids 1 tCO2e
+	if avoidedEmissions(2000000, 0.5) != 1 {
+		t.Fatal("avoided emissions not computed in tCO2e")
+	}
+
+	a := EmissionFactor{Country: "USA", State: "Puerto Rico"}
+	if a.Region() != "Puerto Rico, USA" {
+		t.Fatal("region of state factor wrong")
+	}
+	if !sameRegion(" usa", "USA") {
+		t.Fatal("regions should match regardless of case")
+	}
+}
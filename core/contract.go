@@ -2,6 +2,7 @@ package core
 
 import (
 	"log"
+	"strconv"
 	"time"
 
 	"github.com/pkg/errors"
@@ -9,11 +10,10 @@ import (
 	utils "github.com/Varunram/essentials/utils"
 	xlm "github.com/Varunram/essentials/xlm"
 	assets "github.com/Varunram/essentials/xlm/assets"
-	escrow "github.com/Varunram/essentials/xlm/escrow"
-	issuer "github.com/Varunram/essentials/xlm/issuer"
 	wallet "github.com/Varunram/essentials/xlm/wallet"
 
 	consts "github.com/YaleOpenLab/opensolar/consts"
+	keys "github.com/YaleOpenLab/opensolar/keys"
 	notif "github.com/YaleOpenLab/opensolar/notif"
 	oracle "github.com/YaleOpenLab/opensolar/oracle"
 )
@@ -136,6 +136,14 @@ func preInvestmentCheck(projIndex int, invIndex int, invAmount float64, seed str
 		return project, errors.Wrap(err, "could not get pubkey from seed")
 	}
 
+	return investmentCheck(project, invAmount, pubkey)
+}
+
+// investmentCheck checks whether the account pubkey can invest invAmount in a project and sets
+// up the project's issuer if it doesn't have one yet
+func investmentCheck(project Project, invAmount float64, pubkey string) (Project, error) {
+	var err error
+	projIndex := project.Index
 	if !xlm.AccountExists(pubkey) {
 		return project, errors.New("account doesn't exist yet, quitting")
 	}
@@ -153,18 +161,14 @@ func preInvestmentCheck(projIndex int, invIndex int, invAmount float64, seed str
 		if project.SeedAssetCode == "" && project.InvestorAssetCode == "" {
 			// this project does not have an asset issuer associated with it yet since there has been
 			// no seed round nor investment round
-			project.InvestorAssetCode = assets.AssetID(consts.InvestorAssetPrefix + project.Metadata) // creat investor asset
-			err = project.Save()
-			if err != nil {
-				return project, errors.Wrap(err, "couldn't save project")
-			}
-			err = issuer.InitIssuer(consts.OpenSolarIssuerDir, projIndex, consts.IssuerSeedPwd) // start an issuer with the projIndex
+			_, err = initIssuer(keys.IssuerID(projIndex)) // start and fund an issuer for the project since it needs to issue assets
 			if err != nil {
 				return project, errors.Wrap(err, "error while initializing issuer")
 			}
-			err = issuer.FundIssuer(consts.OpenSolarIssuerDir, projIndex, consts.IssuerSeedPwd, consts.PlatformSeed) // fund the issuer since it needs to issue assets
+			project.InvestorAssetCode = assets.AssetID(consts.InvestorAssetPrefix + project.Metadata) // creat investor asset
+			err = project.Save()
 			if err != nil {
-				return project, errors.Wrap(err, "error while funding issuer")
+				return project, errors.Wrap(err, "couldn't save project")
 			}
 		}
 		return project, nil
@@ -176,8 +180,9 @@ func preInvestmentCheck(projIndex int, invIndex int, invAmount float64, seed str
 }
 
 // SeedInvest is the seed investment function of the opensolar platform. Calls
-// the associated investment model associated with the project.
-func SeedInvest(projIndex int, invIndex int, invAmount float64, invSeed string) error {
+// the associated investment model associated with the project. key is the client's
+// idempotency key for the investment.
+func SeedInvest(projIndex int, invIndex int, invAmount float64, invSeed string, key string) error {
 
 	project, err := preInvestmentCheck(projIndex, invIndex, invAmount, invSeed)
 	if err != nil {
@@ -201,18 +206,13 @@ func SeedInvest(projIndex int, invIndex int, invAmount float64, invSeed string)
 			log.Println("assigning a seed asset code")
 			project.SeedAssetCode = "SEEDASSET" // set this to a constant asset for now
 		}
-		err = MunibondInvest(consts.OpenSolarIssuerDir, invIndex, invSeed, invAmount, projIndex,
-			project.SeedAssetCode, project.TotalValue, project.SeedInvestmentFactor, true)
-		if err != nil {
-			return errors.Wrap(err, "error while investing")
-		}
 
-		err = project.updateAfterInvestment(invAmount, invIndex, true)
+		saga, err := newInvestment(key, invIndex, projIndex, invAmount, project.SeedAssetCode, true)
 		if err != nil {
-			return errors.Wrap(err, "couldn't update project after investment")
+			return errors.Wrap(err, "could not create investment log")
 		}
 
-		return err
+		return runInvestment(&saga, project, invSeed)
 	}
 
 	return errors.New("other chain investments not supported  yet")
@@ -223,7 +223,32 @@ func SeedInvest(projIndex int, invIndex int, invAmount float64, invSeed string)
 // to be invested in an invest in the project respectively. Calls the investment function
 // associated with the platform after completing preliminary checks.
 func Invest(projIndex int, invIndex int, invAmount float64, invSeed string) error {
-	var err error
+	return InvestWithKey(projIndex, invIndex, invAmount, invSeed, "")
+}
+
+// InvestWithKey is Invest with an idempotency key. If an investment with the same key exists,
+// it is resumed (or compensated if it can't proceed) instead of starting a new one. An empty
+// key generates a random one, so the investment is still logged.
+func InvestWithKey(projIndex int, invIndex int, invAmount float64, invSeed string, key string) error {
+	if key == "" {
+		key = utils.GetRandomString(32)
+	}
+
+	unlock := investmentLocks.lock(investmentKey{invIndex, key})
+	defer unlock()
+
+	saga, err := RetrieveInvestmentByKey(invIndex, key)
+	if err == nil {
+		err = saga.matches(projIndex, invAmount)
+		if err != nil {
+			return err
+		}
+		log.Println("resuming investment", saga.Index, "with key", key)
+		return resumeInvestment(&saga, invSeed)
+	}
+	if errors.Cause(err) != ErrInvestmentNotFound {
+		return errors.Wrap(err, "couldn't look up investment key")
+	}
 
 	// run preinvestment checks
 	project, err := preInvestmentCheck(projIndex, invIndex, invAmount, invSeed)
@@ -239,23 +264,18 @@ func Invest(projIndex int, invIndex int, invAmount float64, invSeed string) erro
 		if project.Stage != 4 {
 			if project.Stage == 1 || project.Stage == 2 {
 				// investment is in seed stage
-				return SeedInvest(projIndex, invIndex, invAmount, invSeed)
+				return SeedInvest(projIndex, invIndex, invAmount, invSeed, key)
 			}
 			return errors.New("project not at stage where it can solicit investment, quitting")
 		}
 
-		err = MunibondInvest(consts.OpenSolarIssuerDir, invIndex, invSeed, invAmount, projIndex,
-			project.InvestorAssetCode, project.TotalValue, 1, false)
+		saga, err = newInvestment(key, invIndex, projIndex, invAmount, project.InvestorAssetCode, false)
 		if err != nil {
-			return errors.Wrap(err, "error while investing")
+			return errors.Wrap(err, "could not create investment log")
 		}
 
-		// once the investment is complete, update the project and store in the database
-		err = project.updateAfterInvestment(invAmount, invIndex, false)
-		if err != nil {
-			return errors.Wrap(err, "failed to update project after investment")
-		}
-		return err
+		// once the investment is complete, the project is updated and stored in the database
+		return runInvestment(&saga, project, invSeed)
 	}
 
 	return errors.New("other chain investments not supported right now")
@@ -265,17 +285,33 @@ func Invest(projIndex int, invIndex int, invAmount float64, invSeed string) erro
 // if the project's net amount invested is equal to the project threshold and if so, calls
 // the handlers needed to send funds to the escrow and assets to the receiver. Gets asset
 // balances from the blockchain and updates an internal map that stores returns to publickeys.
-func (project *Project) updateAfterInvestment(invAmount float64, invIndex int, seed bool) error {
+// An investment that has already been counted (a resumed investment that failed after the
+// project was saved) isn't counted again.
+func (project *Project) updateAfterInvestment(invAmount float64, invIndex int, seed bool, investmentIndex int) error {
 	var err error
-	project.MoneyRaised += invAmount
-	if seed {
-		project.SeedMoneyRaised += invAmount * (project.SeedInvestmentFactor - 1)
+	counted := false
+	for _, i := range project.InvestmentIndices {
+		if i == investmentIndex {
+			counted = true
+			break
+		}
 	}
-	project.InvestorIndices = append(project.InvestorIndices, invIndex)
 
-	err = project.Save()
-	if err != nil {
-		return errors.Wrap(err, "couldn't save project")
+	if !counted {
+		project.MoneyRaised += invAmount
+		if seed {
+			project.SeedMoneyRaised += invAmount * (project.SeedInvestmentFactor - 1)
+		}
+		project.InvestorIndices = append(project.InvestorIndices, invIndex)
+		project.InvestmentIndices = append(project.InvestmentIndices, investmentIndex)
+		if seed {
+			project.SeedInvestorIndices = uniqueInts(append(project.SeedInvestorIndices, invIndex))
+		}
+
+		err = project.Save()
+		if err != nil {
+			return errors.Wrap(err, "couldn't save project")
+		}
 	}
 
 	if project.MoneyRaised == project.TotalValue {
@@ -455,6 +491,10 @@ func sendRecipientAssets(projIndex int) error {
 				continue
 			}
 			if !project.Lock {
+				if project.UnlockIntent != 0 {
+					log.Println("project", projIndex, "unlocked with a client signed transaction")
+					return nil
+				}
 				log.Println("Project UNLOCKED IN LOOP")
 				err := checkSeedPwd(project, project.LockPwd)
 				if err != nil {
@@ -480,17 +520,17 @@ func sendRecipientAssets(projIndex int) error {
 		return errors.Wrap(err, "couldn't decrypt seed")
 	}
 
-	log.Println("initializing escrow: ", project.Index, consts.EscrowPwd, recipient.U.StellarWallet.PublicKey, recpSeed, consts.PlatformSeed)
-	escrowPubkey, err := escrow.InitEscrow(project.Index, consts.EscrowPwd, recipient.U.StellarWallet.PublicKey, recpSeed, consts.PlatformSeed)
+	log.Println("initializing escrow: ", project.Index, recipient.U.StellarWallet.PublicKey)
+	escrowPubkey, err := initEscrow(recipient.U.StellarWallet.PublicKey, recpSeed)
 	if err != nil {
-		return errors.Wrap(err, "error while initializing issuer")
+		return errors.Wrap(err, "error while initializing escrow")
 	}
 
 	log.Println("successfully setup escrow")
 	project.EscrowPubkey = escrowPubkey
 	// transfer totalValue to the escrow, don't account for SeedMoneyRaised here
-	log.Println("PLATFORM PUBKEY: ", consts.PlatformPublicKey, project.TotalValue, project.Index, project.EscrowPubkey, consts.PlatformSeed)
-	err = escrow.TransferFundsToEscrow(project.TotalValue, project.Index, project.EscrowPubkey, consts.PlatformSeed)
+	log.Println("PLATFORM PUBKEY: ", consts.PlatformPublicKey, project.TotalValue, project.Index, project.EscrowPubkey)
+	err = fundEscrow(project)
 	if err != nil {
 		log.Println(err)
 		return errors.Wrap(err, "could not transfer funds to the escrow, quitting!")
@@ -503,7 +543,7 @@ func sendRecipientAssets(projIndex int) error {
 	project.LockPwd = "" // lockpwd set to empty immediately after use
 
 	// when sending debt and payback assets, account for SeedMoneyRaised
-	err = MunibondReceive(consts.OpenSolarIssuerDir, project.RecipientIndex, projIndex, project.DebtAssetCode,
+	err = MunibondReceive(project.RecipientIndex, projIndex, project.DebtAssetCode,
 		project.PaybackAssetCode, project.EstimatedAcquisition, recpSeed, project.TotalValue+project.SeedMoneyRaised, project.PaybackPeriod)
 	if err != nil {
 		return errors.Wrap(err, "error while receiving assets from issuer on recipient's end")
@@ -549,14 +589,44 @@ func Payback(recpIndex int, projIndex int, assetName string, amount float64, rec
 		return errors.New("other investment models are not supported right now, quitting")
 	}
 
-	pct, err := MunibondPayback(consts.OpenSolarIssuerDir, recpIndex, amount,
+	pct, err := MunibondPayback(recpIndex, amount,
 		recipientSeed, projIndex, assetName, project.InvestorIndices, project.TotalValue, project.EscrowPubkey)
 	if err != nil {
 		return errors.Wrap(err, "Error while paying back the issuer")
 	}
 
+	err = project.recordPayback(recpIndex, amount, pct)
+	if err != nil {
+		return err
+	}
+
+	err = DistributePayments(recipientSeed, project.EscrowPubkey, projIndex, amount)
+	if err != nil {
+		// return errors.Wrap(err, "error while distributing payments")
+		log.Println("error while distributing payments")
+	}
+
+	return nil
+}
+
+// recordPayback updates a project after its recipient pays back amount, pct of which shifts
+// the project's ownership to the recipient, and applies the payback to the project's invoices
+func (project *Project) recordPayback(recpIndex int, amount float64, pct float64) error {
+	err := project.updateAfterPayback(amount, pct)
+	if err != nil {
+		return err
+	}
+
+	reference := "payback by recipient " + strconv.Itoa(recpIndex) + " at " + strconv.FormatInt(project.DateLastPaid, 10)
+	return project.applyPayback(amount, reference)
+}
+
+// updateAfterPayback updates and saves a project after its recipient pays back amount, pct of
+// which shifts the project's ownership to the recipient
+func (project *Project) updateAfterPayback(amount float64, pct float64) error {
 	project.BalLeft -= (1 - pct) * amount // the balance left should be the percentage paid towards the asset, which is the monthly bill. The rest goes into  ownership
 	project.AmountOwed -= amount          // subtract the amount owed so we can track progress of payments in the monitorPaybacks loop
+	project.AmountRepaid += amount
 	project.OwnershipShift += pct
 	project.DateLastPaid = utils.Unix()
 
@@ -572,20 +642,45 @@ func Payback(recpIndex int, projIndex int, assetName string, amount float64, rec
 		project.AmountOwed = 0
 	}
 
-	err = project.Save()
+	err := project.saveKeepingBilling()
 	if err != nil {
 		return errors.Wrap(err, "coudln't save project")
 	}
+	return nil
+}
 
-	err = DistributePayments(recipientSeed, project.EscrowPubkey, projIndex, amount)
+// applyPayback applies a payback to the project's invoices. The payback has already landed, so a
+// payment that can't be applied now is queued for the next billing run instead of failing the
+// payback
+func (project *Project) applyPayback(amount float64, reference string) error {
+	_, err := ApplyPayment(project.Index, amount, reference)
 	if err != nil {
-		// return errors.Wrap(err, "error while distributing payments")
-		log.Println("error while distributing payments")
+		log.Println("could not apply payback to invoices, queueing it", err)
+		err = queuePayment(project.Index, amount, reference)
+		if err != nil {
+			return errors.Wrap(err, "could not queue payback for invoicing")
+		}
 	}
-
 	return nil
 }
 
+// investorReturns returns the amount each investor receives from a payback of amount
+func (project Project) investorReturns(amount float64) map[string]float64 {
+	var fixedRate float64
+	if project.InterestRate != 0 {
+		fixedRate = project.InterestRate
+	} else {
+		fixedRate = 0.05 // 5 % interest rate if rate not defined
+	}
+
+	returns := make(map[string]float64)
+	amountGivenBack := fixedRate * amount
+	for pubkey, percentage := range project.InvestorMap {
+		returns[pubkey] = percentage * amountGivenBack
+	}
+	return returns
+}
+
 // DistributePayments distributes returns to investors and pays the other entities
 // involved in the project.
 func DistributePayments(recipientSeed string, escrowPubkey string, projIndex int, amount float64) error {
@@ -602,25 +697,11 @@ func DistributePayments(recipientSeed string, escrowPubkey string, projIndex int
 	}
 
 	log.Println("distributing payments")
-	var fixedRate float64
-	if project.InterestRate != 0 {
-		fixedRate = project.InterestRate
-	} else {
-		fixedRate = 0.05 // 5 % interest rate if rate not defined
-	}
-
-	amountGivenBack := fixedRate * amount
-	for pubkey, percentage := range project.InvestorMap {
-		txAmount := percentage * amountGivenBack
+	for pubkey, txAmount := range project.investorReturns(amount) {
 		log.Println("sending amount: ", txAmount, " back to investor: ", pubkey)
 		// here we send funds from the 2of2 multisig. Platform signs by default
-		if !consts.Mainnet {
-			err = escrow.SendAssetsFromEscrow(project.EscrowPubkey, pubkey, consts.StablecoinPublicKey,
-				recipientSeed, consts.PlatformSeed, txAmount, "returns", consts.StablecoinCode)
-		} else {
-			err = escrow.SendAssetsFromEscrow(project.EscrowPubkey, pubkey, consts.StablecoinPublicKey,
-				recipientSeed, consts.PlatformSeed, txAmount, "returns", consts.AnchorUSDCode)
-		}
+		code, issuer := escrowAsset()
+		_, err = escrowPay(project.EscrowPubkey, recipientSeed, pubkey, code, issuer, txAmount, "returns")
 		if err != nil {
 			log.Println("Error with payback to pubkey: ", pubkey, err) // if there is an error with one payback, doesn't mean we should stop and wait for the others
 			continue
@@ -23,7 +23,8 @@ import (
 func TestDb(t *testing.T) {
 	var err error
 	openxconsts.SetConsts(false)
-	opensolarconsts.SetTnConsts()
+	opensolarconsts.HomeDir += "/testnet"
+	opensolarconsts.DbDir = opensolarconsts.HomeDir + "/database/"
 	os.Remove(openxconsts.DbDir + "/opensolar.db")
 	CreateHomeDir() // create home directory if it doesn't exist yet
 	openxdb.CreateHomeDir()
@@ -36,8 +37,7 @@ func TestDb(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	inv.U.AccessToken = "ACCESSTOKEN"
-	inv.U.AccessTokenTimeout = utils.Unix() + 1000000
+	inv.U.AccessToken = map[string]int64{"ACCESSTOKEN": utils.Unix()}
 	err = inv.U.Save()
 	if err != nil {
 		t.Fatal(err)
@@ -61,8 +61,7 @@ func TestDb(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	recp.U.AccessToken = "ACCESSTOKEN"
-	recp.U.AccessTokenTimeout = utils.Unix() + 1000000
+	recp.U.AccessToken = map[string]int64{"ACCESSTOKEN": utils.Unix()}
 
 	err = recp.U.Save()
 	if err != nil {
@@ -87,8 +86,7 @@ func TestDb(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	user.AccessToken = "ACCESSTOKEN"
-	user.AccessTokenTimeout = utils.Unix() + 1000000
+	user.AccessToken = map[string]int64{"ACCESSTOKEN": utils.Unix()}
 	err = user.Save()
 	if err != nil {
 		t.Fatal(err)
@@ -24,9 +24,13 @@ var ContractorBucket = []byte("Contractors")
 // CreateHomeDir creates a home directory at $HOME. If the user does not have permissions
 // to write to home, execution is stopped.
 func CreateHomeDir() {
-	edb.CreateDirs(consts.HomeDir, consts.DbDir, consts.OpenSolarIssuerDir)
+	edb.CreateDirs(consts.HomeDir, consts.DbDir, consts.OpenSolarIssuerDir, consts.RECIssuerDir)
 	log.Println("creating db at: ", consts.DbDir+consts.DbName)
-	db, err := edb.CreateDB(consts.DbDir+consts.DbName, ProjectsBucket, InvestorBucket, RecipientBucket, ContractorBucket)
+	db, err := edb.CreateDB(consts.DbDir+consts.DbName, ProjectsBucket, InvestorBucket, RecipientBucket, ContractorBucket,
+		InvestmentsBucket, StandingOrdersBucket, EnergyBucket, TellerCommandsBucket, FleetBucket, RECBucket,
+		EmissionFactorBucket, IrradianceBucket, PerformanceBucket, InvoiceBucket,
+		UtilityBucket, SettlementBucket, BatteryBucket, EquipmentBucket, WorkOrderBucket,
+		DecommissionBucket, CustodyBucket, WithdrawalBucket, IntentBucket)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -26,6 +26,11 @@ func NewGuarantor(uname string, pwd string, seedpwd string, Name string) (Entity
 	return newEntity(uname, pwd, seedpwd, Name, "guarantor")
 }
 
+// NewRecycler creates a new recycler
+func NewRecycler(uname string, pwd string, seedpwd string, Name string) (Entity, error) {
+	return newEntity(uname, pwd, seedpwd, Name, "recycler")
+}
+
 // NewContractor creates a new contractor
 func NewContractor(uname string, pwd string, seedpwd string, Name string) (Entity, error) {
 	return newEntity(uname, pwd, seedpwd, Name, "contractor")
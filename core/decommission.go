@@ -0,0 +1,797 @@
+package core
+
+import (
+	"encoding/json"
+	"log"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	edb "github.com/Varunram/essentials/database"
+	utils "github.com/Varunram/essentials/utils"
+	xlm "github.com/Varunram/essentials/xlm"
+	wallet "github.com/Varunram/essentials/xlm/wallet"
+	build "github.com/stellar/go/txnbuild"
+
+	consts "github.com/YaleOpenLab/opensolar/consts"
+	keys "github.com/YaleOpenLab/opensolar/keys"
+)
+
+// decommissioning takes a project through stage 9. A developer or contractor of the project starts
+// it by assigning a recycler, which moves the project to stage 9 and snapshots its active
+// equipment. Every piece of equipment then gets a hash chained chain of custody as it is removed,
+// shipped, received and recycled. Once everything has been recycled the recycler certifies the
+// project, after which the platform returns the escrow's remaining balance to investors pro rata
+// and closes the escrow and issuer accounts, terminating the project. The project's REC issuer is
+// kept open so that retired certificates can still be verified.
+
+// Decommissioning statuses
+const (
+	DecommissionStarted   = "started"
+	DecommissionCertified = "certified"
+	DecommissionSettled   = "settled"
+	DecommissionClosed    = "closed"
+)
+
+// Chain of custody events, in the order they happen to a piece of equipment
+const (
+	CustodyRemoved  = "removed"
+	CustodyShipped  = "shipped"
+	CustodyReceived = "received"
+	CustodyRecycled = "recycled"
+)
+
+// custodyEvents are the chain of custody events in order
+var custodyEvents = []string{CustodyRemoved, CustodyShipped, CustodyReceived, CustodyRecycled}
+
+// decommissionLocks serializes settling and closing a decommissioning so that payouts and merges
+// aren't sent twice
+var decommissionLocks keyedLock
+
+// DecommissionPayout is a payment of the escrow's remaining balance to a party of the project
+type DecommissionPayout struct {
+	// PublicKey is the public key of the party paid
+	PublicKey string
+	// Amount is the amount in USD paid
+	Amount float64
+	// TxHash is the hash of the payment
+	TxHash string `json:",omitempty"`
+	// LastTx is the hash of the last failed attempt, looked up on horizon before retrying
+	LastTx string `json:",omitempty"`
+	// Error is set if the payment failed
+	Error string `json:",omitempty"`
+}
+
+// ClosedAccount is a project account closed at the end of decommissioning
+type ClosedAccount struct {
+	// Kind is either escrow or issuer
+	Kind string
+	// PublicKey is the public key of the account
+	PublicKey string
+	// TxHash is the hash of the transaction that merged the account into the platform's
+	TxHash string `json:",omitempty"`
+	// LastTx is the hash of the last failed merge, looked up on horizon before retrying
+	LastTx string `json:",omitempty"`
+	// Missing is true if the account was no longer on the ledger when it was closed
+	Missing bool `json:",omitempty"`
+	// Frozen is true if the account had been frozen and stays on the ledger without any signers
+	Frozen bool `json:",omitempty"`
+	// Error is set if the account couldn't be closed
+	Error string `json:",omitempty"`
+}
+
+// Decommission is the decommissioning of a project
+type Decommission struct {
+	// Index is the index of the decommissioning in the database
+	Index int
+	// ProjIndex is the index of the project decommissioned
+	ProjIndex int
+	// RecyclerIndex is the index of the recycler the project's equipment is disposed to
+	RecyclerIndex int
+	// Reason is why the project is decommissioned
+	Reason string
+	// StartedBy is the index of the entity that started the decommissioning
+	StartedBy int
+	// StartedAt is the unix time at which the decommissioning started
+	StartedAt int64
+	// Equipment are the indices of the project's equipment that must be recycled
+	Equipment []int
+	// Status is one of started, certified, settled or closed
+	Status string
+	// Certificate is the ipfs hash or url of the recycler's certificate
+	Certificate string
+	// CertifiedAt is the unix time at which the recycler certified the project
+	CertifiedAt int64
+	// EscrowBalance is the escrow's balance in USD at settlement
+	EscrowBalance float64
+	// Payouts are the payments of the escrow's balance to the project's parties
+	Payouts []DecommissionPayout
+	// SettledAt is the unix time at which the escrow was settled
+	SettledAt int64
+	// Accounts are the project accounts closed
+	Accounts []ClosedAccount
+	// ClosedAt is the unix time at which the project's accounts were closed
+	ClosedAt int64
+}
+
+// CustodyRecord is a link in the chain of custody of a piece of equipment
+type CustodyRecord struct {
+	// Index is the index of the record in the database
+	Index int
+	// DecommissionIndex is the index of the decommissioning the record belongs to
+	DecommissionIndex int
+	// EquipmentIndex is the index of the equipment
+	EquipmentIndex int
+	// Event is one of removed, shipped, received or recycled
+	Event string
+	// EntityIndex is the index of the entity that recorded the event
+	EntityIndex int
+	// Location is where the event took place
+	Location string
+	// Evidence is the ipfs hash or url of a photo, waybill or other proof of the event
+	Evidence string
+	// Timestamp is the unix time at which the event was recorded
+	Timestamp int64
+	// PrevHash is the hash of the previous record in the equipment's chain, empty for the first
+	PrevHash string
+	// Hash is the hash of the record's contents and PrevHash
+	Hash string
+}
+
+// CustodyChain is the chain of custody of a piece of equipment
+type CustodyChain struct {
+	Equipment Equipment
+	Records   []CustodyRecord
+	Valid     bool
+}
+
+// DecommissionBucket is the bucket where decommissionings are stored
+var DecommissionBucket = []byte("Decommissions")
+
+// CustodyBucket is the bucket where chain of custody records are stored
+var CustodyBucket = []byte("Custody")
+
+// Save inserts a passed Decommission object into the database
+func (a *Decommission) Save() error {
+	return edb.Save(consts.DbDir+consts.DbName, DecommissionBucket, a, a.Index)
+}
+
+// RetrieveDecommission retrieves a decommissioning from the database
+func RetrieveDecommission(key int) (Decommission, error) {
+	var x Decommission
+	temp, err := edb.Retrieve(consts.DbDir+consts.DbName, DecommissionBucket, key)
+	if err != nil {
+		return x, errors.Wrap(err, "error while retrieving key from bucket")
+	}
+
+	err = json.Unmarshal(temp, &x)
+	if err != nil {
+		return x, errors.Wrap(err, "could not unmarshal decommission")
+	}
+	if x.Index == 0 {
+		return x, errors.New("decommission not found")
+	}
+	return x, nil
+}
+
+// RetrieveAllDecommissions retrieves all decommissionings from the database
+func RetrieveAllDecommissions() ([]Decommission, error) {
+	var arr []Decommission
+	x, err := edb.RetrieveAllKeys(consts.DbDir+consts.DbName, DecommissionBucket)
+	if err != nil {
+		return arr, errors.Wrap(err, "error while retrieving all keys")
+	}
+
+	for _, value := range x {
+		var temp Decommission
+		err := json.Unmarshal(value, &temp)
+		if err != nil {
+			return arr, errors.Wrap(err, "could not unmarshal decommission")
+		}
+		arr = append(arr, temp)
+	}
+	return arr, nil
+}
+
+// StartDecommission starts decommissioning a project, assigns its equipment to a recycler and
+// moves the project to stage 9
+func StartDecommission(projIndex int, entityIndex int, recyclerIndex int, reason string) (Decommission, error) {
+	var a Decommission
+	project, err := RetrieveProject(projIndex)
+	if err != nil {
+		return a, errors.Wrap(err, "couldn't retrieve project")
+	}
+	if project.DecommissionIndex != 0 {
+		return a, errors.New("project is already being decommissioned")
+	}
+	if project.Stage < Stage5.Number {
+		return a, errors.New("only installed projects can be decommissioned")
+	}
+	if strings.TrimSpace(reason) == "" {
+		return a, errors.New("decommissioning needs a reason")
+	}
+
+	recycler, err := RetrieveEntity(recyclerIndex)
+	if err != nil {
+		return a, errors.Wrap(err, "couldn't retrieve recycler")
+	}
+	if !recycler.Recycler {
+		return a, errors.New("entity is not a recycler")
+	}
+
+	equipment, err := RetrieveProjectEquipment(projIndex)
+	if err != nil {
+		return a, err
+	}
+	for _, elem := range equipment {
+		if elem.Status == EquipmentActive {
+			a.Equipment = append(a.Equipment, elem.Index)
+		}
+	}
+
+	all, err := RetrieveAllDecommissions()
+	if err != nil {
+		return a, err
+	}
+
+	a.Index = len(all) + 1
+	a.ProjIndex = projIndex
+	a.RecyclerIndex = recyclerIndex
+	a.Reason = strings.TrimSpace(reason)
+	a.StartedBy = entityIndex
+	a.StartedAt = utils.Unix()
+	a.Status = DecommissionStarted
+	err = a.Save()
+	if err != nil {
+		return a, errors.Wrap(err, "could not save decommission")
+	}
+
+	project.DecommissionIndex = a.Index
+	return a, project.SetStage(Stage9.Number)
+}
+
+// Save inserts a passed CustodyRecord object into the database
+func (a *CustodyRecord) Save() error {
+	return edb.Save(consts.DbDir+consts.DbName, CustodyBucket, a, a.Index)
+}
+
+// hash returns the hash of a custody record's contents chained to the previous record
+func (a CustodyRecord) hash() string {
+	return utils.SHA3hash(strings.Join([]string{a.PrevHash, strconv.Itoa(a.DecommissionIndex),
+		strconv.Itoa(a.EquipmentIndex), a.Event, strconv.Itoa(a.EntityIndex), a.Location, a.Evidence,
+		strconv.FormatInt(a.Timestamp, 10)}, "|"))
+}
+
+// RetrieveCustodyRecords retrieves the chain of custody of a piece of equipment, oldest first.
+// Pass 0 to retrieve all records
+func RetrieveCustodyRecords(equipmentIndex int) ([]CustodyRecord, error) {
+	var arr []CustodyRecord
+	x, err := edb.RetrieveAllKeys(consts.DbDir+consts.DbName, CustodyBucket)
+	if err != nil {
+		return arr, errors.Wrap(err, "error while retrieving all keys")
+	}
+
+	for _, value := range x {
+		var temp CustodyRecord
+		err := json.Unmarshal(value, &temp)
+		if err != nil {
+			return arr, errors.Wrap(err, "could not unmarshal custody record")
+		}
+		if equipmentIndex == 0 || temp.EquipmentIndex == equipmentIndex {
+			arr = append(arr, temp)
+		}
+	}
+	return arr, nil
+}
+
+// verifyCustody checks that a chain of custody is linked, untampered and in order
+func verifyCustody(records []CustodyRecord) bool {
+	prev := ""
+	for i, record := range records {
+		if i >= len(custodyEvents) || record.Event != custodyEvents[i] || record.PrevHash != prev ||
+			record.hash() != record.Hash {
+			return false
+		}
+		prev = record.Hash
+	}
+	return true
+}
+
+// RecordCustody records the next event in the chain of custody of a piece of equipment being
+// decommissioned. Equipment is removed and shipped by the project's developers and contractor
+// and received and recycled by the recycler
+func RecordCustody(equipmentIndex int, entity Entity, event string, location string, evidence string) (CustodyRecord, error) {
+	var a CustodyRecord
+	equipment, err := RetrieveEquipment(equipmentIndex)
+	if err != nil {
+		return a, err
+	}
+
+	project, err := RetrieveProject(equipment.ProjIndex)
+	if err != nil {
+		return a, errors.Wrap(err, "couldn't retrieve project")
+	}
+
+	decommission, err := RetrieveDecommission(project.DecommissionIndex)
+	if err != nil {
+		return a, errors.Wrap(err, "project is not being decommissioned")
+	}
+	if decommission.Status != DecommissionStarted {
+		return a, errors.New("project's equipment has already been certified")
+	}
+
+	tracked := false
+	for _, index := range decommission.Equipment {
+		tracked = tracked || index == equipmentIndex
+	}
+	if !tracked {
+		return a, errors.New("equipment is not being decommissioned")
+	}
+
+	all, err := RetrieveCustodyRecords(0)
+	if err != nil {
+		return a, err
+	}
+	var chain []CustodyRecord
+	for _, record := range all {
+		if record.EquipmentIndex == equipmentIndex {
+			chain = append(chain, record)
+		}
+	}
+
+	if len(chain) == len(custodyEvents) {
+		return a, errors.New("equipment has already been recycled")
+	}
+	if event != custodyEvents[len(chain)] {
+		return a, errors.New("next custody event of the equipment is " + custodyEvents[len(chain)])
+	}
+
+	byRecycler := event == CustodyReceived || event == CustodyRecycled
+	if byRecycler && entity.U.Index != decommission.RecyclerIndex {
+		return a, errors.New("only the project's recycler can record this event")
+	}
+	if !byRecycler && !entity.U.Admin && !projectParty(project, entity.U.Index) {
+		return a, errors.New("only the project's contractor or developers can record this event")
+	}
+	if strings.TrimSpace(evidence) == "" {
+		return a, errors.New("custody events need evidence")
+	}
+
+	a.Index = len(all) + 1
+	a.DecommissionIndex = decommission.Index
+	a.EquipmentIndex = equipmentIndex
+	a.Event = event
+	a.EntityIndex = entity.U.Index
+	a.Location = strings.TrimSpace(location)
+	a.Evidence = strings.TrimSpace(evidence)
+	a.Timestamp = utils.Unix()
+	if len(chain) != 0 {
+		a.PrevHash = chain[len(chain)-1].Hash
+	}
+	a.Hash = a.hash()
+
+	err = a.Save()
+	if err != nil {
+		return a, errors.Wrap(err, "could not save custody record")
+	}
+
+	if event == CustodyRemoved {
+		equipment.Status = EquipmentRetired
+		err = equipment.Save()
+		if err != nil {
+			return a, errors.Wrap(err, "could not save equipment")
+		}
+	}
+	return a, nil
+}
+
+// projectParty returns true if an entity is the contractor or one of the developers of a project
+func projectParty(project Project, entityIndex int) bool {
+	if entityIndex == project.ContractorIndex || entityIndex == project.MainDeveloperIndex {
+		return true
+	}
+	for _, index := range project.DeveloperIndices {
+		if index == entityIndex {
+			return true
+		}
+	}
+	return false
+}
+
+// RetrieveCustodyChains returns the chain of custody of every piece of equipment being
+// decommissioned and whether each chain is intact
+func RetrieveCustodyChains(decommission Decommission) ([]CustodyChain, error) {
+	var arr []CustodyChain
+	records, err := RetrieveCustodyRecords(0)
+	if err != nil {
+		return arr, err
+	}
+
+	for _, index := range decommission.Equipment {
+		equipment, err := RetrieveEquipment(index)
+		if err != nil {
+			return arr, err
+		}
+
+		chain := CustodyChain{Equipment: equipment}
+		for _, record := range records {
+			if record.EquipmentIndex == index {
+				chain.Records = append(chain.Records, record)
+			}
+		}
+		chain.Valid = verifyCustody(chain.Records)
+		arr = append(arr, chain)
+	}
+	return arr, nil
+}
+
+// CertifyRecycling records the recycler's certificate that all of a project's equipment has been
+// received and recycled
+func CertifyRecycling(index int, recyclerIndex int, certificate string) (Decommission, error) {
+	a, err := RetrieveDecommission(index)
+	if err != nil {
+		return a, err
+	}
+	if a.Status != DecommissionStarted {
+		return a, errors.New("project has already been certified")
+	}
+	if recyclerIndex != a.RecyclerIndex {
+		return a, errors.New("only the project's recycler can certify it")
+	}
+	if strings.TrimSpace(certificate) == "" {
+		return a, errors.New("certification needs a certificate")
+	}
+
+	chains, err := RetrieveCustodyChains(a)
+	if err != nil {
+		return a, err
+	}
+	for _, chain := range chains {
+		if !chain.Valid || len(chain.Records) != len(custodyEvents) {
+			return a, errors.New("equipment " + strconv.Itoa(chain.Equipment.Index) + " hasn't been recycled")
+		}
+	}
+
+	a.Status = DecommissionCertified
+	a.Certificate = strings.TrimSpace(certificate)
+	a.CertifiedAt = utils.Unix()
+	return a, a.Save()
+}
+
+// escrowPayouts splits an escrow balance between investors in proportion to their share of the
+// project. Payouts are rounded down to the cent and the last investor gets what's left so that
+// the escrow is emptied exactly
+func escrowPayouts(balance float64, investorMap map[string]float64) []DecommissionPayout {
+	var arr []DecommissionPayout
+	var total float64
+	for _, share := range investorMap {
+		total += share
+	}
+	if balance <= 0 || total <= 0 {
+		return arr
+	}
+
+	var pubkeys []string
+	for pubkey, share := range investorMap {
+		if share > 0 {
+			pubkeys = append(pubkeys, pubkey)
+		}
+	}
+	sort.Strings(pubkeys)
+
+	left := balance
+	for i, pubkey := range pubkeys {
+		amount := math.Floor(balance*investorMap[pubkey]/total*100) / 100
+		if i == len(pubkeys)-1 {
+			amount = math.Round(left*1e7) / 1e7
+		}
+		left -= amount
+		arr = append(arr, DecommissionPayout{PublicKey: pubkey, Amount: amount})
+	}
+	return arr
+}
+
+// escrowAsset returns the code and issuer of the stablecoin held in project escrows
+func escrowAsset() (string, string) {
+	if consts.Mainnet {
+		return consts.AnchorUSDCode, consts.AnchorUSDAddress
+	}
+	return consts.StablecoinCode, consts.StablecoinPublicKey
+}
+
+// escrowSigner returns the recipient's seed that co-signs transactions from a project's escrow
+func escrowSigner(project Project) (string, error) {
+	if project.OneTimeUnlock == "" {
+		return "", errors.New("one time unlock not set, recipient must unlock the project")
+	}
+
+	recipient, err := RetrieveRecipient(project.RecipientIndex)
+	if err != nil {
+		return "", errors.Wrap(err, "couldn't retrieve recipient")
+	}
+
+	return wallet.DecryptSeed(recipient.U.StellarWallet.EncryptedSeed, project.OneTimeUnlock)
+}
+
+// SettleDecommission returns the remaining balance of a certified project's escrow to its
+// investors in proportion to their share of the project, or to the recipient if the project has no
+// investors. Failed payouts are retried when called again unless their last attempt landed
+func SettleDecommission(index int) (Decommission, error) {
+	unlock := decommissionLocks.lock(index)
+	defer unlock()
+
+	a, err := RetrieveDecommission(index)
+	if err != nil {
+		return a, err
+	}
+	if a.Status != DecommissionCertified {
+		return a, errors.New("only certified projects can be settled")
+	}
+
+	project, err := RetrieveProject(a.ProjIndex)
+	if err != nil {
+		return a, errors.Wrap(err, "couldn't retrieve project")
+	}
+
+	code, assetIssuer := escrowAsset()
+	if len(a.Payouts) == 0 && project.EscrowPubkey != "" {
+		a.EscrowBalance = xlm.GetAssetBalance(project.EscrowPubkey, code)
+		a.Payouts = escrowPayouts(a.EscrowBalance, project.InvestorMap)
+		if len(a.Payouts) == 0 && a.EscrowBalance > 0 {
+			recipient, err := RetrieveRecipient(project.RecipientIndex)
+			if err != nil {
+				return a, errors.Wrap(err, "couldn't retrieve recipient")
+			}
+			a.Payouts = []DecommissionPayout{{PublicKey: recipient.U.StellarWallet.PublicKey, Amount: a.EscrowBalance}}
+		}
+	}
+
+	failed := false
+	if len(a.Payouts) != 0 {
+		recpSeed, err := escrowSigner(project)
+		if err != nil {
+			return a, err
+		}
+
+		for i, payout := range a.Payouts {
+			if payout.TxHash != "" {
+				continue
+			}
+
+			// an error while submitting doesn't mean that the payment didn't make it into a ledger
+			landed, err := fetchTx(payout.LastTx)
+			if err != nil {
+				log.Println("could not look up the last payout to", payout.PublicKey, err)
+				a.Payouts[i].Error = err.Error()
+				failed = true
+				continue
+			}
+			if landed {
+				a.Payouts[i].TxHash, a.Payouts[i].Error = payout.LastTx, ""
+				continue
+			}
+
+			txhash, err := escrowPay(project.EscrowPubkey, recpSeed, payout.PublicKey, code, assetIssuer,
+				payout.Amount, "Opensolar decommission: "+strconv.Itoa(project.Index))
+			if err != nil {
+				log.Println("could not pay", payout.PublicKey, "from the escrow of project", project.Index, err)
+				a.Payouts[i].Error, a.Payouts[i].LastTx = err.Error(), txhash
+				failed = true
+				continue
+			}
+			a.Payouts[i].TxHash, a.Payouts[i].Error = txhash, ""
+		}
+	}
+
+	if !failed {
+		a.Status = DecommissionSettled
+		a.SettledAt = utils.Unix()
+	}
+	err = a.Save()
+	if err != nil {
+		return a, errors.Wrap(err, "could not save decommission")
+	}
+	if failed {
+		return a, errors.New("some payouts failed, settle again to retry them")
+	}
+	return a, nil
+}
+
+// merged returns true if an account was merged by the last attempt to close it or is no longer on
+// the ledger. An error while submitting a merge doesn't mean that it didn't make it into a ledger
+func merged(account *ClosedAccount) (bool, error) {
+	landed, err := fetchTx(account.LastTx)
+	if err != nil {
+		return false, errors.Wrap(err, "couldn't look up the last merge")
+	}
+	if landed {
+		account.TxHash = account.LastTx
+		return true, nil
+	}
+
+	x, err := lookupAccount(account.PublicKey)
+	if err != nil {
+		return false, errors.Wrap(err, "couldn't look up account")
+	}
+	account.Missing = x.ID == ""
+	return account.Missing, nil
+}
+
+// closeEscrow removes the escrow's stablecoin trustline and merges the escrow into the platform's
+// account
+func closeEscrow(project Project, account *ClosedAccount) error {
+	done, err := merged(account)
+	if err != nil || done {
+		return err
+	}
+
+	recpSeed, err := escrowSigner(project)
+	if err != nil {
+		return err
+	}
+
+	code, assetIssuer := escrowAsset()
+	trust := build.ChangeTrust{Line: build.CreditAsset{Code: code, Issuer: assetIssuer}, Limit: "0"}
+	merge := build.AccountMerge{Destination: consts.PlatformPublicKey}
+	txhash, err := sendTx(project.EscrowPubkey, "close escrow", []keys.Signer{keys.Seed(recpSeed), keys.Key(keys.Platform)},
+		&trust, &merge)
+	if err != nil {
+		account.LastTx = txhash
+		return err
+	}
+	account.TxHash = txhash
+	return nil
+}
+
+// accountFrozen returns true if an account's master key has no weight, which is how issuers are
+// frozen once they've issued a project's assets
+func accountFrozen(pubkey string) (bool, error) {
+	data, err := xlm.GetAccountData(pubkey)
+	if err != nil {
+		return false, errors.Wrap(err, "couldn't retrieve account")
+	}
+
+	var x struct {
+		Signers []struct {
+			Key    string `json:"key"`
+			Weight int    `json:"weight"`
+		} `json:"signers"`
+	}
+	err = json.Unmarshal(data, &x)
+	if err != nil {
+		return false, errors.Wrap(err, "couldn't unmarshal account")
+	}
+
+	for _, signer := range x.Signers {
+		if signer.Key == pubkey {
+			return signer.Weight == 0, nil
+		}
+	}
+	return false, nil
+}
+
+// closeIssuer merges the project's issuer into the platform's account and deletes its key. Issuers
+// that have been frozen can't sign anymore, so they stay on the ledger and only their key is deleted.
+// Issuers whose assets are still held by investors aren't closed. account is the last attempt to
+// close the issuer, if any
+func closeIssuer(projIndex int, account ClosedAccount) (ClosedAccount, error) {
+	account.Kind, account.Error = "issuer", ""
+	id := keys.IssuerID(projIndex)
+	if account.PublicKey == "" {
+		pubkey, err := keyAddress(id)
+		if err != nil {
+			return account, err
+		}
+		account.PublicKey = pubkey
+	}
+
+	done, err := merged(&account)
+	if err != nil {
+		return account, err
+	}
+
+	if !done {
+		account.Frozen, err = accountFrozen(account.PublicKey)
+		if err != nil {
+			return account, err
+		}
+	}
+
+	if !done && !account.Frozen {
+		outstanding, err := issuedAmount(account.PublicKey)
+		if err != nil {
+			return account, errors.Wrap(err, "couldn't retrieve the issuer's assets")
+		}
+		if outstanding > 0 {
+			return account, errors.New("investors still hold the issuer's assets")
+		}
+
+		merge := build.AccountMerge{Destination: consts.PlatformPublicKey}
+		txhash, err := sendTx(account.PublicKey, "close issuer", []keys.Signer{keys.Key(id)}, &merge)
+		if err != nil {
+			account.LastTx = txhash
+			return account, errors.Wrap(err, "couldn't merge issuer")
+		}
+		account.TxHash = txhash
+	}
+
+	// the key is already gone if an earlier attempt deleted it but couldn't be saved
+	err = keys.Manager.Delete(id)
+	if errors.Cause(err) == keys.ErrNotFound {
+		err = nil
+	}
+	return account, err
+}
+
+// CloseProjectAccounts closes the escrow and issuer accounts of a settled project and terminates
+// it. Accounts that couldn't be closed are retried when called again
+func CloseProjectAccounts(index int) (Decommission, error) {
+	unlock := decommissionLocks.lock(index)
+	defer unlock()
+
+	a, err := RetrieveDecommission(index)
+	if err != nil {
+		return a, err
+	}
+	if a.Status != DecommissionSettled {
+		return a, errors.New("only settled projects can be closed")
+	}
+
+	project, err := RetrieveProject(a.ProjIndex)
+	if err != nil {
+		return a, errors.Wrap(err, "couldn't retrieve project")
+	}
+
+	closed := make(map[string]bool)
+	previous := make(map[string]ClosedAccount)
+	var accounts []ClosedAccount
+	for _, account := range a.Accounts {
+		if account.TxHash != "" || account.Frozen || account.Missing {
+			closed[account.Kind] = true
+			accounts = append(accounts, account)
+			continue
+		}
+		previous[account.Kind] = account
+	}
+
+	failed := false
+	if !closed["escrow"] && project.EscrowPubkey != "" {
+		account := ClosedAccount{Kind: "escrow", PublicKey: project.EscrowPubkey, LastTx: previous["escrow"].LastTx}
+		err = closeEscrow(project, &account)
+		if err != nil {
+			account.Error, failed = err.Error(), true
+		}
+		accounts = append(accounts, account)
+	}
+
+	if !closed["issuer"] {
+		account, err := closeIssuer(project.Index, previous["issuer"])
+		if err != nil {
+			account.Error, failed = err.Error(), true
+		}
+		accounts = append(accounts, account)
+	}
+
+	a.Accounts = accounts
+	if failed {
+		err = a.Save()
+		if err != nil {
+			return a, errors.Wrap(err, "could not save decommission")
+		}
+		return a, errors.New("some accounts couldn't be closed, close again to retry them")
+	}
+
+	a.Status = DecommissionClosed
+	a.ClosedAt = utils.Unix()
+	err = a.Save()
+	if err != nil {
+		return a, errors.Wrap(err, "could not save decommission")
+	}
+
+	StopIngestion(project.Index)
+	project.Terminated = true
+	return a, project.Save()
+}
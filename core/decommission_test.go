@@ -0,0 +1,76 @@
+// +build all travis
+
+package core
+
+import (
+	"math"
+	"testing"
+)
+
+func TestCustodyChain(t *testing.T) {
+	var chain []CustodyRecord
+	prev := ""
+	for i, event := range custodyEvents {
+		record := CustodyRecord{Index: i + 1, EquipmentIndex: 1, Event: event, EntityIndex: 2, Evidence: "Qm", PrevHash: prev}
+		record.Hash = record.hash()
+		prev = record.Hash
+		chain = append(chain, record)
+	}
+	if !verifyCustody(chain) {
+		t.Fatal("valid chain of custody not verified")
+	}
+
+	chain[1].Location = "elsewhere"
+	if verifyCustody(chain) {
+		t.Fatal("tampered chain of custody verified")
+	}
+	chain[1].Location = ""
+	if verifyCustody(append(chain[:1], chain[2:]...)) {
+		t.Fatal("chain of custody with a missing event verified")
+	}
+}
+
+func TestEscrowPayouts(t *testing.T) {
+	payouts := escrowPayouts(100, map[string]float64{"A": 1, "B": 1, "C": 1})
+	if len(payouts) != 3 {
+		t.Fatal("payouts not split between investors")
+	}
+	var total float64
+	for _, payout := range payouts {
+		total += payout.Amount
+	}
+	if math.Abs(total-100) > 1e-9 || payouts[0].Amount != 33.33 || payouts[2].PublicKey != "C" {
+		t.Fatal("escrow not emptied exactly", payouts)
+	}
+
+	if len(escrowPayouts(0, map[string]float64{"A": 1})) != 0 || len(escrowPayouts(10, nil)) != 0 {
+		t.Fatal("payouts made without a balance or investors")
+	}
+}
+
+func TestMerged(t *testing.T) {
+	defer func(f func(string) (horizonTx, error)) { lookupTx = f }(lookupTx)
+	defer func(f func(string) (horizonAccount, error)) { lookupAccount = f }(lookupAccount)
+	lookupTx = func(hash string) (horizonTx, error) {
+		return horizonTx{Hash: hash, Successful: hash == "LANDED"}, nil
+	}
+	lookupAccount = func(pubkey string) (horizonAccount, error) {
+		if pubkey == "GONE" {
+			return horizonAccount{}, nil
+		}
+		return horizonAccount{ID: pubkey}, nil
+	}
+
+	account := ClosedAccount{PublicKey: "ESCROW", LastTx: "LANDED"}
+	if done, err := merged(&account); err != nil || !done || account.TxHash != "LANDED" {
+		t.Fatal("landed merge not recorded", account, err)
+	}
+	account = ClosedAccount{PublicKey: "GONE", LastTx: "FAILED"}
+	if done, err := merged(&account); err != nil || !done || !account.Missing || account.TxHash != "" {
+		t.Fatal("missing account not treated as closed", account, err)
+	}
+	account = ClosedAccount{PublicKey: "ESCROW", LastTx: "FAILED"}
+	if done, err := merged(&account); err != nil || done {
+		t.Fatal("open account treated as closed", account, err)
+	}
+}
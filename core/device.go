@@ -0,0 +1,136 @@
+package core
+
+import (
+	"encoding/base64"
+	"log"
+	"strconv"
+
+	"github.com/pkg/errors"
+	"github.com/stellar/go/keypair"
+)
+
+// each teller holds an ed25519 keypair (in Stellar's address format) that it generates on first
+// boot and registers along with its device id. Every report the teller sends is signed over the
+// device id, the kind of report, a counter and the payload. The counter is shared across all
+// kinds of reports and must strictly increase, so replayed or reordered reports are rejected.
+// Readings published over MQTT may be redelivered or arrive out of order, so they're signed with
+// a zero counter and deduplicated by their reading id instead.
+
+// Kinds of signed device reports
+const (
+	DeviceReportRegister = "register"
+	DeviceReportEnergy   = "energy"
+	DeviceReportState    = "state"
+	DeviceReportReading  = "reading"
+)
+
+// DeviceMessage returns the message a device signs for a report
+func DeviceMessage(deviceID string, kind string, counter uint64, payload string) []byte {
+	return []byte(deviceID + "|" + kind + "|" + strconv.FormatUint(counter, 10) + "|" + payload)
+}
+
+// ReadingMessage returns the payload a device signs for an energy reading it publishes
+func ReadingMessage(id string, timestamp string, channel string, value uint32, unit string) string {
+	return id + "|" + timestamp + "|" + channel + "|" + strconv.FormatUint(uint64(value), 10) + "|" + unit
+}
+
+// verifyDeviceSignature verifies a base64 encoded signature of message by pubkey
+func verifyDeviceSignature(pubkey string, message []byte, signature string) error {
+	kp, err := keypair.ParseAddress(pubkey)
+	if err != nil {
+		return errors.Wrap(err, "invalid device public key")
+	}
+
+	sig, err := base64.StdEncoding.DecodeString(signature)
+	if err != nil {
+		return errors.Wrap(err, "could not decode signature")
+	}
+
+	err = kp.Verify(message, sig)
+	if err != nil {
+		return errors.New("invalid device signature")
+	}
+	return nil
+}
+
+// RegisterDevice registers a device's id and public key. The signature must be over a register
+// report containing the public key, proving that the device holds the private key. A registered
+// key can only be replaced (rotated) if the register report is also signed by the old key.
+func (a *Recipient) RegisterDevice(deviceID string, pubkey string, signature string, oldSignature string) error {
+	message := DeviceMessage(deviceID, DeviceReportRegister, 0, pubkey)
+
+	if a.DevicePublicKey != "" && a.DevicePublicKey != pubkey {
+		if oldSignature == "" {
+			return errors.New("a different device key is already registered for this recipient")
+		}
+		err := verifyDeviceSignature(a.DevicePublicKey, message, oldSignature)
+		if err != nil {
+			return errors.Wrap(err, "key rotation not signed by the registered key")
+		}
+	}
+
+	err := verifyDeviceSignature(pubkey, message, signature)
+	if err != nil {
+		return err
+	}
+
+	if a.DevicePublicKey == "" {
+		a.DeviceCounter = 0
+	}
+	if a.DevicePublicKey != pubkey {
+		// the new key has yet to sign a reading
+		a.DeviceReadingsVerified = false
+	}
+	a.DeviceID = deviceID
+	a.DevicePublicKey = pubkey
+	return a.Save()
+}
+
+// VerifyDeviceReport verifies a signed report from the recipient's device and advances the
+// device counter. The caller is expected to save the recipient along with the report's data.
+func (a *Recipient) VerifyDeviceReport(kind string, payload string, counter string, signature string) error {
+	if a.DevicePublicKey == "" {
+		return errors.New("no device key registered for this recipient")
+	}
+
+	count, err := strconv.ParseUint(counter, 10, 64)
+	if err != nil {
+		return errors.Wrap(err, "could not parse counter")
+	}
+
+	err = verifyDeviceSignature(a.DevicePublicKey, DeviceMessage(a.DeviceID, kind, count, payload), signature)
+	if err != nil {
+		return err
+	}
+
+	if count <= a.DeviceCounter {
+		return errors.New("report counter is not greater than the last accepted counter, rejecting replayed report")
+	}
+
+	a.DeviceCounter = count
+	return nil
+}
+
+// ResetDevice removes a recipient's registered device key so that a replacement device can
+// register. Rotating a key needs a signature by the old one, so this is the only way to recover
+// from a lost device
+func ResetDevice(recpIndex int) error {
+	unlock := recipientLocks.lock(recpIndex)
+	defer unlock()
+
+	recipient, err := RetrieveRecipient(recpIndex)
+	if err != nil {
+		return errors.Wrap(err, "couldn't retrieve recipient")
+	}
+
+	if recipient.DevicePublicKey == "" {
+		return errors.New("no device key registered for this recipient")
+	}
+
+	log.Println("resetting device", recipient.DeviceID, "with key", recipient.DevicePublicKey, "of recipient", recpIndex)
+	recipient.DeviceID = ""
+	recipient.DevicePublicKey = ""
+	recipient.DeviceCounter = 0
+	recipient.DeviceReadingsVerified = false
+	return recipient.Save()
+}
@@ -0,0 +1,56 @@
+// +build all travis
+
+package core
+
+import (
+	"encoding/base64"
+	"testing"
+
+	"github.com/stellar/go/keypair"
+)
+
+func TestVerifyDeviceReport(t *testing.T) {
+	kp, err := keypair.Random()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sign := func(kind string, counter uint64, payload string) string {
+		sig, err := kp.Sign(DeviceMessage("DEVICE", kind, counter, payload))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return base64.StdEncoding.EncodeToString(sig)
+	}
+
+	var a Recipient
+	a.DeviceID = "DEVICE"
+	a.DevicePublicKey = kp.Address()
+
+	err = a.VerifyDeviceReport(DeviceReportEnergy, "100", "1", sign(DeviceReportEnergy, 1, "100"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// replay
+	err = a.VerifyDeviceReport(DeviceReportEnergy, "100", "1", sign(DeviceReportEnergy, 1, "100"))
+	if err == nil {
+		t.Fatalf("replayed report accepted")
+	}
+	// tampered payload
+	err = a.VerifyDeviceReport(DeviceReportEnergy, "200", "2", sign(DeviceReportEnergy, 2, "100"))
+	if err == nil {
+		t.Fatalf("tampered report accepted")
+	}
+	// signature for a different kind of report
+	err = a.VerifyDeviceReport(DeviceReportState, "100", "3", sign(DeviceReportEnergy, 3, "100"))
+	if err == nil {
+		t.Fatalf("report accepted with signature of a different kind")
+	}
+	err = a.VerifyDeviceReport(DeviceReportState, "hash", "3", sign(DeviceReportState, 3, "hash"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.DeviceCounter != 3 {
+		t.Fatalf("counter not advanced")
+	}
+}
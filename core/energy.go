@@ -0,0 +1,679 @@
+package core
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/pkg/errors"
+
+	utils "github.com/Varunram/essentials/utils"
+)
+
+// EnergyBucket is the bucket where energy readings are stored. Each project has a nested
+// bucket inside it which holds raw readings keyed by timestamp and hourly, daily and monthly
+// rollups keyed by the start of the period, so that range queries are simple cursor seeks.
+// Readings from the import and export channels of a project's grid meter and the charge and
+// discharge channels of its batteries are kept in separate nested buckets so that they never mix
+// with generation
+var EnergyBucket = []byte("Energy")
+
+// Energy channels
+const (
+	EnergyGeneration = "generation"
+	EnergyImport     = "import"
+	EnergyExport     = "export"
+	EnergyCharge     = "charge"
+	EnergyDischarge  = "discharge"
+)
+
+// Energy granularities
+const (
+	EnergyRaw   = "raw"
+	EnergyHour  = "hour"
+	EnergyDay   = "day"
+	EnergyMonth = "month"
+)
+
+// energyRollups are the granularities that are aggregated on ingestion
+var energyRollups = []string{EnergyHour, EnergyDay, EnergyMonth}
+
+// EnergyRollup is the aggregate of all readings in a period
+type EnergyRollup struct {
+	// Start is the unix time at which the period starts
+	Start int64
+	// Granularity is one of hour, day or month
+	Granularity string
+	// Total is the sum of all readings in the period
+	Total uint64
+	// Count is the number of readings in the period
+	Count int
+	// Min is the smallest reading in the period
+	Min uint32
+	// Max is the largest reading in the period
+	Max uint32
+}
+
+// EnergyReading is a single energy reading reported by a project's device
+type EnergyReading struct {
+	// ID identifies the reading so that redelivered readings are only counted once
+	ID string
+	// Timestamp is the unix time of the reading
+	Timestamp int64
+	// Value is the amount of energy reported
+	Value uint32
+	// Unit is the unit of Value as reported by the device
+	Unit string
+	// DeviceID is the id of the device that reported the reading
+	DeviceID string
+	// AssetID is the id of the asset the device is attached to
+	AssetID string
+	// Source is how the reading reached the platform (eg mqtt)
+	Source string
+	// Channel is the meter channel of the reading: generation, import, export, charge or discharge.
+	// Empty means generation
+	Channel string `json:",omitempty"`
+	// Battery is the battery telemetry reported along with the reading, if any
+	Battery *BatteryTelemetry `json:",omitempty"`
+}
+
+// energyPayload is the structure of the energy data published by devices
+type energyPayload struct {
+	ID              string `json:"id"`
+	EnergyTimestamp string `json:"energy_timestamp"`
+	Unit            string `json:"unit"`
+	Value           uint32 `json:"value"`
+	OwnerID         string `json:"owner_id"`
+	AssetID         string `json:"asset_id"`
+	Channel         string `json:"channel"`
+	// battery telemetry, only reported by devices attached to a battery
+	SoC      *float64 `json:"soc"`
+	Cycles   float64  `json:"cycles"`
+	Capacity uint32   `json:"capacity"`
+	// Signature is the device's signature over the reading's ReadingMessage
+	Signature string `json:"signature"`
+}
+
+// ErrDuplicateReading is returned when a reading with the same id has already been stored
+var ErrDuplicateReading = errors.New("energy reading already stored")
+
+// energyIDs is the name of the nested bucket of a project's energy bucket that holds the ids of
+// all stored readings
+var energyIDs = []byte("ids")
+
+// ingestLocks serializes ingestion of the readings of a project
+var ingestLocks keyedLock
+
+// parseEnergyTimestamp parses a device timestamp which is either unix time or RFC3339.
+// Returns the current time if the timestamp can't be parsed.
+func parseEnergyTimestamp(timestamp string) int64 {
+	unix, err := strconv.ParseInt(timestamp, 10, 64)
+	if err == nil {
+		return unix
+	}
+
+	t, err := time.Parse(time.RFC3339, timestamp)
+	if err == nil {
+		return t.Unix()
+	}
+
+	return utils.Unix()
+}
+
+// energyKey returns the key of a reading in a project's raw bucket. Keys are big endian so
+// that bolt orders readings by time. The sequence number avoids collisions between readings
+// reported in the same second.
+func energyKey(timestamp int64, seq uint64) []byte {
+	key := make([]byte, 16)
+	binary.BigEndian.PutUint64(key[0:8], uint64(timestamp))
+	binary.BigEndian.PutUint64(key[8:16], seq)
+	return key
+}
+
+// periodKey returns the key of a rollup in a project's rollup bucket
+func periodKey(start int64) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, uint64(start))
+	return key
+}
+
+// periodStart returns the start of the hour, day or month (UTC) that timestamp falls in
+func periodStart(timestamp int64, granularity string) int64 {
+	t := time.Unix(timestamp, 0).UTC()
+	switch granularity {
+	case EnergyHour:
+		return t.Truncate(time.Hour).Unix()
+	case EnergyDay:
+		return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC).Unix()
+	case EnergyMonth:
+		return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC).Unix()
+	}
+	return timestamp
+}
+
+// projectEnergyBucket returns the name of a project's nested energy bucket for a channel
+func projectEnergyBucket(projIndex int, channel string) []byte {
+	if channel == "" || channel == EnergyGeneration {
+		return []byte(strconv.Itoa(projIndex))
+	}
+	return []byte(strconv.Itoa(projIndex) + "-" + channel)
+}
+
+// validChannel checks whether channel is a known energy channel
+func validChannel(channel string) bool {
+	switch channel {
+	case "", EnergyGeneration, EnergyImport, EnergyExport, EnergyCharge, EnergyDischarge:
+		return true
+	}
+	return false
+}
+
+// add adds a reading to a rollup
+func (a *EnergyRollup) add(value uint32) {
+	if a.Count == 0 || value < a.Min {
+		a.Min = value
+	}
+	if value > a.Max {
+		a.Max = value
+	}
+	a.Total += uint64(value)
+	a.Count++
+}
+
+// SaveEnergyReading stores an energy reading against a project and updates its rollups.
+// Returns ErrDuplicateReading if a reading with the same id has already been stored
+func SaveEnergyReading(projIndex int, reading EnergyReading) error {
+	if !validChannel(reading.Channel) {
+		return errors.New("energy channel not recognized")
+	}
+	if reading.ID == "" {
+		reading.ID = readingID(reading)
+	}
+
+	db, err := OpenDB()
+	if err != nil {
+		return errors.Wrap(err, "could not open database")
+	}
+	defer db.Close()
+
+	encoded, err := json.Marshal(reading)
+	if err != nil {
+		return errors.Wrap(err, "could not marshal energy reading")
+	}
+
+	return db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists(EnergyBucket)
+		if err != nil {
+			return err
+		}
+		pb, err := b.CreateBucketIfNotExists(projectEnergyBucket(projIndex, reading.Channel))
+		if err != nil {
+			return err
+		}
+
+		ids, err := pb.CreateBucketIfNotExists(energyIDs)
+		if err != nil {
+			return err
+		}
+		if ids.Get([]byte(reading.ID)) != nil {
+			return ErrDuplicateReading
+		}
+		err = ids.Put([]byte(reading.ID), []byte{1})
+		if err != nil {
+			return err
+		}
+
+		raw, err := pb.CreateBucketIfNotExists([]byte(EnergyRaw))
+		if err != nil {
+			return err
+		}
+		seq, err := raw.NextSequence()
+		if err != nil {
+			return err
+		}
+		err = raw.Put(energyKey(reading.Timestamp, seq), encoded)
+		if err != nil {
+			return err
+		}
+
+		for _, granularity := range energyRollups {
+			rb, err := pb.CreateBucketIfNotExists([]byte(granularity))
+			if err != nil {
+				return err
+			}
+
+			start := periodStart(reading.Timestamp, granularity)
+			rollup := EnergyRollup{Start: start, Granularity: granularity}
+			if x := rb.Get(periodKey(start)); x != nil {
+				err = json.Unmarshal(x, &rollup)
+				if err != nil {
+					return err
+				}
+			}
+
+			rollup.add(reading.Value)
+			encoded, err := json.Marshal(rollup)
+			if err != nil {
+				return err
+			}
+			err = rb.Put(periodKey(start), encoded)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// RetrieveEnergyReadings returns a project's raw generation readings with from <= timestamp < to
+func RetrieveEnergyReadings(projIndex int, from int64, to int64) ([]EnergyReading, error) {
+	return RetrieveChannelReadings(projIndex, EnergyGeneration, from, to)
+}
+
+// RetrieveChannelReadings returns a project's raw readings on a channel with from <= timestamp < to
+func RetrieveChannelReadings(projIndex int, channel string, from int64, to int64) ([]EnergyReading, error) {
+	var arr []EnergyReading
+	err := viewEnergyBucket(projIndex, channel, EnergyRaw, from, to, func(value []byte) error {
+		var x EnergyReading
+		err := json.Unmarshal(value, &x)
+		if err != nil {
+			return err
+		}
+		arr = append(arr, x)
+		return nil
+	})
+	return arr, err
+}
+
+// RetrieveEnergyRollups returns a project's generation rollups of the given granularity whose
+// periods start in [from, to). Raw readings are returned as single reading rollups.
+func RetrieveEnergyRollups(projIndex int, granularity string, from int64, to int64) ([]EnergyRollup, error) {
+	return RetrieveChannelRollups(projIndex, EnergyGeneration, granularity, from, to)
+}
+
+// RetrieveChannelRollups returns a project's rollups on a channel of the given granularity whose
+// periods start in [from, to)
+func RetrieveChannelRollups(projIndex int, channel string, granularity string, from int64, to int64) ([]EnergyRollup, error) {
+	var arr []EnergyRollup
+	if !validChannel(channel) {
+		return arr, errors.New("unknown energy channel")
+	}
+
+	if granularity == EnergyRaw {
+		readings, err := RetrieveChannelReadings(projIndex, channel, from, to)
+		if err != nil {
+			return arr, err
+		}
+		for _, reading := range readings {
+			rollup := EnergyRollup{Start: reading.Timestamp, Granularity: EnergyRaw}
+			rollup.add(reading.Value)
+			arr = append(arr, rollup)
+		}
+		return arr, nil
+	}
+
+	if granularity != EnergyHour && granularity != EnergyDay && granularity != EnergyMonth {
+		return arr, errors.New("granularity not recognized")
+	}
+
+	err := viewEnergyBucket(projIndex, channel, granularity, from, to, func(value []byte) error {
+		var x EnergyRollup
+		err := json.Unmarshal(value, &x)
+		if err != nil {
+			return err
+		}
+		arr = append(arr, x)
+		return nil
+	})
+	return arr, err
+}
+
+// TotalEnergy returns the total energy produced by a project with from <= timestamp < to.
+// Whole months in the range are read from the monthly rollups and the rest from raw readings.
+func TotalEnergy(projIndex int, from int64, to int64) (uint64, error) {
+	return ChannelEnergy(projIndex, EnergyGeneration, from, to)
+}
+
+// ChannelEnergy returns the total energy on a project's channel with from <= timestamp < to
+func ChannelEnergy(projIndex int, channel string, from int64, to int64) (uint64, error) {
+	var total uint64
+
+	// first month boundary at or after from
+	monthStart := periodStart(from, EnergyMonth)
+	if monthStart < from {
+		monthStart = time.Unix(monthStart, 0).UTC().AddDate(0, 1, 0).Unix()
+	}
+	monthEnd := periodStart(to, EnergyMonth)
+
+	if monthStart >= monthEnd {
+		readings, err := RetrieveChannelReadings(projIndex, channel, from, to)
+		if err != nil {
+			return 0, err
+		}
+		for _, reading := range readings {
+			total += uint64(reading.Value)
+		}
+		return total, nil
+	}
+
+	months, err := RetrieveChannelRollups(projIndex, channel, EnergyMonth, monthStart, monthEnd)
+	if err != nil {
+		return 0, err
+	}
+	for _, month := range months {
+		total += month.Total
+	}
+
+	for _, r := range [][2]int64{{from, monthStart}, {monthEnd, to}} {
+		readings, err := RetrieveChannelReadings(projIndex, channel, r[0], r[1])
+		if err != nil {
+			return 0, err
+		}
+		for _, reading := range readings {
+			total += uint64(reading.Value)
+		}
+	}
+
+	return total, nil
+}
+
+// InvestorEnergy returns the energy generated by all projects an investor has invested in
+// (total) and the investor's share of it weighted by their stake in each project (direct)
+func InvestorEnergy(investor Investor) (uint64, uint64, error) {
+	var direct, total uint64
+	now := utils.Unix()
+
+	indices := uniqueInts(append(investor.InvestedSolarProjectsIndices, investor.SeedInvestedSolarProjectsIndices...))
+	for _, index := range indices {
+		project, err := RetrieveProject(index)
+		if err != nil {
+			return direct, total, errors.Wrap(err, "couldn't retrieve project")
+		}
+
+		energy, err := TotalEnergy(index, 0, now)
+		if err != nil {
+			return direct, total, errors.Wrap(err, "couldn't retrieve project energy")
+		}
+
+		total += energy
+		direct += uint64(float64(energy) * investorShare(project, investor.U.StellarWallet.PublicKey))
+	}
+
+	return direct, total, nil
+}
+
+// viewEnergyBucket calls fn on each value in a project channel's energy sub bucket whose key's
+// timestamp lies in [from, to)
+func viewEnergyBucket(projIndex int, channel string, name string, from int64, to int64, fn func([]byte) error) error {
+	db, err := OpenDB()
+	if err != nil {
+		return errors.Wrap(err, "could not open database")
+	}
+	defer db.Close()
+
+	return db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(EnergyBucket)
+		if b == nil {
+			return nil
+		}
+		pb := b.Bucket(projectEnergyBucket(projIndex, channel))
+		if pb == nil {
+			return nil
+		}
+		sb := pb.Bucket([]byte(name))
+		if sb == nil {
+			return nil
+		}
+
+		c := sb.Cursor()
+		for k, v := c.Seek(periodKey(from)); k != nil; k, v = c.Next() {
+			if int64(binary.BigEndian.Uint64(k[0:8])) >= to {
+				break
+			}
+			err := fn(v)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// readingID returns the id of a reading that wasn't reported with one. Readings fetched from a
+// provider are identified by the device, channel and time of the reading
+func readingID(reading EnergyReading) string {
+	return reading.Source + "|" + reading.DeviceID + "|" + reading.Channel + "|" + strconv.FormatInt(reading.Timestamp, 10)
+}
+
+// ParseEnergyPayload parses an energy payload published by a device
+func ParseEnergyPayload(payload []byte) (EnergyReading, error) {
+	reading, _, err := parseEnergyPayload(payload)
+	return reading, err
+}
+
+// parseEnergyPayload parses an energy payload and returns the reading along with the
+// payload itself
+func parseEnergyPayload(payload []byte) (EnergyReading, energyPayload, error) {
+	var reading EnergyReading
+	var x energyPayload
+
+	err := json.Unmarshal(payload, &x)
+	if err != nil {
+		return reading, x, errors.Wrap(err, "could not unmarshal energy payload")
+	}
+
+	reading.ID = x.ID
+	reading.Timestamp = parseEnergyTimestamp(x.EnergyTimestamp)
+	reading.Value = x.Value
+	reading.Unit = x.Unit
+	reading.DeviceID = x.OwnerID
+	reading.AssetID = x.AssetID
+	reading.Channel = x.Channel
+	if x.SoC != nil {
+		reading.Battery = &BatteryTelemetry{SoC: *x.SoC, Cycles: x.Cycles, CapacityWh: x.Capacity}
+	}
+	return reading, x, nil
+}
+
+// IngestEnergyReading parses an energy payload published by a project's device and ingests it.
+// The payload has to carry a reading id and be signed by the device registered by the project's
+// recipient, since it feeds into the recipient's bill. Devices that publish unsigned readings
+// have their energy reported by the teller's pushes instead, which are only ignored once the
+// device's signed readings verify
+func IngestEnergyReading(projIndex int, payload []byte, source string) (EnergyReading, error) {
+	reading, x, err := parseEnergyPayload(payload)
+	if err != nil {
+		return reading, err
+	}
+
+	if x.ID == "" || x.Signature == "" {
+		return reading, errors.New("reading is not signed, energy is taken from the teller's pushes")
+	}
+
+	project, err := RetrieveProject(projIndex)
+	if err != nil {
+		return reading, errors.Wrap(err, "couldn't retrieve project")
+	}
+
+	recipient, err := RetrieveRecipient(project.RecipientIndex)
+	if err != nil {
+		return reading, errors.Wrap(err, "couldn't retrieve recipient")
+	}
+
+	if recipient.DevicePublicKey == "" || reading.DeviceID != recipient.DeviceID {
+		return reading, errors.New("reading not published by the recipient's registered device")
+	}
+
+	message := DeviceMessage(recipient.DeviceID, DeviceReportReading, 0,
+		ReadingMessage(x.ID, x.EnergyTimestamp, x.Channel, x.Value, x.Unit))
+	err = verifyDeviceSignature(recipient.DevicePublicKey, message, x.Signature)
+	if err != nil {
+		return reading, err
+	}
+
+	if !recipient.DeviceReadingsVerified {
+		err = markReadingsVerified(recipient.U.Index, recipient.DevicePublicKey)
+		if err != nil {
+			return reading, err
+		}
+	}
+
+	reading.Source = source
+	return reading, IngestReading(projIndex, reading)
+}
+
+// IngestReading stores a reading reported for a project and adds generation to the project
+// recipient's energy for the current payback period. All energy reported by devices, whether
+// published over MQTT or fetched from an IoT provider, goes through here. Readings that have
+// already been ingested are ignored
+func IngestReading(projIndex int, reading EnergyReading) error {
+	unlock := ingestLocks.lock(projIndex)
+	defer unlock()
+
+	if reading.ID == "" {
+		reading.ID = readingID(reading)
+	}
+
+	err := SaveEnergyReading(projIndex, reading)
+	if err == ErrDuplicateReading {
+		log.Println("ignoring duplicate reading", reading.ID, "for project", projIndex)
+		return nil
+	}
+	if err != nil {
+		return errors.Wrap(err, "could not store energy reading")
+	}
+
+	if reading.Battery != nil || reading.Channel == EnergyCharge || reading.Channel == EnergyDischarge {
+		err = RecordBatteryTelemetry(projIndex, reading)
+		if err != nil {
+			log.Println("could not record battery telemetry", err)
+		}
+	}
+
+	if reading.Channel != "" && reading.Channel != EnergyGeneration {
+		log.Println("ingested", reading.Value, reading.Unit, reading.Channel, "for project", projIndex, "from", reading.Source)
+		return nil
+	}
+
+	// the fleet tracks each device's latest generation
+	if reading.DeviceID != "" {
+		err = RecordDeviceEnergy(projIndex, FleetIoTHub, reading.DeviceID, reading.Value)
+		if err != nil {
+			log.Println("could not record device energy in the fleet", err)
+		}
+	}
+
+	project, err := RetrieveProject(projIndex)
+	if err != nil {
+		return errors.Wrap(err, "couldn't retrieve project")
+	}
+
+	err = AddTellerEnergy(project.RecipientIndex, reading.Value)
+	if err != nil {
+		return err
+	}
+
+	log.Println("ingested", reading.Value, reading.Unit, "for project", projIndex, "from", reading.Source)
+	return nil
+}
+
+// AddTellerEnergy adds energy to a recipient's energy for the current payback period
+func AddTellerEnergy(recpIndex int, energy uint32) error {
+	unlock := recipientLocks.lock(recpIndex)
+	defer unlock()
+
+	recipient, err := RetrieveRecipient(recpIndex)
+	if err != nil {
+		return errors.Wrap(err, "couldn't retrieve recipient")
+	}
+
+	recipient.TellerEnergy += energy
+	recipient.PastTellerEnergy = append(recipient.PastTellerEnergy, energy)
+	err = recipient.Save()
+	if err != nil {
+		return errors.Wrap(err, "couldn't save recipient")
+	}
+	return nil
+}
+
+// markReadingsVerified records that the recipient's device with the given key signs its
+// readings, so that the teller's pushes stop being counted
+func markReadingsVerified(recpIndex int, pubkey string) error {
+	unlock := recipientLocks.lock(recpIndex)
+	defer unlock()
+
+	recipient, err := RetrieveRecipient(recpIndex)
+	if err != nil {
+		return errors.Wrap(err, "couldn't retrieve recipient")
+	}
+	if recipient.DevicePublicKey != pubkey {
+		return errors.New("device key changed while verifying reading")
+	}
+
+	log.Println("verified signed reading of device", recipient.DeviceID, "of recipient", recpIndex, "ignoring teller pushes from now on")
+	recipient.DeviceReadingsVerified = true
+	return recipient.Save()
+}
+
+// SaveDeviceCounter stores a recipient's device counter after a verified report without
+// overwriting energy added since the recipient was retrieved
+func SaveDeviceCounter(recpIndex int, counter uint64) error {
+	unlock := recipientLocks.lock(recpIndex)
+	defer unlock()
+
+	recipient, err := RetrieveRecipient(recpIndex)
+	if err != nil {
+		return errors.Wrap(err, "couldn't retrieve recipient")
+	}
+
+	if counter <= recipient.DeviceCounter {
+		return errors.New("report counter is not greater than the last accepted counter, rejecting replayed report")
+	}
+	recipient.DeviceCounter = counter
+	return recipient.Save()
+}
+
+// LatestEnergyTimestamp returns the timestamp of the latest reading a project received from source,
+// 0 if there are none
+func LatestEnergyTimestamp(projIndex int, source string) (int64, error) {
+	var latest int64
+
+	db, err := OpenDB()
+	if err != nil {
+		return latest, errors.Wrap(err, "could not open database")
+	}
+	defer db.Close()
+
+	err = db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(EnergyBucket)
+		if b == nil {
+			return nil
+		}
+		pb := b.Bucket(projectEnergyBucket(projIndex, EnergyGeneration))
+		if pb == nil {
+			return nil
+		}
+		raw := pb.Bucket([]byte(EnergyRaw))
+		if raw == nil {
+			return nil
+		}
+
+		c := raw.Cursor()
+		for k, v := c.Last(); k != nil; k, v = c.Prev() {
+			var x EnergyReading
+			err := json.Unmarshal(v, &x)
+			if err != nil {
+				return err
+			}
+			if x.Source == source {
+				latest = x.Timestamp
+				return nil
+			}
+		}
+		return nil
+	})
+	return latest, err
+}
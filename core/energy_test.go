@@ -0,0 +1,54 @@
+// +build all travis
+
+package core
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestEnergyKeys(t *testing.T) {
+	if parseEnergyTimestamp("1568000000") != 1568000000 {
+		t.Fatalf("unix timestamp not parsed")
+	}
+	if parseEnergyTimestamp("2019-09-09T03:33:20Z") != 1568000000 {
+		t.Fatalf("RFC3339 timestamp not parsed")
+	}
+
+	if bytes.Compare(energyKey(100, 5), energyKey(101, 1)) >= 0 {
+		t.Fatalf("energy keys not ordered by time")
+	}
+	if bytes.Compare(energyKey(100, 1), energyKey(100, 2)) >= 0 {
+		t.Fatalf("energy keys in the same second not ordered by sequence")
+	}
+
+	reading, err := ParseEnergyPayload([]byte(`{"id":"r1","energy_timestamp":"1568000000","value":5}`))
+	if err != nil || reading.ID != "r1" {
+		t.Fatalf("reading id not parsed")
+	}
+	reading.ID = ""
+	if readingID(reading) != readingID(reading) || readingID(reading) == readingID(EnergyReading{Timestamp: 1}) {
+		t.Fatalf("provider reading ids not derived from the reading")
+	}
+}
+
+func TestPeriodStart(t *testing.T) {
+	// 2019-09-09T03:33:20Z
+	if periodStart(1568000000, EnergyHour) != 1567998000 {
+		t.Fatalf("hour not truncated")
+	}
+	if periodStart(1568000000, EnergyDay) != 1567987200 {
+		t.Fatalf("day not truncated")
+	}
+	if periodStart(1568000000, EnergyMonth) != 1567296000 {
+		t.Fatalf("month not truncated")
+	}
+
+	var rollup EnergyRollup
+	rollup.add(5)
+	rollup.add(2)
+	rollup.add(9)
+	if rollup.Total != 16 || rollup.Count != 3 || rollup.Min != 2 || rollup.Max != 9 {
+		t.Fatalf("rollup not aggregated correctly: %v", rollup)
+	}
+}
@@ -34,6 +34,9 @@ type Entity struct {
 	// Guarantor is a bool that is set if the entity is a guarantor
 	Guarantor bool
 
+	// Recycler is a bool that is set if the entity is a recycler
+	Recycler bool
+
 	// PastContracts contains a list of all past contracts associated with the entity
 	PastContracts []Project
 
@@ -66,7 +69,7 @@ type Entity struct {
 }
 
 // RetrieveAllEntitiesWithoutRole retrieves all the entities (contractors, developers,
-// originators, and guarantors) from the database
+// originators, guarantors and recyclers) from the database
 func RetrieveAllEntitiesWithoutRole() ([]Entity, error) {
 	var users []Entity
 	x, err := edb.RetrieveAllKeys(consts.DbDir+consts.DbName, ContractorBucket)
@@ -104,7 +107,8 @@ func RetrieveAllEntities(role string) ([]Entity, error) {
 		if entity.Contractor && role == "contractor" ||
 			entity.Originator && role == "originator" ||
 			entity.Guarantor && role == "guarantor" ||
-			entity.Developer && role == "developer" {
+			entity.Developer && role == "developer" ||
+			entity.Recycler && role == "recycler" {
 			entities = append(entities, entity)
 		}
 	}
@@ -152,6 +156,8 @@ func newEntity(uname string, pwd string, seedpwd string, name string, role strin
 		a.Originator = true
 	case "guarantor":
 		a.Guarantor = true
+	case "recycler":
+		a.Recycler = true
 	default:
 		return a, errors.New("invalid entity type passed")
 	}
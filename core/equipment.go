@@ -0,0 +1,474 @@
+package core
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+
+	edb "github.com/Varunram/essentials/database"
+	utils "github.com/Varunram/essentials/utils"
+
+	consts "github.com/YaleOpenLab/opensolar/consts"
+	notif "github.com/YaleOpenLab/opensolar/notif"
+)
+
+// the equipment registry keeps a record of every serial numbered panel, inverter, battery and meter
+// installed on a project along with its warranty. Contractors open maintenance work orders against
+// a project or a piece of its equipment and close them with evidence of the work done. Equipment
+// with a maintenance interval gets a preventive work order opened whenever maintenance is due, and
+// the project's contractor and developers are reminded consts.WarrantyReminderDays before each
+// warranty expires.
+
+// Equipment kinds
+const (
+	EquipmentPanel    = "panel"
+	EquipmentInverter = "inverter"
+	EquipmentBattery  = "battery"
+	EquipmentMeter    = "meter"
+	EquipmentOther    = "other"
+)
+
+// Equipment statuses
+const (
+	EquipmentActive   = "active"
+	EquipmentReplaced = "replaced"
+	EquipmentRetired  = "retired"
+)
+
+// Work order kinds
+const (
+	WorkOrderPreventive = "preventive"
+	WorkOrderCorrective = "corrective"
+	WorkOrderWarranty   = "warranty"
+)
+
+// Work order statuses
+const (
+	WorkOrderOpen   = "open"
+	WorkOrderClosed = "closed"
+)
+
+// Equipment is a piece of equipment installed on a project
+type Equipment struct {
+	// Index is the index of the equipment in the database
+	Index int
+	// ProjIndex is the index of the project the equipment is installed on
+	ProjIndex int
+	// Kind is one of panel, inverter, battery, meter or other
+	Kind string
+	// Manufacturer is the manufacturer of the equipment
+	Manufacturer string
+	// Model is the model of the equipment
+	Model string
+	// Serial is the serial number of the equipment, unique per manufacturer
+	Serial string
+	// InstalledAt is the unix time at which the equipment was installed
+	InstalledAt int64
+	// WarrantyExpiry is the unix time at which the equipment's warranty expires, 0 if it has none
+	WarrantyExpiry int64
+	// MaintenanceDays is the number of days between preventive maintenance, 0 if it needs none
+	MaintenanceDays int
+	// LastMaintained is the unix time at which the equipment was last maintained
+	LastMaintained int64
+	// Status is one of active, replaced or retired
+	Status string
+	// RegisteredBy is the index of the entity that registered the equipment
+	RegisteredBy int
+	// RemindersSent are the days before expiry at which warranty reminders have been sent
+	RemindersSent []int
+}
+
+// WorkOrderEvidence is evidence of the work done on a work order
+type WorkOrderEvidence struct {
+	// Reference is the ipfs hash or url of a photo, report or other document
+	Reference string
+	// AddedBy is the index of the entity that added the evidence
+	AddedBy int
+	// AddedAt is the unix time at which the evidence was added
+	AddedAt int64
+}
+
+// WorkOrder is a maintenance job on a project or a piece of its equipment
+type WorkOrder struct {
+	// Index is the index of the work order in the database
+	Index int
+	// Number identifies the work order
+	Number string
+	// ProjIndex is the index of the project
+	ProjIndex int
+	// EquipmentIndex is the index of the equipment worked on, 0 if the order is for the whole project
+	EquipmentIndex int
+	// Kind is one of preventive, corrective or warranty
+	Kind string
+	// Description describes the work to be done
+	Description string
+	// OpenedBy is the index of the entity that opened the order, 0 if it was opened by the platform
+	OpenedBy int
+	// OpenedAt is the unix time at which the order was opened
+	OpenedAt int64
+	// ScheduledFor is the unix time the work is scheduled for, 0 if it isn't scheduled
+	ScheduledFor int64
+	// Status is either open or closed
+	Status string
+	// ClosedBy is the index of the entity that closed the order
+	ClosedBy int
+	// ClosedAt is the unix time at which the order was closed
+	ClosedAt int64
+	// Resolution describes the work done
+	Resolution string
+	// Evidence is the evidence of the work done
+	Evidence []WorkOrderEvidence
+}
+
+// EquipmentBucket is the bucket where equipment is stored
+var EquipmentBucket = []byte("Equipment")
+
+// WorkOrderBucket is the bucket where work orders are stored
+var WorkOrderBucket = []byte("WorkOrders")
+
+// Save inserts a passed Equipment object into the database
+func (a *Equipment) Save() error {
+	return edb.Save(consts.DbDir+consts.DbName, EquipmentBucket, a, a.Index)
+}
+
+// Description describes a piece of equipment in reminders and reports
+func (a Equipment) Description() string {
+	return fmt.Sprintf("%s %s %s (serial %s)", a.Manufacturer, a.Model, a.Kind, a.Serial)
+}
+
+// RetrieveEquipment retrieves a piece of equipment from the database
+func RetrieveEquipment(key int) (Equipment, error) {
+	var x Equipment
+	temp, err := edb.Retrieve(consts.DbDir+consts.DbName, EquipmentBucket, key)
+	if err != nil {
+		return x, errors.Wrap(err, "error while retrieving key from bucket")
+	}
+
+	err = json.Unmarshal(temp, &x)
+	if err != nil {
+		return x, errors.Wrap(err, "could not unmarshal equipment")
+	}
+	if x.Index == 0 {
+		return x, errors.New("equipment not found")
+	}
+	return x, nil
+}
+
+// RetrieveProjectEquipment retrieves the equipment installed on a project. Pass 0 to retrieve all
+// equipment
+func RetrieveProjectEquipment(projIndex int) ([]Equipment, error) {
+	var arr []Equipment
+	x, err := edb.RetrieveAllKeys(consts.DbDir+consts.DbName, EquipmentBucket)
+	if err != nil {
+		return arr, errors.Wrap(err, "error while retrieving all keys")
+	}
+
+	for _, value := range x {
+		var temp Equipment
+		err := json.Unmarshal(value, &temp)
+		if err != nil {
+			return arr, errors.Wrap(err, "could not unmarshal equipment")
+		}
+		if projIndex == 0 || temp.ProjIndex == projIndex {
+			arr = append(arr, temp)
+		}
+	}
+	return arr, nil
+}
+
+// RegisterEquipment registers a piece of equipment installed on a project. Only the equipment's
+// details are read from spec
+func RegisterEquipment(projIndex int, entityIndex int, spec Equipment) (Equipment, error) {
+	a := Equipment{
+		Kind:            spec.Kind,
+		Manufacturer:    strings.TrimSpace(spec.Manufacturer),
+		Model:           strings.TrimSpace(spec.Model),
+		Serial:          strings.TrimSpace(spec.Serial),
+		InstalledAt:     spec.InstalledAt,
+		WarrantyExpiry:  spec.WarrantyExpiry,
+		MaintenanceDays: spec.MaintenanceDays,
+	}
+
+	switch a.Kind {
+	case EquipmentPanel, EquipmentInverter, EquipmentBattery, EquipmentMeter, EquipmentOther:
+	default:
+		return a, errors.New("unknown equipment kind")
+	}
+	if a.Manufacturer == "" || a.Model == "" || a.Serial == "" {
+		return a, errors.New("equipment needs a manufacturer, model and serial number")
+	}
+	if a.MaintenanceDays < 0 {
+		return a, errors.New("maintenance interval can't be negative")
+	}
+	if a.InstalledAt == 0 {
+		a.InstalledAt = utils.Unix()
+	}
+	if a.WarrantyExpiry != 0 && a.WarrantyExpiry <= a.InstalledAt {
+		return a, errors.New("warranty must expire after the equipment was installed")
+	}
+
+	_, err := RetrieveProject(projIndex)
+	if err != nil {
+		return a, errors.Wrap(err, "couldn't retrieve project")
+	}
+
+	all, err := RetrieveProjectEquipment(0)
+	if err != nil {
+		return a, err
+	}
+	for _, elem := range all {
+		if strings.EqualFold(elem.Manufacturer, a.Manufacturer) && strings.EqualFold(elem.Serial, a.Serial) {
+			return a, errors.New("equipment with this serial number is already registered on project " +
+				fmt.Sprint(elem.ProjIndex))
+		}
+	}
+
+	a.Index = len(all) + 1
+	a.ProjIndex = projIndex
+	a.LastMaintained = a.InstalledAt
+	a.Status = EquipmentActive
+	a.RegisteredBy = entityIndex
+	return a, a.Save()
+}
+
+// Save inserts a passed WorkOrder object into the database
+func (a *WorkOrder) Save() error {
+	return edb.Save(consts.DbDir+consts.DbName, WorkOrderBucket, a, a.Index)
+}
+
+// RetrieveWorkOrder retrieves a work order from the database
+func RetrieveWorkOrder(key int) (WorkOrder, error) {
+	var x WorkOrder
+	temp, err := edb.Retrieve(consts.DbDir+consts.DbName, WorkOrderBucket, key)
+	if err != nil {
+		return x, errors.Wrap(err, "error while retrieving key from bucket")
+	}
+
+	err = json.Unmarshal(temp, &x)
+	if err != nil {
+		return x, errors.Wrap(err, "could not unmarshal work order")
+	}
+	if x.Index == 0 {
+		return x, errors.New("work order not found")
+	}
+	return x, nil
+}
+
+// RetrieveWorkOrders retrieves the work orders of a project, newest first. Pass 0 to retrieve the
+// work orders of all projects
+func RetrieveWorkOrders(projIndex int) ([]WorkOrder, error) {
+	var arr []WorkOrder
+	x, err := edb.RetrieveAllKeys(consts.DbDir+consts.DbName, WorkOrderBucket)
+	if err != nil {
+		return arr, errors.Wrap(err, "error while retrieving all keys")
+	}
+
+	for _, value := range x {
+		var temp WorkOrder
+		err := json.Unmarshal(value, &temp)
+		if err != nil {
+			return arr, errors.Wrap(err, "could not unmarshal work order")
+		}
+		if projIndex == 0 || temp.ProjIndex == projIndex {
+			arr = append(arr, temp)
+		}
+	}
+
+	sort.Slice(arr, func(i, j int) bool {
+		return arr[i].Index > arr[j].Index
+	})
+	return arr, nil
+}
+
+// OpenWorkOrder opens a work order on a project or on one of its pieces of equipment
+func OpenWorkOrder(projIndex int, equipmentIndex int, kind string, description string, entityIndex int,
+	scheduledFor int64) (WorkOrder, error) {
+	var a WorkOrder
+	switch kind {
+	case WorkOrderPreventive, WorkOrderCorrective, WorkOrderWarranty:
+	default:
+		return a, errors.New("unknown work order kind")
+	}
+	if strings.TrimSpace(description) == "" {
+		return a, errors.New("work order needs a description")
+	}
+
+	if equipmentIndex != 0 {
+		equipment, err := RetrieveEquipment(equipmentIndex)
+		if err != nil {
+			return a, err
+		}
+		if equipment.ProjIndex != projIndex {
+			return a, errors.New("equipment isn't installed on the project")
+		}
+		if kind == WorkOrderWarranty && equipment.WarrantyExpiry != 0 && equipment.WarrantyExpiry < utils.Unix() {
+			return a, errors.New("equipment's warranty has expired")
+		}
+	} else if kind == WorkOrderWarranty {
+		return a, errors.New("warranty work orders must be opened on a piece of equipment")
+	}
+
+	all, err := RetrieveWorkOrders(0)
+	if err != nil {
+		return a, err
+	}
+
+	a.Index = len(all) + 1
+	a.Number = fmt.Sprintf("WO-%04d-%05d", projIndex, a.Index)
+	a.ProjIndex = projIndex
+	a.EquipmentIndex = equipmentIndex
+	a.Kind = kind
+	a.Description = strings.TrimSpace(description)
+	a.OpenedBy = entityIndex
+	a.OpenedAt = utils.Unix()
+	a.ScheduledFor = scheduledFor
+	a.Status = WorkOrderOpen
+	return a, a.Save()
+}
+
+// CloseWorkOrder closes a work order with a description of the work done and at least one piece
+// of evidence. Closing a preventive work order marks its equipment as maintained
+func CloseWorkOrder(index int, entityIndex int, resolution string, evidence []string) (WorkOrder, error) {
+	a, err := RetrieveWorkOrder(index)
+	if err != nil {
+		return a, err
+	}
+	if a.Status != WorkOrderOpen {
+		return a, errors.New("work order is not open")
+	}
+	if strings.TrimSpace(resolution) == "" {
+		return a, errors.New("work order needs a resolution to be closed")
+	}
+
+	now := utils.Unix()
+	for _, reference := range evidence {
+		if strings.TrimSpace(reference) == "" {
+			continue
+		}
+		a.Evidence = append(a.Evidence, WorkOrderEvidence{Reference: strings.TrimSpace(reference),
+			AddedBy: entityIndex, AddedAt: now})
+	}
+	if len(a.Evidence) == 0 {
+		return a, errors.New("work order needs evidence to be closed")
+	}
+
+	a.Status = WorkOrderClosed
+	a.ClosedBy = entityIndex
+	a.ClosedAt = now
+	a.Resolution = strings.TrimSpace(resolution)
+	err = a.Save()
+	if err != nil {
+		return a, errors.Wrap(err, "could not save work order")
+	}
+
+	if a.EquipmentIndex != 0 && a.Kind == WorkOrderPreventive {
+		equipment, err := RetrieveEquipment(a.EquipmentIndex)
+		if err != nil {
+			return a, err
+		}
+		equipment.LastMaintained = now
+		err = equipment.Save()
+		if err != nil {
+			return a, errors.Wrap(err, "could not save equipment")
+		}
+	}
+	return a, nil
+}
+
+// warrantyReminder returns the reminder that is due for a piece of equipment at time now, 0 if
+// none is due. Reminders that were skipped because a later one is already due are not returned
+func (a Equipment) warrantyReminder(now int64) int {
+	if a.WarrantyExpiry == 0 || a.Status != EquipmentActive || now >= a.WarrantyExpiry {
+		return 0
+	}
+
+	left := int((a.WarrantyExpiry - now) / (24 * 3600))
+	due := 0
+	for _, days := range consts.WarrantyReminderDays {
+		if left < days && (due == 0 || days < due) {
+			due = days
+		}
+	}
+	for _, sent := range a.RemindersSent {
+		if due != 0 && sent <= due {
+			return 0
+		}
+	}
+	return due
+}
+
+// maintenanceDue returns true if preventive maintenance of a piece of equipment is due at time now
+func (a Equipment) maintenanceDue(now int64) bool {
+	return a.Status == EquipmentActive && a.MaintenanceDays > 0 &&
+		now-a.LastMaintained >= int64(a.MaintenanceDays)*24*3600
+}
+
+// CheckMaintenance sends warranty reminders and opens preventive work orders for every piece of
+// equipment that needs them at time now
+func CheckMaintenance(now int64) error {
+	equipment, err := RetrieveProjectEquipment(0)
+	if err != nil {
+		return err
+	}
+
+	orders, err := RetrieveWorkOrders(0)
+	if err != nil {
+		return err
+	}
+	pending := make(map[int]bool)
+	for _, order := range orders {
+		if order.Status == WorkOrderOpen && order.Kind == WorkOrderPreventive {
+			pending[order.EquipmentIndex] = true
+		}
+	}
+
+	for _, elem := range equipment {
+		if days := elem.warrantyReminder(now); days != 0 {
+			project, err := RetrieveProject(elem.ProjIndex)
+			if err != nil {
+				log.Println("couldn't retrieve project", elem.ProjIndex, err)
+				continue
+			}
+
+			expiry := time.Unix(elem.WarrantyExpiry, 0).UTC().Format("2006-01-02")
+			for _, email := range performanceContacts(project) {
+				err = notif.SendWarrantyReminderEmail(elem.ProjIndex, email, elem.Description(), expiry)
+				if err != nil {
+					log.Println("could not remind", email, "about warranty of equipment", elem.Index, err)
+				}
+			}
+
+			elem.RemindersSent = append(elem.RemindersSent, days)
+			err = elem.Save()
+			if err != nil {
+				return errors.Wrap(err, "could not save equipment")
+			}
+		}
+
+		if elem.maintenanceDue(now) && !pending[elem.Index] {
+			_, err = OpenWorkOrder(elem.ProjIndex, elem.Index, WorkOrderPreventive,
+				"Scheduled maintenance of "+elem.Description(), 0, now)
+			if err != nil {
+				log.Println("could not open maintenance work order for equipment", elem.Index, err)
+			}
+		}
+	}
+	return nil
+}
+
+// MonitorMaintenance checks for warranty reminders and due maintenance every
+// consts.MaintenanceCheckInterval
+func MonitorMaintenance() {
+	for {
+		err := CheckMaintenance(utils.Unix())
+		if err != nil {
+			log.Println("could not check maintenance", err)
+		}
+		time.Sleep(consts.MaintenanceCheckInterval)
+	}
+}
@@ -0,0 +1,40 @@
+// +build all travis
+
+package core
+
+import (
+	"testing"
+)
+
+func TestWarrantyReminders(t *testing.T) {
+	day := int64(24 * 3600)
+	a := Equipment{Status: EquipmentActive, WarrantyExpiry: 1000 * day}
+	if a.warrantyReminder(800*day) != 0 {
+		t.Fatal("reminder sent too early")
+	}
+	if a.warrantyReminder(950*day) != 90 {
+		t.Fatal("first reminder not due")
+	}
+	a.RemindersSent = []int{90}
+	if a.warrantyReminder(951*day) != 0 {
+		t.Fatal("reminder sent twice")
+	}
+	// a skipped reminder isn't sent once a later one is due
+	if a.warrantyReminder(995*day) != 7 {
+		t.Fatal("last reminder not due")
+	}
+	a.RemindersSent = append(a.RemindersSent, 7)
+	if a.warrantyReminder(996*day) != 0 || a.warrantyReminder(1001*day) != 0 {
+		t.Fatal("reminder sent after the last one")
+	}
+
+	a.MaintenanceDays = 180
+	a.LastMaintained = 100 * day
+	if a.maintenanceDue(279*day) || !a.maintenanceDue(280*day) {
+		t.Fatal("maintenance not due on schedule")
+	}
+	a.Status = EquipmentReplaced
+	if a.maintenanceDue(280*day) {
+		t.Fatal("maintenance due on replaced equipment")
+	}
+}
@@ -0,0 +1,383 @@
+package core
+
+import (
+	"encoding/json"
+	"log"
+	"sort"
+	"time"
+
+	"github.com/pkg/errors"
+
+	edb "github.com/Varunram/essentials/database"
+	utils "github.com/Varunram/essentials/utils"
+
+	consts "github.com/YaleOpenLab/opensolar/consts"
+	notif "github.com/YaleOpenLab/opensolar/notif"
+)
+
+// the fleet registry keeps track of every teller and IoT hub that reports to the platform. Devices
+// are registered the first time they send a heartbeat or an energy reading and are checked
+// periodically for missed heartbeats, stale energy reports and outbound backlogs. Alerts are
+// debounced so that a flapping device doesn't flood admins with emails.
+
+// Fleet device kinds
+const (
+	FleetTeller = "teller"
+	FleetIoTHub = "iothub"
+)
+
+// Fleet health problems
+const (
+	FleetOffline  = "offline"       // no heartbeat within consts.FleetHeartbeatTimeout
+	FleetNoEnergy = "no energy"     // no energy report within consts.FleetEnergyTimeout
+	FleetBacklog  = "queue backlog" // more than consts.FleetMaxQueueDepth outbound operations pending
+)
+
+// UptimeEvent records a device going online or offline
+type UptimeEvent struct {
+	// Timestamp is the unix time of the transition
+	Timestamp int64
+	// Online is true if the device came online and false if it went offline
+	Online bool
+}
+
+// FleetDevice is a teller or IoT hub registered in the fleet
+type FleetDevice struct {
+	// Index is the index of the device in the database
+	Index int
+	// Kind is either teller or iothub
+	Kind string
+	// ProjIndex is the index of the project the device reports for
+	ProjIndex int
+	// DeviceID is the id of the device
+	DeviceID string
+	// Firmware is the firmware version last reported by the device
+	Firmware string
+	// FirstSeen is the unix time at which the device was registered
+	FirstSeen int64
+	// LastSeen is the unix time of the device's latest heartbeat or report
+	LastSeen int64
+	// LastEnergyReport is the unix time of the device's latest energy report
+	LastEnergyReport int64
+	// LastEnergy is the value of the device's latest energy report
+	LastEnergy uint32
+	// LastStateHash is the latest state hash reported by the device
+	LastStateHash string
+	// QueueDepth is the number of outbound operations pending on the device
+	QueueDepth int
+	// Online is false once the device has missed its heartbeats
+	Online bool
+	// History is the device's online / offline transitions, oldest first
+	History []UptimeEvent
+	// UnhealthySince is the unix time since which the device has been unhealthy, 0 if healthy
+	UnhealthySince int64
+	// AlertedAt is the unix time at which an alert was last sent for the device
+	AlertedAt int64
+}
+
+// FleetStatus is the health of a device as returned to admins
+type FleetStatus struct {
+	Device    FleetDevice
+	Problems  []string
+	Uptime24h float64
+	Uptime30d float64
+}
+
+// FleetBucket is the bucket where fleet devices are stored
+var FleetBucket = []byte("Fleet")
+
+// Save inserts a passed FleetDevice object into the database
+func (a *FleetDevice) Save() error {
+	return edb.Save(consts.DbDir+consts.DbName, FleetBucket, a, a.Index)
+}
+
+// RetrieveFleetDevice retrieves a fleet device from the database
+func RetrieveFleetDevice(key int) (FleetDevice, error) {
+	var x FleetDevice
+	temp, err := edb.Retrieve(consts.DbDir+consts.DbName, FleetBucket, key)
+	if err != nil {
+		return x, errors.Wrap(err, "error while retrieving key from bucket")
+	}
+
+	err = json.Unmarshal(temp, &x)
+	if err != nil {
+		return x, errors.Wrap(err, "could not unmarshal fleet device")
+	}
+	return x, nil
+}
+
+// RetrieveFleet retrieves all devices in the fleet
+func RetrieveFleet() ([]FleetDevice, error) {
+	var arr []FleetDevice
+	x, err := edb.RetrieveAllKeys(consts.DbDir+consts.DbName, FleetBucket)
+	if err != nil {
+		return arr, errors.Wrap(err, "error while retrieving all keys")
+	}
+
+	for _, value := range x {
+		var temp FleetDevice
+		err := json.Unmarshal(value, &temp)
+		if err != nil {
+			return arr, errors.Wrap(err, "could not unmarshal fleet device")
+		}
+		arr = append(arr, temp)
+	}
+	return arr, nil
+}
+
+// fleetDevice returns the registered device with the given id reporting for a project,
+// registering it if it hasn't been seen before
+func fleetDevice(projIndex int, kind string, deviceID string) (FleetDevice, error) {
+	devices, err := RetrieveFleet()
+	if err != nil {
+		return FleetDevice{}, err
+	}
+
+	for _, device := range devices {
+		if device.ProjIndex == projIndex && device.DeviceID == deviceID {
+			return device, nil
+		}
+	}
+
+	if kind != FleetTeller && kind != FleetIoTHub {
+		return FleetDevice{}, errors.New("device kind not recognized")
+	}
+
+	now := utils.Unix()
+	log.Println("registering", kind, deviceID, "for project", projIndex, "in the fleet")
+	return FleetDevice{
+		Index:     len(devices) + 1,
+		Kind:      kind,
+		ProjIndex: projIndex,
+		DeviceID:  deviceID,
+		FirstSeen: now,
+		Online:    true,
+		History:   []UptimeEvent{{Timestamp: now, Online: true}},
+	}, nil
+}
+
+// record appends an uptime transition, dropping the oldest ones beyond consts.FleetHistoryLength
+func (a *FleetDevice) record(timestamp int64, online bool) {
+	a.Online = online
+	a.History = append(a.History, UptimeEvent{Timestamp: timestamp, Online: online})
+	if len(a.History) > consts.FleetHistoryLength {
+		a.History = a.History[len(a.History)-consts.FleetHistoryLength:]
+	}
+}
+
+// seen marks the device as alive at timestamp
+func (a *FleetDevice) seen(timestamp int64) {
+	a.LastSeen = timestamp
+	if !a.Online {
+		a.record(timestamp, true)
+	}
+}
+
+// RecordHeartbeat records a heartbeat from a device. An empty firmware or a negative queue
+// depth leaves the stored value unchanged
+func RecordHeartbeat(projIndex int, kind string, deviceID string, firmware string, queueDepth int) (FleetDevice, error) {
+	if deviceID == "" {
+		return FleetDevice{}, errors.New("device id can't be empty")
+	}
+
+	device, err := fleetDevice(projIndex, kind, deviceID)
+	if err != nil {
+		return device, errors.Wrap(err, "could not retrieve fleet device")
+	}
+
+	device.seen(utils.Unix())
+	if firmware != "" {
+		device.Firmware = firmware
+	}
+	if queueDepth >= 0 {
+		device.QueueDepth = queueDepth
+	}
+
+	return device, device.Save()
+}
+
+// RecordDeviceEnergy records an energy report from a device
+func RecordDeviceEnergy(projIndex int, kind string, deviceID string, value uint32) error {
+	if deviceID == "" {
+		return errors.New("device id can't be empty")
+	}
+
+	device, err := fleetDevice(projIndex, kind, deviceID)
+	if err != nil {
+		return errors.Wrap(err, "could not retrieve fleet device")
+	}
+
+	now := utils.Unix()
+	device.seen(now)
+	device.LastEnergyReport = now
+	device.LastEnergy = value
+	return device.Save()
+}
+
+// RecordDeviceState records a state hash reported by a device
+func RecordDeviceState(projIndex int, kind string, deviceID string, hash string) error {
+	if deviceID == "" {
+		return errors.New("device id can't be empty")
+	}
+
+	device, err := fleetDevice(projIndex, kind, deviceID)
+	if err != nil {
+		return errors.Wrap(err, "could not retrieve fleet device")
+	}
+
+	device.seen(utils.Unix())
+	device.LastStateHash = hash
+	return device.Save()
+}
+
+// Problems returns the health problems of a device at time now
+func (a FleetDevice) Problems(now int64) []string {
+	var problems []string
+	if now-a.LastSeen > consts.FleetHeartbeatTimeout {
+		problems = append(problems, FleetOffline)
+	}
+
+	lastEnergy := a.LastEnergyReport
+	if lastEnergy == 0 {
+		lastEnergy = a.FirstSeen
+	}
+	if now-lastEnergy > consts.FleetEnergyTimeout {
+		problems = append(problems, FleetNoEnergy)
+	}
+
+	if a.QueueDepth > consts.FleetMaxQueueDepth {
+		problems = append(problems, FleetBacklog)
+	}
+	return problems
+}
+
+// Uptime returns the fraction of [from, to) that the device was online. Time before the device
+// was registered isn't counted
+func (a FleetDevice) Uptime(from int64, to int64) float64 {
+	if from < a.FirstSeen {
+		from = a.FirstSeen
+	}
+	if to <= from {
+		return 0
+	}
+
+	var online int64
+	state, since := false, from
+	for _, event := range a.History {
+		if event.Timestamp <= from {
+			state = event.Online
+			continue
+		}
+		if event.Timestamp >= to {
+			break
+		}
+		if state {
+			online += event.Timestamp - since
+		}
+		state, since = event.Online, event.Timestamp
+	}
+	if state {
+		online += to - since
+	}
+
+	return float64(online) / float64(to-from)
+}
+
+// Status returns the health of a device at time now
+func (a FleetDevice) Status(now int64) FleetStatus {
+	return FleetStatus{
+		Device:    a,
+		Problems:  a.Problems(now),
+		Uptime24h: a.Uptime(now-24*3600, now),
+		Uptime30d: a.Uptime(now-30*24*3600, now),
+	}
+}
+
+// FleetReport returns the status of all devices in the fleet, or of only the unhealthy ones.
+// Unhealthy devices that have been down the longest come first
+func FleetReport(unhealthyOnly bool) ([]FleetStatus, error) {
+	var arr []FleetStatus
+	devices, err := RetrieveFleet()
+	if err != nil {
+		return arr, err
+	}
+
+	now := utils.Unix()
+	for _, device := range devices {
+		status := device.Status(now)
+		if unhealthyOnly && len(status.Problems) == 0 {
+			continue
+		}
+		arr = append(arr, status)
+	}
+
+	sort.SliceStable(arr, func(i, j int) bool {
+		return arr[i].Device.LastSeen < arr[j].Device.LastSeen
+	})
+	return arr, nil
+}
+
+// checkDevice updates a device's health at time now and returns true if an alert should be sent
+func (a *FleetDevice) checkDevice(now int64) bool {
+	problems := a.Problems(now)
+
+	offline := false
+	for _, problem := range problems {
+		if problem == FleetOffline {
+			offline = true
+		}
+	}
+	if offline && a.Online {
+		// the device was last known to be alive at its last heartbeat
+		a.record(a.LastSeen, false)
+	}
+
+	if len(problems) == 0 {
+		a.UnhealthySince = 0
+		return false
+	}
+	if a.UnhealthySince == 0 {
+		a.UnhealthySince = now
+	}
+
+	// alert only on problems that persist and at most once every consts.FleetAlertDebounce. AlertedAt
+	// isn't reset on recovery so that a device going up and down doesn't alert on every cycle
+	return now-a.UnhealthySince >= consts.FleetAlertGrace && now-a.AlertedAt >= consts.FleetAlertDebounce
+}
+
+// CheckFleet checks the health of all devices in the fleet and alerts admins about unhealthy ones
+func CheckFleet() error {
+	devices, err := RetrieveFleet()
+	if err != nil {
+		return err
+	}
+
+	now := utils.Unix()
+	for _, device := range devices {
+		alert := device.checkDevice(now)
+		if alert {
+			device.AlertedAt = now
+			err = notif.SendFleetAlertEmail(device.ProjIndex, device.Kind, device.DeviceID, device.Problems(now))
+			if err != nil {
+				log.Println("could not send fleet alert", err)
+			}
+		}
+
+		err = device.Save()
+		if err != nil {
+			return errors.Wrap(err, "could not save fleet device")
+		}
+	}
+	return nil
+}
+
+// MonitorFleet checks the health of the fleet every consts.FleetCheckInterval
+func MonitorFleet() {
+	for {
+		err := CheckFleet()
+		if err != nil {
+			log.Println("could not check fleet", err)
+		}
+		time.Sleep(consts.FleetCheckInterval)
+	}
+}
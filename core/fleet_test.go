@@ -0,0 +1,50 @@
+// +build all travis
+
+package core
+
+import (
+	"testing"
+
+	consts "github.com/YaleOpenLab/opensolar/consts"
+)
+
+func TestFleetHealth(t *testing.T) {
+	var a FleetDevice
+	a.FirstSeen = 1000000000
+	a.LastSeen = 1000000000
+	a.LastEnergyReport = 1000000000
+	a.Online = true
+	a.History = []UptimeEvent{{Timestamp: 1000000000, Online: true}}
+
+	now := a.LastSeen + consts.FleetHeartbeatTimeout + 1
+	if a.checkDevice(now) {
+		t.Fatal("alerted before the grace period")
+	}
+	if a.Online || len(a.History) != 2 || a.History[1].Timestamp != 1000000000 {
+		t.Fatal("offline transition not recorded", a.History)
+	}
+
+	now += consts.FleetAlertGrace
+	if !a.checkDevice(now) {
+		t.Fatal("did not alert after the grace period")
+	}
+	a.AlertedAt = now
+
+	// back online and down again within the debounce interval
+	a.seen(now + 10)
+	if a.checkDevice(now+10) || a.UnhealthySince != 0 {
+		t.Fatal("healthy device flagged")
+	}
+	later := now + 10 + consts.FleetHeartbeatTimeout + consts.FleetAlertGrace + 1
+	if a.checkDevice(later) {
+		t.Fatal("alert not debounced")
+	}
+
+	a = FleetDevice{FirstSeen: 0, History: []UptimeEvent{{0, true}, {50, false}, {75, true}}}
+	if uptime := a.Uptime(0, 100); uptime != 0.75 {
+		t.Fatal("wrong uptime", uptime)
+	}
+	if uptime := a.Uptime(60, 100); uptime != 0.625 {
+		t.Fatal("wrong uptime", uptime)
+	}
+}
@@ -0,0 +1,345 @@
+package core
+
+import (
+	"encoding/json"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	ipfs "github.com/Varunram/essentials/ipfs"
+	erpc "github.com/Varunram/essentials/rpc"
+	utils "github.com/Varunram/essentials/utils"
+)
+
+// the teller flushes its data file to ipfs whenever it grows too large and starts the next
+// file with the hash of the flushed one, forming a hash chain. Each new header is anchored on
+// Stellar by the teller as a few memos sent from the recipient's account to itself, each tagged
+// with the anchor's sequence number and its part. The verifier walks the chain back from the
+// latest header and checks every link against those anchors.
+
+// Prefixes used by the teller
+const (
+	// HashChainPrefix is the first line of every flushed file except the genesis file
+	HashChainPrefix = "IPFSHASHCHAIN: "
+	// HashChainMemoPrefix is the prefix of the memos anchoring a hash chain header
+	HashChainMemoPrefix = "HC"
+)
+
+// memoLength is the maximum length of a Stellar text memo
+const memoLength = 28
+
+// Kinds of hash chain issues
+const (
+	ChainIssueMissing    = "missing"    // a link's contents couldn't be retrieved from ipfs
+	ChainIssueCycle      = "cycle"      // a link points back to a later link
+	ChainIssueUnanchored = "unanchored" // a link has not been anchored on chain
+	ChainIssueGap        = "gap"        // an anchored header is not part of the chain
+	ChainIssueOrder      = "order"      // anchors were committed in a different order than the chain
+)
+
+// ChainLink is a single file in a teller's hash chain
+type ChainLink struct {
+	// Hash is the ipfs hash of the file
+	Hash string
+	// Previous is the hash of the previous file, empty for the genesis file
+	Previous string
+	// AnchorTx is the hash of the transaction carrying the second half of the anchor
+	AnchorTx string
+}
+
+// ChainIssue is a problem found while verifying a hash chain
+type ChainIssue struct {
+	// Kind is one of missing, cycle, unanchored, gap or order
+	Kind string
+	// Hash is the hash the issue relates to
+	Hash string
+	// Detail is a human readable description of the issue
+	Detail string
+}
+
+// HashChainReport is the result of verifying a project's hash chain
+type HashChainReport struct {
+	// ProjIndex is the index of the project whose teller's chain was verified
+	ProjIndex int
+	// Timestamp is the time at which the report was generated
+	Timestamp string
+	// Header is the latest hash the walk started from
+	Header string
+	// Links is the chain from the header back to genesis
+	Links []ChainLink
+	// Issues is a list of problems found
+	Issues []ChainIssue
+	// Valid is true if the chain reached genesis and no issues were found
+	Valid bool
+}
+
+// chainAnchor is a hash chain header reassembled from two memos
+type chainAnchor struct {
+	hash string
+	tx   string
+}
+
+// fetchChainFile returns the contents of a hash chain file
+var fetchChainFile = ipfs.GetString
+
+// fetchChainHeader returns the latest hash chain header from a teller
+var fetchChainHeader = func(tellerURL string) (string, error) {
+	data, err := erpc.GetRequest(tellerURL + "/hash")
+	if err != nil {
+		return "", errors.Wrap(err, "could not reach teller")
+	}
+
+	var x struct {
+		Hash string
+	}
+	err = json.Unmarshal(data, &x)
+	if err != nil {
+		return "", errors.Wrap(err, "could not unmarshal teller response")
+	}
+	return x.Hash, nil
+}
+
+// fetchAccountMemos returns the text memos of all transactions sent by an account, oldest
+// first, along with the transaction hashes
+var fetchAccountMemos = func(pubkey string) ([][2]string, error) {
+	var memos [][2]string
+
+	cursor := ""
+	for {
+		data, err := erpc.GetRequest(horizonURL() + "/accounts/" + pubkey + "/transactions?order=asc&limit=200&cursor=" + cursor)
+		if err != nil {
+			return memos, errors.Wrap(err, "did not get response from horizon")
+		}
+
+		var response horizonTxResponse
+		err = json.Unmarshal(data, &response)
+		if err != nil {
+			return memos, errors.Wrap(err, "could not unmarshal transactions response")
+		}
+
+		records := response.Embedded.Records
+		if len(records) == 0 {
+			return memos, nil
+		}
+
+		for _, record := range records {
+			if record.MemoType == "text" && record.SourceAccount == pubkey {
+				memos = append(memos, [2]string{record.Memo, record.Hash})
+			}
+		}
+		cursor = records[len(records)-1].PagingToken
+	}
+}
+
+// HashChainMemos splits a hash chain header into the memos that anchor it. Each memo is
+// HC<seq>.<part>/<parts>:<chunk> with seq in base 36, so that the memos of an anchor can be
+// paired even if they're interleaved with other memos
+func HashChainMemos(seq uint64, header string) []string {
+	prefix := HashChainMemoPrefix + strconv.FormatUint(seq, 36) + "."
+	chunk := memoLength - len(prefix) - len("1/1:")
+
+	var chunks []string
+	for len(header) > chunk {
+		chunks = append(chunks, header[:chunk])
+		header = header[chunk:]
+	}
+	chunks = append(chunks, header)
+
+	memos := make([]string, len(chunks))
+	for i := range chunks {
+		memos[i] = prefix + strconv.Itoa(i+1) + "/" + strconv.Itoa(len(chunks)) + ":" + chunks[i]
+	}
+	return memos
+}
+
+// parseChainMemo parses a memo created by HashChainMemos
+func parseChainMemo(memo string) (seq string, part int, parts int, chunk string, ok bool) {
+	if !strings.HasPrefix(memo, HashChainMemoPrefix) {
+		return
+	}
+	tag := strings.SplitN(memo[len(HashChainMemoPrefix):], ":", 2)
+	if len(tag) != 2 {
+		return
+	}
+	dot := strings.Index(tag[0], ".")
+	slash := strings.Index(tag[0], "/")
+	if dot <= 0 || slash < dot {
+		return
+	}
+
+	var err error
+	seq = tag[0][:dot]
+	part, err = strconv.Atoi(tag[0][dot+1 : slash])
+	if err != nil {
+		return
+	}
+	parts, err = strconv.Atoi(tag[0][slash+1:])
+	if err != nil || part < 1 || part > parts {
+		return
+	}
+	return seq, part, parts, tag[1], true
+}
+
+// parseChainAnchors reassembles hash chain headers from an account's memos, pairing memos by
+// their sequence number. An anchor is complete (and ordered) at the memo carrying its last
+// missing part
+func parseChainAnchors(memos [][2]string) []chainAnchor {
+	var anchors []chainAnchor
+	type partial struct {
+		parts  int
+		chunks map[int]string
+	}
+	partials := make(map[string]*partial)
+	done := make(map[string]bool)
+
+	for _, memo := range memos {
+		seq, part, parts, chunk, ok := parseChainMemo(memo[0])
+		if !ok || done[seq] {
+			continue
+		}
+
+		x, exists := partials[seq]
+		if !exists {
+			x = &partial{parts: parts, chunks: make(map[int]string)}
+			partials[seq] = x
+		}
+		if x.parts != parts {
+			continue
+		}
+		x.chunks[part] = chunk
+		if len(x.chunks) < x.parts {
+			continue
+		}
+
+		var hash string
+		for i := 1; i <= x.parts; i++ {
+			hash += x.chunks[i]
+		}
+		anchors = append(anchors, chainAnchor{hash: hash, tx: memo[1]})
+		done[seq] = true
+		delete(partials, seq)
+	}
+	return anchors
+}
+
+// walkHashChain follows a hash chain from header back to genesis
+func walkHashChain(header string) ([]ChainLink, []ChainIssue) {
+	var links []ChainLink
+	var issues []ChainIssue
+
+	seen := make(map[string]bool)
+	for hash := header; hash != ""; {
+		if seen[hash] {
+			issues = append(issues, ChainIssue{Kind: ChainIssueCycle, Hash: hash,
+				Detail: "chain loops back to a later file"})
+			break
+		}
+		seen[hash] = true
+
+		contents, err := fetchChainFile(hash)
+		if err != nil {
+			issues = append(issues, ChainIssue{Kind: ChainIssueMissing, Hash: hash,
+				Detail: "could not retrieve file from ipfs: " + err.Error()})
+			break
+		}
+
+		link := ChainLink{Hash: hash}
+		if strings.HasPrefix(contents, HashChainPrefix) {
+			firstLine := strings.SplitN(contents, "\n", 2)[0]
+			link.Previous = strings.TrimSpace(strings.TrimPrefix(firstLine, HashChainPrefix))
+		}
+
+		links = append(links, link)
+		hash = link.Previous
+	}
+
+	return links, issues
+}
+
+// checkAnchors checks chain links (latest first) against on chain anchors (oldest first)
+func checkAnchors(links []ChainLink, anchors []chainAnchor) []ChainIssue {
+	var issues []ChainIssue
+
+	position := make(map[string]int)
+	for i, link := range links {
+		position[link.Hash] = i
+	}
+
+	anchored := make(map[string]bool)
+	last := len(links)
+	for _, anchor := range anchors {
+		pos, exists := position[anchor.hash]
+		if !exists {
+			issues = append(issues, ChainIssue{Kind: ChainIssueGap, Hash: anchor.hash,
+				Detail: "anchored in tx " + anchor.tx + " but missing from the chain"})
+			continue
+		}
+
+		if anchored[anchor.hash] {
+			continue
+		}
+		anchored[anchor.hash] = true
+
+		// anchors are oldest first and links latest first, so positions must decrease
+		if pos >= last {
+			issues = append(issues, ChainIssue{Kind: ChainIssueOrder, Hash: anchor.hash,
+				Detail: "anchored in tx " + anchor.tx + " after a later file in the chain"})
+		}
+		last = pos
+		links[pos].AnchorTx = anchor.tx
+	}
+
+	for _, link := range links {
+		if !anchored[link.Hash] {
+			issues = append(issues, ChainIssue{Kind: ChainIssueUnanchored, Hash: link.Hash,
+				Detail: "file has not been anchored on chain"})
+		}
+	}
+
+	return issues
+}
+
+// VerifyHashChain verifies the hash chain of a project's teller against the anchors on the
+// recipient's account. The header is fetched from the teller, falling back to the latest anchor
+// if the teller can't be reached.
+func VerifyHashChain(projIndex int) (HashChainReport, error) {
+	var report HashChainReport
+	report.ProjIndex = projIndex
+	report.Timestamp = utils.Timestamp()
+
+	project, err := RetrieveProject(projIndex)
+	if err != nil {
+		return report, errors.Wrap(err, "couldn't retrieve project")
+	}
+
+	recipient, err := RetrieveRecipient(project.RecipientIndex)
+	if err != nil {
+		return report, errors.Wrap(err, "couldn't retrieve recipient")
+	}
+
+	memos, err := fetchAccountMemos(recipient.U.StellarWallet.PublicKey)
+	if err != nil {
+		return report, errors.Wrap(err, "couldn't retrieve anchors")
+	}
+	anchors := parseChainAnchors(memos)
+
+	if project.TellerURL != "" {
+		report.Header, err = fetchChainHeader(project.TellerURL)
+		if err != nil {
+			report.Header = ""
+		}
+	}
+	if report.Header == "" && len(anchors) > 0 {
+		report.Header = anchors[len(anchors)-1].hash
+	}
+	if report.Header == "" {
+		return report, errors.New("teller has not flushed a hash chain file yet")
+	}
+
+	links, issues := walkHashChain(report.Header)
+	report.Links = links
+	report.Issues = append(issues, checkAnchors(links, anchors)...)
+	report.Valid = len(report.Issues) == 0
+	return report, nil
+}
@@ -0,0 +1,76 @@
+// +build all travis
+
+package core
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestHashChain(t *testing.T) {
+	files := map[string]string{
+		"QmGenesis": "{\"value\": 1}\n",
+		"QmSecond":  HashChainPrefix + "QmGenesis\n{\"value\": 2}\n",
+		"QmThird":   HashChainPrefix + "QmSecond\n{\"value\": 3}\n",
+	}
+	fetchChainFile = func(hash string) (string, error) {
+		contents, exists := files[hash]
+		if !exists {
+			return "", errors.New("not found")
+		}
+		return contents, nil
+	}
+
+	split := func(seq uint64, hash string, tx string) [][2]string {
+		var memos [][2]string
+		for i, memo := range HashChainMemos(seq, hash) {
+			if len(memo) > memoLength {
+				t.Fatalf("memo too long: %s", memo)
+			}
+			memos = append(memos, [2]string{memo, tx + string(rune('a'+i))})
+		}
+		return memos
+	}
+
+	genesis := "QmGenesisQmGenesisQmGenesisQmGenesisQmGenesis1"
+	second := split(2, "QmSecondQmSecondQmSecondQmSecondQmSecondQmSec", "tx2")
+	var memos [][2]string
+	memos = append(memos, [2]string{"STATUPD: unrelated", "tx0"})
+	memos = append(memos, split(1, genesis, "tx1")...)
+	// interleaved and reordered memos of the next anchor, and a stray memo with the same prefix
+	memos = append(memos, second[1], [2]string{"HCHAIN: QmStray", "tx9"}, second[0])
+	memos = append(memos, second[2:]...)
+	files[genesis] = files["QmGenesis"]
+
+	anchors := parseChainAnchors(memos)
+	if len(anchors) != 2 || anchors[0].hash != genesis || anchors[0].tx != "tx1c" ||
+		anchors[1].hash != "QmSecondQmSecondQmSecondQmSecondQmSecondQmSec" {
+		t.Fatalf("anchors not parsed correctly: %v", anchors)
+	}
+
+	links, issues := walkHashChain("QmThird")
+	if len(links) != 3 || len(issues) != 0 || links[2].Previous != "" {
+		t.Fatalf("chain not walked to genesis: %v %v", links, issues)
+	}
+
+	anchors = []chainAnchor{{"QmGenesis", "tx1"}, {"QmSecond", "tx2"}, {"QmThird", "tx3"}}
+	if issues := checkAnchors(links, anchors); len(issues) != 0 {
+		t.Fatalf("valid chain flagged: %v", issues)
+	}
+
+	anchors = []chainAnchor{{"QmGenesis", "tx1"}, {"QmThird", "tx3"}, {"QmSecond", "tx2"}, {"QmForked", "tx4"}}
+	issues = checkAnchors(links, anchors)
+	kinds := make(map[string]bool)
+	for _, issue := range issues {
+		kinds[issue.Kind] = true
+	}
+	if !kinds[ChainIssueGap] || !kinds[ChainIssueOrder] {
+		t.Fatalf("tampered chain not flagged: %v", issues)
+	}
+
+	delete(files, "QmGenesis")
+	links, issues = walkHashChain("QmThird")
+	if len(links) != 2 || len(issues) != 1 || issues[0].Kind != ChainIssueMissing {
+		t.Fatalf("missing link not flagged: %v %v", links, issues)
+	}
+}
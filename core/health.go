@@ -0,0 +1,79 @@
+package core
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+
+	consts "github.com/YaleOpenLab/opensolar/consts"
+)
+
+// ProjectHealth brings together the health of a project's devices, generation and batteries
+type ProjectHealth struct {
+	// ProjIndex is the index of the project
+	ProjIndex int
+	// Timestamp is the unix time at which the health was assessed
+	Timestamp int64
+	// Devices is the health of the project's tellers and IoT hubs
+	Devices []FleetStatus
+	// Performance is the project's generation over the last consts.PerformanceWindow days compared
+	// with its forecast. Nil if the project can't be forecast
+	Performance *PerformanceReport `json:",omitempty"`
+	// Batteries is the health of the project's batteries
+	Batteries []BatteryStatus
+	// Problems lists the problems of the project and its assets
+	Problems []string
+	// Healthy is true if the project has no problems
+	Healthy bool
+}
+
+// RetrieveProjectHealth assesses the health of a project at time now
+func RetrieveProjectHealth(projIndex int, now int64) (ProjectHealth, error) {
+	a := ProjectHealth{ProjIndex: projIndex, Timestamp: now}
+
+	_, err := RetrieveProject(projIndex)
+	if err != nil {
+		return a, errors.Wrap(err, "couldn't retrieve project")
+	}
+
+	devices, err := RetrieveFleet()
+	if err != nil {
+		return a, err
+	}
+	for _, device := range devices {
+		if device.ProjIndex != projIndex {
+			continue
+		}
+		status := device.Status(now)
+		for _, problem := range status.Problems {
+			a.Problems = append(a.Problems, device.Kind+" "+device.DeviceID+": "+problem)
+		}
+		a.Devices = append(a.Devices, status)
+	}
+
+	to := periodStart(now, EnergyDay)
+	from := time.Unix(to, 0).UTC().AddDate(0, 0, -consts.PerformanceWindow).Unix()
+	report, err := ForecastPerformance(projIndex, from, to)
+	if err == nil {
+		a.Performance = &report
+		if report.Days >= consts.PerformanceMinDays && report.Underperforming {
+			a.Problems = append(a.Problems, "underperforming")
+		}
+	}
+
+	batteries, err := RetrieveBatteries(projIndex)
+	if err != nil {
+		return a, err
+	}
+	for _, battery := range batteries {
+		status := battery.Status(now)
+		for _, problem := range status.Problems {
+			a.Problems = append(a.Problems, "battery "+strconv.Itoa(battery.Index)+": "+problem)
+		}
+		a.Batteries = append(a.Batteries, status)
+	}
+
+	a.Healthy = len(a.Problems) == 0
+	return a, nil
+}
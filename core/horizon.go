@@ -0,0 +1,189 @@
+package core
+
+import (
+	"encoding/json"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+
+	erpc "github.com/Varunram/essentials/rpc"
+
+	consts "github.com/YaleOpenLab/opensolar/consts"
+)
+
+// transactions that are sent again after an error are first looked up on horizon, since an error
+// returned while submitting (eg a timeout) doesn't mean that the transaction didn't make it into
+// a ledger.
+
+// horizonURL returns the url of the horizon server of the network the platform runs on
+func horizonURL() string {
+	if consts.Mainnet {
+		return "https://horizon.stellar.org"
+	}
+	return "https://horizon-testnet.stellar.org"
+}
+
+// horizonTx is the subset of a horizon transaction that we need
+type horizonTx struct {
+	Hash          string `json:"hash"`
+	Successful    bool   `json:"successful"`
+	MemoType      string `json:"memo_type"`
+	Memo          string `json:"memo"`
+	SourceAccount string `json:"source_account"`
+	PagingToken   string `json:"paging_token"`
+	CreatedAt     string `json:"created_at"`
+}
+
+// horizonTxResponse is the subset of horizon's account transactions response that we need
+type horizonTxResponse struct {
+	Embedded struct {
+		Records []horizonTx `json:"records"`
+	} `json:"_embedded"`
+}
+
+// lookupTx looks up a transaction by its hash. Transactions horizon doesn't know about are
+// returned empty
+var lookupTx = func(hash string) (horizonTx, error) {
+	var x struct {
+		horizonTx
+		Status int `json:"status"`
+	}
+	if hash == "" {
+		return x.horizonTx, nil
+	}
+
+	data, err := erpc.GetRequest(horizonURL() + "/transactions/" + hash)
+	if err != nil {
+		return x.horizonTx, errors.Wrap(err, "did not get response from horizon")
+	}
+
+	err = json.Unmarshal(data, &x)
+	if err != nil {
+		return x.horizonTx, errors.Wrap(err, "could not unmarshal transaction response")
+	}
+
+	switch x.Status {
+	case 0:
+		return x.horizonTx, nil
+	case 404:
+		return horizonTx{}, nil
+	default:
+		return horizonTx{}, errors.New("horizon returned status " + strconv.Itoa(x.Status))
+	}
+}
+
+// fetchTx looks up a transaction by its hash and returns true if it was applied successfully.
+// Transactions horizon doesn't know about return false
+func fetchTx(hash string) (bool, error) {
+	tx, err := lookupTx(hash)
+	if err != nil {
+		return false, err
+	}
+	return tx.Successful, nil
+}
+
+// findMemoTx looks for a successful transaction sent by pubkey with the given text memo since
+// the given unix time. Returns the hash of the newest such transaction or "" if there is none
+var findMemoTx = func(pubkey string, memo string, since int64) (string, error) {
+	cursor := ""
+	for {
+		data, err := erpc.GetRequest(horizonURL() + "/accounts/" + pubkey + "/transactions?order=desc&limit=200&cursor=" + cursor)
+		if err != nil {
+			return "", errors.Wrap(err, "did not get response from horizon")
+		}
+
+		var response horizonTxResponse
+		err = json.Unmarshal(data, &response)
+		if err != nil {
+			return "", errors.Wrap(err, "could not unmarshal transactions response")
+		}
+
+		records := response.Embedded.Records
+		if len(records) == 0 {
+			return "", nil
+		}
+
+		for _, record := range records {
+			created, err := time.Parse(time.RFC3339, record.CreatedAt)
+			if err == nil && created.Unix() < since {
+				return "", nil
+			}
+			if record.Successful && record.SourceAccount == pubkey && record.MemoType == "text" && record.Memo == memo {
+				return record.Hash, nil
+			}
+		}
+		cursor = records[len(records)-1].PagingToken
+	}
+}
+
+// FindMemoTx looks for a successful transaction sent by pubkey with the given text memo since the
+// given unix time. Returns the hash of the newest such transaction or "" if there is none
+func FindMemoTx(pubkey string, memo string, since int64) (string, error) {
+	return findMemoTx(pubkey, memo, since)
+}
+
+// horizonAccount is the subset of a horizon account that we need
+type horizonAccount struct {
+	ID    string `json:"id"`
+	Flags struct {
+		AuthImmutable bool `json:"auth_immutable"`
+	} `json:"flags"`
+}
+
+// lookupAccount looks up an account. Accounts that don't exist are returned empty
+var lookupAccount = func(pubkey string) (horizonAccount, error) {
+	var x struct {
+		horizonAccount
+		Status int `json:"status"`
+	}
+
+	data, err := erpc.GetRequest(horizonURL() + "/accounts/" + pubkey)
+	if err != nil {
+		return x.horizonAccount, errors.Wrap(err, "did not get response from horizon")
+	}
+
+	err = json.Unmarshal(data, &x)
+	if err != nil {
+		return x.horizonAccount, errors.Wrap(err, "could not unmarshal account response")
+	}
+
+	switch x.Status {
+	case 0:
+		return x.horizonAccount, nil
+	case 404:
+		return horizonAccount{}, nil
+	default:
+		return horizonAccount{}, errors.New("horizon returned status " + strconv.Itoa(x.Status))
+	}
+}
+
+// issuedAmount returns the amount of an issuer's assets held by other accounts
+var issuedAmount = func(issuer string) (float64, error) {
+	data, err := erpc.GetRequest(horizonURL() + "/assets?asset_issuer=" + issuer + "&limit=200")
+	if err != nil {
+		return 0, errors.Wrap(err, "did not get response from horizon")
+	}
+
+	var x struct {
+		Embedded struct {
+			Records []struct {
+				Amount string `json:"amount"`
+			} `json:"records"`
+		} `json:"_embedded"`
+	}
+	err = json.Unmarshal(data, &x)
+	if err != nil {
+		return 0, errors.Wrap(err, "could not unmarshal assets response")
+	}
+
+	var total float64
+	for _, record := range x.Embedded.Records {
+		amount, err := strconv.ParseFloat(record.Amount, 64)
+		if err != nil {
+			return 0, errors.Wrap(err, "could not parse asset amount")
+		}
+		total += amount
+	}
+	return total, nil
+}
@@ -0,0 +1,180 @@
+package core
+
+import (
+	"log"
+	"strconv"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/pkg/errors"
+
+	consts "github.com/YaleOpenLab/opensolar/consts"
+)
+
+// the platform runs an MQTT subscriber for each project that has registered a broker and a
+// topic through AddTellerDetails. Readings are ingested directly so that billing doesn't depend
+// on the teller pushing accumulated energy to the platform. Projects that have chosen an IoT
+// provider are ingested by the iot package, which registers its stop function here.
+
+var (
+	ingestLock  sync.Mutex
+	ingestStops = make(map[int]func())
+)
+
+// RegisterIngestion records that a project's energy is being ingested by the platform. stop is
+// called when the project's ingestion is stopped or restarted. Any ingestion already registered
+// for the project is stopped under the same lock so that concurrent starts can't leak one
+func RegisterIngestion(projIndex int, stop func()) {
+	ingestLock.Lock()
+	defer ingestLock.Unlock()
+
+	if previous, exists := ingestStops[projIndex]; exists {
+		previous()
+	}
+	ingestStops[projIndex] = stop
+}
+
+// StartIngestion starts (or restarts) the MQTT subscriber of a project
+func StartIngestion(projIndex int) error {
+	project, err := RetrieveProject(projIndex)
+	if err != nil {
+		return errors.Wrap(err, "couldn't retrieve project")
+	}
+
+	if project.BrokerURL == "" || project.TellerPublishTopic == "" {
+		return errors.New("project does not have a broker url or topic")
+	}
+
+	if project.DeviceProvider != "" {
+		return errors.New("project's energy is ingested from its iot provider")
+	}
+	if project.Terminated {
+		return errors.New("project has been terminated")
+	}
+
+	// disconnect the old subscriber first since the new one connects with the same client id
+	StopIngestion(projIndex)
+
+	opts := mqtt.NewClientOptions()
+	opts.AddBroker(project.BrokerURL)
+	opts.SetClientID("opensolar-" + strconv.Itoa(projIndex))
+	opts.SetUsername(consts.MqttUsername)
+	opts.SetPassword(consts.MqttPassword)
+	opts.SetAutoReconnect(true)
+	opts.SetOnConnectHandler(func(client mqtt.Client) {
+		// subscriptions are lost on reconnect since we don't use persistent sessions
+		token := client.Subscribe(project.TellerPublishTopic, 1, func(client mqtt.Client, msg mqtt.Message) {
+			_, err := IngestEnergyReading(projIndex, msg.Payload(), "mqtt")
+			if err != nil {
+				log.Println("could not ingest reading for project", projIndex, err)
+			}
+		})
+		if token.Wait() && token.Error() != nil {
+			log.Println("could not subscribe to topic", project.TellerPublishTopic, token.Error())
+		}
+	})
+
+	client := mqtt.NewClient(opts)
+	stop := make(chan struct{})
+	var once sync.Once
+	RegisterIngestion(projIndex, func() {
+		once.Do(func() { close(stop) })
+		client.Disconnect(250)
+	})
+
+	go connectIngestion(projIndex, client, stop)
+	log.Println("started energy ingestion for project", projIndex, "on", project.BrokerURL, project.TellerPublishTopic)
+	return nil
+}
+
+// connectIngestion connects a project's subscriber to its broker, retrying with an exponential
+// backoff until it connects or the ingestion is stopped. paho only reconnects on its own once
+// the first connect succeeded, so a broker that is down when the platform starts would
+// otherwise never be subscribed to
+func connectIngestion(projIndex int, client mqtt.Client, stop <-chan struct{}) {
+	backoff := consts.MqttConnectBaseBackoff
+	for {
+		token := client.Connect()
+		token.Wait()
+		if token.Error() == nil {
+			select {
+			case <-stop:
+				// stopped while connecting
+				client.Disconnect(250)
+			default:
+			}
+			return
+		}
+
+		log.Println("could not connect to broker of project", projIndex, "retrying in", backoff, token.Error())
+		select {
+		case <-stop:
+			return
+		case <-time.After(backoff):
+		}
+
+		backoff *= 2
+		if backoff > consts.MqttConnectMaxBackoff {
+			backoff = consts.MqttConnectMaxBackoff
+		}
+	}
+}
+
+// StopIngestion stops the ingestion of a project's energy if it is running
+func StopIngestion(projIndex int) {
+	ingestLock.Lock()
+	defer ingestLock.Unlock()
+
+	stop, exists := ingestStops[projIndex]
+	if !exists {
+		return
+	}
+
+	stop()
+	delete(ingestStops, projIndex)
+}
+
+// IngestionActive returns true if the platform ingests the project's energy directly
+func IngestionActive(projIndex int) bool {
+	ingestLock.Lock()
+	defer ingestLock.Unlock()
+
+	_, exists := ingestStops[projIndex]
+	return exists
+}
+
+// TellerPushesIgnored returns true if the platform ingests a project's energy itself, in which
+// case the energy pushed by the recipient's teller would be counted twice. Readings published
+// over MQTT only replace the teller's pushes once a signed reading of the recipient's device
+// has been verified, since devices that don't sign their readings are reported by the teller
+func TellerPushesIgnored(projIndex int, recipient Recipient) (bool, error) {
+	if !IngestionActive(projIndex) {
+		return false, nil
+	}
+	project, err := RetrieveProject(projIndex)
+	if err != nil {
+		return false, errors.Wrap(err, "couldn't retrieve project")
+	}
+	return project.DeviceProvider != "" || recipient.DeviceReadingsVerified, nil
+}
+
+// StartAllIngestion starts MQTT subscribers for all projects that have registered a broker and
+// haven't chosen an IoT provider
+func StartAllIngestion() {
+	projects, err := RetrieveAllProjects()
+	if err != nil {
+		log.Println("could not retrieve projects for ingestion", err)
+		return
+	}
+
+	for _, project := range projects {
+		if project.BrokerURL == "" || project.TellerPublishTopic == "" || project.DeviceProvider != "" || project.Terminated {
+			continue
+		}
+		err = StartIngestion(project.Index)
+		if err != nil {
+			log.Println("could not start ingestion for project", project.Index, err)
+		}
+	}
+}
@@ -0,0 +1,753 @@
+package core
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	edb "github.com/Varunram/essentials/database"
+	utils "github.com/Varunram/essentials/utils"
+	xlm "github.com/Varunram/essentials/xlm"
+	assets "github.com/Varunram/essentials/xlm/assets"
+	multisig "github.com/Varunram/essentials/xlm/multisig"
+	build "github.com/stellar/go/txnbuild"
+
+	consts "github.com/YaleOpenLab/opensolar/consts"
+	keys "github.com/YaleOpenLab/opensolar/keys"
+	notif "github.com/YaleOpenLab/opensolar/notif"
+)
+
+// an intent is the client signed alternative to passing seedpwd to a money moving RPC. Instead of
+// decrypting the user's seed, the platform builds the unsigned transaction the user would have
+// signed and stores it along with a human readable summary and a SEP-7 uri that a wallet can sign.
+// The user submits the signed envelope, which the platform checks against the intent, co-signs if
+// the transaction moves funds from the project's escrow and broadcasts. The platform then carries
+// out its own part of the action (sending investor assets, recording the payback and so on).
+
+// Intent kinds
+const (
+	IntentInvest  = "invest"
+	IntentPayback = "payback"
+	IntentUnlock  = "unlock"
+	IntentDeposit = "deposit"
+)
+
+// Intent statuses
+const (
+	IntentPending   = "pending"
+	IntentSubmitted = "submitted"
+	IntentComplete  = "complete"
+	IntentFailed    = "failed"
+	IntentExpired   = "expired"
+)
+
+// Steps of the platform's part of a payback intent, recorded so that completing the intent again
+// doesn't pay back or record the payback twice
+const (
+	IntentStepPaid     = "paid"     // investors are notified and the recipient's payment cycle is reset
+	IntentStepRecorded = "recorded" // project struct is updated in the database
+)
+
+// TxIntent is a transaction built by the platform for a user to sign with their own wallet
+type TxIntent struct {
+	// Index is the index of the intent in the database
+	Index int
+	// Kind is one of invest, payback, unlock or deposit
+	Kind string
+	// UserIndex is the index of the user who must sign the transaction
+	UserIndex int
+	// PublicKey is the public key of the user's account that signs the transaction
+	PublicKey string
+	// ProjIndex is the index of the project the transaction is for
+	ProjIndex int
+	// Amount is the amount in USD (or XLM for XLM deposits) the user pays
+	Amount float64
+	// AssetCode is the asset invested in, the debt asset paid back or the asset deposited
+	AssetCode string `json:",omitempty"`
+	// SeedRound is true if an investment is a seed investment
+	SeedRound bool `json:",omitempty"`
+	// Bill is the recipient's bill when a payback was built
+	Bill float64 `json:",omitempty"`
+	// Summary describes each operation of the transaction
+	Summary []string
+	// TxXDR is the unsigned transaction
+	TxXDR string
+	// TxHash is the hex hash of the transaction
+	TxHash string
+	// URI is the SEP-7 uri that asks a wallet to sign the transaction
+	URI string
+	// Cosign is true if the platform must co-sign the transaction because it moves funds from the escrow
+	Cosign bool `json:",omitempty"`
+	// Status is one of pending, submitted, complete, failed or expired
+	Status string
+	// SubmittedHash is the hash of the submitted transaction on the ledger
+	SubmittedHash string `json:",omitempty"`
+	// Error is set if the transaction couldn't be submitted or the platform's part of the action failed
+	Error string `json:",omitempty"`
+	// CreatedAt is the unix time at which the intent was created
+	CreatedAt int64
+	// ExpiresAt is the unix time after which the transaction isn't valid anymore
+	ExpiresAt int64
+	// SubmittedAt is the unix time at which the transaction was submitted
+	SubmittedAt int64 `json:",omitempty"`
+	// Steps are the steps of the platform's part that have completed
+	Steps []string `json:",omitempty"`
+}
+
+// IntentBucket is the bucket where transaction intents are stored
+var IntentBucket = []byte("Intents")
+
+// Save inserts a passed TxIntent object into the database
+func (a *TxIntent) Save() error {
+	return edb.Save(consts.DbDir+consts.DbName, IntentBucket, a, a.Index)
+}
+
+// RetrieveIntent retrieves a transaction intent from the database
+func RetrieveIntent(key int) (TxIntent, error) {
+	var x TxIntent
+	temp, err := edb.Retrieve(consts.DbDir+consts.DbName, IntentBucket, key)
+	if err != nil {
+		return x, errors.Wrap(err, "error while retrieving key from bucket")
+	}
+
+	err = json.Unmarshal(temp, &x)
+	if err != nil {
+		return x, errors.Wrap(err, "could not unmarshal intent")
+	}
+	if x.Index == 0 {
+		return x, errors.New("intent not found")
+	}
+	if x.Status == IntentPending && utils.Unix() > x.ExpiresAt {
+		x.Status = IntentExpired
+		if x.Error != "" {
+			// a submission that couldn't be confirmed may have landed before the intent expired
+			landed, err := fetchTx(x.TxHash)
+			if err != nil {
+				log.Println("could not look up intent", x.Index, err)
+				return x, nil
+			}
+			if landed {
+				x.Status, x.SubmittedHash, x.SubmittedAt = IntentSubmitted, x.TxHash, utils.Unix()
+			}
+		}
+		err = x.Save()
+		if err != nil {
+			return x, err
+		}
+	}
+	return x, nil
+}
+
+// RetrieveAllIntents retrieves all transaction intents from the database
+func RetrieveAllIntents() ([]TxIntent, error) {
+	var arr []TxIntent
+	x, err := edb.RetrieveAllKeys(consts.DbDir+consts.DbName, IntentBucket)
+	if err != nil {
+		return arr, errors.Wrap(err, "error while retrieving all keys")
+	}
+
+	for _, value := range x {
+		var temp TxIntent
+		err := json.Unmarshal(value, &temp)
+		if err != nil {
+			return arr, errors.Wrap(err, "could not unmarshal intent")
+		}
+		arr = append(arr, temp)
+	}
+	return arr, nil
+}
+
+// newIntent builds the unsigned transaction of an intent from the account pubkey and stores the intent
+func newIntent(a TxIntent, memo string, ops []build.Operation) (TxIntent, error) {
+	sourceAccount, err := xlm.ReturnSourceAccountPubkey(a.PublicKey)
+	if err != nil {
+		return a, errors.Wrap(err, "couldn't load account")
+	}
+
+	all, err := RetrieveAllIntents()
+	if err != nil {
+		return a, err
+	}
+
+	a.Index = len(all) + 1
+	a.Status = IntentPending
+	a.CreatedAt = utils.Unix()
+	a.ExpiresAt = a.CreatedAt + consts.IntentExpiry
+
+	tx, err := build.NewTransaction(build.TransactionParams{
+		SourceAccount:        &sourceAccount,
+		Operations:           ops,
+		Timebounds:           build.NewTimebounds(0, a.ExpiresAt),
+		Memo:                 build.MemoText(memo),
+		IncrementSequenceNum: true,
+		BaseFee:              1000,
+	})
+	if err != nil {
+		return a, errors.Wrap(err, "couldn't build transaction")
+	}
+
+	a.TxXDR, err = tx.Base64()
+	if err != nil {
+		return a, err
+	}
+	a.TxHash, err = tx.HashHex(xlm.Passphrase)
+	if err != nil {
+		return a, err
+	}
+	a.URI = sep7URI(a.TxXDR, strings.Join(a.Summary, "; "))
+	return a, a.Save()
+}
+
+// formatAmount formats an amount for a stellar operation
+func formatAmount(amount float64) string {
+	return strconv.FormatFloat(amount, 'f', 7, 64)
+}
+
+// projectIssuer returns the public key of a project's issuer
+func projectIssuer(projIndex int) (string, error) {
+	return keyAddress(keys.IssuerID(projIndex))
+}
+
+// investmentAsset returns the code of the asset an investor receives for investing amount in a
+// project and whether the investment is a seed investment
+func investmentAsset(project Project, amount float64) (string, bool, error) {
+	switch project.Stage {
+	case 4:
+		return project.InvestorAssetCode, false, nil
+	case 1, 2:
+		if project.SeedInvestmentCap < amount {
+			return "", true, errors.New("you can't invest more than what the seed investment cap permits you to, quitting")
+		}
+		if project.SeedAssetCode == "" {
+			return "SEEDASSET", true, nil
+		}
+		return project.SeedAssetCode, true, nil
+	}
+	return "", false, errors.New("project not at stage where it can solicit investment, quitting")
+}
+
+// munibondAmounts returns the amounts of payback and debt assets a project's recipient receives
+func munibondAmounts(project Project) (float64, float64) {
+	years := project.EstimatedAcquisition
+	if years == 0 {
+		years = 1
+	}
+	return float64(years * 12 * 2), project.TotalValue + project.SeedMoneyRaised
+}
+
+// NewInvestIntent builds the transaction with which an investor invests amount in a project. The
+// investor trusts the project's investor (or seed) asset and pays the platform in stablecoin
+func NewInvestIntent(projIndex int, invIndex int, amount float64) (TxIntent, error) {
+	a := TxIntent{Kind: IntentInvest, UserIndex: invIndex, ProjIndex: projIndex, Amount: amount}
+
+	investor, err := RetrieveInvestor(invIndex)
+	if err != nil {
+		return a, errors.Wrap(err, "couldn't retrieve investor")
+	}
+	if !investor.CanInvest(amount) {
+		return a, errors.New("Investor has less balance than what is required to invest in this project")
+	}
+
+	project, err := RetrieveProject(projIndex)
+	if err != nil {
+		return a, errors.Wrap(err, "couldn't retrieve project")
+	}
+	if project.InvestmentType != "munibond" {
+		return a, errors.New("other investment models are not supported right now, quitting")
+	}
+	if project.Chain != "stellar" && project.Chain != "" {
+		return a, errors.New("other chain investments not supported right now")
+	}
+
+	a.PublicKey = investor.U.StellarWallet.PublicKey
+	project, err = investmentCheck(project, amount, a.PublicKey)
+	if err != nil {
+		return a, errors.Wrap(err, "pre investment check failed")
+	}
+
+	a.AssetCode, a.SeedRound, err = investmentAsset(project, amount)
+	if err != nil {
+		return a, err
+	}
+
+	issuerPubkey, err := projectIssuer(projIndex)
+	if err != nil {
+		return a, err
+	}
+
+	code, stableIssuer := escrowAsset()
+	if xlm.GetAssetBalance(a.PublicKey, code) < amount {
+		return a, errors.New("insufficient " + code + " balance, please refill")
+	}
+
+	ops := []build.Operation{
+		&build.ChangeTrust{
+			Line:  build.CreditAsset{Code: a.AssetCode, Issuer: issuerPubkey},
+			Limit: formatAmount(project.TotalValue),
+		},
+		&build.Payment{
+			Destination: consts.PlatformPublicKey,
+			Amount:      formatAmount(amount),
+			Asset:       build.CreditAsset{Code: code, Issuer: stableIssuer},
+		},
+	}
+	a.Summary = []string{
+		fmt.Sprintf("Trust up to %.2f %s issued by project %d's issuer %s", project.TotalValue, a.AssetCode, projIndex, issuerPubkey),
+		fmt.Sprintf("Pay %.2f %s to the platform %s for an investment in project %d", amount, code, consts.PlatformPublicKey, projIndex),
+	}
+	return newIntent(a, "Opensolar investment: "+strconv.Itoa(projIndex), ops)
+}
+
+// NewPaybackIntent builds the transaction with which a recipient pays back amount towards their
+// project. The recipient pays the escrow in stablecoin and returns debt assets to the issuer. If
+// the escrow distributes returns, the transaction also pays investors their returns from the
+// escrow and is co-signed by the platform
+func NewPaybackIntent(recpIndex int, projIndex int, assetName string, amount float64) (TxIntent, error) {
+	a := TxIntent{Kind: IntentPayback, UserIndex: recpIndex, ProjIndex: projIndex, Amount: amount, AssetCode: assetName}
+
+	project, err := RetrieveProject(projIndex)
+	if err != nil {
+		return a, errors.Wrap(err, "couldn't retrieve project")
+	}
+	if project.RecipientIndex != recpIndex {
+		return a, errors.New("recipient is not the recipient of this project")
+	}
+	if project.InvestmentType != "munibond" {
+		return a, errors.New("other investment models are not supported right now, quitting")
+	}
+	if project.EscrowPubkey == "" {
+		return a, errors.New("project doesn't have an escrow")
+	}
+
+	recipient, err := RetrieveRecipient(recpIndex)
+	if err != nil {
+		return a, errors.Wrap(err, "couldn't retrieve recipient")
+	}
+	a.PublicKey = recipient.U.StellarWallet.PublicKey
+	a.Bill = recipient.MonthlyBill()
+	if amount < a.Bill {
+		return a, errors.New("amount paid is less than amount needed. Please refill your main account")
+	}
+
+	code, stableIssuer := escrowAsset()
+	if xlm.GetAssetBalance(a.PublicKey, code) < amount {
+		return a, errors.New("insufficient " + code + " balance, please refill")
+	}
+
+	issuerPubkey, err := projectIssuer(projIndex)
+	if err != nil {
+		return a, err
+	}
+
+	ops := []build.Operation{
+		&build.Payment{
+			Destination: project.EscrowPubkey,
+			Amount:      formatAmount(amount),
+			Asset:       build.CreditAsset{Code: code, Issuer: stableIssuer},
+		},
+		&build.Payment{
+			Destination: issuerPubkey,
+			Amount:      formatAmount(amount),
+			Asset:       build.CreditAsset{Code: assetName, Issuer: issuerPubkey},
+		},
+	}
+	a.Summary = []string{
+		fmt.Sprintf("Pay %.2f %s to project %d's escrow %s", amount, code, projIndex, project.EscrowPubkey),
+		fmt.Sprintf("Return %.2f %s to project %d's issuer %s", amount, assetName, projIndex, issuerPubkey),
+	}
+
+	if project.EscrowLock {
+		returns := project.investorReturns(amount)
+		var pubkeys []string
+		for pubkey := range returns {
+			pubkeys = append(pubkeys, pubkey)
+		}
+		sort.Strings(pubkeys)
+		for _, pubkey := range pubkeys {
+			ops = append(ops, &build.Payment{
+				SourceAccount: &build.SimpleAccount{AccountID: project.EscrowPubkey},
+				Destination:   pubkey,
+				Amount:        formatAmount(returns[pubkey]),
+				Asset:         build.CreditAsset{Code: code, Issuer: stableIssuer},
+			})
+			a.Summary = append(a.Summary, fmt.Sprintf("Pay investor %s returns of %.2f %s from the escrow", pubkey, returns[pubkey], code))
+		}
+		a.Cosign = len(pubkeys) != 0
+	}
+
+	return newIntent(a, "Opensolar payback: "+strconv.Itoa(projIndex), ops)
+}
+
+// NewUnlockIntent builds the transaction with which a recipient accepts the investment in their
+// project. The platform sets up the project's escrow with the recipient and platform as its
+// signers, and the transaction has the recipient trust the project's payback and debt assets and
+// the escrow trust the stablecoin. The platform co-signs the escrow's operations
+func NewUnlockIntent(recpIndex int, projIndex int) (TxIntent, error) {
+	a := TxIntent{Kind: IntentUnlock, UserIndex: recpIndex, ProjIndex: projIndex, Cosign: true}
+
+	project, err := RetrieveProject(projIndex)
+	if err != nil {
+		return a, errors.Wrap(err, "couldn't retrieve project")
+	}
+	if project.RecipientIndex != recpIndex {
+		return a, errors.New("recipient Indices don't match, quitting")
+	}
+	if !project.Lock {
+		return a, errors.New("Project not locked")
+	}
+
+	recipient, err := RetrieveRecipient(recpIndex)
+	if err != nil {
+		return a, errors.Wrap(err, "couldn't retrieve recipient")
+	}
+	a.PublicKey = recipient.U.StellarWallet.PublicKey
+
+	issuerPubkey, err := projectIssuer(projIndex)
+	if err != nil {
+		return a, err
+	}
+
+	if project.EscrowPubkey == "" {
+		project.EscrowPubkey, err = multisig.New2of2(a.PublicKey, consts.PlatformPublicKey)
+		if err != nil {
+			return a, errors.Wrap(err, "error while initializing escrow")
+		}
+		err = project.Save()
+		if err != nil {
+			return a, errors.Wrap(err, "couldn't save project")
+		}
+	}
+
+	pbAmount, totalValue := munibondAmounts(project)
+	a.Amount = totalValue
+	debtAssetCode := assets.AssetID(consts.DebtAssetPrefix + project.Metadata)
+	paybackAssetCode := assets.AssetID(consts.PaybackAssetPrefix + project.Metadata)
+	code, stableIssuer := escrowAsset()
+	escrowAccount := &build.SimpleAccount{AccountID: project.EscrowPubkey}
+
+	ops := []build.Operation{
+		&build.ChangeTrust{
+			Line:  build.CreditAsset{Code: paybackAssetCode, Issuer: issuerPubkey},
+			Limit: formatAmount(pbAmount),
+		},
+		&build.ChangeTrust{
+			Line:  build.CreditAsset{Code: debtAssetCode, Issuer: issuerPubkey},
+			Limit: formatAmount(totalValue * 2),
+		},
+		&build.SetOptions{
+			SetFlags:      []build.AccountFlag{build.AuthImmutable},
+			SourceAccount: escrowAccount,
+		},
+		&build.ChangeTrust{
+			Line:          build.CreditAsset{Code: code, Issuer: stableIssuer},
+			Limit:         "10000000000",
+			SourceAccount: escrowAccount,
+		},
+	}
+	a.Summary = []string{
+		fmt.Sprintf("Trust up to %.0f %s, the payback asset of project %d", pbAmount, paybackAssetCode, projIndex),
+		fmt.Sprintf("Trust up to %.2f %s, the debt asset of project %d", totalValue*2, debtAssetCode, projIndex),
+		fmt.Sprintf("Make the flags of project %d's escrow %s immutable", projIndex, project.EscrowPubkey),
+		fmt.Sprintf("Have the escrow trust %s", code),
+	}
+	return newIntent(a, "Opensolar unlock: "+strconv.Itoa(projIndex), ops)
+}
+
+// NewDepositIntent builds the transaction with which a guarantor deposits amount of XLM or the
+// stablecoin in a project's escrow
+func NewDepositIntent(entityIndex int, projIndex int, assetCode string, amount float64) (TxIntent, error) {
+	a := TxIntent{Kind: IntentDeposit, UserIndex: entityIndex, ProjIndex: projIndex, Amount: amount, AssetCode: assetCode}
+
+	entity, err := RetrieveEntity(entityIndex)
+	if err != nil {
+		return a, errors.Wrap(err, "couldn't retrieve entity")
+	}
+	if !entity.Guarantor {
+		return a, errors.New("caller not guarantor, quitting")
+	}
+
+	project, err := RetrieveProject(projIndex)
+	if err != nil {
+		return a, errors.Wrap(err, "couldn't retrieve project")
+	}
+	if project.EscrowPubkey == "" {
+		return a, errors.New("project doesn't have an escrow")
+	}
+	a.PublicKey = entity.U.StellarWallet.PublicKey
+
+	var asset build.Asset
+	code, stableIssuer := escrowAsset()
+	switch assetCode {
+	case "", "XLM":
+		a.AssetCode = "XLM"
+		asset = build.NativeAsset{}
+		if xlm.GetNativeBalance(a.PublicKey) < amount+1 {
+			return a, errors.New("insufficient XLM balance")
+		}
+	case code:
+		asset = build.CreditAsset{Code: code, Issuer: stableIssuer}
+		if xlm.GetAssetBalance(a.PublicKey, code) < amount {
+			return a, errors.New("insufficient " + code + " balance")
+		}
+	default:
+		return a, errors.New("only XLM and " + code + " can be deposited")
+	}
+
+	ops := []build.Operation{
+		&build.Payment{
+			Destination: project.EscrowPubkey,
+			Amount:      formatAmount(amount),
+			Asset:       asset,
+		},
+	}
+	a.Summary = []string{fmt.Sprintf("Deposit %.2f %s in project %d's escrow %s", amount, a.AssetCode, projIndex, project.EscrowPubkey)}
+	return newIntent(a, "guarantor refund", ops)
+}
+
+// intentLocks serializes submitting and completing each intent
+var intentLocks keyedLock
+
+// SubmitIntent checks that signedXDR is the intent's transaction signed by the intent's user,
+// broadcasts it and carries out the platform's part of the action
+func SubmitIntent(index int, userIndex int, signedXDR string) (TxIntent, error) {
+	unlock := intentLocks.lock(index)
+	defer unlock()
+
+	a, err := RetrieveIntent(index)
+	if err != nil {
+		return a, err
+	}
+	if a.UserIndex != userIndex {
+		return a, errors.New("intent belongs to another user")
+	}
+	if a.Status != IntentPending {
+		return a, errors.New("intent is " + a.Status)
+	}
+
+	signature, err := extractSignature(a.TxXDR, a.PublicKey, signedXDR)
+	if err != nil {
+		return a, err
+	}
+
+	txhash, err := submitSigned(a.TxXDR, a.PublicKey, signature, a.Cosign)
+	if err != nil {
+		// the transaction has a fixed sequence number, so it's safe to look it up by its hash
+		landed, lerr := fetchTx(a.TxHash)
+		if lerr != nil {
+			// leave the intent pending so that the user can submit it again. The error marks it to
+			// be looked up on horizon if it expires
+			log.Println("could not look up intent", a.Index, lerr)
+			a.Error = err.Error()
+			serr := a.Save()
+			if serr != nil {
+				log.Println("could not save intent", serr)
+			}
+			return a, errors.Wrap(err, "couldn't submit transaction")
+		}
+		if !landed {
+			a.Status, a.Error = IntentFailed, err.Error()
+			serr := a.Save()
+			if serr != nil {
+				log.Println("could not save failed intent", serr)
+			}
+			return a, errors.Wrap(err, "couldn't submit transaction")
+		}
+		txhash = a.TxHash
+	}
+
+	a.Status, a.SubmittedHash, a.SubmittedAt = IntentSubmitted, txhash, utils.Unix()
+	err = a.Save()
+	if err != nil {
+		return a, err
+	}
+
+	err = a.finish()
+	return a, err
+}
+
+// CompleteIntent carries out the platform's part of a submitted intent again after it failed
+func CompleteIntent(index int, userIndex int) (TxIntent, error) {
+	unlock := intentLocks.lock(index)
+	defer unlock()
+
+	a, err := RetrieveIntent(index)
+	if err != nil {
+		return a, err
+	}
+	if a.UserIndex != userIndex {
+		return a, errors.New("intent belongs to another user")
+	}
+	if a.Status != IntentSubmitted {
+		return a, errors.New("intent is " + a.Status)
+	}
+
+	err = a.finish()
+	return a, err
+}
+
+// finish completes a submitted intent and marks it complete. Intents that can't be completed stay
+// submitted with the error so that they can be completed again
+func (a *TxIntent) finish() error {
+	err := a.complete()
+	if err != nil {
+		log.Println("could not complete intent", a.Index, err)
+		a.Error = err.Error()
+		serr := a.Save()
+		if serr != nil {
+			log.Println("could not save intent", serr)
+		}
+		return errors.Wrap(err, "transaction submitted but the platform couldn't complete it")
+	}
+
+	a.Status, a.Error = IntentComplete, ""
+	return a.Save()
+}
+
+// complete carries out the platform's part of an intent once its transaction is on the ledger
+func (a *TxIntent) complete() error {
+	switch a.Kind {
+	case IntentInvest:
+		return a.completeInvest()
+	case IntentPayback:
+		return a.completePayback()
+	case IntentUnlock:
+		return a.completeUnlock()
+	}
+	return nil
+}
+
+// done returns true if the passed step of the platform's part has completed
+func (a *TxIntent) done(step string) bool {
+	for _, s := range a.Steps {
+		if s == step {
+			return true
+		}
+	}
+	return false
+}
+
+// markDone records that the passed step of the platform's part has completed
+func (a *TxIntent) markDone(step string) error {
+	a.Steps = append(a.Steps, step)
+	err := a.Save()
+	if err != nil {
+		return errors.Wrap(err, "could not save intent step")
+	}
+	return nil
+}
+
+// completeInvest records the investor's payment and trustline in an investment and runs the rest
+// of the investment, sending the investor their assets. The investment is created the first time
+// the intent is completed and resumed when it's completed again
+func (a *TxIntent) completeInvest() error {
+	key := "intent-" + strconv.Itoa(a.Index)
+	unlock := investmentLocks.lock(investmentKey{a.UserIndex, key})
+	defer unlock()
+
+	saga, err := RetrieveInvestmentByKey(a.UserIndex, key)
+	if err == nil {
+		log.Println("resuming investment", saga.Index, "of intent", a.Index)
+		return resumeInvestment(&saga, "")
+	}
+	if errors.Cause(err) != ErrInvestmentNotFound {
+		return errors.Wrap(err, "couldn't look up investment key")
+	}
+
+	saga, err = newInvestment(key, a.UserIndex, a.ProjIndex, a.Amount, a.AssetCode, a.SeedRound)
+	if err != nil {
+		return errors.Wrap(err, "could not create investment log")
+	}
+	saga.Steps[InvStepStablecoin] = a.SubmittedHash
+	saga.Steps[InvStepTrust] = a.SubmittedHash
+	err = saga.Save()
+	if err != nil {
+		return errors.Wrap(err, "could not save investment")
+	}
+
+	project, err := RetrieveProject(a.ProjIndex)
+	if err != nil {
+		return errors.Wrap(err, "couldn't retrieve project")
+	}
+	return runInvestment(&saga, project, "")
+}
+
+// completePayback records the recipient's payback. Steps that completed in an earlier attempt
+// aren't run again, and the payment is applied to the project's invoices under a reference to
+// the intent so that it's applied only once
+func (a *TxIntent) completePayback() error {
+	project, err := RetrieveProject(a.ProjIndex)
+	if err != nil {
+		return errors.Wrap(err, "couldn't retrieve project")
+	}
+
+	if !a.done(IntentStepPaid) {
+		recipient, err := RetrieveRecipient(a.UserIndex)
+		if err != nil {
+			return errors.Wrap(err, "couldn't retrieve recipient")
+		}
+
+		if recipient.U.Notification {
+			notif.SendPaybackNotifToRecipient(a.ProjIndex, recipient.U.Email, a.SubmittedHash, a.SubmittedHash)
+		}
+		munibondPaid(recipient, a.ProjIndex, a.Amount, a.Bill, project.TotalValue, project.InvestorIndices,
+			a.SubmittedHash, a.SubmittedHash)
+		err = a.markDone(IntentStepPaid)
+		if err != nil {
+			return err
+		}
+	}
+
+	if !a.done(IntentStepRecorded) {
+		err = project.updateAfterPayback(a.Amount, ownershipPct(a.Amount, a.Bill, project.TotalValue))
+		if err != nil {
+			return err
+		}
+		err = a.markDone(IntentStepRecorded)
+		if err != nil {
+			return err
+		}
+	}
+
+	return project.applyPayback(a.Amount, "payback intent "+strconv.Itoa(a.Index))
+}
+
+// completeUnlock unlocks the project, funds its escrow and sends the recipient their payback and
+// debt assets
+func (a *TxIntent) completeUnlock() error {
+	project, err := RetrieveProject(a.ProjIndex)
+	if err != nil {
+		return errors.Wrap(err, "couldn't retrieve project")
+	}
+	recipient, err := RetrieveRecipient(a.UserIndex)
+	if err != nil {
+		return errors.Wrap(err, "couldn't retrieve recipient")
+	}
+
+	project.Lock = false
+	project.UnlockIntent = a.Index
+	project.DebtAssetCode = assets.AssetID(consts.DebtAssetPrefix + project.Metadata)
+	project.PaybackAssetCode = assets.AssetID(consts.PaybackAssetPrefix + project.Metadata)
+	err = project.Save()
+	if err != nil {
+		return errors.Wrap(err, "couldn't save project")
+	}
+
+	err = fundEscrow(project)
+	if err != nil {
+		return errors.Wrap(err, "could not transfer funds to the escrow")
+	}
+
+	pbAmount, totalValue := munibondAmounts(project)
+	err = issueMunibonds(recipient, a.ProjIndex, project.DebtAssetCode, project.PaybackAssetCode,
+		pbAmount, totalValue, project.PaybackPeriod, a.SubmittedHash, a.SubmittedHash)
+	if err != nil {
+		return errors.Wrap(err, "error while sending assets to recipient")
+	}
+
+	return project.updateProjectAfterAcceptance()
+}
@@ -0,0 +1,50 @@
+// +build all travis
+
+package core
+
+import (
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestSep7URI(t *testing.T) {
+	txXDR := "AAAAAgAAAAB+/a=="
+	uri := sep7URI(txXDR, "Pay 10.00 STABLEUSD to project 1's escrow")
+	if !strings.HasPrefix(uri, "web+stellar:tx?") || strings.Contains(uri, "+to") {
+		t.Fatal("invalid sep-7 uri", uri)
+	}
+	query, err := url.ParseQuery(strings.TrimPrefix(uri, "web+stellar:tx?"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if query.Get("xdr") != txXDR || query.Get("msg") != "Pay 10.00 STABLEUSD to project 1's escrow" {
+		t.Fatal("sep-7 uri doesn't round trip", query)
+	}
+	long, err := url.ParseQuery(strings.TrimPrefix(sep7URI(txXDR, strings.Repeat("a", 400)), "web+stellar:tx?"))
+	if err != nil || len(long.Get("msg")) != 300 {
+		t.Fatal("sep-7 message not truncated")
+	}
+}
+
+func TestInvestmentAsset(t *testing.T) {
+	project := Project{Stage: 4, InvestorAssetCode: "INVASSET", SeedInvestmentCap: 100}
+	code, seed, err := investmentAsset(project, 1000)
+	if err != nil || code != "INVASSET" || seed {
+		t.Fatal("wrong asset for investment round", code, seed, err)
+	}
+
+	project.Stage = 1
+	code, seed, err = investmentAsset(project, 50)
+	if err != nil || code != "SEEDASSET" || !seed {
+		t.Fatal("wrong asset for seed round", code, seed, err)
+	}
+	if _, _, err = investmentAsset(project, 200); err == nil {
+		t.Fatal("seed investment above the cap allowed")
+	}
+
+	project.Stage = 5
+	if _, _, err = investmentAsset(project, 50); err == nil {
+		t.Fatal("investment allowed after the raise")
+	}
+}
@@ -0,0 +1,393 @@
+package core
+
+import (
+	"encoding/json"
+	"log"
+	"strconv"
+
+	"github.com/pkg/errors"
+
+	edb "github.com/Varunram/essentials/database"
+	utils "github.com/Varunram/essentials/utils"
+
+	consts "github.com/YaleOpenLab/opensolar/consts"
+)
+
+// an investment is a saga made up of several steps, some on chain and some in the database.
+// Each step's result is persisted in the investment's step log as soon as it succeeds so that
+// a retry with the same idempotency key resumes from the first incomplete step instead of
+// sending funds twice. If an investment can't be resumed (the project stopped accepting
+// investment, too many failed attempts) before the investor receives their assets, the platform
+// refunds the stablecoin it received.
+
+// Investment steps, in the order in which they are run
+const (
+	InvStepStablecoin = "stablecoin" // investor sends stablecoin to the platform
+	InvStepTrust      = "trust"      // investor trusts the investor asset
+	InvStepAsset      = "asset"      // issuer sends investor assets to the investor
+	InvStepInvestor   = "investor"   // investor struct is updated in the database
+	InvStepProject    = "project"    // project struct is updated in the database
+	InvStepRefund     = "refund"     // platform refunds stablecoin to the investor (compensation)
+)
+
+// Investment statuses
+const (
+	InvStatusPending     = "pending"
+	InvStatusComplete    = "complete"
+	InvStatusCompensated = "compensated"
+)
+
+// Investment is a persisted log of an investment in a project
+type Investment struct {
+	// Index is the index of the investment in the database
+	Index int
+	// Key is the idempotency key passed by the client
+	Key string
+	// InvIndex is the index of the investor
+	InvIndex int
+	// ProjIndex is the index of the project invested in
+	ProjIndex int
+	// Amount is the amount of USD invested
+	Amount float64
+	// AssetCode is the code of the asset the investor receives in return
+	AssetCode string
+	// SeedRound is true if this is a seed investment
+	SeedRound bool
+	// Status is one of pending, complete or compensated
+	Status string
+	// Steps maps a completed step to the tx hash associated with it (empty for db steps)
+	Steps map[string]string
+	// Attempts is the number of times the investment has been run
+	Attempts int
+	// Error is the error returned by the most recent failed attempt
+	Error string
+	// CreatedAt is the unix time at which the investment was created
+	CreatedAt int64
+	// UpdatedAt is the unix time at which the investment was last updated
+	UpdatedAt int64
+}
+
+// investmentKey identifies an investment by its investor and idempotency key
+type investmentKey struct {
+	invIndex int
+	key      string
+}
+
+// investmentLocks serializes the requests and admin calls that create, resume or compensate an
+// investment, so that a retried request doesn't run an investment that is still running
+var investmentLocks keyedLock
+
+// InvestmentsBucket is the bucket where investment logs are stored
+var InvestmentsBucket = []byte("Investments")
+
+// Save inserts a passed Investment object into the database
+func (a *Investment) Save() error {
+	a.UpdatedAt = utils.Unix()
+	return edb.Save(consts.DbDir+consts.DbName, InvestmentsBucket, a, a.Index)
+}
+
+// RetrieveInvestment retrieves an investment from the database
+func RetrieveInvestment(key int) (Investment, error) {
+	var x Investment
+	temp, err := edb.Retrieve(consts.DbDir+consts.DbName, InvestmentsBucket, key)
+	if err != nil {
+		return x, errors.Wrap(err, "error while retrieving key from bucket")
+	}
+
+	err = json.Unmarshal(temp, &x)
+	if err != nil {
+		return x, errors.Wrap(err, "could not unmarshal investment")
+	}
+	return x, nil
+}
+
+// RetrieveAllInvestments retrieves all investments from the database
+func RetrieveAllInvestments() ([]Investment, error) {
+	var arr []Investment
+	x, err := edb.RetrieveAllKeys(consts.DbDir+consts.DbName, InvestmentsBucket)
+	if err != nil {
+		return arr, errors.Wrap(err, "error while retrieving all keys")
+	}
+
+	for _, value := range x {
+		var temp Investment
+		err := json.Unmarshal(value, &temp)
+		if err != nil {
+			return arr, errors.Wrap(err, "could not unmarshal investment")
+		}
+		arr = append(arr, temp)
+	}
+	return arr, nil
+}
+
+// ErrInvestmentNotFound is returned when no investment with a given idempotency key exists
+var ErrInvestmentNotFound = errors.New("investment with given key not found")
+
+// RetrieveInvestmentByKey retrieves an investor's investment by its idempotency key
+func RetrieveInvestmentByKey(invIndex int, key string) (Investment, error) {
+	var x Investment
+	arr, err := RetrieveAllInvestments()
+	if err != nil {
+		return x, errors.Wrap(err, "could not retrieve investments")
+	}
+
+	for _, inv := range arr {
+		if inv.InvIndex == invIndex && inv.Key == key {
+			return inv, nil
+		}
+	}
+	return x, ErrInvestmentNotFound
+}
+
+// RetrieveStuckInvestments returns pending investments that have either failed or not been
+// updated in consts.InvestmentStuckInterval seconds
+func RetrieveStuckInvestments() ([]Investment, error) {
+	var arr []Investment
+	all, err := RetrieveAllInvestments()
+	if err != nil {
+		return arr, err
+	}
+
+	for _, inv := range all {
+		if inv.Status == InvStatusPending && inv.Stuck() {
+			arr = append(arr, inv)
+		}
+	}
+	return arr, nil
+}
+
+// Stuck returns true if the investment's last attempt failed or it hasn't been updated in
+// consts.InvestmentStuckInterval seconds
+func (a *Investment) Stuck() bool {
+	return a.Error != "" || utils.Unix()-a.UpdatedAt > consts.InvestmentStuckInterval
+}
+
+// investmentMemo is the memo of the stablecoin payment of an investment, which is looked up on
+// horizon before the payment is sent again
+func investmentMemo(index int) string {
+	return "Opensolar investment " + strconv.Itoa(index)
+}
+
+// newInvestment creates and stores a new pending investment
+func newInvestment(key string, invIndex int, projIndex int, amount float64, assetCode string, seed bool) (Investment, error) {
+	var a Investment
+	all, err := RetrieveAllInvestments()
+	if err != nil {
+		return a, errors.Wrap(err, "could not retrieve investments")
+	}
+
+	a.Index = len(all) + 1
+	a.Key = key
+	a.InvIndex = invIndex
+	a.ProjIndex = projIndex
+	a.Amount = amount
+	a.AssetCode = assetCode
+	a.SeedRound = seed
+	a.Status = InvStatusPending
+	a.Steps = make(map[string]string)
+	a.CreatedAt = utils.Unix()
+	return a, a.Save()
+}
+
+// Done returns true if the passed step has completed
+func (a *Investment) Done(step string) bool {
+	if a == nil {
+		return false
+	}
+	_, done := a.Steps[step]
+	return done
+}
+
+// step runs fn if the passed step has not completed yet and records its result. A nil
+// investment runs fn without logging.
+func (a *Investment) step(name string, fn func() (string, error)) (string, error) {
+	if a == nil {
+		return fn()
+	}
+
+	if hash, done := a.Steps[name]; done {
+		log.Println("investment", a.Index, "skipping completed step:", name)
+		return hash, nil
+	}
+
+	hash, err := fn()
+	if err != nil {
+		return hash, err
+	}
+
+	if a.Steps == nil {
+		a.Steps = make(map[string]string)
+	}
+	a.Steps[name] = hash
+	err = a.Save()
+	if err != nil {
+		return hash, errors.Wrap(err, "could not save investment step log")
+	}
+	return hash, nil
+}
+
+// fail records a failed attempt
+func (a *Investment) fail(err error) error {
+	a.Error = err.Error()
+	serr := a.Save()
+	if serr != nil {
+		log.Println("could not save failed investment", serr)
+	}
+	return err
+}
+
+// matches checks whether a retried request has the same parameters as the stored investment
+func (a *Investment) matches(projIndex int, invAmount float64) error {
+	if a.ProjIndex != projIndex || a.Amount != invAmount {
+		return errors.New("idempotency key already used for a different investment")
+	}
+	return nil
+}
+
+// resumeInvestment resumes a stored investment. Completed investments return immediately,
+// investments that can't proceed are compensated. Investments whose last attempt hasn't failed
+// or gone stale may still be running and aren't resumed
+func resumeInvestment(a *Investment, invSeed string) error {
+	switch a.Status {
+	case InvStatusComplete:
+		return nil
+	case InvStatusCompensated:
+		return errors.New("investment was refunded, please retry with a new key")
+	}
+	if !a.Stuck() {
+		return errors.New("investment is still running, please retry later")
+	}
+
+	project, err := RetrieveProject(a.ProjIndex)
+	if err != nil {
+		return errors.Wrap(err, "couldn't retrieve project")
+	}
+
+	if !a.Done(InvStepStablecoin) {
+		// no funds have moved yet, run the pre investment checks again
+		project, err = preInvestmentCheck(a.ProjIndex, a.InvIndex, a.Amount, invSeed)
+		if err != nil {
+			return a.fail(errors.Wrap(err, "pre investment check failed"))
+		}
+		return runInvestment(a, project, invSeed)
+	}
+
+	if !a.Done(InvStepAsset) {
+		// the platform holds the investor's funds but the investor has no assets yet. Refund
+		// if the project can't accept the investment anymore or if we've tried too many times
+		if a.Attempts >= consts.InvestmentMaxAttempts {
+			return compensateInvestment(a)
+		}
+		if project.AdminFlagged || a.Amount > project.TotalValue-project.MoneyRaised {
+			return compensateInvestment(a)
+		}
+	}
+
+	// assets have been sent out, the remaining steps only touch the database so we always
+	// roll forward
+	return runInvestment(a, project, invSeed)
+}
+
+// runInvestment runs all pending steps of an investment
+func runInvestment(a *Investment, project Project, invSeed string) error {
+	a.Attempts++
+	a.Error = ""
+	err := a.Save()
+	if err != nil {
+		return errors.Wrap(err, "could not save investment")
+	}
+
+	factor := 1.0
+	if a.SeedRound {
+		factor = project.SeedInvestmentFactor
+	}
+
+	err = MunibondInvest(a.InvIndex, invSeed, a.Amount, a.ProjIndex,
+		a.AssetCode, project.TotalValue, factor, a.SeedRound, a)
+	if err != nil {
+		return a.fail(errors.Wrap(err, "error while investing"))
+	}
+
+	_, err = a.step(InvStepProject, func() (string, error) {
+		if a.SeedRound {
+			project.SeedAssetCode = a.AssetCode
+		}
+		return "", project.updateAfterInvestment(a.Amount, a.InvIndex, a.SeedRound, a.Index)
+	})
+	if err != nil {
+		return a.fail(errors.Wrap(err, "couldn't update project after investment"))
+	}
+
+	a.Status = InvStatusComplete
+	a.Error = ""
+	return a.Save()
+}
+
+// CompensateInvestment refunds the stablecoin an investor sent to the platform for an
+// investment that has not been completed. Investments whose assets have already been sent out
+// can't be compensated and must be resumed instead.
+func CompensateInvestment(a *Investment) error {
+	err := a.compensable()
+	if err != nil {
+		return err
+	}
+
+	unlock := investmentLocks.lock(investmentKey{a.InvIndex, a.Key})
+	defer unlock()
+
+	*a, err = RetrieveInvestment(a.Index)
+	if err != nil {
+		return errors.Wrap(err, "couldn't retrieve investment")
+	}
+	err = a.compensable()
+	if err != nil {
+		return err
+	}
+	return compensateInvestment(a)
+}
+
+// compensable checks that an investment is pending and not running
+func (a *Investment) compensable() error {
+	if a.Status != InvStatusPending {
+		return errors.New("only pending investments can be compensated")
+	}
+	if !a.Stuck() {
+		return errors.New("investment is still running, only failed or stale investments can be compensated")
+	}
+	return nil
+}
+
+// compensateInvestment refunds a pending investment without checking whether it is still running
+func compensateInvestment(a *Investment) error {
+	if a.Done(InvStepAsset) {
+		return errors.New("investor assets already sent, investment must be resumed")
+	}
+
+	if a.Done(InvStepStablecoin) {
+		investor, err := RetrieveInvestor(a.InvIndex)
+		if err != nil {
+			return errors.Wrap(err, "couldn't retrieve investor")
+		}
+
+		projIndexString, err := utils.ToString(a.ProjIndex)
+		if err != nil {
+			return err
+		}
+
+		_, err = a.step(InvStepRefund, func() (string, error) {
+			code, issuerPubkey := consts.StablecoinCode, consts.StablecoinPublicKey
+			if consts.Mainnet {
+				code, issuerPubkey = consts.AnchorUSDCode, consts.AnchorUSDAddress
+			}
+			return platformPay(investor.U.StellarWallet.PublicKey, code, issuerPubkey, a.Amount,
+				"Opensolar refund: "+projIndexString)
+		})
+		if err != nil {
+			return a.fail(errors.Wrap(err, "could not refund investor"))
+		}
+	}
+
+	log.Println("compensated investment", a.Index, "of investor", a.InvIndex)
+	a.Status = InvStatusCompensated
+	return a.Save()
+}
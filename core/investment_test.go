@@ -0,0 +1,51 @@
+// +build all travis
+
+package core
+
+import (
+	"testing"
+
+	utils "github.com/Varunram/essentials/utils"
+)
+
+func TestInvestmentSteps(t *testing.T) {
+	var nilSaga *Investment
+	hash, err := nilSaga.step(InvStepTrust, func() (string, error) { return "hash", nil })
+	if err != nil || hash != "hash" {
+		t.Fatalf("nil investment did not run step")
+	}
+
+	saga := Investment{ProjIndex: 1, Amount: 100, Steps: map[string]string{InvStepStablecoin: "stablehash"}}
+	if !saga.Done(InvStepStablecoin) || saga.Done(InvStepAsset) {
+		t.Fatalf("step log not read correctly")
+	}
+
+	ran := false
+	hash, err = saga.step(InvStepStablecoin, func() (string, error) {
+		ran = true
+		return "newhash", nil
+	})
+	if err != nil || ran || hash != "stablehash" {
+		t.Fatalf("completed step was run again")
+	}
+
+	if saga.matches(1, 100) != nil {
+		t.Fatalf("matching investment rejected")
+	}
+	if saga.matches(1, 50) == nil || saga.matches(2, 100) == nil {
+		t.Fatalf("reused idempotency key not rejected")
+	}
+
+	saga.Status = InvStatusPending
+	saga.UpdatedAt = utils.Unix()
+	if CompensateInvestment(&saga) == nil {
+		t.Fatalf("running investment compensated")
+	}
+	if resumeInvestment(&saga, "") == nil {
+		t.Fatalf("running investment resumed")
+	}
+
+	if len(investmentMemo(999999)) > 28 {
+		t.Fatalf("investment memo too long for a text memo")
+	}
+}
@@ -0,0 +1,296 @@
+package core
+
+import (
+	"log"
+	"strconv"
+
+	"github.com/pkg/errors"
+
+	xlm "github.com/Varunram/essentials/xlm"
+	multisig "github.com/Varunram/essentials/xlm/multisig"
+	build "github.com/stellar/go/txnbuild"
+
+	consts "github.com/YaleOpenLab/opensolar/consts"
+	keys "github.com/YaleOpenLab/opensolar/keys"
+)
+
+// transactions signed by the platform and the project issuers. Their keys are held by the key
+// manager, so transactions are built here and passed to it to be signed instead of handing seeds
+// to the xlm helpers.
+
+// sendTx builds a transaction from source with ops, signs it with signers and submits it. Returns
+// the hash of the transaction, also when submitting it fails so that callers can look it up on
+// horizon before sending again
+func sendTx(source string, memo string, signers []keys.Signer, ops ...build.Operation) (string, error) {
+	account, err := xlm.ReturnSourceAccountPubkey(source)
+	if err != nil {
+		return "", errors.Wrap(err, "couldn't load source account")
+	}
+
+	tx, err := build.NewTransaction(build.TransactionParams{
+		SourceAccount:        &account,
+		IncrementSequenceNum: true,
+		Operations:           ops,
+		Timebounds:           build.NewInfiniteTimeout(),
+		Memo:                 build.MemoText(memo),
+		BaseFee:              1000,
+	})
+	if err != nil {
+		return "", errors.Wrap(err, "couldn't build transaction")
+	}
+
+	for _, signer := range signers {
+		tx, err = signer.SignTx(tx)
+		if err != nil {
+			return "", errors.Wrap(err, "couldn't sign transaction")
+		}
+	}
+
+	txhash, err := tx.HashHex(xlm.Passphrase)
+	if err != nil {
+		return "", errors.Wrap(err, "couldn't hash transaction")
+	}
+
+	txe, err := tx.Base64()
+	if err != nil {
+		return "", err
+	}
+	_, _, err = multisig.SendTx(txe)
+	return txhash, err
+}
+
+// platformPay sends an asset from the platform's account
+func platformPay(destination string, code string, issuer string, amount float64, memo string) (string, error) {
+	payment := build.Payment{
+		Destination: destination,
+		Amount:      formatAmount(amount),
+		Asset:       build.CreditAsset{Code: code, Issuer: issuer},
+	}
+	return sendTx(consts.PlatformPublicKey, memo, []keys.Signer{keys.Key(keys.Platform)}, &payment)
+}
+
+// PlatformTrust trusts an asset from the platform's account
+func PlatformTrust(code string, issuer string, limit float64) (string, error) {
+	trust := build.ChangeTrust{
+		Line:  build.CreditAsset{Code: code, Issuer: issuer},
+		Limit: formatAmount(limit),
+	}
+	return sendTx(consts.PlatformPublicKey, "trust asset", []keys.Signer{keys.Key(keys.Platform)}, &trust)
+}
+
+// fundEscrow transfers a project's value in stablecoin from the platform to its escrow
+func fundEscrow(project Project) error {
+	code, issuer := escrowAsset()
+	txhash, err := platformPay(project.EscrowPubkey, code, issuer, project.TotalValue, "escrow init")
+	if err != nil {
+		return errors.Wrap(err, "could not fund escrow")
+	}
+	log.Println("tx hash for funding project escrow is: ", txhash)
+	return nil
+}
+
+// initEscrow creates a 2 of 2 multisig escrow between the recipient and the platform, sets it
+// auth immutable and trusts the stablecoin from it
+func initEscrow(recpPubkey string, recpSeed string) (string, error) {
+	pubkey, err := multisig.New2of2(recpPubkey, consts.PlatformPublicKey)
+	if err != nil {
+		return "", errors.Wrap(err, "error while initializing multisig escrow")
+	}
+
+	code, issuer := escrowAsset()
+	immutable := build.SetOptions{SetFlags: []build.AccountFlag{build.AuthImmutable}}
+	trust := build.ChangeTrust{Line: build.CreditAsset{Code: code, Issuer: issuer}, Limit: "10000000000"}
+	_, err = sendTx(pubkey, "escrow setup", []keys.Signer{keys.Seed(recpSeed), keys.Key(keys.Platform)}, &immutable, &trust)
+	if err != nil {
+		return pubkey, errors.Wrap(err, "could not set up escrow")
+	}
+	return pubkey, nil
+}
+
+// escrowPay sends an asset from a project's escrow, signed by the recipient and the platform
+func escrowPay(escrowPubkey string, recpSeed string, destination string, code string, issuer string,
+	amount float64, memo string) (string, error) {
+	payment := build.Payment{
+		Destination: destination,
+		Amount:      formatAmount(amount),
+		Asset:       build.CreditAsset{Code: code, Issuer: issuer},
+	}
+	return sendTx(escrowPubkey, memo, []keys.Signer{keys.Seed(recpSeed), keys.Key(keys.Platform)}, &payment)
+}
+
+// keyAddress returns the public key of the key with the given id
+func keyAddress(id string) (string, error) {
+	pubkey, err := keys.Key(id).Address()
+	if err != nil {
+		return "", errors.Wrap(err, "couldn't retrieve key "+id)
+	}
+	return pubkey, nil
+}
+
+// initIssuer generates an issuer key, creates its account from the platform's account and sets
+// it auth immutable. Steps that were done by an earlier attempt are skipped, so it can be retried
+// after failing halfway. Returns the issuer's public key
+func initIssuer(id string) (string, error) {
+	if keys.Manager == nil {
+		return "", errors.New("key manager not set up")
+	}
+	pubkey, err := keys.Manager.PublicKey(id)
+	if err != nil {
+		if errors.Cause(err) != keys.ErrNotFound {
+			return "", errors.Wrap(err, "error while retrieving issuer key")
+		}
+		pubkey, err = keys.Manager.Generate(id)
+		if err != nil {
+			return "", errors.Wrap(err, "error while generating issuer key")
+		}
+	}
+
+	account, err := lookupAccount(pubkey)
+	if err != nil {
+		return pubkey, errors.Wrap(err, "error while looking up issuer")
+	}
+
+	if account.ID == "" {
+		create := build.CreateAccount{Destination: pubkey, Amount: "5"}
+		txhash, err := sendTx(consts.PlatformPublicKey, "create account", []keys.Signer{keys.Key(keys.Platform)}, &create)
+		if err != nil {
+			return pubkey, errors.Wrap(err, "error while sending xlm to create issuer")
+		}
+		log.Printf("Txhash for setting up issuer %s is %s", id, txhash)
+	}
+
+	if !account.Flags.AuthImmutable {
+		immutable := build.SetOptions{SetFlags: []build.AccountFlag{build.AuthImmutable}}
+		txhash, err := sendTx(pubkey, "set immutable", []keys.Signer{keys.Key(id)}, &immutable)
+		if err != nil {
+			return pubkey, errors.Wrap(err, "error while setting auth immutable on issuer")
+		}
+		log.Printf("Txhash for setting Auth Immutable on issuer %s is %s", id, txhash)
+	}
+	return pubkey, nil
+}
+
+// issuerPay sends an asset from the issuer with the given key id
+func issuerPay(id string, code string, destination string, amount float64, memo string) (string, error) {
+	pubkey, err := keyAddress(id)
+	if err != nil {
+		return "", err
+	}
+	payment := build.Payment{
+		Destination: destination,
+		Amount:      formatAmount(amount),
+		Asset:       build.CreditAsset{Code: code, Issuer: pubkey},
+	}
+	return sendTx(pubkey, memo, []keys.Signer{keys.Key(id)}, &payment)
+}
+
+// freezeIssuer removes the weight of the issuer's key so that it can't issue any more assets
+func freezeIssuer(id string) (string, error) {
+	pubkey, err := keyAddress(id)
+	if err != nil {
+		return "", err
+	}
+	freeze := build.SetOptions{
+		MasterWeight:    build.NewThreshold(0),
+		LowThreshold:    build.NewThreshold(0),
+		MediumThreshold: build.NewThreshold(0),
+		HighThreshold:   build.NewThreshold(0),
+	}
+	return sendTx(pubkey, "freeze account", []keys.Signer{keys.Key(id)}, &freeze)
+}
+
+// MigrateCiphertexts re-encrypts the seeds and credentials encrypted with the platform's key that
+// the platform's key manager didn't encrypt itself: ciphertexts from before the local keystore
+// sealed its data, or from the local keystore when moving to another backend. from is the key
+// manager they were encrypted with. Returns the number of re-encrypted ciphertexts
+func MigrateCiphertexts(from keys.KeyManager) (int, error) {
+	if keys.Manager == nil {
+		return 0, errors.New("key manager not set up")
+	}
+	migrated := 0
+
+	orders, err := RetrieveAllStandingOrders()
+	if err != nil {
+		return migrated, errors.Wrap(err, "couldn't retrieve standing orders")
+	}
+	for _, order := range orders {
+		n, err := migrateStandingOrder(from, order.Index)
+		if err != nil {
+			return migrated, err
+		}
+		migrated += n
+	}
+
+	recipients, err := RetrieveAllRecipients()
+	if err != nil {
+		return migrated, errors.Wrap(err, "couldn't retrieve recipients")
+	}
+	for _, recipient := range recipients {
+		n, err := migrateRecipient(from, recipient.U.Index)
+		if err != nil {
+			return migrated, err
+		}
+		migrated += n
+	}
+
+	projects, err := RetrieveAllProjects()
+	if err != nil {
+		return migrated, errors.Wrap(err, "couldn't retrieve projects")
+	}
+	for _, project := range projects {
+		config, changed, err := keys.Reencrypt(from, keys.Manager, keys.Platform, project.ProviderConfig)
+		if err != nil {
+			return migrated, errors.Wrap(err, "couldn't migrate provider config of project "+strconv.Itoa(project.Index))
+		}
+		if !changed {
+			continue
+		}
+		project.ProviderConfig = config
+		err = project.Save()
+		if err != nil {
+			return migrated, errors.Wrap(err, "couldn't save project")
+		}
+		migrated++
+	}
+	return migrated, nil
+}
+
+// migrateStandingOrder re-encrypts the seed of a standing order
+func migrateStandingOrder(from keys.KeyManager, index int) (int, error) {
+	unlock := standingOrderLocks.lock(index)
+	defer unlock()
+
+	order, err := RetrieveStandingOrder(index)
+	if err != nil {
+		return 0, err
+	}
+	seed, changed, err := keys.Reencrypt(from, keys.Manager, keys.Platform, order.EncryptedSeed)
+	if err != nil {
+		return 0, errors.Wrap(err, "couldn't migrate seed of standing order "+strconv.Itoa(index))
+	}
+	if !changed {
+		return 0, nil
+	}
+	order.EncryptedSeed = seed
+	return 1, order.Save()
+}
+
+// migrateRecipient re-encrypts the autoreload seed of a recipient
+func migrateRecipient(from keys.KeyManager, recpIndex int) (int, error) {
+	unlock := recipientLocks.lock(recpIndex)
+	defer unlock()
+
+	recipient, err := RetrieveRecipient(recpIndex)
+	if err != nil {
+		return 0, err
+	}
+	seed, changed, err := keys.Reencrypt(from, keys.Manager, keys.Platform, recipient.AutoreloadSeed)
+	if err != nil {
+		return 0, errors.Wrap(err, "couldn't migrate autoreload seed of recipient "+strconv.Itoa(recpIndex))
+	}
+	if !changed {
+		return 0, nil
+	}
+	recipient.AutoreloadSeed = seed
+	return 1, recipient.Save()
+}
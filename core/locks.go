@@ -0,0 +1,30 @@
+package core
+
+import (
+	"sync"
+)
+
+// keyedLock serializes operations on a single database object (eg a standing order or an
+// intent) that may be run by the RPC handlers and the monitoring goroutines at the same time.
+// Objects are usually keyed by their index, any comparable key works
+type keyedLock struct {
+	mu    sync.Mutex
+	locks map[interface{}]*sync.Mutex
+}
+
+// lock locks the object with the given key and returns a function that unlocks it
+func (l *keyedLock) lock(index interface{}) func() {
+	l.mu.Lock()
+	if l.locks == nil {
+		l.locks = make(map[interface{}]*sync.Mutex)
+	}
+	m, ok := l.locks[index]
+	if !ok {
+		m = new(sync.Mutex)
+		l.locks[index] = m
+	}
+	l.mu.Unlock()
+
+	m.Lock()
+	return m.Unlock
+}
@@ -2,29 +2,30 @@ package core
 
 import (
 	"log"
+	"strconv"
 	"time"
 
-	tickers "github.com/Varunram/essentials/exchangetickers"
-
 	"github.com/pkg/errors"
 
 	utils "github.com/Varunram/essentials/utils"
 
 	xlm "github.com/Varunram/essentials/xlm"
 	assets "github.com/Varunram/essentials/xlm/assets"
-	issuer "github.com/Varunram/essentials/xlm/issuer"
-	wallet "github.com/Varunram/essentials/xlm/wallet"
 	stablecoin "github.com/YaleOpenLab/opensolar/stablecoin"
 
 	consts "github.com/YaleOpenLab/opensolar/consts"
+	keys "github.com/YaleOpenLab/opensolar/keys"
 	notif "github.com/YaleOpenLab/opensolar/notif"
 	oracle "github.com/YaleOpenLab/opensolar/oracle"
 )
 
 // MunibondInvest invests in a munibond. Sends USD to the platform, receives INVAssets
 // in return, and sends an email to the investor's email id confirming investment if it succeeds.
-func MunibondInvest(issuerPath string, invIndex int, invSeed string, invAmount float64,
-	projIndex int, invAssetCode string, totalValue float64, seedInvestmentFactor float64, seed bool) error {
+// If an investment log is passed, steps that have already completed are skipped and each
+// completed step is recorded so that a failed investment can be resumed.
+func MunibondInvest(invIndex int, invSeed string, invAmount float64,
+	projIndex int, invAssetCode string, totalValue float64, seedInvestmentFactor float64, seed bool,
+	saga *Investment) error {
 
 	var err error
 
@@ -33,60 +34,95 @@ func MunibondInvest(issuerPath string, invIndex int, invSeed string, invAmount f
 		return errors.Wrap(err, "Unable to retrieve investor from database")
 	}
 
-	if !consts.Mainnet {
-		usdBalance := xlm.GetAssetBalance(investor.U.StellarWallet.PublicKey, "STABLEUSD")
-		if usdBalance < invAmount {
-			// need to exchange stablecoin equivalent to the difference in balance plus some change
-			amount := invAmount - usdBalance + 10
-			err = stablecoin.GetTestStablecoin(investor.U.Username, investor.U.StellarWallet.PublicKey, invSeed, amount)
-			if err != nil {
-				return errors.Wrap(err, "Unable to offer xlm to STABLEUSD excahnge for investor")
-			}
-			time.Sleep(30 * time.Second)
-		}
-	}
-
 	projIndexString, err := utils.ToString(projIndex)
 	if err != nil {
 		return err
 	}
 
-	stableTxHash, err := SendUSDToPlatform(invSeed, invAmount, "Opensolar investment: "+projIndexString)
+	stableTxHash, err := saga.step(InvStepStablecoin, func() (string, error) {
+		memo := "Opensolar investment: " + projIndexString
+		if saga != nil {
+			memo = investmentMemo(saga.Index)
+			if saga.Attempts > 1 {
+				// an earlier attempt may have sent the stablecoin without getting to record it
+				txhash, err := findMemoTx(investor.U.StellarWallet.PublicKey, memo, saga.CreatedAt-60)
+				if err != nil {
+					return "", errors.Wrap(err, "couldn't look up earlier stablecoin payment")
+				}
+				if txhash != "" {
+					log.Println("investment", saga.Index, "found stablecoin payment", txhash, "on horizon")
+					return txhash, nil
+				}
+			}
+		}
+
+		if !consts.Mainnet {
+			usdBalance := xlm.GetAssetBalance(investor.U.StellarWallet.PublicKey, "STABLEUSD")
+			if usdBalance < invAmount {
+				// need to exchange stablecoin equivalent to the difference in balance plus some change
+				amount := invAmount - usdBalance + 10
+				err := stablecoin.GetTestStablecoin(investor.U.Username, investor.U.StellarWallet.PublicKey, invSeed, amount)
+				if err != nil {
+					return "", errors.Wrap(err, "Unable to offer xlm to STABLEUSD excahnge for investor")
+				}
+				time.Sleep(30 * time.Second)
+			}
+		}
+
+		txhash, err := SendUSDToPlatform(invSeed, invAmount, memo)
+		if err != nil {
+			return txhash, errors.Wrap(err, "Unable to send STABLEUSD to platform")
+		}
+		return txhash, nil
+	})
 	if err != nil {
-		return errors.Wrap(err, "Unable to send STABLEUSD to platform")
+		return err
 	}
 
-	issuerPubkey, issuerSeed, err := wallet.RetrieveSeed(issuer.GetPath(issuerPath, projIndex), consts.IssuerSeedPwd)
+	issuerPubkey, err := projectIssuer(projIndex)
 	if err != nil {
-		return errors.Wrap(err, "Unable to retrieve seed")
+		return err
 	}
 
 	InvestorAsset := assets.CreateAsset(invAssetCode, issuerPubkey)
 
-	invTrustTxHash, err := assets.TrustAsset(InvestorAsset.GetCode(), issuerPubkey, totalValue, invSeed)
+	invTrustTxHash, err := saga.step(InvStepTrust, func() (string, error) {
+		txhash, err := assets.TrustAsset(InvestorAsset.GetCode(), issuerPubkey, totalValue, invSeed)
+		if err != nil {
+			return txhash, errors.Wrap(err, "Error while trusting investor asset")
+		}
+		log.Printf("Investor trusts InvAsset %s with txhash %s", InvestorAsset.GetCode(), txhash)
+		return txhash, nil
+	})
 	if err != nil {
-		return errors.Wrap(err, "Error while trusting investor asset")
+		return err
 	}
 
-	log.Printf("Investor trusts InvAsset %s with txhash %s", InvestorAsset.GetCode(), invTrustTxHash)
-	_, invAssetTxHash, err := assets.SendAssetFromIssuer(InvestorAsset.GetCode(), investor.U.StellarWallet.PublicKey, invAmount, issuerSeed, issuerPubkey)
+	invAssetTxHash, err := saga.step(InvStepAsset, func() (string, error) {
+		txhash, err := issuerPay(keys.IssuerID(projIndex), InvestorAsset.GetCode(), investor.U.StellarWallet.PublicKey, invAmount, "send asset")
+		if err != nil {
+			return txhash, errors.Wrap(err, "Error while sending out investor asset")
+		}
+		log.Printf("Sent InvAsset %s to investor %s with txhash %s", InvestorAsset.GetCode(), investor.U.StellarWallet.PublicKey, txhash)
+		return txhash, nil
+	})
 	if err != nil {
-		return errors.Wrap(err, "Error while sending out investor asset")
+		return err
 	}
 
-	log.Printf("Sent InvAsset %s to investor %s with txhash %s", InvestorAsset.GetCode(), investor.U.StellarWallet.PublicKey, invAssetTxHash)
+	_, err = saga.step(InvStepInvestor, func() (string, error) {
+		investor.AmountInvested += invAmount
 
-	investor.AmountInvested += invAmount
-
-	if seed {
-		investor.SeedInvestedSolarProjects = append(investor.InvestedSolarProjects, InvestorAsset.GetCode())
-		investor.SeedInvestedSolarProjectsIndices = append(investor.InvestedSolarProjectsIndices, projIndex)
-	} else {
-		investor.InvestedSolarProjects = append(investor.InvestedSolarProjects, InvestorAsset.GetCode())
-		investor.InvestedSolarProjectsIndices = append(investor.InvestedSolarProjectsIndices, projIndex)
-	}
+		if seed {
+			investor.SeedInvestedSolarProjects = append(investor.InvestedSolarProjects, InvestorAsset.GetCode())
+			investor.SeedInvestedSolarProjectsIndices = append(investor.InvestedSolarProjectsIndices, projIndex)
+		} else {
+			investor.InvestedSolarProjects = append(investor.InvestedSolarProjects, InvestorAsset.GetCode())
+			investor.InvestedSolarProjectsIndices = append(investor.InvestedSolarProjectsIndices, projIndex)
+		}
 
-	err = investor.Save()
+		return "", investor.Save()
+	})
 	if err != nil {
 		return err
 	}
@@ -99,7 +135,7 @@ func MunibondInvest(issuerPath string, invIndex int, invSeed string, invAmount f
 
 // MunibondReceive sends Debt and Payback assets to the recipient. Sends a notification email
 // to the recipient containing the tx hashes of all transactions involved.
-func MunibondReceive(issuerPath string, recpIndex int, projIndex int, debtAssetID string,
+func MunibondReceive(recpIndex int, projIndex int, debtAssetID string,
 	paybackAssetID string, years int, recpSeed string, totalValue float64, paybackPeriod time.Duration) error {
 
 	log.Println("Retrieving recipient")
@@ -109,9 +145,9 @@ func MunibondReceive(issuerPath string, recpIndex int, projIndex int, debtAssetI
 	}
 
 	log.Println("Retrieving issuer")
-	issuerPubkey, issuerSeed, err := wallet.RetrieveSeed(issuer.GetPath(issuerPath, projIndex), consts.IssuerSeedPwd)
+	issuerPubkey, err := projectIssuer(projIndex)
 	if err != nil {
-		return errors.Wrap(err, "Unable to retrieve issuer seed")
+		return err
 	}
 
 	DebtAsset := assets.CreateAsset(debtAssetID, issuerPubkey)
@@ -129,33 +165,43 @@ func MunibondReceive(issuerPath string, recpIndex int, projIndex int, debtAssetI
 	}
 	log.Printf("Recipient Trusts Payback asset %s with txhash %s", PaybackAsset.GetCode(), paybackTrustHash)
 
-	_, paybackAssetHash, err := assets.SendAssetFromIssuer(PaybackAsset.GetCode(), recipient.U.StellarWallet.PublicKey, pbAmtTrust, issuerSeed, issuerPubkey) // same amount as debt
+	debtTrustHash, err := assets.TrustAsset(DebtAsset.GetCode(), issuerPubkey, totalValue*2, recpSeed)
 	if err != nil {
-		return errors.Wrap(err, "Error while sending payback asset from issue")
+		return errors.Wrap(err, "Error while trusting debt asset")
 	}
+	log.Printf("Recipient Trusts Debt asset %s with txhash %s", DebtAsset.GetCode(), debtTrustHash)
 
-	log.Printf("Sent PaybackAsset to recipient %s with txhash %s", recipient.U.StellarWallet.PublicKey, paybackAssetHash)
+	return issueMunibonds(recipient, projIndex, DebtAsset.GetCode(), PaybackAsset.GetCode(),
+		pbAmtTrust, totalValue, paybackPeriod, paybackTrustHash, debtTrustHash)
+}
 
-	debtTrustHash, err := assets.TrustAsset(DebtAsset.GetCode(), issuerPubkey, totalValue*2, recpSeed)
+// issueMunibonds sends Debt and Payback assets to a recipient who trusts them and freezes the
+// project's issuer
+func issueMunibonds(recipient Recipient, projIndex int, debtAssetCode string, paybackAssetCode string,
+	pbAmount float64, totalValue float64, paybackPeriod time.Duration, paybackTrustHash string, debtTrustHash string) error {
+
+	issuerID := keys.IssuerID(projIndex)
+	paybackAssetHash, err := issuerPay(issuerID, paybackAssetCode, recipient.U.StellarWallet.PublicKey, pbAmount, "send asset") // same amount as debt
 	if err != nil {
-		return errors.Wrap(err, "Error while trusting debt asset")
+		return errors.Wrap(err, "Error while sending payback asset from issue")
 	}
-	log.Printf("Recipient Trusts Debt asset %s with txhash %s", DebtAsset.GetCode(), debtTrustHash)
 
-	_, recpDebtAssetHash, err := assets.SendAssetFromIssuer(DebtAsset.GetCode(), recipient.U.StellarWallet.PublicKey, totalValue, issuerSeed, issuerPubkey) // same amount as debt
+	log.Printf("Sent PaybackAsset to recipient %s with txhash %s", recipient.U.StellarWallet.PublicKey, paybackAssetHash)
+
+	recpDebtAssetHash, err := issuerPay(issuerID, debtAssetCode, recipient.U.StellarWallet.PublicKey, totalValue, "send asset") // same amount as debt
 	if err != nil {
 		return errors.Wrap(err, "Error while sending debt asset")
 	}
 
 	log.Printf("Sent DebtAsset to recipient %s with txhash %s\n", recipient.U.StellarWallet.PublicKey, recpDebtAssetHash)
-	recipient.ReceivedSolarProjects = append(recipient.ReceivedSolarProjects, DebtAsset.GetCode())
+	recipient.ReceivedSolarProjects = append(recipient.ReceivedSolarProjects, debtAssetCode)
 	recipient.ReceivedSolarProjectIndices = append(recipient.ReceivedSolarProjectIndices, projIndex)
 	err = recipient.Save()
 	if err != nil {
 		return errors.Wrap(err, "couldn't save recipient")
 	}
 
-	txhash, err := issuer.FreezeIssuer(issuerPath, projIndex, "blah")
+	txhash, err := freezeIssuer(issuerID)
 	if err != nil {
 		return errors.Wrap(err, "Error while freezing issuer")
 	}
@@ -190,6 +236,16 @@ func sendPaymentNotif(recpIndex int, projIndex int, paybackPeriod time.Duration,
 		}
 
 		// PAYBACK TIME!!
+		// top up the recipient's account for this cycle's bill if they've opted into autoreloads
+		recipient, err := RetrieveRecipient(recpIndex)
+		if err == nil {
+			bill := oracle.MonthlyBill() * float64(recipient.TellerEnergy) / 1000000
+			err = AutoreloadRecipient(recpIndex, projIndex, bill)
+			if err != nil {
+				log.Println("could not autoreload recipient", err)
+			}
+		}
+
 		// we don't know if the user has paid, but we send an email anyway
 		notif.SendPaybackAlertEmail(projIndex, email)
 		// sleep until the next payment is due
@@ -201,7 +257,7 @@ func sendPaymentNotif(recpIndex int, projIndex int, paybackPeriod time.Duration,
 
 // MunibondPayback is used by the recipient to pay the platform back. Pays the
 // project escrow USD, and the project issuer DebtAsset and Payback Asset.
-func MunibondPayback(issuerPath string, recpIndex int, amount float64, recipientSeed string, projIndex int,
+func MunibondPayback(recpIndex int, amount float64, recipientSeed string, projIndex int,
 	assetName string, projectInvestors []int, totalValue float64, escrowPubkey string) (float64, error) {
 
 	recipient, err := RetrieveRecipient(recpIndex)
@@ -209,15 +265,12 @@ func MunibondPayback(issuerPath string, recpIndex int, amount float64, recipient
 		return -1, errors.Wrap(err, "Error while retrieving recipient from database")
 	}
 
-	issuerPubkey, _, err := wallet.RetrieveSeed(issuer.GetPath(issuerPath, projIndex), consts.IssuerSeedPwd)
+	issuerPubkey, err := projectIssuer(projIndex)
 	if err != nil {
-		return -1, errors.Wrap(err, "Unable to retrieve issuer seed")
+		return -1, err
 	}
 
-	monthlyBill := oracle.MonthlyBill() * float64(recipient.TellerEnergy) / 1000000
-	if err != nil {
-		return -1, errors.Wrap(err, "Unable to fetch oracle price, exiting")
-	}
+	monthlyBill := recipient.MonthlyBill()
 
 	log.Println("YOUR BILL: ", monthlyBill)
 
@@ -225,6 +278,15 @@ func MunibondPayback(issuerPath string, recpIndex int, amount float64, recipient
 		return -1, errors.New("amount paid is less than amount needed. Please refill your main account")
 	}
 
+	// standing reloads are sent once per cycle by sendPaymentNotif. Threshold reloads only top up
+	// what's missing, so running them again before the payback doesn't reload twice
+	if recipient.AutoreloadMode != AutoreloadStandingMode {
+		err = AutoreloadRecipient(recpIndex, projIndex, amount)
+		if err != nil {
+			log.Println("could not autoreload recipient before payback", err)
+		}
+	}
+
 	var StableBalance float64
 	var xlmBalance float64
 
@@ -235,9 +297,9 @@ func MunibondPayback(issuerPath string, recpIndex int, amount float64, recipient
 	}
 
 	xlmBalance = xlm.GetNativeBalance(recipient.U.StellarWallet.PublicKey)
-	xlmUSD, err := tickers.BinanceTicker()
+	xlmUSD, err := oracle.XLMUSD()
 	if err != nil {
-		return -1, errors.Wrap(err, "unable to fetch ticker price from binance")
+		return -1, errors.Wrap(err, "unable to fetch xlm price from oracle")
 	}
 
 	balance := StableBalance + xlmUSD*xlmBalance
@@ -260,21 +322,16 @@ func MunibondPayback(issuerPath string, recpIndex int, amount float64, recipient
 		time.Sleep(30 * time.Second) // wait for the stablecoin daemon to give stablecoin
 	}
 
-	projIndexString, err := utils.ToString(projIndex)
-	if err != nil {
-		return -1, err
-	}
-
 	var stablecoinHash string
 	if !consts.Mainnet {
 		_, stablecoinHash, err = assets.SendAsset(consts.StablecoinCode, consts.StablecoinPublicKey,
-			escrowPubkey, amount, recipientSeed, "Opensolar payback: "+projIndexString)
+			escrowPubkey, amount, recipientSeed, PaybackMemo(projIndex))
 		if err != nil {
 			return -1, errors.Wrap(err, "Error while sending STABLEUSD back")
 		}
 	} else {
 		_, stablecoinHash, err = assets.SendAsset(consts.AnchorUSDCode, consts.AnchorUSDAddress,
-			escrowPubkey, amount, recipientSeed, "Opensolar payback: "+projIndexString)
+			escrowPubkey, amount, recipientSeed, PaybackMemo(projIndex))
 		if err != nil {
 			return -1, errors.Wrap(err, "Error while sending STABLEUSD back")
 		}
@@ -292,6 +349,27 @@ func MunibondPayback(issuerPath string, recpIndex int, amount float64, recipient
 		notif.SendPaybackNotifToRecipient(projIndex, recipient.U.Email, stablecoinHash, debtPaybackHash)
 	}
 
+	// reload the recipient so that records saved since it was retrieved (eg reloads, energy) aren't
+	// overwritten
+	unlock := recipientLocks.lock(recpIndex)
+	defer unlock()
+	recipient, err = RetrieveRecipient(recpIndex)
+	if err != nil {
+		return -1, errors.Wrap(err, "Error while retrieving recipient from database")
+	}
+
+	return munibondPaid(recipient, projIndex, amount, monthlyBill, totalValue, projectInvestors, stablecoinHash, debtPaybackHash), nil
+}
+
+// PaybackMemo is the memo of the stablecoin payment of a payback towards a project
+func PaybackMemo(projIndex int) string {
+	return "Opensolar payback: " + strconv.Itoa(projIndex)
+}
+
+// munibondPaid notifies investors of a payback and returns the share of the project's ownership
+// shifted to the recipient by it
+func munibondPaid(recipient Recipient, projIndex int, amount float64, monthlyBill float64, totalValue float64,
+	projectInvestors []int, stablecoinHash string, debtPaybackHash string) float64 {
 	for _, i := range projectInvestors {
 		investor, err := RetrieveInvestor(i)
 		if err != nil {
@@ -303,17 +381,25 @@ func MunibondPayback(issuerPath string, recpIndex int, amount float64, recipient
 		}
 	}
 
-	ownershipAmt := amount - monthlyBill
-	ownershipPct := ownershipAmt / totalValue
-
 	recipient.NextPaymentInterval = utils.IntToHumanTime(utils.Unix() + 2419200)
 	recipient.TellerEnergy = 0
-	err = recipient.Save()
+	err := recipient.Save()
 	if err != nil {
 		log.Println(err)
 	}
 
-	return ownershipPct, nil
+	return ownershipPct(amount, monthlyBill, totalValue)
+}
+
+// ownershipPct returns the share of the project the recipient owns through the part of a payback
+// of amount that exceeds their bill
+func ownershipPct(amount float64, monthlyBill float64, totalValue float64) float64 {
+	return (amount - monthlyBill) / totalValue
+}
+
+// MonthlyBill returns the recipient's bill for the energy consumed in the current payment cycle
+func (a Recipient) MonthlyBill() float64 {
+	return oracle.MonthlyBill() * float64(a.TellerEnergy) / 1000000
 }
 
 // SendUSDToPlatform sends STABLEUSD to the platform. Used by investors investing in projects.
@@ -0,0 +1,493 @@
+package core
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+
+	edb "github.com/Varunram/essentials/database"
+	utils "github.com/Varunram/essentials/utils"
+
+	consts "github.com/YaleOpenLab/opensolar/consts"
+)
+
+// projects with a grid connection report the energy they import from and export to the grid on
+// separate meter channels. Each month the project's exports are settled under the rules of its
+// utility: net metering offsets imports at the retail rate and either rolls surplus credits over
+// to the next month or pays them out at the export rate, while a feed-in tariff pays every
+// exported kWh at the export rate. Settlements wait for the utility's payment to be recorded, and
+// only the amount received is either applied to the recipient's invoices or paid out to
+// investors pro rata.
+
+// Export compensation schemes
+const (
+	SchemeNEM = "nem"
+	SchemeFiT = "fit"
+)
+
+// Settlement beneficiaries
+const (
+	SettleToRecipient = "recipient"
+	SettleToInvestors = "investors"
+)
+
+// Settlement statuses
+const (
+	SettlementAwaiting = "awaiting"
+	SettlementSettled  = "settled"
+)
+
+// settlementLocks serializes recording the utility's payment per settlement
+var settlementLocks keyedLock
+
+// Utility is a utility whose grid projects are connected to and its export compensation rules
+type Utility struct {
+	// Index is the index of the utility in the database
+	Index int
+	// Name is the name of the utility
+	Name string
+	// Scheme is either nem (net metering) or fit (feed-in tariff)
+	Scheme string
+	// ImportRate is the retail price of energy in USD/kWh that net metered exports offset
+	ImportRate float64
+	// ExportRate is the price in USD/kWh paid for feed-in exports or net metering surplus
+	ExportRate float64
+	// Rollover is true if net metering surplus is carried to the next month instead of paid out
+	Rollover bool
+}
+
+// SettlementPayout is a payment of settlement value to an investor
+type SettlementPayout struct {
+	// PublicKey is the investor's public key
+	PublicKey string
+	// Amount is the amount in USD paid
+	Amount float64
+	// TxHash is the hash of the payment
+	TxHash string
+	// Error is set if the payment failed
+	Error string `json:",omitempty"`
+}
+
+// Settlement is the monthly settlement of a project's grid exports
+type Settlement struct {
+	// Index is the index of the settlement in the database
+	Index int
+	// Number identifies the settlement, unique per project and month
+	Number string
+	// ProjIndex is the index of the project
+	ProjIndex int
+	// UtilityIndex is the index of the utility the exports were settled with
+	UtilityIndex int
+	// Scheme is the scheme the exports were settled under
+	Scheme string
+	// PeriodStart is the unix time at which the settled month starts
+	PeriodStart int64
+	// PeriodEnd is the unix time at which the settled month ends
+	PeriodEnd int64
+	// Import is the energy imported from the grid in kWh
+	Import float64
+	// Export is the energy exported to the grid in kWh
+	Export float64
+	// CarriedIn is the net metering surplus in kWh carried in from the previous month
+	CarriedIn float64
+	// Offset is the imported energy in kWh offset by exports
+	Offset float64
+	// CarriedOut is the net metering surplus in kWh carried to the next month
+	CarriedOut float64
+	// Value is the value of the exports in USD
+	Value float64
+	// Status is awaiting until the utility's payment is recorded, then settled
+	Status string
+	// Received is the amount in USD the utility paid for the settlement
+	Received float64
+	// Reference identifies the utility's payment
+	Reference string
+	// ReceivedAt is the unix time at which the utility's payment was recorded
+	ReceivedAt int64
+	// Beneficiary is either recipient or investors
+	Beneficiary string
+	// Invoices are the indices of the invoices the value was applied to
+	Invoices []int
+	// Payouts are the payments made to investors
+	Payouts []SettlementPayout
+	// CreatedAt is the unix time at which the settlement was made
+	CreatedAt int64
+}
+
+// UtilityBucket is the bucket where utilities are stored
+var UtilityBucket = []byte("Utilities")
+
+// SettlementBucket is the bucket where export settlements are stored
+var SettlementBucket = []byte("Settlements")
+
+// Save inserts a passed Utility object into the database
+func (a *Utility) Save() error {
+	return edb.Save(consts.DbDir+consts.DbName, UtilityBucket, a, a.Index)
+}
+
+// RetrieveUtility retrieves a utility from the database
+func RetrieveUtility(key int) (Utility, error) {
+	var x Utility
+	temp, err := edb.Retrieve(consts.DbDir+consts.DbName, UtilityBucket, key)
+	if err != nil {
+		return x, errors.Wrap(err, "error while retrieving key from bucket")
+	}
+
+	err = json.Unmarshal(temp, &x)
+	if err != nil {
+		return x, errors.Wrap(err, "could not unmarshal utility")
+	}
+	if x.Index == 0 {
+		return x, errors.New("utility not found")
+	}
+	return x, nil
+}
+
+// RetrieveAllUtilities retrieves all utilities from the database
+func RetrieveAllUtilities() ([]Utility, error) {
+	var arr []Utility
+	x, err := edb.RetrieveAllKeys(consts.DbDir+consts.DbName, UtilityBucket)
+	if err != nil {
+		return arr, errors.Wrap(err, "error while retrieving all keys")
+	}
+
+	for _, value := range x {
+		var temp Utility
+		err := json.Unmarshal(value, &temp)
+		if err != nil {
+			return arr, errors.Wrap(err, "could not unmarshal utility")
+		}
+		arr = append(arr, temp)
+	}
+	return arr, nil
+}
+
+// SetUtility creates a utility, or updates the utility at index if index is not 0
+func SetUtility(index int, name string, scheme string, importRate float64, exportRate float64,
+	rollover bool) (Utility, error) {
+	var a Utility
+	if strings.TrimSpace(name) == "" {
+		return a, errors.New("utility name can't be empty")
+	}
+	if scheme != SchemeNEM && scheme != SchemeFiT {
+		return a, errors.New("scheme must be nem or fit")
+	}
+	if importRate < 0 || exportRate < 0 {
+		return a, errors.New("rates can't be negative")
+	}
+
+	if index != 0 {
+		_, err := RetrieveUtility(index)
+		if err != nil {
+			return a, err
+		}
+		a.Index = index
+	} else {
+		all, err := RetrieveAllUtilities()
+		if err != nil {
+			return a, err
+		}
+		a.Index = len(all) + 1
+	}
+
+	a.Name = strings.TrimSpace(name)
+	a.Scheme = scheme
+	a.ImportRate = importRate
+	a.ExportRate = exportRate
+	a.Rollover = rollover
+	return a, a.Save()
+}
+
+// SetProjectUtility connects a project to a utility and sets who its export settlements go to
+func SetProjectUtility(projIndex int, utilityIndex int, beneficiary string) (Project, error) {
+	if beneficiary != SettleToRecipient && beneficiary != SettleToInvestors {
+		return Project{}, errors.New("beneficiary must be recipient or investors")
+	}
+
+	_, err := RetrieveUtility(utilityIndex)
+	if err != nil {
+		return Project{}, err
+	}
+
+	project, err := RetrieveProject(projIndex)
+	if err != nil {
+		return project, errors.Wrap(err, "couldn't retrieve project")
+	}
+
+	project.UtilityIndex = utilityIndex
+	project.ExportBeneficiary = beneficiary
+	return project, project.Save()
+}
+
+// Save inserts a passed Settlement object into the database
+func (a *Settlement) Save() error {
+	return edb.Save(consts.DbDir+consts.DbName, SettlementBucket, a, a.Index)
+}
+
+// RetrieveSettlement retrieves a settlement from the database
+func RetrieveSettlement(key int) (Settlement, error) {
+	var x Settlement
+	temp, err := edb.Retrieve(consts.DbDir+consts.DbName, SettlementBucket, key)
+	if err != nil {
+		return x, errors.Wrap(err, "error while retrieving key from bucket")
+	}
+
+	err = json.Unmarshal(temp, &x)
+	if err != nil {
+		return x, errors.Wrap(err, "could not unmarshal settlement")
+	}
+	if x.Index == 0 {
+		return x, errors.New("settlement not found")
+	}
+	return x, nil
+}
+
+// RetrieveSettlements retrieves the settlements of a project sorted by period. Pass 0 to
+// retrieve the settlements of all projects
+func RetrieveSettlements(projIndex int) ([]Settlement, error) {
+	var arr []Settlement
+	x, err := edb.RetrieveAllKeys(consts.DbDir+consts.DbName, SettlementBucket)
+	if err != nil {
+		return arr, errors.Wrap(err, "error while retrieving all keys")
+	}
+
+	for _, value := range x {
+		var temp Settlement
+		err := json.Unmarshal(value, &temp)
+		if err != nil {
+			return arr, errors.Wrap(err, "could not unmarshal settlement")
+		}
+		if projIndex == 0 || temp.ProjIndex == projIndex {
+			arr = append(arr, temp)
+		}
+	}
+	return arr, nil
+}
+
+// settlementNumber returns the number of a project's settlement for the month starting at start
+func settlementNumber(projIndex int, start int64) string {
+	return fmt.Sprintf("ST-%04d-%s", projIndex, time.Unix(start, 0).UTC().Format("200601"))
+}
+
+// settle computes the value of a month's exports under a utility's rules
+func (a *Settlement) settle(utility Utility) {
+	switch utility.Scheme {
+	case SchemeFiT:
+		a.Value = a.Export * utility.ExportRate
+	case SchemeNEM:
+		credits := a.Export + a.CarriedIn
+		a.Offset = math.Min(credits, a.Import)
+		surplus := credits - a.Offset
+		a.Value = a.Offset * utility.ImportRate
+		if utility.Rollover {
+			a.CarriedOut = surplus
+		} else {
+			a.Value += surplus * utility.ExportRate
+		}
+	}
+	a.Value = roundCents(a.Value)
+}
+
+// payInvestors pays the amount received for a settlement out to the project's investors pro rata
+func (a *Settlement) payInvestors(project Project) {
+	code, issuer := consts.StablecoinCode, consts.StablecoinPublicKey
+	if consts.Mainnet {
+		code, issuer = consts.AnchorUSDCode, consts.AnchorUSDAddress
+	}
+
+	for pubkey, share := range project.InvestorMap {
+		payout := SettlementPayout{PublicKey: pubkey, Amount: roundCents(a.Received * share)}
+		if payout.Amount <= 0 {
+			continue
+		}
+
+		var err error
+		payout.TxHash, err = platformPay(pubkey, code, issuer, payout.Amount, "Opensolar export: "+a.Number)
+		if err != nil {
+			log.Println("could not pay settlement", a.Number, "to", pubkey, err)
+			payout.Error = err.Error()
+		}
+		a.Payouts = append(a.Payouts, payout)
+	}
+}
+
+// SettleExports settles a project's grid exports for the month starting at start
+func SettleExports(projIndex int, start int64, now int64) (Settlement, error) {
+	var a Settlement
+	start = periodStart(start, EnergyMonth)
+	end := time.Unix(start, 0).UTC().AddDate(0, 1, 0).Unix()
+	if end > now {
+		return a, errors.New("can't settle a month that hasn't ended")
+	}
+
+	project, err := RetrieveProject(projIndex)
+	if err != nil {
+		return a, errors.Wrap(err, "couldn't retrieve project")
+	}
+
+	utility, err := RetrieveUtility(project.UtilityIndex)
+	if err != nil {
+		return a, errors.Wrap(err, "project is not connected to a utility")
+	}
+
+	all, err := RetrieveSettlements(0)
+	if err != nil {
+		return a, err
+	}
+
+	number := settlementNumber(projIndex, start)
+	var previous Settlement
+	for _, elem := range all {
+		if elem.ProjIndex != projIndex {
+			continue
+		}
+		if elem.Number == number {
+			return a, errors.New("month has already been settled")
+		}
+		if elem.PeriodStart < start && elem.PeriodStart >= previous.PeriodStart {
+			previous = elem
+		}
+	}
+
+	imported, err := ChannelEnergy(projIndex, EnergyImport, start, end)
+	if err != nil {
+		return a, errors.Wrap(err, "couldn't retrieve imported energy")
+	}
+	exported, err := ChannelEnergy(projIndex, EnergyExport, start, end)
+	if err != nil {
+		return a, errors.Wrap(err, "couldn't retrieve exported energy")
+	}
+
+	a.Index = len(all) + 1
+	a.Number = number
+	a.ProjIndex = projIndex
+	a.UtilityIndex = utility.Index
+	a.Scheme = utility.Scheme
+	a.PeriodStart = start
+	a.PeriodEnd = end
+	a.Import = float64(imported) / 1000
+	a.Export = float64(exported) / 1000
+	if utility.Scheme == SchemeNEM {
+		a.CarriedIn = previous.CarriedOut
+	}
+	a.Beneficiary = project.ExportBeneficiary
+	if a.Beneficiary == "" {
+		a.Beneficiary = SettleToRecipient
+	}
+	a.CreatedAt = now
+	a.settle(utility)
+
+	a.Status = SettlementAwaiting
+	if a.Value <= 0 {
+		a.Status = SettlementSettled
+	}
+	return a, a.Save()
+}
+
+// RecordUtilityPayment records the utility's payment for a settlement and passes the amount
+// received on to the settlement's beneficiary
+func RecordUtilityPayment(index int, amount float64, reference string) (Settlement, error) {
+	unlock := settlementLocks.lock(index)
+	defer unlock()
+
+	if amount <= 0 {
+		return Settlement{}, errors.New("payment must be positive")
+	}
+
+	a, err := RetrieveSettlement(index)
+	if err != nil {
+		return a, err
+	}
+	if a.Status != SettlementAwaiting {
+		return a, errors.New("settlement is not awaiting payment")
+	}
+
+	project, err := RetrieveProject(a.ProjIndex)
+	if err != nil {
+		return a, errors.Wrap(err, "couldn't retrieve project")
+	}
+
+	// store the payment before any value moves so that it is never passed on twice
+	a.Status = SettlementSettled
+	a.Received = roundCents(amount)
+	a.Reference = reference
+	a.ReceivedAt = utils.Unix()
+	err = a.Save()
+	if err != nil {
+		return a, errors.Wrap(err, "could not save settlement")
+	}
+
+	if a.Beneficiary == SettleToInvestors && len(project.InvestorMap) != 0 {
+		a.payInvestors(project)
+	} else {
+		invoices, err := ApplyPayment(a.ProjIndex, a.Received, "export settlement "+a.Number)
+		if err != nil {
+			log.Println("could not apply settlement to invoices, queueing it", err)
+			err = queuePayment(a.ProjIndex, a.Received, "export settlement "+a.Number)
+			if err != nil {
+				return a, errors.Wrap(err, "could not queue settlement for invoicing")
+			}
+		}
+		for _, invoice := range invoices {
+			a.Invoices = append(a.Invoices, invoice.Index)
+		}
+	}
+
+	return a, a.Save()
+}
+
+// SettleAllExports settles every month that has ended and hasn't been settled for each project
+// connected to a utility, starting from the month the project was connected
+func SettleAllExports(now int64) ([]Settlement, error) {
+	var arr []Settlement
+	projects, err := RetrieveAllProjects()
+	if err != nil {
+		return arr, errors.Wrap(err, "couldn't retrieve projects")
+	}
+
+	settlements, err := RetrieveSettlements(0)
+	if err != nil {
+		return arr, err
+	}
+	settled := make(map[string]bool)
+	for _, settlement := range settlements {
+		settled[settlement.Number] = true
+	}
+
+	for _, project := range projects {
+		if project.UtilityIndex == 0 || project.DateFunded == "" || project.Terminated {
+			continue
+		}
+
+		connected, err := connectedStart(project)
+		if err != nil {
+			log.Println("could not find when project", project.Index, "was connected", err)
+			continue
+		}
+		if connected == 0 {
+			continue // not generating yet
+		}
+
+		for start := connected; ; start = time.Unix(start, 0).UTC().AddDate(0, 1, 0).Unix() {
+			if time.Unix(start, 0).UTC().AddDate(0, 1, 0).Unix() > now {
+				break
+			}
+			if settled[settlementNumber(project.Index, start)] {
+				continue
+			}
+
+			settlement, err := SettleExports(project.Index, start, now)
+			if err != nil {
+				log.Println("could not settle exports of project", project.Index, err)
+				break
+			}
+			arr = append(arr, settlement)
+		}
+	}
+	return arr, nil
+}
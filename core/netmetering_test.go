@@ -0,0 +1,33 @@
+// +build all travis
+
+package core
+
+import (
+	"testing"
+)
+
+func TestSettleExports(t *testing.T) {
+	nem := Utility{Scheme: SchemeNEM, ImportRate: 0.2, ExportRate: 0.05, Rollover: true}
+	a := Settlement{Import: 100, Export: 150, CarriedIn: 10}
+	a.settle(nem)
+	if a.Offset != 100 || a.CarriedOut != 60 || a.Value != 20 {
+		t.Fatal("net metering surplus not rolled over", a.Offset, a.CarriedOut, a.Value)
+	}
+
+	nem.Rollover = false
+	a = Settlement{Import: 100, Export: 150}
+	a.settle(nem)
+	if a.CarriedOut != 0 || a.Value != 22.5 {
+		t.Fatal("net metering surplus not paid out", a.CarriedOut, a.Value)
+	}
+
+	a = Settlement{Import: 100, Export: 40}
+	a.settle(Utility{Scheme: SchemeFiT, ImportRate: 0.2, ExportRate: 0.1})
+	if a.Offset != 0 || a.Value != 4 {
+		t.Fatal("feed-in tariff not paid on all exports", a.Value)
+	}
+
+	if settlementNumber(1, 1546300800) != "ST-0001-201901" {
+		t.Fatal("settlement number wrong", settlementNumber(1, 1546300800))
+	}
+}
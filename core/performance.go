@@ -0,0 +1,604 @@
+package core
+
+import (
+	"encoding/json"
+	"log"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+
+	edb "github.com/Varunram/essentials/database"
+	utils "github.com/Varunram/essentials/utils"
+
+	consts "github.com/YaleOpenLab/opensolar/consts"
+	notif "github.com/YaleOpenLab/opensolar/notif"
+)
+
+// a project's expected generation is forecast from its capacity, tilt and the irradiance of its
+// region. Irradiance tables hold the average daily global horizontal irradiance of each month and
+// are looked up by state and country like emission factors. Irradiance on the tilted panels is
+// estimated with an isotropic sky model at solar noon, and the expected generation is the DC
+// capacity times the plane of array irradiance, less system losses. Days on which the project's
+// devices didn't report are left out of the comparison since the fleet monitor already alerts on
+// those.
+
+// PerformanceModel contains the parameters used to forecast a project's generation
+type PerformanceModel struct {
+	// CapacityKW is the DC capacity of the panels in kW. If zero, it is parsed from the project's content
+	CapacityKW float64
+	// Latitude is the latitude of the project in degrees. If zero, the latitude of the irradiance table is used
+	Latitude float64
+	// Tilt is the tilt of the panels from the horizontal in degrees. Panels face the equator
+	Tilt float64
+	// Losses is the fraction of generation lost in the system. Defaults to consts.PerformanceLosses
+	Losses float64
+	// Threshold is the ratio of actual to expected generation below which the project
+	// underperforms. Defaults to consts.PerformanceThreshold
+	Threshold float64
+}
+
+// IrradianceTable contains the average daily global horizontal irradiance of a region by month
+type IrradianceTable struct {
+	// Index is the index of the table in the database
+	Index int
+	// Country is the country the table applies to
+	Country string
+	// State is the state the table applies to. Empty if the table covers the whole country
+	State string
+	// Latitude is the latitude of the region in degrees
+	Latitude float64
+	// Monthly contains the average daily irradiance in kWh/m2 of each month, starting in January
+	Monthly [12]float64
+	// Source describes where the table was taken from
+	Source string
+	// UpdatedAt is the unix time at which the table was last set
+	UpdatedAt int64
+}
+
+// DailyPerformance is a project's expected and actual generation on a single day
+type DailyPerformance struct {
+	// Start is the unix time at which the day starts
+	Start int64
+	// Expected is the expected generation in Wh
+	Expected float64
+	// Actual is the metered generation in Wh
+	Actual uint64
+	// Readings is the number of readings reported on the day
+	Readings int
+}
+
+// PerformanceReport compares a project's expected and actual generation over a period
+type PerformanceReport struct {
+	// ProjIndex is the index of the project
+	ProjIndex int
+	// From is the unix time at which the period starts
+	From int64
+	// To is the unix time at which the period ends
+	To int64
+	// CapacityKW is the capacity used in the forecast
+	CapacityKW float64
+	// Region is the region whose irradiance table was used
+	Region string
+	// Days is the number of days in the period with readings
+	Days int
+	// Expected is the expected generation in Wh on days with readings
+	Expected float64
+	// Actual is the metered generation in Wh
+	Actual uint64
+	// PerformanceRatio is the actual generation divided by the generation of a lossless system
+	PerformanceRatio float64
+	// PerformanceIndex is the actual generation divided by the expected generation
+	PerformanceIndex float64
+	// Threshold is the performance index below which the project underperforms
+	Threshold float64
+	// Underperforming is true if the performance index is below the threshold
+	Underperforming bool
+	// Daily contains the expected and actual generation of each day in the period
+	Daily []DailyPerformance
+}
+
+// PerformanceEvent is raised when a project generates less than its threshold
+type PerformanceEvent struct {
+	// Index is the index of the event in the database
+	Index int
+	// ProjIndex is the index of the project
+	ProjIndex int
+	// Timestamp is the unix time at which the event was raised
+	Timestamp int64
+	// From is the unix time at which the evaluated window starts
+	From int64
+	// To is the unix time at which the evaluated window ends
+	To int64
+	// Expected is the expected generation in Wh over the window
+	Expected float64
+	// Actual is the metered generation in Wh over the window
+	Actual uint64
+	// PerformanceIndex is the actual generation divided by the expected generation
+	PerformanceIndex float64
+	// Threshold is the threshold the project fell below
+	Threshold float64
+	// Notified contains the emails of the contractor and developers notified about the event
+	Notified []string
+}
+
+// IrradianceBucket is the bucket where irradiance tables are stored
+var IrradianceBucket = []byte("Irradiance")
+
+// PerformanceBucket is the bucket where underperformance events are stored
+var PerformanceBucket = []byte("Performance")
+
+// defaultIrradiance is used for regions that have no configured table. The values are approximate
+// long term averages and should be replaced by measured data where available
+var defaultIrradiance = []IrradianceTable{
+	{Country: "USA", State: "Puerto Rico", Latitude: 18.2,
+		Monthly: [12]float64{4.6, 5.2, 6.0, 6.3, 6.1, 6.3, 6.4, 6.3, 5.7, 5.1, 4.6, 4.3}, Source: "default"},
+	{Country: "USA", State: "New York", Latitude: 41.3,
+		Monthly: [12]float64{1.9, 2.7, 3.8, 4.7, 5.5, 6.0, 6.0, 5.3, 4.3, 3.0, 1.9, 1.6}, Source: "default"},
+	{Country: "USA", State: "Connecticut", Latitude: 41.3,
+		Monthly: [12]float64{1.9, 2.7, 3.8, 4.7, 5.5, 6.0, 6.0, 5.3, 4.3, 3.0, 1.9, 1.6}, Source: "default"},
+	{Country: "USA", Latitude: 38.0,
+		Monthly: [12]float64{2.6, 3.4, 4.5, 5.6, 6.3, 6.8, 6.8, 6.1, 5.1, 3.9, 2.8, 2.3}, Source: "default"},
+	{Country: "Rwanda", Latitude: -2.0,
+		Monthly: [12]float64{5.0, 5.2, 5.0, 4.7, 4.7, 5.0, 5.3, 5.4, 5.3, 4.9, 4.7, 4.8}, Source: "default"},
+}
+
+// Save inserts a passed IrradianceTable object into the database
+func (a *IrradianceTable) Save() error {
+	return edb.Save(consts.DbDir+consts.DbName, IrradianceBucket, a, a.Index)
+}
+
+// Region returns the name of the region the table applies to
+func (a IrradianceTable) Region() string {
+	if a.State == "" {
+		return a.Country
+	}
+	return a.State + ", " + a.Country
+}
+
+// RetrieveIrradianceTables retrieves all configured irradiance tables
+func RetrieveIrradianceTables() ([]IrradianceTable, error) {
+	var arr []IrradianceTable
+	x, err := edb.RetrieveAllKeys(consts.DbDir+consts.DbName, IrradianceBucket)
+	if err != nil {
+		return arr, errors.Wrap(err, "error while retrieving all keys")
+	}
+
+	for _, value := range x {
+		var temp IrradianceTable
+		err := json.Unmarshal(value, &temp)
+		if err != nil {
+			return arr, errors.Wrap(err, "could not unmarshal irradiance table")
+		}
+		arr = append(arr, temp)
+	}
+	return arr, nil
+}
+
+// SetIrradianceTable sets the irradiance table of a country, or of a state if state is not empty
+func SetIrradianceTable(country string, state string, latitude float64, monthly [12]float64,
+	source string) (IrradianceTable, error) {
+	var a IrradianceTable
+	if strings.TrimSpace(country) == "" {
+		return a, errors.New("country can't be empty")
+	}
+	if latitude < -90 || latitude > 90 {
+		return a, errors.New("latitude must be between -90 and 90")
+	}
+	for _, value := range monthly {
+		if value < 0 || value > 12 {
+			return a, errors.New("daily irradiance must be between 0 and 12 kWh/m2")
+		}
+	}
+
+	tables, err := RetrieveIrradianceTables()
+	if err != nil {
+		return a, err
+	}
+
+	a.Index = len(tables) + 1
+	for _, elem := range tables {
+		if sameRegion(elem.Country, country) && sameRegion(elem.State, state) {
+			a.Index = elem.Index
+			break
+		}
+	}
+
+	a.Country = strings.TrimSpace(country)
+	a.State = strings.TrimSpace(state)
+	a.Latitude = latitude
+	a.Monthly = monthly
+	a.Source = source
+	a.UpdatedAt = utils.Unix()
+	return a, a.Save()
+}
+
+// ProjectIrradiance returns the irradiance table of the region a project is located in.
+// Configured tables take precedence over the defaults
+func ProjectIrradiance(project Project) (IrradianceTable, error) {
+	tables, err := RetrieveIrradianceTables()
+	if err != nil {
+		return IrradianceTable{}, err
+	}
+
+	for _, arr := range [][]IrradianceTable{tables, defaultIrradiance} {
+		var country *IrradianceTable
+		for i, elem := range arr {
+			if !sameRegion(elem.Country, project.Country) {
+				continue
+			}
+			if elem.State == "" {
+				country = &arr[i]
+			} else if sameRegion(elem.State, project.State) {
+				return elem, nil
+			}
+		}
+
+		if country != nil {
+			return *country, nil
+		}
+	}
+	return IrradianceTable{}, errors.New("no irradiance table for the project's region")
+}
+
+// parseCapacity parses a capacity like 2.5kW, 500 W or 1MWp into kW
+func parseCapacity(capacity string) (float64, error) {
+	x := strings.ToLower(strings.Replace(capacity, " ", "", -1))
+	x = strings.TrimSuffix(x, "p")
+
+	multiplier := 0.0
+	switch {
+	case strings.HasSuffix(x, "kw"):
+		x, multiplier = strings.TrimSuffix(x, "kw"), 1
+	case strings.HasSuffix(x, "mw"):
+		x, multiplier = strings.TrimSuffix(x, "mw"), 1000
+	case strings.HasSuffix(x, "w"):
+		x, multiplier = strings.TrimSuffix(x, "w"), 0.001
+	default:
+		return 0, errors.New("capacity must be in W, kW or MW")
+	}
+
+	value, err := strconv.ParseFloat(x, 64)
+	if err != nil || value <= 0 {
+		return 0, errors.New("could not parse capacity")
+	}
+	return value * multiplier, nil
+}
+
+// ProjectCapacity returns the DC capacity of a project's panels in kW. The capacity set in the
+// performance model takes precedence over the panel size and capacity in the project's content
+func ProjectCapacity(project Project) (float64, error) {
+	if project.Performance.CapacityKW > 0 {
+		return project.Performance.CapacityKW, nil
+	}
+
+	candidates := [][2]string{
+		{"Other Details", "panel size"},
+		{"Other Details", "capacity"},
+		{"Explore Tab", "solar"},
+	}
+	for _, candidate := range candidates {
+		value, ok := project.Content.Details[candidate[0]][candidate[1]].(string)
+		if !ok {
+			continue
+		}
+		capacity, err := parseCapacity(value)
+		if err == nil {
+			return capacity, nil
+		}
+	}
+	return 0, errors.New("project capacity not set")
+}
+
+// SetPerformanceModel updates the parameters used to forecast a project's generation. update is
+// applied to the stored model so that parameters which aren't passed are kept
+func SetPerformanceModel(projIndex int, update func(*PerformanceModel)) (Project, error) {
+	project, err := RetrieveProject(projIndex)
+	if err != nil {
+		return project, errors.Wrap(err, "couldn't retrieve project")
+	}
+
+	model := project.Performance
+	update(&model)
+
+	if model.CapacityKW < 0 {
+		return project, errors.New("capacity can't be negative")
+	}
+	if model.Latitude < -90 || model.Latitude > 90 {
+		return project, errors.New("latitude must be between -90 and 90")
+	}
+	if model.Tilt < 0 || model.Tilt > 90 {
+		return project, errors.New("tilt must be between 0 and 90")
+	}
+	if model.Losses < 0 || model.Losses >= 1 {
+		return project, errors.New("losses must be between 0 and 1")
+	}
+	if model.Threshold < 0 || model.Threshold > 1 {
+		return project, errors.New("threshold must be between 0 and 1")
+	}
+
+	project.Performance = model
+	return project, project.Save()
+}
+
+// monthDays are the recommended average days of each month used for solar geometry
+var monthDays = [12]float64{17, 47, 75, 105, 135, 162, 198, 228, 258, 288, 318, 344}
+
+// diffuseFraction and albedo are the fraction of irradiance assumed to be diffuse and the
+// reflectance of the ground in the plane of array model
+const (
+	diffuseFraction = 0.3
+	albedo          = 0.2
+)
+
+// planeOfArray converts the average daily horizontal irradiance of a month to irradiance on
+// panels tilted towards the equator
+func planeOfArray(ghi float64, month int, latitude float64, tilt float64) float64 {
+	rad := math.Pi / 180
+	declination := 23.45 * math.Sin(rad*360*(284+monthDays[month])/365)
+
+	// equator facing panels tilt towards the sun at noon in both hemispheres
+	sign := 1.0
+	if latitude < 0 {
+		sign = -1
+	}
+
+	horizontal := math.Cos(rad * (latitude - declination))
+	if horizontal < 0.05 {
+		horizontal = 0.05
+	}
+	beam := math.Cos(rad*(latitude-sign*tilt-declination)) / horizontal
+	if beam < 0 {
+		beam = 0
+	}
+
+	cosTilt := math.Cos(rad * tilt)
+	return ghi * ((1-diffuseFraction)*beam + diffuseFraction*(1+cosTilt)/2 + albedo*(1-cosTilt)/2)
+}
+
+// forecaster forecasts a project's daily generation
+type forecaster struct {
+	capacity  float64
+	latitude  float64
+	tilt      float64
+	losses    float64
+	threshold float64
+	table     IrradianceTable
+}
+
+// newForecaster builds a forecaster from a project's performance model and region
+func newForecaster(project Project) (forecaster, error) {
+	var a forecaster
+	var err error
+
+	a.capacity, err = ProjectCapacity(project)
+	if err != nil {
+		return a, err
+	}
+
+	a.table, err = ProjectIrradiance(project)
+	if err != nil {
+		return a, err
+	}
+
+	a.latitude = project.Performance.Latitude
+	if a.latitude == 0 {
+		a.latitude = a.table.Latitude
+	}
+
+	a.tilt = project.Performance.Tilt
+	a.losses = project.Performance.Losses
+	if a.losses == 0 {
+		a.losses = consts.PerformanceLosses
+	}
+
+	a.threshold = project.Performance.Threshold
+	if a.threshold == 0 {
+		a.threshold = consts.PerformanceThreshold
+	}
+	return a, nil
+}
+
+// ideal returns the generation in Wh of a lossless system on the day starting at start
+func (a forecaster) ideal(start int64) float64 {
+	month := int(time.Unix(start, 0).UTC().Month()) - 1
+	return a.capacity * planeOfArray(a.table.Monthly[month], month, a.latitude, a.tilt) * 1000
+}
+
+// expected returns the expected generation in Wh on the day starting at start
+func (a forecaster) expected(start int64) float64 {
+	return a.ideal(start) * (1 - a.losses)
+}
+
+// ForecastPerformance compares a project's expected and actual generation over the days in
+// [from, to). Partial days at either end of the range are left out
+func ForecastPerformance(projIndex int, from int64, to int64) (PerformanceReport, error) {
+	var a PerformanceReport
+	project, err := RetrieveProject(projIndex)
+	if err != nil {
+		return a, errors.Wrap(err, "couldn't retrieve project")
+	}
+
+	model, err := newForecaster(project)
+	if err != nil {
+		return a, err
+	}
+
+	from = periodStart(from+86399, EnergyDay)
+	to = periodStart(to, EnergyDay)
+	if to <= from {
+		return a, errors.New("range must contain at least one whole day")
+	}
+
+	days, err := RetrieveEnergyRollups(projIndex, EnergyDay, from, to)
+	if err != nil {
+		return a, errors.Wrap(err, "couldn't retrieve project energy")
+	}
+
+	actual := make(map[int64]EnergyRollup)
+	for _, day := range days {
+		actual[day.Start] = day
+	}
+
+	a.ProjIndex = projIndex
+	a.From = from
+	a.To = to
+	a.CapacityKW = model.capacity
+	a.Region = model.table.Region()
+	a.Threshold = model.threshold
+
+	var ideal float64
+	for start := from; start < to; start = time.Unix(start, 0).UTC().AddDate(0, 0, 1).Unix() {
+		day := DailyPerformance{Start: start, Expected: model.expected(start),
+			Actual: actual[start].Total, Readings: actual[start].Count}
+		a.Daily = append(a.Daily, day)
+
+		if day.Readings == 0 {
+			continue
+		}
+		a.Days++
+		a.Expected += day.Expected
+		a.Actual += day.Actual
+		ideal += model.ideal(start)
+	}
+
+	if a.Days == 0 {
+		return a, nil
+	}
+
+	a.PerformanceRatio = float64(a.Actual) / ideal
+	a.PerformanceIndex = float64(a.Actual) / a.Expected
+	a.Underperforming = a.PerformanceIndex < a.Threshold
+	return a, nil
+}
+
+// Save inserts a passed PerformanceEvent object into the database
+func (a *PerformanceEvent) Save() error {
+	return edb.Save(consts.DbDir+consts.DbName, PerformanceBucket, a, a.Index)
+}
+
+// RetrievePerformanceEvents retrieves the underperformance events of a project. Pass 0 to
+// retrieve the events of all projects
+func RetrievePerformanceEvents(projIndex int) ([]PerformanceEvent, error) {
+	var arr []PerformanceEvent
+	x, err := edb.RetrieveAllKeys(consts.DbDir+consts.DbName, PerformanceBucket)
+	if err != nil {
+		return arr, errors.Wrap(err, "error while retrieving all keys")
+	}
+
+	for _, value := range x {
+		var temp PerformanceEvent
+		err := json.Unmarshal(value, &temp)
+		if err != nil {
+			return arr, errors.Wrap(err, "could not unmarshal performance event")
+		}
+		if projIndex == 0 || temp.ProjIndex == projIndex {
+			arr = append(arr, temp)
+		}
+	}
+	return arr, nil
+}
+
+// performanceContacts returns the emails of a project's contractor and developers
+func performanceContacts(project Project) []string {
+	var emails []string
+	indices := uniqueInts(append([]int{project.ContractorIndex, project.MainDeveloperIndex}, project.DeveloperIndices...))
+	for _, index := range indices {
+		if index == 0 {
+			continue
+		}
+		entity, err := RetrieveEntity(index)
+		if err != nil {
+			log.Println("could not retrieve entity", index, "of project", project.Index, err)
+			continue
+		}
+		if entity.U.Email != "" {
+			emails = append(emails, entity.U.Email)
+		}
+	}
+	return emails
+}
+
+// CheckPerformance compares a project's generation over the last consts.PerformanceWindow days
+// with its forecast and raises an underperformance event if it falls below the threshold. Events
+// are raised at most once every consts.PerformanceAlertDebounce
+func CheckPerformance(projIndex int, now int64) (*PerformanceEvent, error) {
+	to := periodStart(now, EnergyDay)
+	from := time.Unix(to, 0).UTC().AddDate(0, 0, -consts.PerformanceWindow).Unix()
+
+	report, err := ForecastPerformance(projIndex, from, to)
+	if err != nil {
+		return nil, err
+	}
+	if report.Days < consts.PerformanceMinDays || !report.Underperforming {
+		return nil, nil
+	}
+
+	events, err := RetrievePerformanceEvents(0)
+	if err != nil {
+		return nil, err
+	}
+	for _, event := range events {
+		if event.ProjIndex == projIndex && now-event.Timestamp < consts.PerformanceAlertDebounce {
+			return nil, nil
+		}
+	}
+
+	project, err := RetrieveProject(projIndex)
+	if err != nil {
+		return nil, errors.Wrap(err, "couldn't retrieve project")
+	}
+
+	event := PerformanceEvent{
+		Index:            len(events) + 1,
+		ProjIndex:        projIndex,
+		Timestamp:        now,
+		From:             report.From,
+		To:               report.To,
+		Expected:         report.Expected,
+		Actual:           report.Actual,
+		PerformanceIndex: report.PerformanceIndex,
+		Threshold:        report.Threshold,
+	}
+
+	for _, email := range performanceContacts(project) {
+		err = notif.SendUnderperformanceEmail(projIndex, email, report.PerformanceIndex, report.Threshold)
+		if err != nil {
+			log.Println("could not notify", email, "about underperformance", err)
+			continue
+		}
+		event.Notified = append(event.Notified, email)
+	}
+
+	return &event, event.Save()
+}
+
+// MonitorPerformance checks the performance of all projects every consts.PerformanceCheckInterval
+func MonitorPerformance() {
+	for {
+		projects, err := RetrieveAllProjects()
+		if err != nil {
+			log.Println("could not retrieve projects for performance checks", err)
+		}
+
+		now := utils.Unix()
+		for _, project := range projects {
+			if project.Terminated {
+				continue
+			}
+			event, err := CheckPerformance(project.Index, now)
+			if err != nil {
+				// projects without a capacity or region can't be forecast
+				continue
+			}
+			if event != nil {
+				log.Println("project", project.Index, "is underperforming with a performance index of",
+					event.PerformanceIndex)
+			}
+		}
+
+		time.Sleep(consts.PerformanceCheckInterval)
+	}
+}
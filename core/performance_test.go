@@ -0,0 +1,31 @@
+// +build all travis
+
+package core
+
+import (
+	"testing"
+)
+
+func TestPerformanceForecast(t *testing.T) {
+	for capacity, kw := range map[string]float64{"2.5kW": 2.5, "500 W": 0.5, "1MWp": 1000} {
+		x, err := parseCapacity(capacity)
+		if err != nil || x != kw {
+			t.Fatal("could not parse capacity", capacity, x, err)
+		}
+	}
+	_, err := parseCapacity("60m")
+	if err == nil {
+		t.Fatal("capacity in meters should not be accepted")
+	}
+
+	// panels tilted towards the equator collect more than flat ones in winter in both hemispheres
+	if planeOfArray(2, 0, 41, 40) <= planeOfArray(2, 0, 41, 0) {
+		t.Fatal("tilted panels should collect more in a northern winter")
+	}
+	if planeOfArray(2, 6, -35, 35) <= planeOfArray(2, 6, -35, 0) {
+		t.Fatal("tilted panels should collect more in a southern winter")
+	}
+	if planeOfArray(5, 5, 20, 0) != 5 {
+		t.Fatal("flat panels should collect the horizontal irradiance")
+	}
+}
@@ -72,6 +72,9 @@ type Project struct {
 	// SeedInvestorIndices contains investors who took part before the contract was at stage 3
 	SeedInvestorIndices []int
 
+	// InvestmentIndices contains the investment logs whose amounts are counted in MoneyRaised
+	InvestmentIndices []int
+
 	// DateInitiated contains the date when the project was created
 	DateInitiated string
 
@@ -81,6 +84,9 @@ type Project struct {
 	// DateLastPaid contains the int64 ie unix time of last payment
 	DateLastPaid int64
 
+	// DateConnected is the unix time at which the project moved to stage 6 and began generating power
+	DateConnected int64
+
 	// AuctionType is the type of the auction the recipient has chosen (if they have)
 	AuctionType string
 
@@ -105,6 +111,12 @@ type Project struct {
 	// SeedAssetCode is the code of the asset given to seed investors on seed investment in the project
 	SeedAssetCode string
 
+	// RECAssetCode is the code of the asset that represents the project's renewable energy certificates
+	RECAssetCode string
+
+	// RECIssuer is the public key of the account that issues the project's renewable energy certificates
+	RECIssuer string
+
 	// SeedInvestmentFactor is the factor that a seed investor's investment is multiplied by in case they do invest at the seed stage
 	SeedInvestmentFactor float64
 
@@ -129,6 +141,24 @@ type Project struct {
 	// BalLeft is the balance left against the original investment
 	BalLeft float64
 
+	// AmountRepaid is the total amount that the recipient has paid back towards the project
+	AmountRepaid float64
+
+	// EscrowBalance is the escrow's stablecoin balance as of the last reconciliation
+	EscrowBalance float64
+
+	// DecommissionIndex is the index of the project's decommissioning, 0 if it isn't being decommissioned
+	DecommissionIndex int
+
+	// UnlockIntent is the index of the client signed transaction with which the recipient unlocked the project
+	UnlockIntent int
+
+	// GuarantorApproval is set if the guarantor must approve withdrawals from the escrow along with the recipient
+	GuarantorApproval bool
+
+	// Terminated is set once a decommissioned project's escrow and issuer accounts have been closed
+	Terminated bool
+
 	// AdminFlagged is set if someone reports the project
 	AdminFlagged bool
 
@@ -150,6 +180,27 @@ type Project struct {
 	// TellerPublishTopic is the topic using which the publisher / subscriber must post / subscribe messages from
 	TellerPublishTopic string
 
+	// DeviceProvider is the IoT provider (particle, swytch or mock) that reports the project's energy
+	DeviceProvider string
+
+	// ProviderDeviceID is the id of the project's device or asset on the provider's platform
+	ProviderDeviceID string
+
+	// ProviderConfig contains the provider's credentials encrypted with the platform's key
+	ProviderConfig []byte
+
+	// Performance contains the parameters used to forecast the project's generation
+	Performance PerformanceModel
+
+	// Billing contains the terms the project's recipient is invoiced on
+	Billing BillingPlan
+
+	// UtilityIndex is the index of the utility the project exports energy to
+	UtilityIndex int
+
+	// ExportBeneficiary is who the value of exports is settled to, either recipient or investors
+	ExportBeneficiary string
+
 	// Metadata contains other metadata and is used to derive project asset ids.
 	Metadata string
 
@@ -0,0 +1,492 @@
+package core
+
+import (
+	"encoding/json"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stellar/go/keypair"
+
+	edb "github.com/Varunram/essentials/database"
+	utils "github.com/Varunram/essentials/utils"
+	assets "github.com/Varunram/essentials/xlm/assets"
+
+	consts "github.com/YaleOpenLab/opensolar/consts"
+	keys "github.com/YaleOpenLab/opensolar/keys"
+)
+
+// renewable energy certificates (RECs) are minted from a project's metered generation at one
+// Stellar asset unit per MWh. Each project has its own REC issuer and asset. Certificates are
+// held in the platform's custody: the ledger proves issuance and retirement (retired units are
+// burned by sending them back to the issuer with a memo naming the certificate) while the
+// database tracks the vintage, location and holder of each certificate. Only readings that
+// reached the platform through MQTT, an IoT provider or a signed teller report are stored, so
+// all stored generation counts as verified.
+
+// WhPerREC is the energy in Wh that backs a single REC
+const WhPerREC = 1000000
+
+// REC statuses
+const (
+	RECPending = "pending"
+	RECActive  = "active"
+	RECRetired = "retired"
+)
+
+// recLocks serializes minting per project
+var recLocks keyedLock
+
+// RECEvent is an entry in a certificate's history
+type RECEvent struct {
+	// Timestamp is the unix time of the event
+	Timestamp int64
+	// Action is one of mint, split, transfer or retire
+	Action string
+	// From is the holder before the event
+	From string
+	// To is the holder after the event
+	To string
+	// Quantity is the number of RECs involved
+	Quantity int
+	// TxHash is the hash of the on-chain transaction, if any
+	TxHash string
+}
+
+// RECCertificate is a batch of RECs of the same project and vintage held by a single holder
+type RECCertificate struct {
+	// Index is the index of the certificate in the database
+	Index int
+	// ProjIndex is the index of the project whose generation backs the certificate
+	ProjIndex int
+	// AssetCode is the code of the project's REC asset
+	AssetCode string
+	// Issuer is the public key of the project's REC issuer
+	Issuer string
+	// Vintage is the month (YYYY-MM) in which the energy was generated
+	Vintage string
+	// Location is the city, state and country of the project
+	Location string
+	// Quantity is the number of RECs (MWh) in the certificate
+	Quantity int
+	// Holder is the Stellar public key of the certificate's owner
+	Holder string
+	// Parent is the certificate this one was split from, 0 if it was minted
+	Parent int
+	// Status is pending until the RECs are minted, then active or retired
+	Status string
+	// MintTx is the hash of the transaction that minted the RECs
+	MintTx string
+	// RetireTx is the hash of the transaction that burned the RECs
+	RetireTx string
+	// Beneficiary is the party on whose behalf the certificate was retired
+	Beneficiary string
+	// History contains the certificate's mints, splits, transfers and retirement
+	History []RECEvent
+}
+
+// RECBucket is the bucket where RECs are stored
+var RECBucket = []byte("RECs")
+
+// Save inserts a passed RECCertificate object into the database
+func (a *RECCertificate) Save() error {
+	return edb.Save(consts.DbDir+consts.DbName, RECBucket, a, a.Index)
+}
+
+// RetrieveREC retrieves a certificate from the database
+func RetrieveREC(key int) (RECCertificate, error) {
+	var x RECCertificate
+	temp, err := edb.Retrieve(consts.DbDir+consts.DbName, RECBucket, key)
+	if err != nil {
+		return x, errors.Wrap(err, "error while retrieving key from bucket")
+	}
+
+	err = json.Unmarshal(temp, &x)
+	if err != nil {
+		return x, errors.Wrap(err, "could not unmarshal certificate")
+	}
+	if x.Index == 0 {
+		return x, errors.New("certificate not found")
+	}
+	return x, nil
+}
+
+// RetrieveRECs retrieves all certificates that match filter. A nil filter returns all of them
+func RetrieveRECs(filter func(RECCertificate) bool) ([]RECCertificate, error) {
+	var arr []RECCertificate
+	x, err := edb.RetrieveAllKeys(consts.DbDir+consts.DbName, RECBucket)
+	if err != nil {
+		return arr, errors.Wrap(err, "error while retrieving all keys")
+	}
+
+	for _, value := range x {
+		var temp RECCertificate
+		err := json.Unmarshal(value, &temp)
+		if err != nil {
+			return arr, errors.Wrap(err, "could not unmarshal certificate")
+		}
+		if filter == nil || filter(temp) {
+			arr = append(arr, temp)
+		}
+	}
+	return arr, nil
+}
+
+// recLocation returns the location metadata of a project
+func recLocation(project Project) string {
+	var parts []string
+	for _, part := range []string{project.City, project.State, project.Country} {
+		if part != "" {
+			parts = append(parts, part)
+		}
+	}
+	return strings.Join(parts, ", ")
+}
+
+// vintage returns the vintage of a month starting at start
+func vintage(start int64) string {
+	return time.Unix(start, 0).UTC().Format("2006-01")
+}
+
+// recMintMemo is the memo of a mint transaction
+func recMintMemo(projIndex int, vintage string) string {
+	return "RECMINT " + strconv.Itoa(projIndex) + " " + vintage
+}
+
+// recRetireMemo is the memo of a retirement transaction
+func recRetireMemo(index int) string {
+	return "RECRETIRE " + strconv.Itoa(index)
+}
+
+// setupRECIssuer creates and funds the project's REC issuer and trusts its asset from the
+// platform's account if it hasn't been done before
+func setupRECIssuer(project *Project) error {
+	id := keys.RECIssuerID(project.Index)
+	if project.RECAssetCode != "" {
+		pubkey, err := keyAddress(id)
+		if err != nil {
+			return errors.Wrap(err, "could not retrieve rec issuer")
+		}
+		project.RECIssuer = pubkey
+		return nil
+	}
+
+	pubkey, err := initIssuer(id)
+	if err != nil {
+		return errors.Wrap(err, "could not create rec issuer")
+	}
+
+	code := assets.AssetID(consts.RECAssetPrefix + project.Metadata)
+	_, err = PlatformTrust(code, pubkey, consts.RECTrustLimit)
+	if err != nil {
+		return errors.Wrap(err, "could not trust rec asset")
+	}
+
+	project.RECAssetCode = code
+	project.RECIssuer = pubkey
+	return project.Save()
+}
+
+// recsDue returns the number of RECs each vintage of a project should have been minted by the
+// end of the previous month. Generation below a MWh is carried over to the next vintage
+func recsDue(months []EnergyRollup) map[string]int {
+	due := make(map[string]int)
+	var cumulative uint64
+	var minted int
+	for _, month := range months {
+		cumulative += month.Total
+		units := int(cumulative / WhPerREC)
+		if units > minted {
+			due[vintage(month.Start)] = units - minted
+			minted = units
+		}
+	}
+	return due
+}
+
+// sendRECMint mints the RECs of a pending certificate and activates it. A certificate left
+// pending by an earlier run is first looked up on the issuer's account so that a mint that
+// landed before an error isn't sent twice
+func sendRECMint(cert RECCertificate, retry bool) (RECCertificate, error) {
+	memo := recMintMemo(cert.ProjIndex, cert.Vintage)
+
+	var txhash string
+	var err error
+	if retry {
+		txhash, err = findMemoTx(cert.Issuer, memo, cert.History[0].Timestamp-60)
+		if err != nil {
+			return cert, errors.Wrap(err, "could not look up rec mint")
+		}
+	}
+
+	if txhash == "" {
+		txhash, err = issuerPay(keys.RECIssuerID(cert.ProjIndex), cert.AssetCode, consts.PlatformPublicKey,
+			float64(cert.Quantity), memo)
+		if err != nil {
+			return cert, errors.Wrap(err, "could not mint recs")
+		}
+	}
+
+	cert.Status = RECActive
+	cert.MintTx = txhash
+	cert.History[0].TxHash = txhash
+	err = cert.Save()
+	if err != nil {
+		return cert, errors.Wrap(err, "could not save certificate")
+	}
+
+	log.Println("minted", cert.Quantity, "recs of vintage", cert.Vintage, "for project", cert.ProjIndex)
+	return cert, nil
+}
+
+// MintRECs mints RECs for all months of a project's generation that haven't been minted yet. The
+// current month is minted once it is over. RECs are held by the project's recipient
+func MintRECs(projIndex int) ([]RECCertificate, error) {
+	var minted []RECCertificate
+
+	unlock := recLocks.lock(projIndex)
+	defer unlock()
+
+	months, err := RetrieveEnergyRollups(projIndex, EnergyMonth, 0, periodStart(utils.Unix(), EnergyMonth))
+	if err != nil {
+		return minted, errors.Wrap(err, "couldn't retrieve project energy")
+	}
+	if len(months) == 0 {
+		return minted, nil
+	}
+
+	project, err := RetrieveProject(projIndex)
+	if err != nil {
+		return minted, errors.Wrap(err, "couldn't retrieve project")
+	}
+
+	recipient, err := RetrieveRecipient(project.RecipientIndex)
+	if err != nil {
+		return minted, errors.Wrap(err, "couldn't retrieve recipient")
+	}
+
+	existing, err := RetrieveRECs(func(a RECCertificate) bool {
+		return a.ProjIndex == projIndex && a.Parent == 0
+	})
+	if err != nil {
+		return minted, err
+	}
+
+	// minted certificates shrink when they're split, so count what was originally minted
+	already := make(map[string]int)
+	for _, cert := range existing {
+		for _, event := range cert.History {
+			if event.Action == "mint" {
+				already[cert.Vintage] += event.Quantity
+			}
+		}
+	}
+
+	all, err := RetrieveRECs(nil)
+	if err != nil {
+		return minted, err
+	}
+
+	// certificates are recorded as pending before their mint is sent, so finish the ones that an
+	// earlier run left behind first
+	for _, cert := range existing {
+		if cert.Status != RECPending {
+			continue
+		}
+		cert, err = sendRECMint(cert, true)
+		if err != nil {
+			return minted, err
+		}
+		minted = append(minted, cert)
+	}
+
+	due := recsDue(months)
+	issuerSetup := false
+	created := 0
+	for _, month := range months {
+		period := vintage(month.Start)
+		quantity := due[period] - already[period]
+		if quantity <= 0 {
+			continue
+		}
+
+		if !issuerSetup {
+			err = setupRECIssuer(&project)
+			if err != nil {
+				return minted, err
+			}
+			issuerSetup = true
+		}
+
+		now := utils.Unix()
+		cert := RECCertificate{
+			Index:     len(all) + created + 1,
+			ProjIndex: projIndex,
+			AssetCode: project.RECAssetCode,
+			Issuer:    project.RECIssuer,
+			Vintage:   period,
+			Location:  recLocation(project),
+			Quantity:  quantity,
+			Holder:    recipient.U.StellarWallet.PublicKey,
+			Status:    RECPending,
+			History:   []RECEvent{{now, "mint", "", recipient.U.StellarWallet.PublicKey, quantity, ""}},
+		}
+
+		err = cert.Save()
+		if err != nil {
+			return minted, errors.Wrap(err, "could not save certificate")
+		}
+		created++
+
+		cert, err = sendRECMint(cert, false)
+		if err != nil {
+			return minted, err
+		}
+		minted = append(minted, cert)
+	}
+
+	return minted, nil
+}
+
+// splitREC splits quantity RECs off a certificate into a new certificate held by the same holder.
+// Returns the certificate itself if quantity covers all of it
+func splitREC(a RECCertificate, quantity int) (RECCertificate, error) {
+	if quantity <= 0 || quantity > a.Quantity {
+		return a, errors.New("invalid quantity")
+	}
+	if quantity == a.Quantity {
+		return a, nil
+	}
+
+	all, err := RetrieveRECs(nil)
+	if err != nil {
+		return a, err
+	}
+
+	now := utils.Unix()
+	split := a
+	split.Index = len(all) + 1
+	split.Parent = a.Index
+	split.Quantity = quantity
+	split.History = []RECEvent{{now, "split", a.Holder, a.Holder, quantity, ""}}
+
+	a.Quantity -= quantity
+	a.History = append(a.History, RECEvent{now, "split", a.Holder, a.Holder, quantity, ""})
+
+	err = a.Save()
+	if err != nil {
+		return a, errors.Wrap(err, "could not save certificate")
+	}
+
+	return split, split.Save()
+}
+
+// holderREC retrieves an active certificate and checks that it belongs to holder
+func holderREC(index int, holder string) (RECCertificate, error) {
+	a, err := RetrieveREC(index)
+	if err != nil {
+		return a, err
+	}
+	if a.Holder != holder {
+		return a, errors.New("certificate does not belong to holder")
+	}
+	if a.Status != RECActive {
+		return a, errors.New("certificate has been retired")
+	}
+	return a, nil
+}
+
+// TransferREC transfers quantity RECs of a certificate to another holder. The RECs stay in the
+// platform's custody so only the certificate's holder changes
+func TransferREC(index int, from string, to string, quantity int) (RECCertificate, error) {
+	_, err := keypair.ParseAddress(to)
+	if err != nil {
+		return RECCertificate{}, errors.Wrap(err, "invalid destination")
+	}
+	if to == from {
+		return RECCertificate{}, errors.New("can't transfer a certificate to its holder")
+	}
+
+	a, err := holderREC(index, from)
+	if err != nil {
+		return a, err
+	}
+
+	a, err = splitREC(a, quantity)
+	if err != nil {
+		return a, err
+	}
+
+	a.Holder = to
+	a.History = append(a.History, RECEvent{utils.Unix(), "transfer", from, to, quantity, ""})
+	return a, a.Save()
+}
+
+// RetireREC retires quantity RECs of a certificate on behalf of beneficiary by burning them. The
+// burn transaction's memo names the certificate so that retirements can be proved on-chain
+func RetireREC(index int, holder string, quantity int, beneficiary string) (RECCertificate, error) {
+	a, err := holderREC(index, holder)
+	if err != nil {
+		return a, err
+	}
+
+	a, err = splitREC(a, quantity)
+	if err != nil {
+		return a, err
+	}
+
+	// sending an asset back to its issuer removes it from circulation
+	txhash, err := platformPay(a.Issuer, a.AssetCode, a.Issuer, float64(a.Quantity), recRetireMemo(a.Index))
+	if err != nil {
+		return a, errors.Wrap(err, "could not burn recs")
+	}
+
+	a.Status = RECRetired
+	a.RetireTx = txhash
+	a.Beneficiary = beneficiary
+	a.History = append(a.History, RECEvent{utils.Unix(), "retire", holder, a.Issuer, a.Quantity, txhash})
+	return a, a.Save()
+}
+
+// VerifyRECRetirement checks that a retired certificate's burn transaction is on-chain with
+// the certificate's memo
+func VerifyRECRetirement(index int) (bool, error) {
+	a, err := RetrieveREC(index)
+	if err != nil {
+		return false, err
+	}
+	if a.Status != RECRetired {
+		return false, errors.New("certificate has not been retired")
+	}
+
+	tx, err := lookupTx(a.RetireTx)
+	if err != nil {
+		return false, errors.Wrap(err, "could not retrieve retirement transaction")
+	}
+
+	return tx.Successful && tx.MemoType == "text" && tx.Memo == recRetireMemo(a.Index), nil
+}
+
+// MonitorRECs mints RECs for all projects every consts.RECMintInterval
+func MonitorRECs() {
+	for {
+		projects, err := RetrieveAllProjects()
+		if err != nil {
+			log.Println("could not retrieve projects for rec minting", err)
+		}
+
+		for _, project := range projects {
+			if project.Terminated {
+				continue
+			}
+			_, err = MintRECs(project.Index)
+			if err != nil {
+				log.Println("could not mint recs for project", project.Index, err)
+			}
+		}
+
+		time.Sleep(consts.RECMintInterval)
+	}
+}
@@ -0,0 +1,27 @@
+// +build all travis
+
+package core
+
+import (
+	"testing"
+)
+
+func TestRECsDue(t *testing.T) {
+	// 2019-01, 2019-02 and 2019-03
+	months := []EnergyRollup{
+		{Start: 1546300800, Total: 600000},
+		{Start: 1548979200, Total: 1900000},
+		{Start: 1551398400, Total: 400000},
+	}
+
+	due := recsDue(months)
+	if len(due) != 1 || due["2019-02"] != 2 {
+		t.Fatal("generation below a MWh not carried over", due)
+	}
+
+	months = append(months, EnergyRollup{Start: 1554076800, Total: 100000})
+	due = recsDue(months)
+	if due["2019-04"] != 1 || due["2019-02"] != 2 {
+		t.Fatal("remainder not minted once it reached a MWh", due)
+	}
+}
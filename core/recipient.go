@@ -32,6 +32,16 @@ type Recipient struct {
 	// DeviceID is the device ID of the associated solar hub / IoT device
 	DeviceID string
 
+	// DevicePublicKey is the public key of the device's signing keypair, registered along with DeviceID
+	DevicePublicKey string
+
+	// DeviceCounter is the counter of the last signed report accepted from the device
+	DeviceCounter uint64
+
+	// DeviceReadingsVerified is set once a signed reading published by the device over MQTT has
+	// been verified. Until then the device's energy is taken from the teller's pushes
+	DeviceReadingsVerified bool
+
 	// DeviceStarts contains the start time of the above IoT devices.
 	DeviceStarts []string
 
@@ -52,8 +62,27 @@ type Recipient struct {
 
 	// Autoreload is a bool to denote whether the recipient wants to reload balance from their secondary account
 	Autoreload bool
+
+	// AutoreloadMode is either threshold (top up when the balance is too low) or standing (fixed top up every payback)
+	AutoreloadMode string
+
+	// AutoreloadThreshold is the stablecoin balance that should remain after a payback in threshold mode
+	AutoreloadThreshold float64
+
+	// AutoreloadAmount is the max amount reloaded at once in threshold mode (zero means no limit) and
+	// the amount reloaded before every payback in standing mode
+	AutoreloadAmount float64
+
+	// AutoreloadSeed is the secondary account's seed encrypted with the platform's key
+	AutoreloadSeed []byte
+
+	// Reloads is a list of reloads the platform has performed on behalf of the recipient
+	Reloads []Reload
 }
 
+// recipientLocks serializes updates to a recipient's energy for the current payback period
+var recipientLocks keyedLock
+
 // NewRecipient creates and returns a new recipient
 func NewRecipient(uname string, pwd string, seedpwd string, Name string) (Recipient, error) {
 	var a Recipient
@@ -0,0 +1,306 @@
+package core
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"time"
+
+	"github.com/pkg/errors"
+
+	utils "github.com/Varunram/essentials/utils"
+	xlm "github.com/Varunram/essentials/xlm"
+
+	consts "github.com/YaleOpenLab/opensolar/consts"
+	notif "github.com/YaleOpenLab/opensolar/notif"
+)
+
+// reconciliation compares the amounts that we track in the database with the balances
+// that actually sit on Stellar. Investor assets are issued 1:1 with the USD invested, and debt
+// assets are returned 1:1 with the USD paid back, so both can be derived from the chain.
+
+// reconcileTolerance is the difference below which two amounts are considered equal. Stellar
+// amounts have 7 decimal places
+const reconcileTolerance = 1e-6
+
+// Discrepancy is a mismatch between a database field and the ledger
+type Discrepancy struct {
+	// Field is the database field that doesn't match the ledger
+	Field string
+	// Account is the Stellar account whose balance was checked
+	Account string
+	// DB is the value stored in the database
+	DB float64
+	// Chain is the value derived from the ledger
+	Chain float64
+	// Repairable is true if the DB field can be overwritten with the ledger value
+	Repairable bool
+}
+
+// ReconciliationReport is the result of reconciling a project against the ledger
+type ReconciliationReport struct {
+	// ProjIndex is the index of the project reconciled
+	ProjIndex int
+	// Timestamp is the time at which the report was generated
+	Timestamp string
+	// Discrepancies is a list of mismatches found
+	Discrepancies []Discrepancy
+	// Repaired is true if repairable fields were overwritten with ledger values
+	Repaired bool
+}
+
+// amountsDiffer returns true if a and b differ by more than the tolerance
+func amountsDiffer(a float64, b float64) bool {
+	return math.Abs(a-b) > reconcileTolerance
+}
+
+// uniqueInts removes duplicate entries from a slice of ints, preserving order
+func uniqueInts(arr []int) []int {
+	var ret []int
+	seen := make(map[int]bool)
+	for _, elem := range arr {
+		if !seen[elem] {
+			seen[elem] = true
+			ret = append(ret, elem)
+		}
+	}
+	return ret
+}
+
+// uniqueStrings removes duplicate and empty entries from a slice of strings, preserving order
+func uniqueStrings(arr []string) []string {
+	var ret []string
+	seen := make(map[string]bool)
+	for _, elem := range arr {
+		if elem != "" && !seen[elem] {
+			seen[elem] = true
+			ret = append(ret, elem)
+		}
+	}
+	return ret
+}
+
+// assetBalance returns an account's balance of an asset
+var assetBalance = xlm.GetAssetBalance
+
+// ledgerState is the ledger's view of the fields of a project and its investors that
+// reconciliation checks
+type ledgerState struct {
+	raised      float64
+	investorMap map[string]float64
+	invested    map[int]float64
+	repaid      float64
+	escrow      float64
+}
+
+// compareLedger derives a project's fields from the balances its investors, recipient and
+// escrow hold on chain and returns the fields that don't match the database. recipient is only
+// used once the project's debt asset has been issued
+func compareLedger(project Project, investors []Investor, recipient Recipient) (ledgerState, []Discrepancy) {
+	var discrepancies []Discrepancy
+	add := func(field string, account string, db float64, chain float64, repairable bool) {
+		if amountsDiffer(db, chain) {
+			discrepancies = append(discrepancies, Discrepancy{
+				Field: field, Account: account, DB: db, Chain: chain, Repairable: repairable,
+			})
+		}
+	}
+
+	chain := ledgerState{investorMap: make(map[string]float64), invested: make(map[int]float64)}
+
+	// investor and seed assets held by the project's investors
+	for _, investor := range investors {
+		pubkey := investor.U.StellarWallet.PublicKey
+		balance := 0.0
+		for _, code := range uniqueStrings([]string{project.InvestorAssetCode, project.SeedAssetCode}) {
+			balance += assetBalance(pubkey, code)
+		}
+
+		chain.raised += balance
+		if project.TotalValue != 0 {
+			chain.investorMap[pubkey] = balance / project.TotalValue
+		}
+	}
+
+	add("MoneyRaised", "", project.MoneyRaised, chain.raised, true)
+
+	for pubkey, pct := range chain.investorMap {
+		add("InvestorMap", pubkey, project.InvestorMap[pubkey], pct, true)
+	}
+	for pubkey, pct := range project.InvestorMap {
+		if _, exists := chain.investorMap[pubkey]; !exists {
+			add("InvestorMap", pubkey, pct, 0, true)
+		}
+	}
+
+	// an investor's AmountInvested spans all projects they've invested in, so we sum the balances
+	// of every asset they hold through the platform
+	for _, investor := range investors {
+		codes := append(investor.InvestedSolarProjects, investor.SeedInvestedSolarProjects...)
+		total := 0.0
+		for _, code := range uniqueStrings(codes) {
+			total += assetBalance(investor.U.StellarWallet.PublicKey, code)
+		}
+		chain.invested[investor.U.Index] = total
+		add("AmountInvested", investor.U.StellarWallet.PublicKey, investor.AmountInvested, total, true)
+	}
+
+	// debt and payback assets are sent to the recipient once the recipient accepts the project
+	if project.DebtAssetCode != "" {
+		pubkey := recipient.U.StellarWallet.PublicKey
+		debtIssued := project.TotalValue + project.SeedMoneyRaised
+		debtBalance := assetBalance(pubkey, project.DebtAssetCode)
+
+		chain.repaid = debtIssued - debtBalance
+		add("AmountRepaid", pubkey, project.AmountRepaid, chain.repaid, true)
+
+		// BalLeft only decreases by the part of each payback that isn't an ownership shift, so it
+		// can't be lower than the debt left on chain
+		if project.BalLeft < debtBalance-reconcileTolerance {
+			add("BalLeft", pubkey, project.BalLeft, debtBalance, false)
+		}
+
+		years := project.EstimatedAcquisition
+		if years == 0 {
+			years = 1
+		}
+		add("PaybackAsset", pubkey, float64(years*12*2), assetBalance(pubkey, project.PaybackAssetCode), false)
+	}
+
+	// stablecoin sitting in the escrow
+	if project.EscrowPubkey != "" {
+		if consts.Mainnet {
+			chain.escrow = assetBalance(project.EscrowPubkey, consts.AnchorUSDCode)
+		} else {
+			chain.escrow = assetBalance(project.EscrowPubkey, consts.StablecoinCode)
+		}
+		add("EscrowBalance", project.EscrowPubkey, project.EscrowBalance, chain.escrow, true)
+	}
+
+	return chain, discrepancies
+}
+
+// ReconcileProject compares a project's database fields with on chain balances of the investor,
+// seed, debt and payback assets and the escrow's stablecoin balance. If repair is set, fields
+// that can be derived from the chain are overwritten with the chain's values.
+//
+// Repairs assume that the platform's assets are never transferred: every investor and seed
+// asset is held by the investor it was issued to and debt assets only leave the recipient
+// when paid back. MoneyRaised, InvestorMap and AmountInvested are rebuilt from what the
+// project's investors hold, so an asset sent to another account would be dropped from them.
+// Review the report before repairing a project whose assets may have moved
+func ReconcileProject(projIndex int, repair bool) (ReconciliationReport, error) {
+	var report ReconciliationReport
+	report.ProjIndex = projIndex
+	report.Timestamp = utils.Timestamp()
+
+	project, err := RetrieveProject(projIndex)
+	if err != nil {
+		return report, errors.Wrap(err, "couldn't retrieve project")
+	}
+
+	var investors []Investor
+	for _, index := range uniqueInts(append(project.InvestorIndices, project.SeedInvestorIndices...)) {
+		investor, err := RetrieveInvestor(index)
+		if err != nil {
+			return report, errors.Wrap(err, "couldn't retrieve investor")
+		}
+		investors = append(investors, investor)
+	}
+
+	var recipient Recipient
+	if project.DebtAssetCode != "" {
+		recipient, err = RetrieveRecipient(project.RecipientIndex)
+		if err != nil {
+			return report, errors.Wrap(err, "couldn't retrieve recipient")
+		}
+	}
+
+	chain, discrepancies := compareLedger(project, investors, recipient)
+	report.Discrepancies = discrepancies
+	if !repair || len(report.Discrepancies) == 0 {
+		return report, nil
+	}
+
+	project.MoneyRaised = chain.raised
+	project.InvestorMap = chain.investorMap
+	if project.DebtAssetCode != "" {
+		project.AmountRepaid = chain.repaid
+	}
+	if project.EscrowPubkey != "" {
+		project.EscrowBalance = chain.escrow
+	}
+
+	err = project.Save()
+	if err != nil {
+		return report, errors.Wrap(err, "couldn't save project")
+	}
+
+	for _, investor := range investors {
+		if !amountsDiffer(investor.AmountInvested, chain.invested[investor.U.Index]) {
+			continue
+		}
+		investor.AmountInvested = chain.invested[investor.U.Index]
+		err = investor.Save()
+		if err != nil {
+			return report, errors.Wrap(err, "couldn't save investor")
+		}
+	}
+
+	log.Println("repaired project", projIndex, "from ledger")
+	report.Repaired = true
+	return report, nil
+}
+
+// ReconcileAllProjects reconciles all projects in the database
+func ReconcileAllProjects(repair bool) ([]ReconciliationReport, error) {
+	var reports []ReconciliationReport
+	projects, err := RetrieveAllProjects()
+	if err != nil {
+		return reports, errors.Wrap(err, "couldn't retrieve projects")
+	}
+
+	for _, project := range projects {
+		report, err := ReconcileProject(project.Index, repair)
+		if err != nil {
+			log.Println("could not reconcile project", project.Index, err)
+			continue
+		}
+		reports = append(reports, report)
+	}
+	return reports, nil
+}
+
+// MonitorReconciliation reconciles all projects every consts.ReconcileInterval and alerts the
+// admin of any discrepancies. The job only reports, repairs must be requested by an admin.
+func MonitorReconciliation() {
+	for {
+		time.Sleep(consts.ReconcileInterval)
+
+		reports, err := ReconcileAllProjects(false)
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+
+		message := ""
+		for _, report := range reports {
+			for _, d := range report.Discrepancies {
+				message += fmt.Sprintf("Project %d: %s (%s) db: %f chain: %f\n",
+					report.ProjIndex, d.Field, d.Account, d.DB, d.Chain)
+			}
+		}
+
+		if message == "" {
+			continue
+		}
+
+		log.Println("reconciliation discrepancies found:\n" + message)
+		if consts.AdminEmail != "" {
+			err = notif.SendAlertEmail("Reconciliation found the following discrepancies:\n\n"+message, consts.AdminEmail)
+			if err != nil {
+				log.Println(err)
+			}
+		}
+	}
+}
@@ -0,0 +1,78 @@
+// +build all travis
+
+package core
+
+import (
+	"testing"
+
+	openxdb "github.com/YaleOpenLab/openx/database"
+)
+
+func TestReconcileHelpers(t *testing.T) {
+	if amountsDiffer(1, 1+reconcileTolerance/2) || !amountsDiffer(1, 1.001) {
+		t.Fatal("amounts not compared with the tolerance")
+	}
+
+	unique := uniqueInts([]int{3, 1, 3, 2, 1})
+	if len(unique) != 3 || unique[0] != 3 || unique[1] != 1 || unique[2] != 2 {
+		t.Fatal("duplicates not removed in order", unique)
+	}
+	if len(uniqueStrings([]string{"A", "", "A", "B"})) != 2 {
+		t.Fatal("duplicate and empty strings not removed")
+	}
+}
+
+func TestCompareLedger(t *testing.T) {
+	balances := map[string]float64{
+		"INV1/INVASSET":  600,
+		"INV2/INVASSET":  400,
+		"INV2/SEEDASSET": 100,
+		"RECP/DEBT":      900,
+		"RECP/PAYBACK":   24,
+	}
+	defer func(f func(string, string) float64) { assetBalance = f }(assetBalance)
+	assetBalance = func(pubkey string, code string) float64 {
+		return balances[pubkey+"/"+code]
+	}
+
+	project := Project{
+		TotalValue:        1000,
+		InvestorAssetCode: "INVASSET",
+		SeedAssetCode:     "SEEDASSET",
+		DebtAssetCode:     "DEBT",
+		PaybackAssetCode:  "PAYBACK",
+		MoneyRaised:       1100,
+		InvestorMap:       map[string]float64{"INV1": 0.6, "INV2": 0.5},
+		AmountRepaid:      50,
+		BalLeft:           850,
+	}
+	inv1 := Investor{U: &openxdb.User{Index: 1}, AmountInvested: 600, InvestedSolarProjects: []string{"INVASSET"}}
+	inv1.U.StellarWallet.PublicKey = "INV1"
+	inv2 := Investor{U: &openxdb.User{Index: 2}, AmountInvested: 400, InvestedSolarProjects: []string{"INVASSET"},
+		SeedInvestedSolarProjects: []string{"SEEDASSET"}}
+	inv2.U.StellarWallet.PublicKey = "INV2"
+	recipient := Recipient{U: &openxdb.User{}}
+	recipient.U.StellarWallet.PublicKey = "RECP"
+
+	chain, discrepancies := compareLedger(project, []Investor{inv1, inv2}, recipient)
+	if chain.raised != 1100 || chain.repaid != 100 || chain.invested[2] != 500 {
+		t.Fatal("ledger state not derived from balances", chain)
+	}
+
+	found := make(map[string]Discrepancy)
+	for _, d := range discrepancies {
+		found[d.Field+" "+d.Account] = d
+	}
+	if len(discrepancies) != 3 {
+		t.Fatal("wrong discrepancies", discrepancies)
+	}
+	if d, ok := found["AmountInvested INV2"]; !ok || d.DB != 400 || d.Chain != 500 || !d.Repairable {
+		t.Fatal("seed asset not counted towards amount invested", discrepancies)
+	}
+	if d, ok := found["AmountRepaid RECP"]; !ok || d.Chain != 100 {
+		t.Fatal("repaid amount not derived from the debt left", discrepancies)
+	}
+	if d, ok := found["BalLeft RECP"]; !ok || d.Repairable {
+		t.Fatal("balance below the debt on chain not reported as unrepairable", discrepancies)
+	}
+}
@@ -4,6 +4,8 @@ import (
 	"log"
 
 	"github.com/pkg/errors"
+
+	utils "github.com/Varunram/essentials/utils"
 )
 
 // StageXtoY promotes a contract's stage by one
@@ -356,6 +358,9 @@ func (a *Project) SetStage(number int) error {
 			log.Println("Error while changing recipient reputation", err)
 			return err
 		}
+		if a.DateConnected == 0 {
+			a.DateConnected = utils.Unix()
+		}
 	default:
 		log.Println("default")
 	}
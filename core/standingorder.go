@@ -0,0 +1,341 @@
+package core
+
+import (
+	"encoding/json"
+	"log"
+	"time"
+
+	"github.com/pkg/errors"
+
+	edb "github.com/Varunram/essentials/database"
+	utils "github.com/Varunram/essentials/utils"
+	wallet "github.com/Varunram/essentials/xlm/wallet"
+
+	consts "github.com/YaleOpenLab/opensolar/consts"
+	keys "github.com/YaleOpenLab/opensolar/keys"
+	notif "github.com/YaleOpenLab/opensolar/notif"
+	oracle "github.com/YaleOpenLab/opensolar/oracle"
+)
+
+// a standing order lets the platform pay back towards a project on the recipient's behalf. The
+// recipient authorizes it once with their seedpwd and the platform stores the recipient's seed
+// encrypted with its own seed. Each payback is computed from the energy reported by the teller
+// so paybacks continue even if the teller is offline when the payment is due.
+
+// StandingOrder is a recurring payback authorized by a recipient
+type StandingOrder struct {
+	// Index is the index of the standing order in the database
+	Index int
+	// RecpIndex is the index of the recipient paying back
+	RecpIndex int
+	// ProjIndex is the index of the project paid back towards
+	ProjIndex int
+	// AssetName is the debt asset sent back to the issuer on each payback
+	AssetName string
+	// EncryptedSeed is the recipient's seed encrypted with the platform's key
+	EncryptedSeed []byte
+	// Active is false once the order has been cancelled
+	Active bool
+	// Interval is the time in seconds between two paybacks
+	Interval int64
+	// NextRun is the unix time at which the next payback (or retry) is due
+	NextRun int64
+	// Retries is the number of consecutive failed attempts for the current cycle
+	Retries int
+	// LastAttempt is the unix time at which the current cycle's payback was last sent, 0 if it
+	// hasn't been sent this cycle
+	LastAttempt int64
+	// History is a list of all payback attempts
+	History []StandingOrderRun
+	// CreatedAt is the time at which the order was authorized
+	CreatedAt string
+	// CancelledAt is the time at which the order was cancelled
+	CancelledAt string
+}
+
+// StandingOrderRun is a single payback attempt of a standing order
+type StandingOrderRun struct {
+	// Timestamp is the time of the attempt
+	Timestamp string
+	// Amount is the amount paid back
+	Amount float64
+	// Energy is the teller energy the amount was computed from
+	Energy uint32
+	// Error is set if the attempt failed
+	Error string
+	// Landed is the hash of a payback from a failed attempt that was found on-chain instead of
+	// being sent again
+	Landed string
+}
+
+// standingOrderLocks serializes updates to a standing order between the monitor and the RPCs
+var standingOrderLocks keyedLock
+
+// StandingOrdersBucket is the bucket where standing orders are stored
+var StandingOrdersBucket = []byte("StandingOrders")
+
+// Save inserts a passed StandingOrder object into the database
+func (a *StandingOrder) Save() error {
+	return edb.Save(consts.DbDir+consts.DbName, StandingOrdersBucket, a, a.Index)
+}
+
+// RetrieveStandingOrder retrieves a standing order from the database
+func RetrieveStandingOrder(key int) (StandingOrder, error) {
+	var x StandingOrder
+	temp, err := edb.Retrieve(consts.DbDir+consts.DbName, StandingOrdersBucket, key)
+	if err != nil {
+		return x, errors.Wrap(err, "error while retrieving key from bucket")
+	}
+
+	err = json.Unmarshal(temp, &x)
+	if err != nil {
+		return x, errors.Wrap(err, "could not unmarshal standing order")
+	}
+	return x, nil
+}
+
+// RetrieveAllStandingOrders retrieves all standing orders from the database
+func RetrieveAllStandingOrders() ([]StandingOrder, error) {
+	var arr []StandingOrder
+	x, err := edb.RetrieveAllKeys(consts.DbDir+consts.DbName, StandingOrdersBucket)
+	if err != nil {
+		return arr, errors.Wrap(err, "error while retrieving all keys")
+	}
+
+	for _, value := range x {
+		var temp StandingOrder
+		err := json.Unmarshal(value, &temp)
+		if err != nil {
+			return arr, errors.Wrap(err, "could not unmarshal standing order")
+		}
+		arr = append(arr, temp)
+	}
+	return arr, nil
+}
+
+// RetrieveRecipientStandingOrders retrieves all standing orders authorized by a recipient
+func RetrieveRecipientStandingOrders(recpIndex int) ([]StandingOrder, error) {
+	var arr []StandingOrder
+	all, err := RetrieveAllStandingOrders()
+	if err != nil {
+		return arr, err
+	}
+
+	for _, order := range all {
+		if order.RecpIndex == recpIndex {
+			arr = append(arr, order)
+		}
+	}
+	return arr, nil
+}
+
+// AuthorizeStandingOrder authorizes the platform to pay back towards a project on behalf of
+// the recipient every payback period
+func (a *Recipient) AuthorizeStandingOrder(projIndex int, seedpwd string) (StandingOrder, error) {
+	var order StandingOrder
+
+	project, err := RetrieveProject(projIndex)
+	if err != nil {
+		return order, errors.Wrap(err, "couldn't retrieve project")
+	}
+
+	if project.RecipientIndex != a.U.Index {
+		return order, errors.New("recipient not associated with project")
+	}
+
+	if project.DebtAssetCode == "" {
+		return order, errors.New("project has not been funded yet, nothing to pay back")
+	}
+
+	existing, err := RetrieveRecipientStandingOrders(a.U.Index)
+	if err != nil {
+		return order, errors.Wrap(err, "couldn't retrieve standing orders")
+	}
+
+	for _, elem := range existing {
+		if elem.ProjIndex == projIndex && elem.Active {
+			return order, errors.New("standing order already exists for this project")
+		}
+	}
+
+	seed, err := wallet.DecryptSeed(a.U.StellarWallet.EncryptedSeed, seedpwd)
+	if err != nil {
+		return order, errors.Wrap(err, "could not decrypt seed")
+	}
+
+	all, err := RetrieveAllStandingOrders()
+	if err != nil {
+		return order, errors.Wrap(err, "couldn't retrieve standing orders")
+	}
+
+	order.Index = len(all) + 1
+	order.RecpIndex = a.U.Index
+	order.ProjIndex = projIndex
+	order.AssetName = project.DebtAssetCode
+	order.Active = true
+	order.CreatedAt = utils.Timestamp()
+
+	// PaybackPeriod is stored in weeks
+	order.Interval = int64(project.PaybackPeriod) * int64(consts.OneWeek)
+	if order.Interval <= 0 {
+		order.Interval = int64(consts.PaybackInterval)
+	}
+	order.NextRun = utils.Unix() + order.Interval
+
+	order.EncryptedSeed, err = keys.Encrypt(keys.Platform, []byte(seed))
+	if err != nil {
+		return order, errors.Wrap(err, "could not encrypt seed")
+	}
+
+	return order, order.Save()
+}
+
+// CancelStandingOrder cancels a recipient's standing order
+func (a *Recipient) CancelStandingOrder(index int) error {
+	unlock := standingOrderLocks.lock(index)
+	defer unlock()
+
+	order, err := RetrieveStandingOrder(index)
+	if err != nil {
+		return errors.Wrap(err, "couldn't retrieve standing order")
+	}
+
+	if order.RecpIndex != a.U.Index {
+		return errors.New("standing order does not belong to recipient")
+	}
+
+	if !order.Active {
+		return errors.New("standing order already cancelled")
+	}
+
+	order.Active = false
+	order.EncryptedSeed = nil
+	order.CancelledAt = utils.Timestamp()
+	return order.Save()
+}
+
+// execute runs a single payback of the standing order and schedules the next run. Paybacks
+// can't be sent twice, so a retry first checks that an earlier attempt of the same cycle didn't
+// make it on-chain
+func (a *StandingOrder) execute() error {
+	var run StandingOrderRun
+	run.Timestamp = utils.Timestamp()
+	var attempted int64
+
+	// a new cycle starts with no payback sent, so last cycle's payback isn't mistaken for this one's
+	newCycle := a.Retries == 0
+	if newCycle {
+		a.LastAttempt = 0
+	}
+
+	err := func() error {
+		recipient, err := RetrieveRecipient(a.RecpIndex)
+		if err != nil {
+			return errors.Wrap(err, "couldn't retrieve recipient")
+		}
+
+		if a.Retries > 0 && a.LastAttempt != 0 {
+			run.Landed, err = findMemoTx(recipient.U.StellarWallet.PublicKey, PaybackMemo(a.ProjIndex), a.LastAttempt)
+			if err != nil {
+				return errors.Wrap(err, "couldn't check whether the previous payback went through")
+			}
+			if run.Landed != "" {
+				log.Println("previous payback of standing order", a.Index, "is on-chain in tx", run.Landed, "not retrying")
+				return nil
+			}
+		}
+
+		run.Energy = recipient.TellerEnergy
+		run.Amount = oracle.MonthlyBill() * float64(recipient.TellerEnergy) / 1000000
+		if run.Amount <= 0 {
+			// no energy reported this cycle, nothing to pay
+			return nil
+		}
+
+		seed, err := keys.Decrypt(keys.Platform, a.EncryptedSeed)
+		if err != nil {
+			return errors.Wrap(err, "could not decrypt recipient seed")
+		}
+
+		attempted = utils.Unix()
+		return Payback(a.RecpIndex, a.ProjIndex, a.AssetName, run.Amount, string(seed))
+	}()
+
+	unlock := standingOrderLocks.lock(a.Index)
+	defer unlock()
+
+	// reload the order so that a cancel while the payback was running isn't overwritten
+	order, rerr := RetrieveStandingOrder(a.Index)
+	if rerr != nil {
+		log.Println("could not reload standing order", rerr)
+	} else {
+		*a = order
+	}
+
+	if attempted != 0 || newCycle {
+		a.LastAttempt = attempted
+	}
+
+	if err != nil {
+		run.Error = err.Error()
+		a.Retries++
+		if a.Retries > consts.StandingOrderMaxRetries {
+			// give up on this cycle and try again next period
+			a.Retries = 0
+			a.NextRun = utils.Unix() + a.Interval
+		} else {
+			a.NextRun = utils.Unix() + consts.StandingOrderRetryInterval*int64(a.Retries)
+		}
+	} else {
+		a.Retries = 0
+		a.NextRun = utils.Unix() + a.Interval
+	}
+
+	a.History = append(a.History, run)
+	serr := a.Save()
+	if serr != nil {
+		log.Println("could not save standing order", serr)
+	}
+	return err
+}
+
+// MonitorStandingOrders runs due standing orders every consts.StandingOrderPollInterval. Failed
+// paybacks are retried with a linear backoff and the recipient is notified of each failure.
+func MonitorStandingOrders() {
+	for {
+		orders, err := RetrieveAllStandingOrders()
+		if err != nil {
+			log.Println("could not retrieve standing orders", err)
+		}
+
+		now := utils.Unix()
+		for _, order := range orders {
+			if !order.Active || order.NextRun > now {
+				continue
+			}
+
+			project, err := RetrieveProject(order.ProjIndex)
+			if err != nil {
+				log.Println("couldn't retrieve project of standing order", order.Index, err)
+				continue
+			}
+			if project.Terminated {
+				continue
+			}
+
+			err = order.execute()
+			if err == nil {
+				log.Println("executed standing order", order.Index, "for project", order.ProjIndex)
+				continue
+			}
+
+			log.Println("standing order", order.Index, "failed:", err)
+			recipient, rerr := RetrieveRecipient(order.RecpIndex)
+			if rerr == nil && recipient.U.Notification {
+				notif.SendStandingOrderFailureNotif(order.ProjIndex, recipient.U.Email, err.Error(), order.Retries)
+			}
+		}
+
+		time.Sleep(consts.StandingOrderPollInterval)
+	}
+}
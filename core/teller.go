@@ -6,34 +6,37 @@ import (
 	"time"
 
 	erpc "github.com/Varunram/essentials/rpc"
-	//	consts "github.com/YaleOpenLab/opensolar/consts"
-	notif "github.com/YaleOpenLab/opensolar/notif"
+	consts "github.com/YaleOpenLab/opensolar/consts"
 )
 
-const tellerURL = "https://localhost"
-
 type statusResponse struct {
 	Code   int
 	Status string
 }
 
-// MonitorTeller monitors a teller and checks whether its live. If not,
-// sends an email to platform admins
+// MonitorTeller pings a project's teller every consts.FleetPingInterval and records successful
+// pings as heartbeats in the fleet registry. Tellers that stop responding are reported to admins
+// by MonitorFleet
 func MonitorTeller(projIndex int, tellerURL string) {
 	// call this function only after a order has been accepted by the recipient
 	log.Println("monitoring the teller")
 	for {
+		time.Sleep(consts.FleetPingInterval)
+
 		project, err := RetrieveProject(projIndex)
 		if err != nil {
 			log.Println(err)
 			continue
 		}
 
+		if project.TellerURL != tellerURL {
+			log.Println("teller url of project", projIndex, "changed, stopping monitor for", tellerURL)
+			return
+		}
+
 		data, err := erpc.GetRequest(tellerURL + "/ping")
 		if err != nil {
-			log.Println("did not create new GET request", err)
-			notif.SendTellerDownEmail(project.Index, project.RecipientIndex)
-			time.Sleep(5 * time.Second)
+			log.Println("could not ping teller", err)
 			continue
 		}
 
@@ -41,15 +44,23 @@ func MonitorTeller(projIndex int, tellerURL string) {
 		err = json.Unmarshal(data, &x)
 		if err != nil {
 			log.Println("error while unmarshalling data", err, string(data))
-			notif.SendTellerDownEmail(project.Index, project.RecipientIndex)
-			time.Sleep(5 * time.Second)
 			continue
 		}
 
 		if x.Code != 200 || x.Status != "HEALTH OK" {
-			notif.SendTellerDownEmail(project.Index, project.RecipientIndex)
+			log.Println("teller of project", projIndex, "not healthy:", x.Status)
+			continue
+		}
+
+		recipient, err := RetrieveRecipient(project.RecipientIndex)
+		if err != nil {
+			log.Println(err)
+			continue
 		}
 
-		time.Sleep(5 * time.Second)
+		_, err = RecordHeartbeat(projIndex, FleetTeller, recipient.DeviceID, "", -1)
+		if err != nil {
+			log.Println("could not record teller heartbeat", err)
+		}
 	}
 }
@@ -0,0 +1,205 @@
+package core
+
+import (
+	"encoding/json"
+
+	"github.com/pkg/errors"
+
+	edb "github.com/Varunram/essentials/database"
+	utils "github.com/Varunram/essentials/utils"
+
+	consts "github.com/YaleOpenLab/opensolar/consts"
+)
+
+// admins push configuration changes and one off commands to a project's teller through a
+// downlink that the teller polls. A command is handed to the teller only once, and the teller
+// acknowledges each command with a result once it has been run.
+
+// Teller command kinds
+const (
+	TellerKindConfig  = "config"
+	TellerKindCommand = "command"
+)
+
+// TellerConfigKeys are the settings that can be changed remotely
+var TellerConfigKeys = []string{"pollinterval", "loginrefresh", "maxstorage", "brokerurl", "apiurl"}
+
+// TellerCommands are the one off commands a teller can run
+var TellerCommands = []string{"updatestate", "flushchain", "rotatecredentials", "shutdown"}
+
+// Teller command statuses
+const (
+	TellerCmdPending   = "pending"   // waiting to be picked up by the teller
+	TellerCmdDelivered = "delivered" // picked up by the teller, no result yet
+	TellerCmdDone      = "done"      // run successfully by the teller
+	TellerCmdFailed    = "failed"    // run by the teller, but failed
+)
+
+// TellerCommand is a config change or command sent to a project's teller
+type TellerCommand struct {
+	// Index is the index of the command in the database
+	Index int
+	// ProjIndex is the index of the project whose teller should run the command
+	ProjIndex int
+	// Kind is either config or command
+	Kind string
+	// Name is the config key to set or the command to run
+	Name string
+	// Value is the new value of a config key
+	Value string
+	// Status is one of pending, delivered, done or failed
+	Status string
+	// Result is the result reported by the teller
+	Result string
+	// CreatedBy is the username of the admin who issued the command
+	CreatedBy string
+	// CreatedAt is the unix time at which the command was issued
+	CreatedAt int64
+	// DeliveredAt is the unix time at which the teller picked up the command
+	DeliveredAt int64
+	// AckedAt is the unix time at which the teller acknowledged the command
+	AckedAt int64
+}
+
+// TellerCommandsBucket is the bucket where teller commands are stored
+var TellerCommandsBucket = []byte("TellerCommands")
+
+// Save inserts a passed TellerCommand object into the database
+func (a *TellerCommand) Save() error {
+	return edb.Save(consts.DbDir+consts.DbName, TellerCommandsBucket, a, a.Index)
+}
+
+// RetrieveTellerCommand retrieves a teller command from the database
+func RetrieveTellerCommand(key int) (TellerCommand, error) {
+	var x TellerCommand
+	temp, err := edb.Retrieve(consts.DbDir+consts.DbName, TellerCommandsBucket, key)
+	if err != nil {
+		return x, errors.Wrap(err, "error while retrieving key from bucket")
+	}
+
+	err = json.Unmarshal(temp, &x)
+	if err != nil {
+		return x, errors.Wrap(err, "could not unmarshal teller command")
+	}
+	return x, nil
+}
+
+// RetrieveTellerCommands retrieves all commands sent to a project's teller
+func RetrieveTellerCommands(projIndex int) ([]TellerCommand, error) {
+	var arr []TellerCommand
+	x, err := edb.RetrieveAllKeys(consts.DbDir+consts.DbName, TellerCommandsBucket)
+	if err != nil {
+		return arr, errors.Wrap(err, "error while retrieving all keys")
+	}
+
+	for _, value := range x {
+		var temp TellerCommand
+		err := json.Unmarshal(value, &temp)
+		if err != nil {
+			return arr, errors.Wrap(err, "could not unmarshal teller command")
+		}
+		if temp.ProjIndex == projIndex {
+			arr = append(arr, temp)
+		}
+	}
+	return arr, nil
+}
+
+// contains returns true if arr contains elem
+func contains(arr []string, elem string) bool {
+	for _, x := range arr {
+		if x == elem {
+			return true
+		}
+	}
+	return false
+}
+
+// NewTellerCommand queues a config change or command for a project's teller
+func NewTellerCommand(projIndex int, kind string, name string, value string, createdBy string) (TellerCommand, error) {
+	var a TellerCommand
+
+	switch kind {
+	case TellerKindConfig:
+		if !contains(TellerConfigKeys, name) {
+			return a, errors.New("config key not recognized")
+		}
+		if value == "" {
+			return a, errors.New("config value can't be empty")
+		}
+	case TellerKindCommand:
+		if !contains(TellerCommands, name) {
+			return a, errors.New("command not recognized")
+		}
+	default:
+		return a, errors.New("kind must be config or command")
+	}
+
+	_, err := RetrieveProject(projIndex)
+	if err != nil {
+		return a, errors.Wrap(err, "couldn't retrieve project")
+	}
+
+	x, err := edb.RetrieveAllKeys(consts.DbDir+consts.DbName, TellerCommandsBucket)
+	if err != nil {
+		return a, errors.Wrap(err, "error while retrieving all keys")
+	}
+
+	a.Index = len(x) + 1
+	a.ProjIndex = projIndex
+	a.Kind = kind
+	a.Name = name
+	a.Value = value
+	a.Status = TellerCmdPending
+	a.CreatedBy = createdBy
+	a.CreatedAt = utils.Unix()
+	return a, a.Save()
+}
+
+// DeliverTellerCommands returns the pending commands of a project's teller in the order they
+// were issued and marks them as delivered
+func DeliverTellerCommands(projIndex int) ([]TellerCommand, error) {
+	var arr []TellerCommand
+	all, err := RetrieveTellerCommands(projIndex)
+	if err != nil {
+		return arr, err
+	}
+
+	for _, cmd := range all {
+		if cmd.Status != TellerCmdPending {
+			continue
+		}
+		cmd.Status = TellerCmdDelivered
+		cmd.DeliveredAt = utils.Unix()
+		err = cmd.Save()
+		if err != nil {
+			return arr, errors.Wrap(err, "couldn't save teller command")
+		}
+		arr = append(arr, cmd)
+	}
+	return arr, nil
+}
+
+// AckTellerCommand records the result of a command reported by a project's teller
+func AckTellerCommand(index int, projIndex int, success bool, result string) (TellerCommand, error) {
+	cmd, err := RetrieveTellerCommand(index)
+	if err != nil {
+		return cmd, err
+	}
+
+	if cmd.ProjIndex != projIndex {
+		return cmd, errors.New("command was not sent to this project's teller")
+	}
+
+	if cmd.Status != TellerCmdDelivered {
+		return cmd, errors.New("command has not been delivered or has already been acknowledged")
+	}
+
+	cmd.Status = TellerCmdFailed
+	if success {
+		cmd.Status = TellerCmdDone
+	}
+	cmd.Result = result
+	cmd.AckedAt = utils.Unix()
+	return cmd, cmd.Save()
+}
@@ -0,0 +1,583 @@
+package core
+
+import (
+	"encoding/json"
+	"log"
+	"strconv"
+
+	"github.com/pkg/errors"
+
+	edb "github.com/Varunram/essentials/database"
+	utils "github.com/Varunram/essentials/utils"
+	xlm "github.com/Varunram/essentials/xlm"
+	build "github.com/stellar/go/txnbuild"
+
+	consts "github.com/YaleOpenLab/opensolar/consts"
+	notif "github.com/YaleOpenLab/opensolar/notif"
+)
+
+// withdrawals from a project's escrow go through a proposal. A developer in the project's waterfall
+// map requests funds, which builds an unsigned payment from the escrow to the developer. The
+// recipient, who holds one of the escrow's two signers, approves by signing the payment, ideally
+// client side, and the project's guarantor approves by signing its hash if the project requires it.
+// Once every required party has approved, the platform adds the second signature and submits the
+// payment. Any required party can reject the proposal and proposals that aren't approved in time
+// expire.
+
+// Withdrawal proposal statuses
+const (
+	WithdrawalPending   = "pending"
+	WithdrawalRejected  = "rejected"
+	WithdrawalExecuted  = "executed"
+	WithdrawalFailed    = "failed"
+	WithdrawalExpired   = "expired"
+	WithdrawalCancelled = "cancelled"
+)
+
+// Withdrawal approver roles
+const (
+	WithdrawalRecipient = "recipient"
+	WithdrawalGuarantor = "guarantor"
+)
+
+// WithdrawalApproval is the decision of an approver on a withdrawal proposal
+type WithdrawalApproval struct {
+	// Role is either recipient or guarantor
+	Role string
+	// UserIndex is the index of the approver
+	UserIndex int
+	// Approve is true if the approver approved the proposal and false if they rejected it
+	Approve bool
+	// Signature is the approver's base64 signature of the payment's hash
+	Signature string `json:",omitempty"`
+	// Comment is the approver's reason for their decision
+	Comment string `json:",omitempty"`
+	// Timestamp is the unix time of the decision
+	Timestamp int64
+}
+
+// WithdrawalEvent is an entry in the history of a withdrawal proposal
+type WithdrawalEvent struct {
+	// Timestamp is the unix time of the event
+	Timestamp int64
+	// UserIndex is the index of the user who caused the event, 0 for the platform
+	UserIndex int
+	// Action is what happened
+	Action string
+	// Detail is any further information about the event
+	Detail string `json:",omitempty"`
+}
+
+// WithdrawalProposal is a developer's request for funds from a project's escrow
+type WithdrawalProposal struct {
+	// Index is the index of the proposal in the database
+	Index int
+	// ProjIndex is the index of the project whose escrow the funds are withdrawn from
+	ProjIndex int
+	// EntityIndex is the index of the developer who requested the funds
+	EntityIndex int
+	// Destination is the public key the funds are paid to
+	Destination string
+	// Amount is the amount in USD requested
+	Amount float64
+	// Status is one of pending, rejected, executed, failed, expired or cancelled
+	Status string
+	// Required are the roles that must approve the proposal before it's executed
+	Required []string
+	// Approvals are the decisions of the approvers
+	Approvals []WithdrawalApproval
+	// TxXDR is the unsigned payment from the escrow that approvers sign
+	TxXDR string
+	// TxHash is the hex hash of the payment that approvers sign
+	TxHash string
+	// SubmittedHash is the hash of the submitted payment on the ledger
+	SubmittedHash string `json:",omitempty"`
+	// Error is set if the payment couldn't be submitted
+	Error string `json:",omitempty"`
+	// CreatedAt is the unix time at which the proposal was made
+	CreatedAt int64
+	// ExpiresAt is the unix time after which the payment can't be submitted
+	ExpiresAt int64
+	// History is the history of the proposal
+	History []WithdrawalEvent
+}
+
+// withdrawalLocks serializes decisions on each proposal
+var withdrawalLocks keyedLock
+
+// WithdrawalBucket is the bucket where withdrawal proposals are stored
+var WithdrawalBucket = []byte("Withdrawals")
+
+// Save inserts a passed WithdrawalProposal object into the database
+func (a *WithdrawalProposal) Save() error {
+	return edb.Save(consts.DbDir+consts.DbName, WithdrawalBucket, a, a.Index)
+}
+
+// RetrieveWithdrawal retrieves a withdrawal proposal from the database
+func RetrieveWithdrawal(key int) (WithdrawalProposal, error) {
+	var x WithdrawalProposal
+	temp, err := edb.Retrieve(consts.DbDir+consts.DbName, WithdrawalBucket, key)
+	if err != nil {
+		return x, errors.Wrap(err, "error while retrieving key from bucket")
+	}
+
+	err = json.Unmarshal(temp, &x)
+	if err != nil {
+		return x, errors.Wrap(err, "could not unmarshal withdrawal proposal")
+	}
+	if x.Index == 0 {
+		return x, errors.New("withdrawal proposal not found")
+	}
+	if x.expire(utils.Unix()) {
+		err = x.Save()
+		if err != nil {
+			return x, err
+		}
+	}
+	return x, nil
+}
+
+// RetrieveWithdrawals retrieves the withdrawal proposals of a project, or all proposals if projIndex is 0
+func RetrieveWithdrawals(projIndex int) ([]WithdrawalProposal, error) {
+	var arr []WithdrawalProposal
+	x, err := edb.RetrieveAllKeys(consts.DbDir+consts.DbName, WithdrawalBucket)
+	if err != nil {
+		return arr, errors.Wrap(err, "error while retrieving all keys")
+	}
+
+	now := utils.Unix()
+	for _, value := range x {
+		var temp WithdrawalProposal
+		err := json.Unmarshal(value, &temp)
+		if err != nil {
+			return arr, errors.Wrap(err, "could not unmarshal withdrawal proposal")
+		}
+		if projIndex != 0 && temp.ProjIndex != projIndex {
+			continue
+		}
+		if temp.expire(now) {
+			err = temp.Save()
+			if err != nil {
+				return arr, err
+			}
+		}
+		arr = append(arr, temp)
+	}
+	return arr, nil
+}
+
+// event adds an event to the history of a proposal
+func (a *WithdrawalProposal) event(now int64, userIndex int, action string, detail string) {
+	a.History = append(a.History, WithdrawalEvent{Timestamp: now, UserIndex: userIndex, Action: action, Detail: detail})
+}
+
+// expire marks a pending proposal as expired if it wasn't approved in time. Approved proposals
+// whose payment couldn't be confirmed are looked up on horizon instead, since the payment can't
+// land after its time bounds. Returns true if the proposal changed
+func (a *WithdrawalProposal) expire(now int64) bool {
+	if a.Status != WithdrawalPending || now <= a.ExpiresAt {
+		return false
+	}
+
+	if a.approved() {
+		landed, err := fetchTx(a.TxHash)
+		if err != nil {
+			log.Println("could not look up withdrawal", a.Index, err)
+			return false
+		}
+		if landed {
+			a.Status, a.SubmittedHash, a.Error = WithdrawalExecuted, a.TxHash, ""
+			a.event(now, 0, "executed", a.TxHash)
+		} else {
+			a.Status = WithdrawalFailed
+			a.event(now, 0, "failed", a.Error)
+		}
+		return true
+	}
+
+	a.Status = WithdrawalExpired
+	a.event(now, 0, "expired", "")
+	return true
+}
+
+// approval returns the decision of the given role on the proposal
+func (a *WithdrawalProposal) approval(role string) (WithdrawalApproval, bool) {
+	for _, elem := range a.Approvals {
+		if elem.Role == role {
+			return elem, true
+		}
+	}
+	return WithdrawalApproval{}, false
+}
+
+// approved returns true if every required role has approved the proposal
+func (a *WithdrawalProposal) approved() bool {
+	for _, role := range a.Required {
+		elem, ok := a.approval(role)
+		if !ok || !elem.Approve {
+			return false
+		}
+	}
+	return true
+}
+
+// withdrawalApprovers returns the roles that must approve withdrawals from a project's escrow
+func withdrawalApprovers(project Project) []string {
+	roles := []string{WithdrawalRecipient}
+	if project.GuarantorApproval && project.GuarantorIndex != 0 {
+		roles = append(roles, WithdrawalGuarantor)
+	}
+	return roles
+}
+
+// withdrawn returns the amount paid or pending payment to a public key from a project's escrow
+func withdrawn(proposals []WithdrawalProposal, projIndex int, pubkey string) float64 {
+	var sum float64
+	for _, elem := range proposals {
+		if elem.ProjIndex != projIndex || elem.Destination != pubkey {
+			continue
+		}
+		if elem.Status == WithdrawalPending || elem.Status == WithdrawalExecuted {
+			sum += elem.Amount
+		}
+	}
+	return sum
+}
+
+// buildWithdrawalTx builds the unsigned payment of a withdrawal from a project's escrow. Returns
+// the payment's xdr and hex hash
+func buildWithdrawalTx(project Project, destination string, amount float64, memo string, expiresAt int64) (string, string, error) {
+	sourceAccount, err := xlm.ReturnSourceAccountPubkey(project.EscrowPubkey)
+	if err != nil {
+		return "", "", errors.Wrap(err, "couldn't load escrow account")
+	}
+
+	code, assetIssuer := escrowAsset()
+	payment := build.Payment{
+		Destination: destination,
+		Amount:      strconv.FormatFloat(amount, 'f', 7, 64),
+		Asset:       build.CreditAsset{Code: code, Issuer: assetIssuer},
+	}
+
+	tx, err := build.NewTransaction(build.TransactionParams{
+		SourceAccount:        &sourceAccount,
+		Operations:           []build.Operation{&payment},
+		Timebounds:           build.NewTimebounds(0, expiresAt),
+		Memo:                 build.MemoText(memo),
+		IncrementSequenceNum: true,
+		BaseFee:              1000,
+	})
+	if err != nil {
+		return "", "", errors.Wrap(err, "couldn't build withdrawal")
+	}
+
+	txXDR, err := tx.Base64()
+	if err != nil {
+		return "", "", err
+	}
+	txHash, err := tx.HashHex(xlm.Passphrase)
+	if err != nil {
+		return "", "", err
+	}
+	return txXDR, txHash, nil
+}
+
+// RequestWaterfallWithdrawal proposes the withdrawal of funds from a project's escrow to a
+// developer in its waterfall map. The developer can withdraw up to their allotment, less what
+// has already been paid or is pending. The recipient and, if required, the guarantor are notified
+// to approve the proposal
+func RequestWaterfallWithdrawal(entityIndex int, projIndex int, amount float64) (WithdrawalProposal, error) {
+	var a WithdrawalProposal
+	if amount <= 0 {
+		return a, errors.New("amount must be positive")
+	}
+
+	entity, err := RetrieveEntity(entityIndex)
+	if err != nil {
+		return a, errors.Wrap(err, "couldn't retrieve entity")
+	}
+
+	project, err := RetrieveProject(projIndex)
+	if err != nil {
+		return a, errors.Wrap(err, "couldn't retrieve project")
+	}
+
+	if project.AdminFlagged {
+		log.Println("project: ", projIndex, " has been flagged by admin")
+		return a, errors.New("project flagged, can't withdraw")
+	}
+	if project.EscrowPubkey == "" {
+		return a, errors.New("project doesn't have an escrow")
+	}
+
+	pubkey := entity.U.StellarWallet.PublicKey
+	allotted, ok := project.WaterfallMap[pubkey]
+	if !ok {
+		return a, errors.New("developer not found in the project's waterfall map")
+	}
+
+	proposals, err := RetrieveWithdrawals(projIndex)
+	if err != nil {
+		return a, err
+	}
+	for _, elem := range proposals {
+		if elem.Status == WithdrawalPending {
+			return a, errors.New("project already has a pending withdrawal: " + strconv.Itoa(elem.Index))
+		}
+	}
+	if remaining := allotted - withdrawn(proposals, projIndex, pubkey); amount > remaining {
+		return a, errors.New("amount requested greater than the remaining allotment of " + strconv.FormatFloat(remaining, 'f', 2, 64))
+	}
+
+	code, _ := escrowAsset()
+	if balance := xlm.GetAssetBalance(project.EscrowPubkey, code); balance < amount {
+		return a, errors.New("sufficient amount not available in escrow")
+	}
+
+	all, err := RetrieveWithdrawals(0)
+	if err != nil {
+		return a, err
+	}
+
+	now := utils.Unix()
+	a.Index = len(all) + 1
+	a.ProjIndex = projIndex
+	a.EntityIndex = entityIndex
+	a.Destination = pubkey
+	a.Amount = amount
+	a.Status = WithdrawalPending
+	a.Required = withdrawalApprovers(project)
+	a.CreatedAt = now
+	a.ExpiresAt = now + consts.WithdrawalExpiry
+
+	a.TxXDR, a.TxHash, err = buildWithdrawalTx(project, pubkey, amount, "withdrawal: "+strconv.Itoa(a.Index), a.ExpiresAt)
+	if err != nil {
+		return a, err
+	}
+	a.event(now, entityIndex, "requested", strconv.FormatFloat(amount, 'f', 2, 64)+" USD")
+
+	err = a.Save()
+	if err != nil {
+		return a, err
+	}
+
+	a.notifyApprovers(project)
+	return a, nil
+}
+
+// notifyApprovers emails the approvers of a proposal
+func (a *WithdrawalProposal) notifyApprovers(project Project) {
+	recipient, err := RetrieveRecipient(project.RecipientIndex)
+	if err == nil && recipient.U.Email != "" {
+		err = notif.SendWithdrawalProposalEmail(project.Index, recipient.U.Email, a.Index, a.Amount)
+		if err != nil {
+			log.Println(err)
+		}
+	}
+	for _, role := range a.Required {
+		if role != WithdrawalGuarantor {
+			continue
+		}
+		guarantor, err := RetrieveEntity(project.GuarantorIndex)
+		if err == nil && guarantor.U.Email != "" {
+			err = notif.SendWithdrawalProposalEmail(project.Index, guarantor.U.Email, a.Index, a.Amount)
+			if err != nil {
+				log.Println(err)
+			}
+		}
+	}
+}
+
+// decide records an approver's decision on a pending proposal
+func (a *WithdrawalProposal) decide(role string, userIndex int, approve bool, signature string, comment string, now int64) error {
+	if a.Status != WithdrawalPending {
+		return errors.New("proposal is " + a.Status)
+	}
+	required := false
+	for _, elem := range a.Required {
+		if elem == role {
+			required = true
+		}
+	}
+	if !required {
+		return errors.New("the " + role + " is not an approver of this proposal")
+	}
+	if _, ok := a.approval(role); ok {
+		return errors.New("the " + role + " has already decided on this proposal")
+	}
+
+	a.Approvals = append(a.Approvals, WithdrawalApproval{Role: role, UserIndex: userIndex, Approve: approve,
+		Signature: signature, Comment: comment, Timestamp: now})
+	if approve {
+		a.event(now, userIndex, "approved", role)
+	} else {
+		a.Status = WithdrawalRejected
+		a.event(now, userIndex, "rejected", role+": "+comment)
+	}
+	return nil
+}
+
+// ApproveWithdrawalRecipient records the recipient's decision on a withdrawal proposal. An
+// approval must carry the recipient's signature of the payment, either as a client signed xdr or
+// a base64 signature of its hash
+func ApproveWithdrawalRecipient(index int, recpIndex int, approve bool, signedXDR string, signature string,
+	comment string) (WithdrawalProposal, error) {
+	unlock := withdrawalLocks.lock(index)
+	defer unlock()
+
+	a, err := RetrieveWithdrawal(index)
+	if err != nil {
+		return a, err
+	}
+	project, err := RetrieveProject(a.ProjIndex)
+	if err != nil {
+		return a, errors.Wrap(err, "couldn't retrieve project")
+	}
+	if project.RecipientIndex != recpIndex {
+		return a, errors.New("recipient is not the recipient of this project")
+	}
+	recipient, err := RetrieveRecipient(recpIndex)
+	if err != nil {
+		return a, errors.Wrap(err, "couldn't retrieve recipient")
+	}
+
+	if approve {
+		pubkey := recipient.U.StellarWallet.PublicKey
+		switch {
+		case signedXDR != "":
+			signature, err = extractSignature(a.TxXDR, pubkey, signedXDR)
+		case signature != "":
+			err = verifySignature(a.TxXDR, pubkey, signature)
+		default:
+			err = errors.New("approval must be signed")
+		}
+		if err != nil {
+			return a, err
+		}
+	}
+
+	return a.decideAndExecute(WithdrawalRecipient, recpIndex, approve, signature, comment)
+}
+
+// ApproveWithdrawalGuarantor records the guarantor's decision on a withdrawal proposal. An
+// approval must carry the guarantor's base64 signature of the payment's hash. The guarantor isn't
+// a signer of the escrow so their signature is kept as evidence and not added to the payment
+func ApproveWithdrawalGuarantor(index int, entityIndex int, approve bool, signature string, comment string) (WithdrawalProposal, error) {
+	unlock := withdrawalLocks.lock(index)
+	defer unlock()
+
+	a, err := RetrieveWithdrawal(index)
+	if err != nil {
+		return a, err
+	}
+	project, err := RetrieveProject(a.ProjIndex)
+	if err != nil {
+		return a, errors.Wrap(err, "couldn't retrieve project")
+	}
+	if project.GuarantorIndex != entityIndex {
+		return a, errors.New("entity is not the guarantor of this project")
+	}
+	guarantor, err := RetrieveEntity(entityIndex)
+	if err != nil {
+		return a, errors.Wrap(err, "couldn't retrieve guarantor")
+	}
+
+	if approve {
+		if signature == "" {
+			return a, errors.New("approval must be signed")
+		}
+		err = verifySignature(a.TxXDR, guarantor.U.StellarWallet.PublicKey, signature)
+		if err != nil {
+			return a, err
+		}
+	}
+
+	return a.decideAndExecute(WithdrawalGuarantor, entityIndex, approve, signature, comment)
+}
+
+// decideAndExecute records a decision and executes the proposal once every required role has
+// approved it. Callers hold the proposal's lock from the time they retrieve it
+func (a *WithdrawalProposal) decideAndExecute(role string, userIndex int, approve bool, signature string,
+	comment string) (WithdrawalProposal, error) {
+	err := a.decide(role, userIndex, approve, signature, comment, utils.Unix())
+	if err != nil {
+		return *a, err
+	}
+	if a.approved() {
+		a.execute()
+	}
+	return *a, a.Save()
+}
+
+// execute adds the recipient's and platform's signatures to the payment and submits it
+func (a *WithdrawalProposal) execute() {
+	now := utils.Unix()
+	txhash, err := a.submit()
+	if err != nil {
+		log.Println("could not submit withdrawal", a.Index, err)
+		a.Error = err.Error()
+
+		// the payment has a fixed sequence number, so it's safe to look it up by its hash
+		landed, lerr := fetchTx(a.TxHash)
+		if lerr != nil {
+			// leave the proposal pending so that it is looked up again once it expires
+			a.event(now, 0, "unconfirmed", err.Error())
+			return
+		}
+		if !landed {
+			a.Status = WithdrawalFailed
+			a.event(now, 0, "failed", err.Error())
+			return
+		}
+		txhash = a.TxHash
+	}
+	a.Status, a.SubmittedHash, a.Error = WithdrawalExecuted, txhash, ""
+	a.event(now, 0, "executed", txhash)
+}
+
+// submit signs the payment with the recipient's approval and the platform's seed and submits it
+func (a *WithdrawalProposal) submit() (string, error) {
+	approval, ok := a.approval(WithdrawalRecipient)
+	if !ok || !approval.Approve {
+		return "", errors.New("recipient hasn't approved the withdrawal")
+	}
+	recipient, err := RetrieveRecipient(approval.UserIndex)
+	if err != nil {
+		return "", errors.Wrap(err, "couldn't retrieve recipient")
+	}
+
+	return submitSigned(a.TxXDR, recipient.U.StellarWallet.PublicKey, approval.Signature, true)
+}
+
+// CancelWithdrawal cancels a pending withdrawal proposal. Only the developer who requested it can cancel it
+func CancelWithdrawal(index int, entityIndex int) (WithdrawalProposal, error) {
+	unlock := withdrawalLocks.lock(index)
+	defer unlock()
+
+	a, err := RetrieveWithdrawal(index)
+	if err != nil {
+		return a, err
+	}
+	if a.EntityIndex != entityIndex {
+		return a, errors.New("only the developer who requested the withdrawal can cancel it")
+	}
+	if a.Status != WithdrawalPending {
+		return a, errors.New("proposal is " + a.Status)
+	}
+	a.Status = WithdrawalCancelled
+	a.event(utils.Unix(), entityIndex, "cancelled", "")
+	return a, a.Save()
+}
+
+// SetWithdrawalPolicy sets whether the guarantor of a project must approve withdrawals from its escrow
+func SetWithdrawalPolicy(projIndex int, guarantor bool) error {
+	project, err := RetrieveProject(projIndex)
+	if err != nil {
+		return errors.Wrap(err, "couldn't retrieve project")
+	}
+	if guarantor && project.GuarantorIndex == 0 {
+		return errors.New("project doesn't have a guarantor")
+	}
+	project.GuarantorApproval = guarantor
+	return project.Save()
+}
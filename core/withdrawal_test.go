@@ -0,0 +1,92 @@
+// +build all travis
+
+package core
+
+import (
+	"testing"
+
+	xlm "github.com/Varunram/essentials/xlm"
+	"github.com/stellar/go/keypair"
+	build "github.com/stellar/go/txnbuild"
+)
+
+func TestWithdrawalSignatures(t *testing.T) {
+	xlm.SetConsts(0, false)
+	escrow, _ := keypair.Random()
+	recipient, _ := keypair.Random()
+	other, _ := keypair.Random()
+
+	tx, err := build.NewTransaction(build.TransactionParams{
+		SourceAccount: &build.SimpleAccount{AccountID: escrow.Address(), Sequence: 1},
+		Operations: []build.Operation{&build.Payment{Destination: other.Address(), Amount: "10",
+			Asset: build.CreditAsset{Code: "STABLEUSD", Issuer: escrow.Address()}}},
+		Timebounds: build.NewTimebounds(0, 1000),
+		BaseFee:    1000,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	txXDR, err := tx.Base64()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	signature, err := signTx(txXDR, recipient.Seed())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if verifySignature(txXDR, recipient.Address(), signature) != nil {
+		t.Fatal("recipient signature not verified")
+	}
+	if verifySignature(txXDR, other.Address(), signature) == nil {
+		t.Fatal("signature verified against the wrong key")
+	}
+
+	signed, err := tx.Sign(xlm.Passphrase, recipient)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signedXDR, err := signed.Base64()
+	if err != nil {
+		t.Fatal(err)
+	}
+	extracted, err := extractSignature(txXDR, recipient.Address(), signedXDR)
+	if err != nil || extracted != signature {
+		t.Fatal("signature not extracted from signed transaction", err)
+	}
+	_, err = extractSignature(txXDR, other.Address(), signedXDR)
+	if err == nil {
+		t.Fatal("signature of the wrong key extracted")
+	}
+}
+
+func TestWithdrawalDecisions(t *testing.T) {
+	a := WithdrawalProposal{ProjIndex: 1, Destination: "A", Amount: 40, Status: WithdrawalPending,
+		Required: []string{WithdrawalRecipient, WithdrawalGuarantor}, ExpiresAt: 100}
+
+	err := a.decide(WithdrawalRecipient, 1, true, "sig", "", 10)
+	if err != nil || a.approved() {
+		t.Fatal("proposal approved without the guarantor", err)
+	}
+	if a.decide(WithdrawalRecipient, 1, true, "sig", "", 11) == nil {
+		t.Fatal("recipient decided twice")
+	}
+	err = a.decide(WithdrawalGuarantor, 2, true, "sig", "", 12)
+	if err != nil || !a.approved() {
+		t.Fatal("proposal not approved", err)
+	}
+
+	proposals := []WithdrawalProposal{a, {ProjIndex: 1, Destination: "A", Amount: 10, Status: WithdrawalRejected},
+		{ProjIndex: 1, Destination: "A", Amount: 5, Status: WithdrawalExecuted}, {ProjIndex: 2, Destination: "A", Amount: 5}}
+	if withdrawn(proposals, 1, "A") != 45 {
+		t.Fatal("wrong amount withdrawn")
+	}
+
+	b := WithdrawalProposal{Status: WithdrawalPending, Required: []string{WithdrawalRecipient}, ExpiresAt: 100}
+	if b.decide(WithdrawalGuarantor, 2, true, "", "", 10) == nil {
+		t.Fatal("guarantor decided on a proposal it isn't an approver of")
+	}
+	if !b.expire(101) || b.Status != WithdrawalExpired || len(b.History) != 1 {
+		t.Fatal("proposal not expired")
+	}
+}
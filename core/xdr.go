@@ -0,0 +1,151 @@
+package core
+
+import (
+	"encoding/base64"
+	"net/url"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	xlm "github.com/Varunram/essentials/xlm"
+	multisig "github.com/Varunram/essentials/xlm/multisig"
+	"github.com/stellar/go/keypair"
+	build "github.com/stellar/go/txnbuild"
+
+	consts "github.com/YaleOpenLab/opensolar/consts"
+	keys "github.com/YaleOpenLab/opensolar/keys"
+)
+
+// helpers for transactions that are signed outside the platform. The platform builds an unsigned
+// envelope, the signer returns either a signed copy of the envelope or a signature of its hash,
+// and the platform checks the signature against the envelope it built before adding its own
+// signature where needed and submitting it.
+
+// parseTx parses the xdr of a transaction envelope
+func parseTx(txXDR string) (*build.Transaction, error) {
+	gtx, err := build.TransactionFromXDR(txXDR)
+	if err != nil {
+		return nil, errors.Wrap(err, "couldn't parse transaction")
+	}
+	tx, ok := gtx.Transaction()
+	if !ok {
+		return nil, errors.New("fee bump transactions are not supported")
+	}
+	return tx, nil
+}
+
+// verifySignature checks that signature is the base64 signature of pubkey on the transaction
+func verifySignature(txXDR string, pubkey string, signature string) error {
+	tx, err := parseTx(txXDR)
+	if err != nil {
+		return err
+	}
+	_, err = tx.AddSignatureBase64(xlm.Passphrase, pubkey, signature)
+	if err != nil {
+		return errors.Wrap(err, "invalid signature")
+	}
+	return nil
+}
+
+// extractSignature returns the base64 signature of pubkey from a client signed copy of the transaction
+func extractSignature(txXDR string, pubkey string, signedXDR string) (string, error) {
+	tx, err := parseTx(txXDR)
+	if err != nil {
+		return "", err
+	}
+	signed, err := parseTx(signedXDR)
+	if err != nil {
+		return "", err
+	}
+
+	hash, err := tx.HashHex(xlm.Passphrase)
+	if err != nil {
+		return "", err
+	}
+	signedHash, err := signed.HashHex(xlm.Passphrase)
+	if err != nil {
+		return "", err
+	}
+	if hash != signedHash {
+		return "", errors.New("signed transaction doesn't match the transaction to be signed")
+	}
+
+	kp, err := keypair.ParseAddress(pubkey)
+	if err != nil {
+		return "", err
+	}
+	for _, sig := range signed.Signatures() {
+		if sig.Hint != kp.Hint() {
+			continue
+		}
+		signature := base64.StdEncoding.EncodeToString(sig.Signature)
+		if verifySignature(txXDR, pubkey, signature) == nil {
+			return signature, nil
+		}
+	}
+	return "", errors.New("transaction not signed by " + pubkey)
+}
+
+// signTx signs the hash of the transaction with a seed and returns the base64 signature
+func signTx(txXDR string, seed string) (string, error) {
+	tx, err := parseTx(txXDR)
+	if err != nil {
+		return "", err
+	}
+	kp, err := keypair.ParseFull(seed)
+	if err != nil {
+		return "", errors.Wrap(err, "couldn't parse seed")
+	}
+	hash, err := tx.Hash(xlm.Passphrase)
+	if err != nil {
+		return "", err
+	}
+	sig, err := kp.Sign(hash[:])
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(sig), nil
+}
+
+// submitSigned adds signature, the base64 signature of pubkey, to the transaction, co-signs it
+// with the platform's key if cosign is set and submits it. Returns the hash of the transaction
+func submitSigned(txXDR string, pubkey string, signature string, cosign bool) (string, error) {
+	tx, err := parseTx(txXDR)
+	if err != nil {
+		return "", err
+	}
+	tx, err = tx.AddSignatureBase64(xlm.Passphrase, pubkey, signature)
+	if err != nil {
+		return "", errors.Wrap(err, "invalid signature")
+	}
+
+	if cosign {
+		tx, err = keys.Key(keys.Platform).SignTx(tx)
+		if err != nil {
+			return "", errors.Wrap(err, "couldn't co-sign transaction")
+		}
+	}
+
+	txe, err := tx.Base64()
+	if err != nil {
+		return "", err
+	}
+	_, txhash, err := multisig.SendTx(txe)
+	return txhash, err
+}
+
+// sep7URI returns a SEP-7 uri that asks a wallet to sign the transaction, with msg shown to the signer
+func sep7URI(txXDR string, msg string) string {
+	params := url.Values{}
+	params.Set("xdr", txXDR)
+	if len(msg) > 300 {
+		msg = msg[:297] + "..."
+	}
+	if msg != "" {
+		params.Set("msg", msg)
+	}
+	if xlm.Passphrase != "" && !consts.Mainnet {
+		params.Set("network_passphrase", xlm.Passphrase)
+	}
+	return "web+stellar:tx?" + strings.Replace(params.Encode(), "+", "%20", -1)
+}
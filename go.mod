@@ -17,5 +17,6 @@ require (
 	github.com/spf13/viper v1.7.0
 	github.com/stellar/go v0.0.0-20200716182341-328413370fad
 	github.com/stretchr/testify v1.6.0 // indirect
+	golang.org/x/crypto v0.0.0-20200510223506-06a226fb4e37
 	gopkg.in/yaml.v3 v3.0.0-20200506231410-2ff61e1afc86 // indirect
 )
@@ -0,0 +1,120 @@
+package iot
+
+import (
+	"log"
+	"time"
+
+	"github.com/pkg/errors"
+
+	consts "github.com/YaleOpenLab/opensolar/consts"
+	core "github.com/YaleOpenLab/opensolar/core"
+)
+
+// StartIngestion streams readings from a project's provider into core.IngestReading and records
+// the device's pings in the fleet registry. A failed stream is restarted after
+// consts.ProviderRetryInterval from the latest reading that was ingested
+func StartIngestion(projIndex int) error {
+	project, err := core.RetrieveProject(projIndex)
+	if err != nil {
+		return errors.Wrap(err, "couldn't retrieve project")
+	}
+	if project.Terminated {
+		return errors.New("project has been terminated")
+	}
+
+	provider, err := ProjectProvider(project)
+	if err != nil {
+		return err
+	}
+
+	deviceID := project.ProviderDeviceID
+	stop := make(chan struct{})
+	readings := make(chan core.EnergyReading)
+	// replaces (and stops) any ingestion running for the project, including an MQTT subscriber
+	core.RegisterIngestion(projIndex, func() {
+		close(stop)
+	})
+
+	go func() {
+		for {
+			since, err := core.LatestEnergyTimestamp(projIndex, provider.Name())
+			if err != nil {
+				log.Println("could not retrieve latest reading of project", projIndex, err)
+			} else {
+				err = provider.StreamReadings(deviceID, since, readings, stop)
+				if err != nil {
+					log.Println("stream from", provider.Name(), "for project", projIndex, "failed", err)
+				}
+			}
+
+			select {
+			case <-stop:
+				return
+			case <-time.After(consts.ProviderRetryInterval):
+			}
+		}
+	}()
+
+	go func() {
+		for {
+			select {
+			case <-stop:
+				return
+			case reading := <-readings:
+				reading.Source = provider.Name()
+				if reading.DeviceID == "" {
+					reading.DeviceID = deviceID
+				}
+				err := core.IngestReading(projIndex, reading)
+				if err != nil {
+					log.Println("could not ingest reading for project", projIndex, err)
+				}
+			}
+		}
+	}()
+
+	go func() {
+		for {
+			select {
+			case <-stop:
+				return
+			case <-time.After(consts.FleetPingInterval):
+			}
+
+			device, err := provider.DeviceStatus(deviceID)
+			if err != nil {
+				log.Println("could not retrieve status of device", deviceID, err)
+				continue
+			}
+			if !device.Online {
+				continue
+			}
+			_, err = core.RecordHeartbeat(projIndex, core.FleetIoTHub, deviceID, device.Firmware, -1)
+			if err != nil {
+				log.Println("could not record heartbeat of device", deviceID, err)
+			}
+		}
+	}()
+
+	log.Println("started energy ingestion for project", projIndex, "from", provider.Name(), deviceID)
+	return nil
+}
+
+// StartAllIngestion starts ingestion for all projects that have chosen an IoT provider
+func StartAllIngestion() {
+	projects, err := core.RetrieveAllProjects()
+	if err != nil {
+		log.Println("could not retrieve projects for ingestion", err)
+		return
+	}
+
+	for _, project := range projects {
+		if project.DeviceProvider == "" || project.Terminated {
+			continue
+		}
+		err = StartIngestion(project.Index)
+		if err != nil {
+			log.Println("could not start ingestion for project", project.Index, err)
+		}
+	}
+}
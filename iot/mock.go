@@ -0,0 +1,146 @@
+package iot
+
+import (
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+
+	core "github.com/YaleOpenLab/opensolar/core"
+)
+
+// Mock is a local DeviceProvider used for testing and demos. Its devices are always online and
+// report a fixed value every interval
+type Mock struct {
+	// value is the energy reported in each reading
+	value uint32
+	// interval is the number of seconds between two readings
+	interval int64
+
+	lock     sync.Mutex
+	readings map[string][]core.EnergyReading
+}
+
+// mockDevices are the devices every mock provider has
+var mockDevices = []string{"mock-1", "mock-2", "mock-3"}
+
+// NewMock returns a mock provider. Takes the value of each reading (default: 100) and the
+// interval between readings in seconds (default: 60)
+func NewMock(config map[string]string) (DeviceProvider, error) {
+	a := &Mock{value: 100, interval: 60, readings: make(map[string][]core.EnergyReading)}
+
+	if config["value"] != "" {
+		value, err := strconv.ParseUint(config["value"], 10, 32)
+		if err != nil {
+			return nil, errors.Wrap(err, "could not parse mock value")
+		}
+		a.value = uint32(value)
+	}
+
+	if config["interval"] != "" {
+		interval, err := strconv.ParseInt(config["interval"], 10, 64)
+		if err != nil || interval <= 0 {
+			return nil, errors.New("mock interval must be a positive integer")
+		}
+		a.interval = interval
+	}
+	return a, nil
+}
+
+// Name returns the name of the provider
+func (a *Mock) Name() string {
+	return "mock"
+}
+
+// mockDevice returns the mock device with the given id
+func mockDevice(deviceID string) (Device, error) {
+	for _, id := range mockDevices {
+		if id == deviceID {
+			return Device{ID: id, Name: id, Provider: "mock", Online: true, Firmware: "mock",
+				Serial: id, LastSeen: time.Now().Unix()}, nil
+		}
+	}
+	return Device{}, errors.New("mock device not found")
+}
+
+// ListDevices lists the mock devices
+func (a *Mock) ListDevices() ([]Device, error) {
+	var arr []Device
+	for _, id := range mockDevices {
+		device, _ := mockDevice(id)
+		arr = append(arr, device)
+	}
+	return arr, nil
+}
+
+// DeviceStatus returns the status of a mock device
+func (a *Mock) DeviceStatus(deviceID string) (Device, error) {
+	return mockDevice(deviceID)
+}
+
+// Ping returns true for all mock devices
+func (a *Mock) Ping(deviceID string) (bool, error) {
+	_, err := mockDevice(deviceID)
+	return err == nil, err
+}
+
+// StreamReadings reports a reading every interval
+func (a *Mock) StreamReadings(deviceID string, since int64, out chan<- core.EnergyReading, stop <-chan struct{}) error {
+	_, err := mockDevice(deviceID)
+	if err != nil {
+		return err
+	}
+
+	for {
+		select {
+		case <-stop:
+			return nil
+		case <-time.After(time.Duration(a.interval) * time.Second):
+		}
+
+		reading := core.EnergyReading{Timestamp: time.Now().Unix(), Value: a.value, Unit: "Wh", DeviceID: deviceID}
+		a.lock.Lock()
+		a.readings[deviceID] = append(a.readings[deviceID], reading)
+		a.lock.Unlock()
+
+		select {
+		case out <- reading:
+		case <-stop:
+			return nil
+		}
+	}
+}
+
+// FetchEnergy returns the readings a mock device has streamed after since
+func (a *Mock) FetchEnergy(deviceID string, since int64) ([]core.EnergyReading, error) {
+	var arr []core.EnergyReading
+	_, err := mockDevice(deviceID)
+	if err != nil {
+		return arr, err
+	}
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	for _, reading := range a.readings[deviceID] {
+		if reading.Timestamp > since {
+			arr = append(arr, reading)
+		}
+	}
+	return arr, nil
+}
+
+// FetchAttributions returns a single attribution covering all readings a mock device has streamed
+func (a *Mock) FetchAttributions(deviceID string) ([]Attribution, error) {
+	readings, err := a.FetchEnergy(deviceID, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	var energy float64
+	for _, reading := range readings {
+		energy += float64(reading.Value)
+	}
+	return []Attribution{{ID: deviceID + "-attribution", DeviceID: deviceID, Energy: energy,
+		Period: "all", Timestamp: time.Now().Unix()}}, nil
+}
@@ -0,0 +1,265 @@
+package iot
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+
+	core "github.com/YaleOpenLab/opensolar/core"
+)
+
+// particleAPI is the base url of the particle cloud API
+var particleAPI = "https://api.particle.io/v1"
+
+// Particle is a DeviceProvider backed by the particle cloud. Devices publish readings as events
+// which are streamed over server sent events. Particle doesn't store event history, so readings
+// published while the stream is down are lost
+type Particle struct {
+	accessToken string
+	// event is the name of the event devices publish readings under
+	event string
+}
+
+// particleDevice is the subset of particle's device response that we need
+type particleDevice struct {
+	ID                    string `json:"id"`
+	Name                  string `json:"name"`
+	Connected             bool   `json:"connected"`
+	LastHeard             string `json:"last_heard"`
+	SerialNumber          string `json:"serial_number"`
+	SystemFirmwareVersion string `json:"system_firmware_version"`
+}
+
+// particlePing is particle's ping response
+type particlePing struct {
+	Online bool `json:"online"`
+	Ok     bool `json:"ok"`
+}
+
+// particleEvent is an event published by a particle device
+type particleEvent struct {
+	Data        string `json:"data"`
+	PublishedAt string `json:"published_at"`
+	Coreid      string `json:"coreid"`
+}
+
+// NewParticle returns a particle provider. Needs an accessToken and optionally the name of the
+// event devices publish readings under (default: energy)
+func NewParticle(config map[string]string) (DeviceProvider, error) {
+	a := &Particle{accessToken: config["accessToken"], event: config["event"]}
+	if a.event == "" {
+		a.event = "energy"
+	}
+	return a, nil
+}
+
+// Name returns the name of the provider
+func (a *Particle) Name() string {
+	return "particle"
+}
+
+// particleRequest sends a request to the particle cloud with the access token in the
+// authorization header so that it doesn't end up in urls and access logs
+func (a *Particle) particleRequest(method string, url string) (*http.Response, error) {
+	req, err := http.NewRequest(method, url, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Add("authorization", "Bearer "+a.accessToken)
+	return http.DefaultClient.Do(req)
+}
+
+// call sends an authenticated request to the particle cloud and returns the response body
+func (a *Particle) call(method string, url string) ([]byte, error) {
+	res, err := a.particleRequest(method, url)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	data, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if res.StatusCode != http.StatusOK {
+		return nil, errors.New("particle returned status " + res.Status)
+	}
+	return data, nil
+}
+
+// device converts a particle device to a Device
+func (x particleDevice) device() Device {
+	var lastSeen int64
+	t, err := time.Parse(time.RFC3339, x.LastHeard)
+	if err == nil {
+		lastSeen = t.Unix()
+	}
+
+	return Device{
+		ID:       x.ID,
+		Name:     x.Name,
+		Provider: "particle",
+		Online:   x.Connected,
+		Firmware: x.SystemFirmwareVersion,
+		Serial:   x.SerialNumber,
+		LastSeen: lastSeen,
+	}
+}
+
+// ListDevices lists all devices registered to the holder of the access token
+func (a *Particle) ListDevices() ([]Device, error) {
+	var arr []Device
+	data, err := a.call("GET", particleAPI+"/devices")
+	if err != nil {
+		return arr, errors.Wrap(err, "could not list particle devices")
+	}
+
+	var x []particleDevice
+	err = json.Unmarshal(data, &x)
+	if err != nil {
+		return arr, errors.Wrap(err, "could not unmarshal particle devices")
+	}
+
+	for _, device := range x {
+		arr = append(arr, device.device())
+	}
+	return arr, nil
+}
+
+// DeviceStatus returns the current status of a device
+func (a *Particle) DeviceStatus(deviceID string) (Device, error) {
+	data, err := a.call("GET", particleAPI+"/devices/"+deviceID)
+	if err != nil {
+		return Device{}, errors.Wrap(err, "could not retrieve particle device")
+	}
+
+	var x particleDevice
+	err = json.Unmarshal(data, &x)
+	if err != nil {
+		return Device{}, errors.Wrap(err, "could not unmarshal particle device")
+	}
+	if x.ID == "" {
+		return Device{}, errors.New("particle device not found")
+	}
+	return x.device(), nil
+}
+
+// Ping pings a device through the particle cloud
+func (a *Particle) Ping(deviceID string) (bool, error) {
+	data, err := a.call("PUT", particleAPI+"/devices/"+deviceID+"/ping")
+	if err != nil {
+		return false, errors.Wrap(err, "could not ping particle device")
+	}
+
+	var x particlePing
+	err = json.Unmarshal(data, &x)
+	if err != nil {
+		return false, errors.Wrap(err, "could not unmarshal ping response")
+	}
+	return x.Ok && x.Online, nil
+}
+
+// parseParticleEvent converts an event to a reading. Event data is either an energy payload or a
+// plain number
+func parseParticleEvent(event particleEvent) (core.EnergyReading, error) {
+	reading, err := core.ParseEnergyPayload([]byte(event.Data))
+	if err != nil {
+		value, err := strconv.ParseUint(strings.TrimSpace(event.Data), 10, 32)
+		if err != nil {
+			return reading, errors.New("event data is neither an energy payload nor a number")
+		}
+		reading = core.EnergyReading{Value: uint32(value)}
+
+		t, err := time.Parse(time.RFC3339, event.PublishedAt)
+		if err == nil {
+			reading.Timestamp = t.Unix()
+		} else {
+			reading.Timestamp = time.Now().Unix()
+		}
+	}
+
+	if reading.DeviceID == "" {
+		reading.DeviceID = event.Coreid
+	}
+	return reading, nil
+}
+
+// StreamReadings streams a device's events over server sent events. since is ignored since
+// particle can't replay past events
+func (a *Particle) StreamReadings(deviceID string, since int64, out chan<- core.EnergyReading, stop <-chan struct{}) error {
+	body := particleAPI + "/devices/" + deviceID + "/events/" + url.PathEscape(a.event)
+	resp, err := a.particleRequest("GET", body)
+	if err != nil {
+		return errors.Wrap(err, "could not open particle event stream")
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return errors.New("particle event stream returned status " + resp.Status)
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		// unblock the scanner when ingestion is stopped
+		select {
+		case <-stop:
+			resp.Body.Close()
+		case <-done:
+		}
+	}()
+
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if !strings.HasPrefix(line, "data:") {
+			continue // event names, keepalives and blank separators
+		}
+
+		var event particleEvent
+		err = json.Unmarshal([]byte(strings.TrimSpace(line[5:])), &event)
+		if err != nil {
+			continue
+		}
+
+		reading, err := parseParticleEvent(event)
+		if err != nil {
+			continue
+		}
+
+		select {
+		case out <- reading:
+		case <-stop:
+			return nil
+		}
+	}
+
+	select {
+	case <-stop:
+		return nil
+	default:
+	}
+	if scanner.Err() != nil {
+		return errors.Wrap(scanner.Err(), "particle event stream failed")
+	}
+	return errors.New("particle event stream closed")
+}
+
+// FetchEnergy isn't supported since particle doesn't store event history
+func (a *Particle) FetchEnergy(deviceID string, since int64) ([]core.EnergyReading, error) {
+	return nil, ErrUnsupported
+}
+
+// FetchAttributions isn't supported by particle
+func (a *Particle) FetchAttributions(deviceID string) ([]Attribution, error) {
+	return nil, ErrUnsupported
+}
@@ -0,0 +1,181 @@
+package iot
+
+import (
+	"encoding/json"
+	"sort"
+
+	"github.com/pkg/errors"
+
+	core "github.com/YaleOpenLab/opensolar/core"
+	keys "github.com/YaleOpenLab/opensolar/keys"
+)
+
+// projects choose the IoT provider that their devices report to. Each provider is wrapped behind
+// DeviceProvider so that the platform can list, ping and read from devices without knowing whose
+// cloud they're on, and readings from every provider end up in core.IngestReading.
+
+// ErrUnsupported is returned by providers for operations their API doesn't offer
+var ErrUnsupported = errors.New("operation not supported by provider")
+
+// Device is a device (or asset) registered on a provider's platform
+type Device struct {
+	// ID is the id of the device on the provider's platform
+	ID string
+	// Name is the name given to the device
+	Name string
+	// Provider is the name of the provider the device is registered with
+	Provider string
+	// Online is true if the provider reports the device as connected
+	Online bool
+	// Firmware is the firmware version running on the device
+	Firmware string
+	// Serial is the serial number of the device
+	Serial string
+	// LastSeen is the unix time at which the provider last heard from the device
+	LastSeen int64
+}
+
+// Attribution is a record of energy produced by a device and attributed to its owner by a provider
+type Attribution struct {
+	// ID is the id of the attribution on the provider's platform
+	ID string
+	// DeviceID is the id of the device that produced the energy
+	DeviceID string
+	// Energy is the energy produced in the attribution period
+	Energy float64
+	// CarbonOffset is the carbon offset the provider credits for the energy
+	CarbonOffset float64
+	// Period is the production period as reported by the provider
+	Period string
+	// Timestamp is the unix time at which the attribution was made
+	Timestamp int64
+	// Claimed is true if the attribution has been claimed by its holder
+	Claimed bool
+}
+
+// DeviceProvider is an IoT platform that a project's devices report to
+type DeviceProvider interface {
+	// Name returns the name of the provider
+	Name() string
+	// ListDevices lists all devices the provider's credentials have access to
+	ListDevices() ([]Device, error)
+	// DeviceStatus returns the current status of a device
+	DeviceStatus(deviceID string) (Device, error)
+	// Ping checks whether a device is online
+	Ping(deviceID string) (bool, error)
+	// StreamReadings sends readings reported by a device after since to out until stop is closed
+	// or the stream fails
+	StreamReadings(deviceID string, since int64, out chan<- core.EnergyReading, stop <-chan struct{}) error
+	// FetchEnergy returns readings reported by a device after since
+	FetchEnergy(deviceID string, since int64) ([]core.EnergyReading, error)
+	// FetchAttributions returns the energy attributions made for a device
+	FetchAttributions(deviceID string) ([]Attribution, error)
+}
+
+// providerSetup describes how to build a provider and the config keys it takes
+type providerSetup struct {
+	required []string
+	optional []string
+	new      func(config map[string]string) (DeviceProvider, error)
+}
+
+// providers maps each provider name to its setup
+var providers = map[string]providerSetup{
+	"particle": {[]string{"accessToken"}, []string{"event"}, NewParticle},
+	"swytch":   {[]string{"clientId", "clientSecret", "susername", "spassword"}, nil, NewSwytch},
+	"mock":     {nil, []string{"value", "interval"}, NewMock},
+}
+
+// Providers returns the names of all supported providers
+func Providers() []string {
+	var names []string
+	for name := range providers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// ConfigKeys returns the config keys a provider requires and the ones it optionally takes
+func ConfigKeys(name string) ([]string, []string, error) {
+	setup, exists := providers[name]
+	if !exists {
+		return nil, nil, errors.New("provider not recognized")
+	}
+	return setup.required, setup.optional, nil
+}
+
+// NewProvider builds a provider from its name and config
+func NewProvider(name string, config map[string]string) (DeviceProvider, error) {
+	setup, exists := providers[name]
+	if !exists {
+		return nil, errors.New("provider not recognized")
+	}
+
+	for _, key := range setup.required {
+		if config[key] == "" {
+			return nil, errors.New("required config: " + key + " not found")
+		}
+	}
+	return setup.new(config)
+}
+
+// ProjectProvider returns the provider a project has chosen
+func ProjectProvider(project core.Project) (DeviceProvider, error) {
+	if project.DeviceProvider == "" {
+		return nil, errors.New("project has not chosen an iot provider")
+	}
+
+	config := make(map[string]string)
+	if len(project.ProviderConfig) != 0 {
+		decrypted, err := keys.Decrypt(keys.Platform, project.ProviderConfig)
+		if err != nil {
+			return nil, errors.Wrap(err, "could not decrypt provider config")
+		}
+
+		err = json.Unmarshal(decrypted, &config)
+		if err != nil {
+			return nil, errors.Wrap(err, "could not unmarshal provider config")
+		}
+	}
+
+	return NewProvider(project.DeviceProvider, config)
+}
+
+// SetProjectProvider sets the provider that reports a project's energy and (re)starts ingestion
+// from it. The config is encrypted with the platform's key before it is stored
+func SetProjectProvider(projIndex int, name string, deviceID string, config map[string]string) error {
+	provider, err := NewProvider(name, config)
+	if err != nil {
+		return err
+	}
+
+	_, err = provider.DeviceStatus(deviceID)
+	if err != nil {
+		return errors.Wrap(err, "could not retrieve device from provider")
+	}
+
+	project, err := core.RetrieveProject(projIndex)
+	if err != nil {
+		return errors.Wrap(err, "couldn't retrieve project")
+	}
+
+	encoded, err := json.Marshal(config)
+	if err != nil {
+		return errors.Wrap(err, "could not marshal provider config")
+	}
+
+	project.ProviderConfig, err = keys.Encrypt(keys.Platform, encoded)
+	if err != nil {
+		return errors.Wrap(err, "could not encrypt provider config")
+	}
+
+	project.DeviceProvider = name
+	project.ProviderDeviceID = deviceID
+	err = project.Save()
+	if err != nil {
+		return errors.Wrap(err, "couldn't save project")
+	}
+
+	return StartIngestion(projIndex)
+}
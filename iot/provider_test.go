@@ -0,0 +1,95 @@
+// +build all travis
+
+package iot
+
+import (
+	"testing"
+
+	core "github.com/YaleOpenLab/opensolar/core"
+)
+
+func TestProviders(t *testing.T) {
+	_, err := NewProvider("particle", map[string]string{})
+	if err == nil {
+		t.Fatal("particle provider built without an access token")
+	}
+
+	_, err = NewProvider("blah", map[string]string{})
+	if err == nil {
+		t.Fatal("unknown provider built")
+	}
+
+	provider, err := NewProvider("mock", map[string]string{"value": "250", "interval": "1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	devices, err := provider.ListDevices()
+	if err != nil || len(devices) == 0 {
+		t.Fatal("mock provider has no devices", err)
+	}
+
+	online, err := provider.Ping(devices[0].ID)
+	if err != nil || !online {
+		t.Fatal("mock device not online", err)
+	}
+
+	_, err = provider.DeviceStatus("blah")
+	if err == nil {
+		t.Fatal("status of unknown device returned")
+	}
+
+	stop := make(chan struct{})
+	out := make(chan core.EnergyReading)
+	go provider.StreamReadings(devices[0].ID, 0, out, stop)
+	reading := <-out
+	close(stop)
+	if reading.Value != 250 || reading.DeviceID != devices[0].ID {
+		t.Fatal("wrong reading streamed", reading)
+	}
+
+	readings, err := provider.FetchEnergy(devices[0].ID, reading.Timestamp-1)
+	if err != nil || len(readings) != 1 {
+		t.Fatal("streamed reading not fetched", err)
+	}
+}
+
+func TestParseParticleEvent(t *testing.T) {
+	reading, err := parseParticleEvent(particleEvent{Data: "42", PublishedAt: "2020-01-01T00:00:00Z", Coreid: "core"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reading.Value != 42 || reading.Timestamp != 1577836800 || reading.DeviceID != "core" {
+		t.Fatal("wrong reading parsed", reading)
+	}
+
+	reading, err = parseParticleEvent(particleEvent{Data: `{"energy_timestamp":"1577836800","unit":"Wh","value":7,"owner_id":"owner"}`, Coreid: "core"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reading.Value != 7 || reading.DeviceID != "owner" {
+		t.Fatal("wrong reading parsed", reading)
+	}
+
+	_, err = parseParticleEvent(particleEvent{Data: "blah"})
+	if err == nil {
+		t.Fatal("invalid event parsed")
+	}
+}
+
+func TestSwytchWh(t *testing.T) {
+	value, err := swytchWh(1.2345, "kWh")
+	if err != nil || value != 1235 {
+		t.Fatal("kWh not converted to Wh", value, err)
+	}
+
+	value, err = swytchWh(99.6, "Wh")
+	if err != nil || value != 100 {
+		t.Fatal("Wh not rounded", value, err)
+	}
+
+	_, err = swytchWh(1, "joules")
+	if err == nil {
+		t.Fatal("unknown unit converted")
+	}
+}
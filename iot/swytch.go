@@ -0,0 +1,386 @@
+package iot
+
+import (
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+
+	consts "github.com/YaleOpenLab/opensolar/consts"
+	core "github.com/YaleOpenLab/opensolar/core"
+)
+
+// swytchAPI is the base url of the swytch platform API
+var swytchAPI = "https://platformapi-staging.swytch.io/v1"
+
+// Swytch is a DeviceProvider backed by the swytch platform. Swytch stores the energy reported by
+// its assets, so readings are polled every consts.ProviderPollInterval and none are lost while
+// the platform is down
+type Swytch struct {
+	clientID     string
+	clientSecret string
+	username     string
+	password     string
+
+	lock         sync.Mutex
+	accessToken  string
+	refreshToken string
+	expiry       int64
+}
+
+// swytchToken is swytch's oauth token response
+type swytchToken struct {
+	Data []struct {
+		AccessToken  string `json:"access_token"`
+		RefreshToken string `json:"refresh_token"`
+		ExpiresIn    int64  `json:"expires_in"`
+	} `json:"data"`
+}
+
+// swytchUser is the subset of swytch's user response that we need
+type swytchUser struct {
+	Data []struct {
+		ID string `json:"id"`
+	} `json:"data"`
+}
+
+// swytchAssets is the subset of swytch's asset response that we need
+type swytchAssets struct {
+	Data []struct {
+		AssetID    string `json:"asset_id"`
+		Name       string `json:"name"`
+		UpdatedAt  string `json:"updatedAt"`
+		Status     string `json:"status"`
+		Generating bool   `json:"generating"`
+		Meta       struct {
+			SerialNO string `json:"serialNO"`
+		} `json:"meta"`
+	} `json:"data"`
+}
+
+// swytchEnergy is the subset of swytch's energy response that we need
+type swytchEnergy struct {
+	Data []struct {
+		AssetID         string  `json:"asset_id"`
+		Value           float64 `json:"value"`
+		Unit            string  `json:"unit"`
+		EnergyTimestamp string  `json:"energy_timestamp"`
+	} `json:"data"`
+}
+
+// swytchAttributions is the subset of swytch's attribution response that we need
+type swytchAttributions struct {
+	Data []struct {
+		ID               string `json:"_id"`
+		AssetID          string `json:"asset_id"`
+		CarbonOffset     string `json:"carbon_offset"`
+		EnergyProduced   string `json:"energy_produced"`
+		ProductionPeriod string `json:"production_period"`
+		Timestamp        string `json:"timestamp"`
+		Claimed          bool   `json:"claimed"`
+	} `json:"data"`
+}
+
+// NewSwytch returns a swytch provider. Needs the clientId and clientSecret of the IoT hub and the
+// susername and spassword of the swytch account it is registered to
+func NewSwytch(config map[string]string) (DeviceProvider, error) {
+	return &Swytch{
+		clientID:     config["clientId"],
+		clientSecret: config["clientSecret"],
+		username:     config["susername"],
+		password:     config["spassword"],
+	}, nil
+}
+
+// Name returns the name of the provider
+func (a *Swytch) Name() string {
+	return "swytch"
+}
+
+// token returns a valid access token, refreshing or requesting a new one if needed
+func (a *Swytch) token() (string, error) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	now := time.Now().Unix()
+	if a.accessToken != "" && now < a.expiry {
+		return a.accessToken, nil
+	}
+
+	request := map[string]string{"client_id": a.clientID, "client_secret": a.clientSecret}
+	if a.refreshToken != "" {
+		request["grant_type"] = "refresh_token"
+		request["refresh_token"] = a.refreshToken
+	} else {
+		request["grant_type"] = "password"
+		request["username"] = a.username
+		request["password"] = a.password
+	}
+
+	payload, err := json.Marshal(request)
+	if err != nil {
+		return "", err
+	}
+
+	data, err := swytchRequest("POST", swytchAPI+"/oauth/token", "", strings.NewReader(string(payload)))
+	if err != nil {
+		a.refreshToken = "" // fall back to the password grant next time
+		return "", errors.Wrap(err, "could not get swytch access token")
+	}
+
+	var x swytchToken
+	err = json.Unmarshal(data, &x)
+	if err != nil || len(x.Data) == 0 || x.Data[0].AccessToken == "" {
+		a.refreshToken = ""
+		return "", errors.New("could not parse swytch access token")
+	}
+
+	a.accessToken = x.Data[0].AccessToken
+	a.refreshToken = x.Data[0].RefreshToken
+	// refresh a minute early so that requests in flight don't race the expiry
+	a.expiry = now + x.Data[0].ExpiresIn - 60
+	return a.accessToken, nil
+}
+
+// swytchRequest sends a request to the swytch API and returns the response body
+func swytchRequest(method string, url string, authToken string, body io.Reader) ([]byte, error) {
+	req, err := http.NewRequest(method, url, body)
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Add("content-type", "application/json")
+	if authToken != "" {
+		req.Header.Add("authorization", "Bearer "+authToken)
+	}
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	data, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if res.StatusCode != http.StatusOK {
+		return nil, errors.New("swytch returned status " + res.Status)
+	}
+	return data, nil
+}
+
+// get sends an authenticated GET request to the swytch API and unmarshals the response into x
+func (a *Swytch) get(path string, x interface{}) error {
+	token, err := a.token()
+	if err != nil {
+		return err
+	}
+
+	data, err := swytchRequest("GET", swytchAPI+path, token, nil)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, x)
+}
+
+// ListDevices lists all assets registered to the swytch account
+func (a *Swytch) ListDevices() ([]Device, error) {
+	var arr []Device
+
+	var user swytchUser
+	err := a.get("/auth/user", &user)
+	if err != nil {
+		return arr, errors.Wrap(err, "could not retrieve swytch user")
+	}
+	if len(user.Data) == 0 {
+		return arr, errors.New("swytch user not found")
+	}
+
+	var assets swytchAssets
+	err = a.get("/users/"+user.Data[0].ID+"/assets", &assets)
+	if err != nil {
+		return arr, errors.Wrap(err, "could not retrieve swytch assets")
+	}
+
+	for _, asset := range assets.Data {
+		var lastSeen int64
+		t, err := time.Parse(time.RFC3339, asset.UpdatedAt)
+		if err == nil {
+			lastSeen = t.Unix()
+		}
+
+		arr = append(arr, Device{
+			ID:       asset.AssetID,
+			Name:     asset.Name,
+			Provider: "swytch",
+			Online:   asset.Status == "active" || asset.Generating,
+			Serial:   asset.Meta.SerialNO,
+			LastSeen: lastSeen,
+		})
+	}
+	return arr, nil
+}
+
+// DeviceStatus returns the current status of an asset
+func (a *Swytch) DeviceStatus(deviceID string) (Device, error) {
+	devices, err := a.ListDevices()
+	if err != nil {
+		return Device{}, err
+	}
+
+	for _, device := range devices {
+		if device.ID == deviceID {
+			return device, nil
+		}
+	}
+	return Device{}, errors.New("swytch asset not found")
+}
+
+// Ping returns true if swytch reports the asset as online. Swytch can't ping assets directly
+func (a *Swytch) Ping(deviceID string) (bool, error) {
+	device, err := a.DeviceStatus(deviceID)
+	if err != nil {
+		return false, err
+	}
+	return device.Online, nil
+}
+
+// swytchPageSize is the number of records requested from swytch per page
+var swytchPageSize = 100
+
+// swytchWh converts an energy value reported by swytch to Wh, the unit readings are stored in
+func swytchWh(value float64, unit string) (uint32, error) {
+	switch strings.ToLower(unit) {
+	case "wh", "":
+	case "kwh":
+		value *= 1000
+	case "mwh":
+		value *= 1000000
+	default:
+		return 0, errors.New("unknown energy unit: " + unit)
+	}
+
+	value = math.Round(value)
+	if value > math.MaxUint32 {
+		return 0, errors.New("energy value out of range")
+	}
+	return uint32(value), nil
+}
+
+// FetchEnergy returns the readings reported by an asset after since, paging back through
+// swytch's history until it reaches since
+func (a *Swytch) FetchEnergy(deviceID string, since int64) ([]core.EnergyReading, error) {
+	var arr []core.EnergyReading
+
+	for offset := 0; ; offset += swytchPageSize {
+		var x swytchEnergy
+		err := a.get("/assets/"+deviceID+"/energy?limit="+strconv.Itoa(swytchPageSize)+"&offset="+strconv.Itoa(offset), &x)
+		if err != nil {
+			return arr, errors.Wrap(err, "could not retrieve swytch energy")
+		}
+
+		// swytch returns the latest readings first, so older pages only matter until we reach since
+		reached := false
+		for _, elem := range x.Data {
+			t, err := time.Parse(time.RFC3339, elem.EnergyTimestamp)
+			if err != nil {
+				continue
+			}
+			if t.Unix() <= since {
+				reached = true
+				continue
+			}
+			if elem.Value < 0 {
+				continue
+			}
+
+			value, err := swytchWh(elem.Value, elem.Unit)
+			if err != nil {
+				log.Println("skipping swytch reading of asset", elem.AssetID, err)
+				continue
+			}
+			arr = append(arr, core.EnergyReading{
+				Timestamp: t.Unix(),
+				Value:     value,
+				Unit:      "Wh",
+				AssetID:   elem.AssetID,
+			})
+		}
+
+		if reached || len(x.Data) < swytchPageSize {
+			break
+		}
+	}
+
+	for i, j := 0, len(arr)-1; i < j; i, j = i+1, j-1 {
+		arr[i], arr[j] = arr[j], arr[i]
+	}
+	return arr, nil
+}
+
+// StreamReadings polls an asset's energy every consts.ProviderPollInterval
+func (a *Swytch) StreamReadings(deviceID string, since int64, out chan<- core.EnergyReading, stop <-chan struct{}) error {
+	for {
+		readings, err := a.FetchEnergy(deviceID, since)
+		if err != nil {
+			return err
+		}
+
+		for _, reading := range readings {
+			select {
+			case out <- reading:
+				since = reading.Timestamp
+			case <-stop:
+				return nil
+			}
+		}
+
+		select {
+		case <-stop:
+			return nil
+		case <-time.After(consts.ProviderPollInterval):
+		}
+	}
+}
+
+// FetchAttributions returns the energy attributions swytch has made for an asset
+func (a *Swytch) FetchAttributions(deviceID string) ([]Attribution, error) {
+	var arr []Attribution
+
+	var x swytchAttributions
+	err := a.get("/assets/"+deviceID+"/attributions?limit=100&offset=0", &x)
+	if err != nil {
+		return arr, errors.Wrap(err, "could not retrieve swytch attributions")
+	}
+
+	for _, elem := range x.Data {
+		energy, _ := strconv.ParseFloat(elem.EnergyProduced, 64)
+		offset, _ := strconv.ParseFloat(elem.CarbonOffset, 64)
+		var timestamp int64
+		t, err := time.Parse(time.RFC3339, elem.Timestamp)
+		if err == nil {
+			timestamp = t.Unix()
+		}
+
+		arr = append(arr, Attribution{
+			ID:           elem.ID,
+			DeviceID:     elem.AssetID,
+			Energy:       energy,
+			CarbonOffset: offset,
+			Period:       elem.ProductionPeriod,
+			Timestamp:    timestamp,
+			Claimed:      elem.Claimed,
+		})
+	}
+	return arr, nil
+}
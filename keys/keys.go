@@ -0,0 +1,213 @@
+package keys
+
+import (
+	"encoding/base64"
+	"regexp"
+	"strconv"
+
+	"github.com/pkg/errors"
+
+	xlm "github.com/Varunram/essentials/xlm"
+	"github.com/stellar/go/keypair"
+	build "github.com/stellar/go/txnbuild"
+)
+
+// keys holds the Stellar keys that the platform signs with: its own account and the issuers
+// of every project and REC asset. Keys are referred to by an id and sign on behalf of the
+// platform without their seeds ever leaving the backend that holds them.
+
+// KeyManager is a backend that generates, holds and signs with ed25519 Stellar keys
+type KeyManager interface {
+	// Generate creates a new key with the given id and returns its public key
+	Generate(id string) (string, error)
+	// Import stores an existing seed under the given id and returns its public key
+	Import(id string, seed string) (string, error)
+	// PublicKey returns the public key of the key with the given id
+	PublicKey(id string) (string, error)
+	// Sign signs data with the key with the given id
+	Sign(id string, data []byte) ([]byte, error)
+	// Encrypt encrypts data with a secret bound to the key with the given id
+	Encrypt(id string, data []byte) ([]byte, error)
+	// Decrypt decrypts data encrypted by Encrypt
+	Decrypt(id string, data []byte) ([]byte, error)
+	// Delete deletes the key with the given id
+	Delete(id string) error
+}
+
+// Platform is the id of the platform's key
+const Platform = "platform"
+
+// Manager is the key manager the platform signs with, set up when the platform starts
+var Manager KeyManager
+
+// ErrNotFound is returned when no key with the given id exists
+var ErrNotFound = errors.New("key not found")
+
+// validID matches the ids keys can be stored under
+var validID = regexp.MustCompile(`^[a-z0-9-]{1,64}$`)
+
+// checkID checks that a key id is safe to use as a file name or url path segment
+func checkID(id string) error {
+	if !validID.MatchString(id) {
+		return errors.New("invalid key id: " + id)
+	}
+	return nil
+}
+
+// IssuerID is the id of the issuer of a project's investor, debt and payback assets
+func IssuerID(projIndex int) string {
+	return "issuer-" + strconv.Itoa(projIndex)
+}
+
+// RECIssuerID is the id of the issuer of a project's REC asset
+func RECIssuerID(projIndex int) string {
+	return "recissuer-" + strconv.Itoa(projIndex)
+}
+
+// errNoManager is returned when the platform's key manager hasn't been set up
+var errNoManager = errors.New("key manager not set up")
+
+// Encrypt encrypts data with the platform key manager's key with the given id
+func Encrypt(id string, data []byte) ([]byte, error) {
+	if Manager == nil {
+		return nil, errNoManager
+	}
+	return Manager.Encrypt(id, data)
+}
+
+// Decrypt decrypts data encrypted by Encrypt
+func Decrypt(id string, data []byte) ([]byte, error) {
+	if Manager == nil {
+		return nil, errNoManager
+	}
+	return Manager.Decrypt(id, data)
+}
+
+// migrator is implemented by key managers that can tell their ciphertexts apart from ones
+// encrypted by another backend or in an older format
+type migrator interface {
+	// Current returns true if data was encrypted by the key manager and doesn't need to be migrated
+	Current(data []byte) bool
+}
+
+// Reencrypt decrypts data with from and encrypts it with to's key with the given id, unless
+// to already encrypted it. Returns the ciphertext and whether it was re-encrypted
+func Reencrypt(from KeyManager, to KeyManager, id string, data []byte) ([]byte, bool, error) {
+	m, ok := to.(migrator)
+	if !ok || len(data) == 0 || m.Current(data) {
+		return data, false, nil
+	}
+	if from == nil {
+		return nil, false, errors.New("no key manager to migrate ciphertext from")
+	}
+	plaintext, err := from.Decrypt(id, data)
+	if err != nil {
+		return nil, false, errors.Wrap(err, "couldn't decrypt ciphertext to migrate")
+	}
+	ciphertext, err := to.Encrypt(id, plaintext)
+	if err != nil {
+		return nil, false, errors.Wrap(err, "couldn't encrypt migrated ciphertext")
+	}
+	return ciphertext, true, nil
+}
+
+// Signer signs transactions on behalf of a single Stellar account
+type Signer interface {
+	// Address returns the public key of the account
+	Address() (string, error)
+	// SignTx adds the account's signature to a transaction
+	SignTx(tx *build.Transaction) (*build.Transaction, error)
+}
+
+// managed is a signer whose key is held by a key manager
+type managed struct {
+	km KeyManager
+	id string
+}
+
+// Key returns a signer for the key with the given id held by the platform's key manager
+func Key(id string) Signer {
+	return managed{km: Manager, id: id}
+}
+
+// Address returns the public key of the managed key
+func (m managed) Address() (string, error) {
+	if m.km == nil {
+		return "", errNoManager
+	}
+	return m.km.PublicKey(m.id)
+}
+
+// SignTx signs the hash of the transaction with the managed key
+func (m managed) SignTx(tx *build.Transaction) (*build.Transaction, error) {
+	pubkey, err := m.Address()
+	if err != nil {
+		return nil, err
+	}
+	hash, err := tx.Hash(xlm.Passphrase)
+	if err != nil {
+		return nil, errors.Wrap(err, "couldn't hash transaction")
+	}
+	sig, err := m.km.Sign(m.id, hash[:])
+	if err != nil {
+		return nil, errors.Wrap(err, "couldn't sign transaction with key "+m.id)
+	}
+	return tx.AddSignatureBase64(xlm.Passphrase, pubkey, base64.StdEncoding.EncodeToString(sig))
+}
+
+// seedSigner is a signer for a seed held by the caller, used for user accounts whose seeds are
+// decrypted with the user's own password
+type seedSigner struct {
+	seed string
+}
+
+// Seed returns a signer for a seed held by the caller
+func Seed(seed string) Signer {
+	return seedSigner{seed: seed}
+}
+
+// Address returns the public key of the seed
+func (s seedSigner) Address() (string, error) {
+	kp, err := keypair.ParseFull(s.seed)
+	if err != nil {
+		return "", errors.Wrap(err, "couldn't parse seed")
+	}
+	return kp.Address(), nil
+}
+
+// SignTx signs the transaction with the seed
+func (s seedSigner) SignTx(tx *build.Transaction) (*build.Transaction, error) {
+	kp, err := keypair.ParseFull(s.seed)
+	if err != nil {
+		return nil, errors.Wrap(err, "couldn't parse seed")
+	}
+	return tx.Sign(xlm.Passphrase, kp)
+}
+
+// ImportPlatform makes sure the key manager holds the platform's key. Backends that already hold
+// it are checked against the platform's public key, otherwise seed is imported
+func ImportPlatform(km KeyManager, pubkey string, seed string) error {
+	existing, err := km.PublicKey(Platform)
+	if err == nil {
+		if existing != pubkey {
+			return errors.New("platform key held by the key manager doesn't match the platform's public key")
+		}
+		return nil
+	}
+	if errors.Cause(err) != ErrNotFound {
+		return err
+	}
+	if seed == "" {
+		return errors.New("platform key not held by the key manager and no seed to import")
+	}
+
+	imported, err := km.Import(Platform, seed)
+	if err != nil {
+		return errors.Wrap(err, "couldn't import platform key")
+	}
+	if imported != pubkey {
+		km.Delete(Platform)
+		return errors.New("platform seed doesn't match the platform's public key")
+	}
+	return nil
+}
@@ -0,0 +1,194 @@
+// +build all travis
+
+package keys
+
+import (
+	"bytes"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	aes "github.com/Varunram/essentials/aes"
+	xlm "github.com/Varunram/essentials/xlm"
+	wallet "github.com/Varunram/essentials/xlm/wallet"
+	"github.com/stellar/go/keypair"
+	build "github.com/stellar/go/txnbuild"
+)
+
+// testManager runs through the operations a key manager has to support
+func testManager(t *testing.T, km KeyManager, id string) {
+	pubkey, err := km.Generate(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer km.Delete(id)
+	if _, err := km.Generate(id); err == nil {
+		t.Fatal("key generated twice")
+	}
+	stored, err := km.PublicKey(id)
+	if err != nil || stored != pubkey {
+		t.Fatal("public key not returned", err)
+	}
+
+	sig, err := km.Sign(id, []byte("hash"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	kp, _ := keypair.ParseAddress(pubkey)
+	if kp.Verify([]byte("hash"), sig) != nil {
+		t.Fatal("signature not verified")
+	}
+
+	ciphertext, err := km.Encrypt(id, []byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	plaintext, err := km.Decrypt(id, ciphertext)
+	if err != nil || string(plaintext) != "secret" {
+		t.Fatal("ciphertext not decrypted", err)
+	}
+
+	seed, _ := keypair.Random()
+	err = ImportPlatform(km, seed.Address(), seed.Seed())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer km.Delete(Platform)
+	if ImportPlatform(km, pubkey, "") == nil {
+		t.Fatal("platform key not checked against the platform's public key")
+	}
+
+	xlm.SetConsts(0, false)
+	tx, err := build.NewTransaction(build.TransactionParams{
+		SourceAccount: &build.SimpleAccount{AccountID: seed.Address(), Sequence: 1},
+		Operations:    []build.Operation{&build.BumpSequence{BumpTo: 2}},
+		Timebounds:    build.NewTimebounds(0, 1000),
+		BaseFee:       1000,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	Manager = km
+	signed, err := Key(Platform).SignTx(tx)
+	if err != nil || len(signed.Signatures()) != 1 {
+		t.Fatal("transaction not signed with the platform's key", err)
+	}
+
+	err = km.Delete(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := km.PublicKey(id); err == nil {
+		t.Fatal("key not deleted")
+	}
+}
+
+func TestLocal(t *testing.T) {
+	dir, err := ioutil.TempDir("", "keystore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if _, err := NewLocal(dir, "blah"); err == nil {
+		t.Fatal("keystore opened with a weak passphrase")
+	}
+	km, err := NewLocal(dir, "correct horse battery staple")
+	if err != nil {
+		t.Fatal(err)
+	}
+	testManager(t, km, IssuerID(1))
+
+	if _, err := km.PublicKey("../platform"); err == nil {
+		t.Fatal("key id escaped the keystore")
+	}
+}
+
+func TestLocalMigrate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "keystore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	passphrase := "correct horse battery staple"
+	km, err := NewLocal(dir, passphrase)
+	if err != nil {
+		t.Fatal(err)
+	}
+	seed, _ := keypair.Random()
+	path := dir + "/" + Platform + ".key"
+	err = wallet.StoreSeed(seed.Seed(), passphrase, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	migrated, err := km.Migrate()
+	if err != nil || migrated != 1 {
+		t.Fatal("legacy key file not resealed", migrated, err)
+	}
+	data, _ := ioutil.ReadFile(path)
+	if !sealed(data) {
+		t.Fatal("key file not sealed")
+	}
+	if pubkey, err := km.PublicKey(Platform); err != nil || pubkey != seed.Address() {
+		t.Fatal("resealed key doesn't match", err)
+	}
+	if migrated, _ := km.Migrate(); migrated != 0 {
+		t.Fatal("sealed key file resealed")
+	}
+
+	legacy, err := aes.Encrypt([]byte("secret"), seed.Seed())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ciphertext, changed, err := Reencrypt(km, km, Platform, legacy)
+	if err != nil || !changed || !km.Current(ciphertext) {
+		t.Fatal("legacy ciphertext not re-encrypted", err)
+	}
+	if _, changed, _ := Reencrypt(km, km, Platform, ciphertext); changed {
+		t.Fatal("current ciphertext re-encrypted")
+	}
+	plaintext, err := km.Decrypt(Platform, ciphertext)
+	if err != nil || string(plaintext) != "secret" {
+		t.Fatal("re-encrypted ciphertext not decrypted", err)
+	}
+
+	again, _ := km.Encrypt(Platform, []byte("secret"))
+	if bytes.Equal(again, ciphertext) {
+		t.Fatal("same ciphertext for the same plaintext")
+	}
+	if _, err := km.Decrypt(Platform, append(again[:len(again)-1], again[len(again)-1]^1)); err == nil {
+		t.Fatal("tampered ciphertext decrypted")
+	}
+}
+
+func TestVault(t *testing.T) {
+	// run against a dev server started with `vault server -dev` and `vault secrets enable transit`
+	if os.Getenv("VAULT_ADDR") == "" || os.Getenv("VAULT_TOKEN") == "" {
+		t.Skip("VAULT_ADDR and VAULT_TOKEN not set")
+	}
+	km, err := NewVault(os.Getenv("VAULT_ADDR"), os.Getenv("VAULT_TOKEN"), "transit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	testManager(t, km, IssuerID(1))
+}
+
+func TestWrapKWP(t *testing.T) {
+	// test vectors from RFC 5649
+	kek, _ := hex.DecodeString("5840df6e29b02af1ab493b705bf16ea1ae8338f4dcc176a8")
+	vectors := map[string]string{
+		"c37b7e6492584340bed12207808941155068f738": "138bdeaa9b8fa7fc61f97742e72248ee5ae6ae5360d1ae6a5f54f373fa543b6a",
+		"466f7250617369":                           "afbeb0f07dfbf5419200f2ccb50bb24f",
+	}
+	for key, wrapped := range vectors {
+		plaintext, _ := hex.DecodeString(key)
+		expected, _ := hex.DecodeString(wrapped)
+		out, err := wrapKWP(kek, plaintext)
+		if err != nil || !bytes.Equal(out, expected) {
+			t.Fatalf("wrong wrapping of %s: %x", key, out)
+		}
+	}
+}
@@ -0,0 +1,297 @@
+package keys
+
+import (
+	"crypto/cipher"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+
+	aes "github.com/Varunram/essentials/aes"
+	wallet "github.com/Varunram/essentials/xlm/wallet"
+	"github.com/stellar/go/keypair"
+)
+
+// MinPassphraseLength is the minimum length of the local keystore's passphrase
+const MinPassphraseLength = 16
+
+// legacyIssuerPwd is the password issuer seeds were encrypted with before the keystore existed
+const legacyIssuerPwd = "blah"
+
+// Local is a keystore that keeps each key as a seed file in a directory, sealed with a key
+// derived from the deployment's passphrase and the file's salt
+type Local struct {
+	Dir        string
+	passphrase string
+
+	mu       sync.Mutex
+	fileKeys map[string]cipher.AEAD // keys derived from the passphrase by salt, so signing doesn't run scrypt
+}
+
+// NewLocal opens the local keystore in dir, creating it if it doesn't exist
+func NewLocal(dir string, passphrase string) (*Local, error) {
+	if len(passphrase) < MinPassphraseLength {
+		return nil, errors.New("keystore passphrase must be at least " + strconv.Itoa(MinPassphraseLength) + " characters long")
+	}
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return nil, errors.Wrap(err, "couldn't create keystore directory")
+	}
+	return &Local{Dir: dir, passphrase: passphrase, fileKeys: make(map[string]cipher.AEAD)}, nil
+}
+
+// fileKey derives the key a key file with the given salt is sealed with from the passphrase
+func (l *Local) fileKey(salt []byte) (cipher.AEAD, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if gcm, ok := l.fileKeys[string(salt)]; ok {
+		return gcm, nil
+	}
+	gcm, err := scryptKey(l.passphrase)(salt)
+	if err != nil {
+		return nil, err
+	}
+	l.fileKeys[string(salt)] = gcm
+	return gcm, nil
+}
+
+// path returns the path of the file the key with the given id is stored in
+func (l *Local) path(id string) (string, error) {
+	err := checkID(id)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(l.Dir, id+".key"), nil
+}
+
+// seed decrypts the seed of the key with the given id
+func (l *Local) seed(id string) (*keypair.Full, error) {
+	path, err := l.path(id)
+	if err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, errors.Wrap(ErrNotFound, id)
+		}
+		return nil, errors.Wrap(err, "couldn't read key "+id)
+	}
+	if !sealed(data) {
+		// key files stored before sealing existed are resealed by Migrate
+		_, seed, err := wallet.RetrieveSeed(path, l.passphrase)
+		if err != nil {
+			return nil, errors.Wrap(err, "couldn't decrypt key "+id)
+		}
+		return keypair.ParseFull(seed)
+	}
+	seed, err := unseal(l.fileKey, data)
+	if err != nil {
+		return nil, errors.Wrap(err, "couldn't decrypt key "+id)
+	}
+	return keypair.ParseFull(string(seed))
+}
+
+// store encrypts and stores a seed under the given id
+func (l *Local) store(id string, kp *keypair.Full) (string, error) {
+	path, err := l.path(id)
+	if err != nil {
+		return "", err
+	}
+	data, err := seal(l.fileKey, []byte(kp.Seed()))
+	if err != nil {
+		return "", errors.Wrap(err, "couldn't encrypt key "+id)
+	}
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		if os.IsExist(err) {
+			return "", errors.New("key " + id + " already exists")
+		}
+		return "", errors.Wrap(err, "couldn't store key "+id)
+	}
+	_, err = file.Write(data)
+	if cerr := file.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(path)
+		return "", errors.Wrap(err, "couldn't store key "+id)
+	}
+	return kp.Address(), nil
+}
+
+// Generate creates a new key with the given id and returns its public key
+func (l *Local) Generate(id string) (string, error) {
+	kp, err := keypair.Random()
+	if err != nil {
+		return "", errors.Wrap(err, "couldn't generate keypair")
+	}
+	return l.store(id, kp)
+}
+
+// Import stores an existing seed under the given id and returns its public key
+func (l *Local) Import(id string, seed string) (string, error) {
+	kp, err := keypair.ParseFull(seed)
+	if err != nil {
+		return "", errors.Wrap(err, "couldn't parse seed")
+	}
+	return l.store(id, kp)
+}
+
+// PublicKey returns the public key of the key with the given id
+func (l *Local) PublicKey(id string) (string, error) {
+	kp, err := l.seed(id)
+	if err != nil {
+		return "", err
+	}
+	return kp.Address(), nil
+}
+
+// Sign signs data with the key with the given id
+func (l *Local) Sign(id string, data []byte) ([]byte, error) {
+	kp, err := l.seed(id)
+	if err != nil {
+		return nil, err
+	}
+	return kp.Sign(data)
+}
+
+// Encrypt seals data with a key derived from the key's seed, which is what the platform's seed
+// was used for before the keystore existed
+func (l *Local) Encrypt(id string, data []byte) ([]byte, error) {
+	kp, err := l.seed(id)
+	if err != nil {
+		return nil, err
+	}
+	return seal(scryptKey(kp.Seed()), data)
+}
+
+// Decrypt decrypts data encrypted by Encrypt. Data encrypted with the key's seed before sealing
+// existed is still decrypted so that it can be migrated
+func (l *Local) Decrypt(id string, data []byte) ([]byte, error) {
+	kp, err := l.seed(id)
+	if err != nil {
+		return nil, err
+	}
+	if !sealed(data) {
+		return aes.Decrypt(data, kp.Seed())
+	}
+	return unseal(scryptKey(kp.Seed()), data)
+}
+
+// Current returns true if data was encrypted by Encrypt and doesn't need to be migrated
+func (l *Local) Current(data []byte) bool {
+	return sealed(data)
+}
+
+// Migrate reseals the key files stored before sealing existed and returns the number of
+// resealed files. Files are replaced by renaming so a key is never left half written
+func (l *Local) Migrate() (int, error) {
+	files, err := ioutil.ReadDir(l.Dir)
+	if err != nil {
+		return 0, errors.Wrap(err, "couldn't read keystore directory")
+	}
+
+	migrated := 0
+	for _, file := range files {
+		id := strings.TrimSuffix(file.Name(), ".key")
+		if file.IsDir() || !strings.HasSuffix(file.Name(), ".key") || checkID(id) != nil {
+			continue
+		}
+		path := filepath.Join(l.Dir, file.Name())
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return migrated, errors.Wrap(err, "couldn't read key "+id)
+		}
+		if sealed(data) {
+			continue
+		}
+
+		kp, err := l.seed(id)
+		if err != nil {
+			return migrated, err
+		}
+		data, err = seal(l.fileKey, []byte(kp.Seed()))
+		if err != nil {
+			return migrated, errors.Wrap(err, "couldn't encrypt key "+id)
+		}
+		tmp := path + ".tmp"
+		err = ioutil.WriteFile(tmp, data, 0600)
+		if err == nil {
+			err = os.Rename(tmp, path)
+		}
+		if err != nil {
+			os.Remove(tmp)
+			return migrated, errors.Wrap(err, "couldn't reseal key "+id)
+		}
+		log.Println("resealed key", id)
+		migrated++
+	}
+	return migrated, nil
+}
+
+// Delete deletes the key with the given id
+func (l *Local) Delete(id string) error {
+	path, err := l.path(id)
+	if err != nil {
+		return err
+	}
+	err = os.Remove(path)
+	if os.IsNotExist(err) {
+		return errors.Wrap(ErrNotFound, id)
+	}
+	return err
+}
+
+// MigrateIssuers imports the issuer seeds stored in dir with the old default password into the
+// key manager under the ids returned by idFn and deletes the seed files once imported
+func MigrateIssuers(km KeyManager, dir string, idFn func(int) string) (int, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, nil
+		}
+		return 0, errors.Wrap(err, "couldn't read issuer directory")
+	}
+
+	migrated := 0
+	for _, file := range files {
+		projIndex, err := strconv.Atoi(strings.TrimSuffix(file.Name(), ".key"))
+		if err != nil || file.IsDir() || !strings.HasSuffix(file.Name(), ".key") {
+			continue
+		}
+		path := filepath.Join(dir, file.Name())
+		pubkey, seed, err := wallet.RetrieveSeed(path, legacyIssuerPwd)
+		if err != nil {
+			return migrated, errors.Wrap(err, "couldn't decrypt issuer seed "+path)
+		}
+
+		id := idFn(projIndex)
+		existing, err := km.PublicKey(id)
+		if err == nil && existing != pubkey {
+			return migrated, errors.New("key " + id + " already exists with a different public key")
+		}
+		if err != nil {
+			if errors.Cause(err) != ErrNotFound {
+				return migrated, err
+			}
+			_, err = km.Import(id, seed)
+			if err != nil {
+				return migrated, errors.Wrap(err, "couldn't import issuer seed "+path)
+			}
+		}
+
+		err = os.Remove(path)
+		if err != nil {
+			return migrated, errors.Wrap(err, "couldn't delete issuer seed "+path)
+		}
+		log.Println("migrated issuer seed", path, "to key", id)
+		migrated++
+	}
+	return migrated, nil
+}
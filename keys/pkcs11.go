@@ -0,0 +1,61 @@
+package keys
+
+import (
+	"github.com/pkg/errors"
+)
+
+// ErrPKCS11Unsupported is returned by every operation of the PKCS#11 backend in builds that don't
+// link a PKCS#11 library
+var ErrPKCS11Unsupported = errors.New("pkcs#11 backend not supported in this build")
+
+// PKCS11 is a stub for keys held in a hardware security module behind a PKCS#11 module. The token
+// needs to support ed25519 keys (CKK_EC_EDWARDS) and signing with CKM_EDDSA. Seeds are generated
+// on the token and never exported, so Import is limited to tokens that allow unwrapping keys
+type PKCS11 struct {
+	Module     string // path to the PKCS#11 shared library
+	TokenLabel string
+	Pin        string
+}
+
+// NewPKCS11 returns a PKCS#11 backend for the token with the given label
+func NewPKCS11(module string, tokenLabel string, pin string) (*PKCS11, error) {
+	if module == "" || tokenLabel == "" {
+		return nil, errors.New("pkcs#11 module and token label required")
+	}
+	return &PKCS11{Module: module, TokenLabel: tokenLabel, Pin: pin}, nil
+}
+
+// Generate creates a new key on the token
+func (p *PKCS11) Generate(id string) (string, error) {
+	return "", errors.Wrap(ErrPKCS11Unsupported, "generate "+id)
+}
+
+// Import unwraps an existing seed onto the token
+func (p *PKCS11) Import(id string, seed string) (string, error) {
+	return "", errors.Wrap(ErrPKCS11Unsupported, "import "+id)
+}
+
+// PublicKey returns the public key of a key on the token
+func (p *PKCS11) PublicKey(id string) (string, error) {
+	return "", errors.Wrap(ErrPKCS11Unsupported, "public key "+id)
+}
+
+// Sign signs data with a key on the token
+func (p *PKCS11) Sign(id string, data []byte) ([]byte, error) {
+	return nil, errors.Wrap(ErrPKCS11Unsupported, "sign "+id)
+}
+
+// Encrypt encrypts data with a secret key on the token
+func (p *PKCS11) Encrypt(id string, data []byte) ([]byte, error) {
+	return nil, errors.Wrap(ErrPKCS11Unsupported, "encrypt "+id)
+}
+
+// Decrypt decrypts data with a secret key on the token
+func (p *PKCS11) Decrypt(id string, data []byte) ([]byte, error) {
+	return nil, errors.Wrap(ErrPKCS11Unsupported, "decrypt "+id)
+}
+
+// Delete destroys a key on the token
+func (p *PKCS11) Delete(id string) error {
+	return errors.Wrap(ErrPKCS11Unsupported, "delete "+id)
+}
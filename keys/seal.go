@@ -0,0 +1,97 @@
+package keys
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+
+	"github.com/pkg/errors"
+
+	"golang.org/x/crypto/scrypt"
+)
+
+// the local keystore seals key files and data with AES-256-GCM under a key derived from a secret
+// with scrypt. Every sealed blob carries its own random salt and nonce, so the same secret never
+// encrypts two blobs with the same key and nonce. Sealed blobs are laid out as
+// sealPrefix | salt | nonce | ciphertext
+
+// sealPrefix marks data sealed by seal. Data without it was encrypted with the essentials aes
+// package before sealing existed and is only decrypted to be migrated
+var sealPrefix = []byte("ossealed1:")
+
+const (
+	saltSize = 16
+	// scrypt parameters recommended for interactive logins in 2017, ~100ms per derivation
+	scryptN = 1 << 15
+	scryptR = 8
+	scryptP = 1
+)
+
+// sealed returns true if data was sealed by seal
+func sealed(data []byte) bool {
+	return bytes.HasPrefix(data, sealPrefix)
+}
+
+// deriveFunc derives the key a blob is sealed with from the blob's salt
+type deriveFunc func(salt []byte) (cipher.AEAD, error)
+
+// scryptKey returns a deriveFunc that derives keys from secret with scrypt
+func scryptKey(secret string) deriveFunc {
+	return func(salt []byte) (cipher.AEAD, error) {
+		key, err := scrypt.Key([]byte(secret), salt, scryptN, scryptR, scryptP, 32)
+		if err != nil {
+			return nil, errors.Wrap(err, "couldn't derive key")
+		}
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, err
+		}
+		return cipher.NewGCM(block)
+	}
+}
+
+// seal encrypts plaintext with a key derived from a random salt
+func seal(derive deriveFunc, plaintext []byte) ([]byte, error) {
+	salt := make([]byte, saltSize)
+	_, err := rand.Read(salt)
+	if err != nil {
+		return nil, errors.Wrap(err, "couldn't generate salt")
+	}
+	gcm, err := derive(salt)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	_, err = rand.Read(nonce)
+	if err != nil {
+		return nil, errors.Wrap(err, "couldn't generate nonce")
+	}
+
+	out := append(append(append([]byte{}, sealPrefix...), salt...), nonce...)
+	return gcm.Seal(out, nonce, plaintext, sealPrefix), nil
+}
+
+// unseal decrypts data sealed by seal
+func unseal(derive deriveFunc, data []byte) ([]byte, error) {
+	if !sealed(data) {
+		return nil, errors.New("data not sealed")
+	}
+	data = data[len(sealPrefix):]
+	if len(data) < saltSize {
+		return nil, errors.New("sealed data too short")
+	}
+	gcm, err := derive(data[:saltSize])
+	if err != nil {
+		return nil, err
+	}
+	data = data[saltSize:]
+	if len(data) < gcm.NonceSize() {
+		return nil, errors.New("sealed data too short")
+	}
+	plaintext, err := gcm.Open(nil, data[:gcm.NonceSize()], data[gcm.NonceSize():], sealPrefix)
+	if err != nil {
+		return nil, errors.New("couldn't unseal data, wrong secret or corrupted data")
+	}
+	return plaintext, nil
+}
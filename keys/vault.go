@@ -0,0 +1,338 @@
+package keys
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"encoding/pem"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/stellar/go/strkey"
+)
+
+// Vault is a backend that holds keys in the transit secrets engine of a Vault server. Keys are
+// ed25519 keys that are generated or imported into Vault and sign without leaving it.
+// Encryption uses a separate aes256-gcm96 key named after the signing key
+type Vault struct {
+	Address string // address of the Vault server, eg http://127.0.0.1:8200
+	Mount   string // path the transit engine is mounted at
+	token   string
+	client  *http.Client
+}
+
+// NewVault returns a Vault backend that authenticates with token
+func NewVault(address string, token string, mount string) (*Vault, error) {
+	if address == "" || token == "" {
+		return nil, errors.New("vault address and token required")
+	}
+	if mount == "" {
+		mount = "transit"
+	}
+	return &Vault{Address: strings.TrimRight(address, "/"), Mount: strings.Trim(mount, "/"), token: token,
+		client: &http.Client{Timeout: 30 * time.Second}}, nil
+}
+
+// vaultResponse is the envelope of the responses of Vault's API
+type vaultResponse struct {
+	Data   json.RawMessage
+	Errors []string
+}
+
+// request calls Vault's API and decodes the data of the response into out
+func (v *Vault) request(method string, path string, body interface{}, out interface{}) error {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequest(method, v.Address+"/v1/"+v.Mount+"/"+path, reader)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("X-Vault-Token", v.token)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	res, err := v.client.Do(req)
+	if err != nil {
+		return errors.Wrap(err, "couldn't reach vault")
+	}
+	defer res.Body.Close()
+
+	data, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return err
+	}
+	var x vaultResponse
+	if len(data) != 0 {
+		err = json.Unmarshal(data, &x)
+		if err != nil {
+			return errors.Wrap(err, "couldn't decode vault response")
+		}
+	}
+
+	if res.StatusCode == http.StatusNotFound {
+		return errors.Wrap(ErrNotFound, path)
+	}
+	if res.StatusCode >= 300 {
+		return errors.New("vault returned " + res.Status + ": " + strings.Join(x.Errors, ", "))
+	}
+	if out == nil || len(x.Data) == 0 {
+		return nil
+	}
+	return json.Unmarshal(x.Data, out)
+}
+
+// stripVersion strips the vault:v<n>: prefix off signatures returned by Vault
+func stripVersion(s string) string {
+	return s[strings.LastIndex(s, ":")+1:]
+}
+
+// Generate creates a new ed25519 key in Vault and returns its public key
+func (v *Vault) Generate(id string) (string, error) {
+	err := checkID(id)
+	if err != nil {
+		return "", err
+	}
+	_, err = v.PublicKey(id)
+	if err == nil {
+		return "", errors.New("key " + id + " already exists")
+	}
+
+	err = v.request("POST", "keys/"+id, map[string]interface{}{"type": "ed25519"}, nil)
+	if err != nil {
+		return "", errors.Wrap(err, "couldn't create key "+id)
+	}
+	return v.PublicKey(id)
+}
+
+// Import wraps a seed with Vault's wrapping key and imports it, so the seed is only ever sent
+// to Vault encrypted
+func (v *Vault) Import(id string, seed string) (string, error) {
+	err := checkID(id)
+	if err != nil {
+		return "", err
+	}
+	raw, err := strkey.Decode(strkey.VersionByteSeed, seed)
+	if err != nil {
+		return "", errors.Wrap(err, "couldn't parse seed")
+	}
+	key, err := x509.MarshalPKCS8PrivateKey(ed25519.NewKeyFromSeed(raw))
+	if err != nil {
+		return "", err
+	}
+
+	var wrapping struct {
+		PublicKey string `json:"public_key"`
+	}
+	err = v.request("GET", "wrapping_key", nil, &wrapping)
+	if err != nil {
+		return "", errors.Wrap(err, "couldn't get vault's wrapping key")
+	}
+	block, _ := pem.Decode([]byte(wrapping.PublicKey))
+	if block == nil {
+		return "", errors.New("couldn't decode vault's wrapping key")
+	}
+	parsed, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return "", errors.Wrap(err, "couldn't parse vault's wrapping key")
+	}
+	wrappingKey, ok := parsed.(*rsa.PublicKey)
+	if !ok {
+		return "", errors.New("vault's wrapping key is not an rsa key")
+	}
+
+	ciphertext, err := wrapForImport(wrappingKey, key)
+	if err != nil {
+		return "", err
+	}
+	err = v.request("POST", "keys/"+id+"/import", map[string]interface{}{
+		"ciphertext":    base64.StdEncoding.EncodeToString(ciphertext),
+		"type":          "ed25519",
+		"hash_function": "SHA256",
+	}, nil)
+	if err != nil {
+		return "", errors.Wrap(err, "couldn't import key "+id)
+	}
+	return v.PublicKey(id)
+}
+
+// PublicKey returns the public key of the latest version of a key in Vault
+func (v *Vault) PublicKey(id string) (string, error) {
+	err := checkID(id)
+	if err != nil {
+		return "", err
+	}
+	var key struct {
+		Type          string
+		LatestVersion int `json:"latest_version"`
+		Keys          map[string]struct {
+			PublicKey string `json:"public_key"`
+		}
+	}
+	err = v.request("GET", "keys/"+id, nil, &key)
+	if err != nil {
+		return "", err
+	}
+	if key.Type != "ed25519" {
+		return "", errors.New("key " + id + " is not an ed25519 key")
+	}
+
+	version, ok := key.Keys[strconv.Itoa(key.LatestVersion)]
+	if !ok {
+		return "", errors.New("couldn't find the latest version of key " + id)
+	}
+	raw, err := base64.StdEncoding.DecodeString(version.PublicKey)
+	if err != nil || len(raw) != ed25519.PublicKeySize {
+		return "", errors.New("couldn't decode public key of " + id)
+	}
+	return strkey.Encode(strkey.VersionByteAccountID, raw)
+}
+
+// Sign signs data with a key in Vault
+func (v *Vault) Sign(id string, data []byte) ([]byte, error) {
+	err := checkID(id)
+	if err != nil {
+		return nil, err
+	}
+	var x struct {
+		Signature string
+	}
+	err = v.request("POST", "sign/"+id, map[string]interface{}{"input": base64.StdEncoding.EncodeToString(data)}, &x)
+	if err != nil {
+		return nil, errors.Wrap(err, "couldn't sign with key "+id)
+	}
+	return base64.StdEncoding.DecodeString(stripVersion(x.Signature))
+}
+
+// Encrypt encrypts data with the key's data key in Vault and returns Vault's ciphertext
+func (v *Vault) Encrypt(id string, data []byte) ([]byte, error) {
+	err := checkID(id)
+	if err != nil {
+		return nil, err
+	}
+	var x struct {
+		Ciphertext string
+	}
+	err = v.request("POST", "encrypt/"+id+"-data", map[string]interface{}{"plaintext": base64.StdEncoding.EncodeToString(data)}, &x)
+	if err != nil {
+		return nil, errors.Wrap(err, "couldn't encrypt with key "+id)
+	}
+	return []byte(x.Ciphertext), nil
+}
+
+// Decrypt decrypts a ciphertext returned by Encrypt. Ciphertexts of the local keystore have to
+// be migrated with Reencrypt first
+func (v *Vault) Decrypt(id string, data []byte) ([]byte, error) {
+	err := checkID(id)
+	if err != nil {
+		return nil, err
+	}
+	if !v.Current(data) {
+		return nil, errors.New("ciphertext not encrypted by vault, migrate it from the local keystore")
+	}
+	var x struct {
+		Plaintext string
+	}
+	err = v.request("POST", "decrypt/"+id+"-data", map[string]interface{}{"ciphertext": string(data)}, &x)
+	if err != nil {
+		return nil, errors.Wrap(err, "couldn't decrypt with key "+id)
+	}
+	return base64.StdEncoding.DecodeString(x.Plaintext)
+}
+
+// Current returns true if data is a ciphertext returned by Encrypt
+func (v *Vault) Current(data []byte) bool {
+	return strings.HasPrefix(string(data), "vault:v")
+}
+
+// Delete allows a key to be deleted and deletes it from Vault
+func (v *Vault) Delete(id string) error {
+	err := checkID(id)
+	if err != nil {
+		return err
+	}
+	err = v.request("POST", "keys/"+id+"/config", map[string]interface{}{"deletion_allowed": true}, nil)
+	if err != nil {
+		return err
+	}
+	return v.request("DELETE", "keys/"+id, nil, nil)
+}
+
+// wrapForImport encrypts a key in the format Vault's BYOK import expects: an ephemeral AES-256
+// key wrapped with RSA-OAEP followed by the key wrapped with the ephemeral key using AES-KWP
+func wrapForImport(wrappingKey *rsa.PublicKey, key []byte) ([]byte, error) {
+	ephemeral := make([]byte, 32)
+	_, err := rand.Read(ephemeral)
+	if err != nil {
+		return nil, err
+	}
+	wrappedEphemeral, err := rsa.EncryptOAEP(sha256.New(), rand.Reader, wrappingKey, ephemeral, nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "couldn't wrap ephemeral key")
+	}
+	wrappedKey, err := wrapKWP(ephemeral, key)
+	if err != nil {
+		return nil, errors.Wrap(err, "couldn't wrap key")
+	}
+	return append(wrappedEphemeral, wrappedKey...), nil
+}
+
+// wrapKWP wraps plaintext with kek using AES key wrap with padding (RFC 5649)
+func wrapKWP(kek []byte, plaintext []byte) ([]byte, error) {
+	block, err := aes.NewCipher(kek)
+	if err != nil {
+		return nil, err
+	}
+	if len(plaintext) == 0 {
+		return nil, errors.New("nothing to wrap")
+	}
+
+	// alternative initial value: a fixed prefix and the length of the plaintext
+	a := make([]byte, 8)
+	copy(a, []byte{0xA6, 0x59, 0x59, 0xA6})
+	binary.BigEndian.PutUint32(a[4:], uint32(len(plaintext)))
+
+	n := (len(plaintext) + 7) / 8
+	padded := make([]byte, n*8)
+	copy(padded, plaintext)
+
+	if n == 1 {
+		out := make([]byte, 16)
+		block.Encrypt(out, append(a, padded...))
+		return out, nil
+	}
+
+	// the wrapping process of RFC 3394 with the alternative initial value
+	b := make([]byte, 16)
+	for j := 0; j < 6; j++ {
+		for i := 1; i <= n; i++ {
+			copy(b, a)
+			copy(b[8:], padded[(i-1)*8:i*8])
+			block.Encrypt(b, b)
+			t := uint64(n*j + i)
+			binary.BigEndian.PutUint64(a, binary.BigEndian.Uint64(b[:8])^t)
+			copy(padded[(i-1)*8:i*8], b[8:])
+		}
+	}
+	return append(a, padded...), nil
+}
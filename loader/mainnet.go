@@ -15,7 +15,9 @@ func Mainnet() error {
 	consts.HomeDir += "/mainnet"
 	consts.DbDir = consts.HomeDir + "/database/"
 	consts.OpenSolarIssuerDir = consts.HomeDir + "/projects/"
+	consts.RECIssuerDir = consts.HomeDir + "/recissuers/"
 	consts.PlatformSeedFile = consts.HomeDir + "/platformseed.hex"
+	consts.KeystoreDir = consts.HomeDir + "/keys/"
 	xlm.SetConsts(0, consts.Mainnet)
 
 	if _, err := os.Stat(consts.HomeDir); os.IsNotExist(err) {
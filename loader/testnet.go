@@ -16,7 +16,9 @@ func Testnet() error {
 	consts.HomeDir += "/testnet"
 	consts.DbDir = consts.HomeDir + "/database/"                   // the directory where the database is stored (project info, user info, etc)
 	consts.OpenSolarIssuerDir = consts.HomeDir + "/projects/"      // the directory where we store opensolar projects' issuer seeds
+	consts.RECIssuerDir = consts.HomeDir + "/recissuers/"          // the directory where we store project REC issuer seeds
 	consts.PlatformSeedFile = consts.HomeDir + "/platformseed.hex" // where the platform's seed is stored
+	consts.KeystoreDir = consts.HomeDir + "/keys/"                 // the directory of the local keystore
 
 	if _, err := os.Stat(consts.HomeDir); os.IsNotExist(err) {
 		// no home directory exists, create
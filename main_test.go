@@ -669,7 +669,7 @@ func TestDb(t *testing.T) {
 	}
 
 	// copy these from the main consts file
-	consts.PlatformSeed = "SCPTLLG2U2HG6VYK3EFEVRPG6DD6YCOMMCC7ZNNBLAVZAPMR3FU7Q5QX"
+	platformSeed := "SCPTLLG2U2HG6VYK3EFEVRPG6DD6YCOMMCC7ZNNBLAVZAPMR3FU7Q5QX"
 	consts.PlatformPublicKey = "GBVAF2FTXGO476YX4XLHIJ2R6Z7RSKCTAMDNXA2KFRLBRUS3CF77YZ33"
 	consts.StablecoinPublicKey = "GDPCLB35E4JBVCL2OI6GCM7XK6PLTSKD5EDLRRKFHEI5L4FDKGL4CLIS"
 	consts.StablecoinSeed = "SD3FRV7UUKBBXIT6HQ74YTR3GBHYKY6QK75QTX6E7MJBN5UOBZYVGRJO"
@@ -689,7 +689,7 @@ func TestDb(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	err = escrow.SendFundsFromEscrow(escrowPubkey, pubkey1, seed1, consts.PlatformSeed, 1, "")
+	err = escrow.SendFundsFromEscrow(escrowPubkey, pubkey1, seed1, platformSeed, 1, "")
 	if err != nil {
 		t.Fatal(err)
 	}
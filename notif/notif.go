@@ -2,9 +2,11 @@ package notif
 
 import (
 	"encoding/json"
+	"fmt"
 	"log"
 	"net/http"
 	"net/url"
+	"strings"
 	"time"
 
 	erpc "github.com/Varunram/essentials/rpc"
@@ -120,6 +122,47 @@ func SendPaybackNotifToRecipient(projIndex int, to string, stableUSDHash string,
 	return SendMail(body, to)
 }
 
+// SendAutoreloadNotifToRecipient sends a notification email to the recipient when the platform
+// reloads their primary account from their secondary account before a payback
+func SendAutoreloadNotifToRecipient(projIndex int, to string, amount float64, txhash string) error {
+	projIndexString, err := utils.ToString(projIndex)
+	if err != nil {
+		return err
+	}
+	amountString, err := utils.ToString(amount)
+	if err != nil {
+		return err
+	}
+	body := "Greetings from the opensolar platform! \n\n" +
+		"We're writing to let you know that we have reloaded your primary account with " + amountString +
+		" USD from your secondary account ahead of your payback towards project number: " + projIndexString + "\n\n" +
+		"Your proof of reload is attached below:  \n\n" +
+		"Reload reference is: https://testnet.steexp.com/tx/" + txhash + "\n\n\n" +
+		footerString
+	return SendMail(body, to)
+}
+
+// SendStandingOrderFailureNotif sends a notification email to the recipient when a scheduled
+// payback towards a project fails
+func SendStandingOrderFailureNotif(projIndex int, to string, reason string, retries int) error {
+	projIndexString, err := utils.ToString(projIndex)
+	if err != nil {
+		return err
+	}
+	var retryString string
+	if retries == 0 {
+		retryString = "We will try again during the next payback period.\n\n"
+	} else {
+		retryString = "We will retry the payment shortly.\n\n"
+	}
+	body := "Greetings from the opensolar platform! \n\n" +
+		"We're writing to let you know that your scheduled payback towards project number: " + projIndexString +
+		" failed with the following error: \n\n" + reason + "\n\n" + retryString +
+		"Please make sure your account has enough funds or cancel the standing order and pay back manually.\n\n\n" +
+		footerString
+	return SendMail(body, to)
+}
+
 // SendPaybackNotifToInvestor sends a notification email to the investor when the recipient
 // pays back towards an order
 func SendPaybackNotifToInvestor(projIndex int, to string, stableUSDHash string, debtPaybackHash string) error {
@@ -136,6 +179,20 @@ func SendPaybackNotifToInvestor(projIndex int, to string, stableUSDHash string,
 	return SendMail(body, to)
 }
 
+// SendInvoiceNotifToRecipient sends a notification to the recipient that a new invoice has been issued
+func SendInvoiceNotifToRecipient(projIndex int, to string, number string, amount float64, dueDate string) error {
+	projIndexString, err := utils.ToString(projIndex)
+	if err != nil {
+		return err
+	}
+
+	body := "Greetings from the opensolar platform! \n\nWe're writing to let you know that invoice " + number +
+		" for project: " + projIndexString + " has been issued. The amount due is $" + fmt.Sprintf("%.2f", amount) +
+		", payable by " + dueDate + ".\n\n\n" +
+		footerString
+	return SendMail(body, to)
+}
+
 // SendUnlockNotifToRecipient sends a notification email to the recipient to unlock
 // the given project for accepting investment
 func SendUnlockNotifToRecipient(projIndex int, to string) error {
@@ -342,6 +399,79 @@ func SendTellerDownEmail(projIndex int, recpIndex int) error {
 	return SendMail(body, consts.PlatformEmail)
 }
 
+// SendFleetAlertEmail sends an email to the platform admin that a teller or IoT hub is unhealthy
+func SendFleetAlertEmail(projIndex int, kind string, deviceID string, problems []string) error {
+	projIndexString, err := utils.ToString(projIndex)
+	if err != nil {
+		return err
+	}
+
+	body := "Greetings from the opensolar platform! \n\nWe're writing to let you know that the " + kind + " with device id: " +
+		deviceID + " reporting for project: " + projIndexString + " is unhealthy (" + strings.Join(problems, ", ") +
+		"). Please take action at the earliest," + "\n\n\n" +
+		footerString
+	return SendMail(body, consts.PlatformEmail)
+}
+
+// SendUnderperformanceEmail sends an email to a project's contractor or developer that the
+// project is generating less than its forecast
+func SendUnderperformanceEmail(projIndex int, to string, index float64, threshold float64) error {
+	projIndexString, err := utils.ToString(projIndex)
+	if err != nil {
+		return err
+	}
+
+	body := "Greetings from the opensolar platform! \n\nWe're writing to let you know that project: " + projIndexString +
+		" generated " + fmt.Sprintf("%.0f%%", index*100) + " of its expected energy over the past " + fmt.Sprintf("%d days", consts.PerformanceWindow) + ", which is below its productivity threshold of " +
+		fmt.Sprintf("%.0f%%", threshold*100) + ". Please inspect the installation at the earliest," + "\n\n\n" +
+		footerString
+	return SendMail(body, to)
+}
+
+// SendBatteryDegradedEmail sends an email to a project's contractor or developer when one of its
+// batteries reaches its end of life
+func SendBatteryDegradedEmail(projIndex int, to string, health float64, endOfLife float64) error {
+	projIndexString, err := utils.ToString(projIndex)
+	if err != nil {
+		return err
+	}
+
+	body := "Greetings from the opensolar platform! \n\nWe're writing to let you know that a battery of project: " + projIndexString +
+		" is down to " + fmt.Sprintf("%.0f%%", health*100) + " of its rated capacity, which is at or below its end of life of " +
+		fmt.Sprintf("%.0f%%", endOfLife*100) + ". Please plan for its replacement," + "\n\n\n" +
+		footerString
+	return SendMail(body, to)
+}
+
+// SendWithdrawalProposalEmail asks a project's recipient or guarantor to approve a developer's
+// withdrawal from the project's escrow
+func SendWithdrawalProposalEmail(projIndex int, to string, index int, amount float64) error {
+	projIndexString, err := utils.ToString(projIndex)
+	if err != nil {
+		return err
+	}
+
+	body := "Greetings from the opensolar platform! \n\nWe're writing to let you know that a developer of project: " + projIndexString +
+		" has requested " + fmt.Sprintf("%.2f", amount) + " USD from the project's escrow (proposal " + fmt.Sprintf("%d", index) +
+		"). Please review the proposal and approve or reject it," + "\n\n\n" +
+		footerString
+	return SendMail(body, to)
+}
+
+// SendWarrantyReminderEmail reminds a project's contractor or developer that the warranty of a
+// piece of its equipment expires soon
+func SendWarrantyReminderEmail(projIndex int, to string, equipment string, expiry string) error {
+	projIndexString, err := utils.ToString(projIndex)
+	if err != nil {
+		return err
+	}
+
+	body := "Greetings from the opensolar platform! \n\nWe're writing to remind you that the warranty of the " + equipment +
+		" installed on project: " + projIndexString + " expires on " + expiry + ". Please inspect the equipment and file any claims before then," + "\n\n\n" +
+		footerString
+	return SendMail(body, to)
+}
+
 // SendRecpNotFoundEmail sends an email to the platform admin that the recipient was not
 // found associacted with a project.
 func SendRecpNotFoundEmail(projIndex int, recpIndex int) error {
@@ -14,6 +14,8 @@ import (
 	erpc "github.com/Varunram/essentials/rpc"
 	consts "github.com/YaleOpenLab/opensolar/consts"
 	core "github.com/YaleOpenLab/opensolar/core"
+	iot "github.com/YaleOpenLab/opensolar/iot"
+	keys "github.com/YaleOpenLab/opensolar/keys"
 	loader "github.com/YaleOpenLab/opensolar/loader"
 	rpc "github.com/YaleOpenLab/opensolar/rpc"
 
@@ -57,6 +59,22 @@ func parseConfig(args []string) (bool, int, error) {
 	}
 
 	consts.TopSecretCode = viper.GetString("code")
+	// optional credentials used to subscribe to project mqtt brokers
+	consts.MqttUsername = viper.GetString("mqttusername")
+	consts.MqttPassword = viper.GetString("mqttpassword")
+	// the backend holding the platform's and issuers' keys and its credentials
+	if viper.IsSet("keybackend") {
+		consts.KeyBackend = viper.GetString("keybackend")
+	}
+	consts.KeystorePassphrase = viper.GetString("keystorepassphrase")
+	consts.VaultAddress = viper.GetString("vaultaddress")
+	consts.VaultToken = viper.GetString("vaulttoken")
+	if viper.IsSet("vaultmount") {
+		consts.VaultMount = viper.GetString("vaultmount")
+	}
+	consts.PKCS11Module = viper.GetString("pkcs11module")
+	consts.PKCS11TokenLabel = viper.GetString("pkcs11token")
+	consts.PKCS11Pin = viper.GetString("pkcs11pin")
 
 	return opts.Insecure, port, nil
 }
@@ -71,6 +89,20 @@ func parseEnvVars() (int, string, bool, bool, bool, string) {
 	sandbox := viper.GetBool("OPENS_SB")
 	insecure := viper.GetBool("OPENS_INSECURE")
 	openxURL := viper.GetString("OPENX_URL")
+	consts.MqttUsername = viper.GetString("OPENS_MQTT_USERNAME")
+	consts.MqttPassword = viper.GetString("OPENS_MQTT_PASSWORD")
+	if viper.IsSet("OPENS_KEY_BACKEND") {
+		consts.KeyBackend = viper.GetString("OPENS_KEY_BACKEND")
+	}
+	consts.KeystorePassphrase = viper.GetString("OPENS_KEYSTORE_PASSPHRASE")
+	consts.VaultAddress = viper.GetString("VAULT_ADDR")
+	consts.VaultToken = viper.GetString("VAULT_TOKEN")
+	if viper.IsSet("OPENS_VAULT_MOUNT") {
+		consts.VaultMount = viper.GetString("OPENS_VAULT_MOUNT")
+	}
+	consts.PKCS11Module = viper.GetString("OPENS_PKCS11_MODULE")
+	consts.PKCS11TokenLabel = viper.GetString("OPENS_PKCS11_TOKEN")
+	consts.PKCS11Pin = viper.GetString("OPENS_PKCS11_PIN")
 
 	return port, code, populate, sandbox, insecure, openxURL
 }
@@ -96,22 +128,31 @@ func mainnet() bool {
 	return data[0] == byte(1)
 }
 
-// loadOpenxConsts parses consts by receiving consts from the openx API
-func loadOpenxConsts() error {
+// getOpenxConsts receives the platform's consts from the openx API
+func getOpenxConsts() (openxrpc.OpensolarConstReturn, error) {
+	var x openxrpc.OpensolarConstReturn
 	body := consts.OpenxURL + "/platform/getconsts?code=" + consts.TopSecretCode
 	data, err := erpc.GetRequest(body)
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	var x openxrpc.OpensolarConstReturn
 	err = json.Unmarshal(data, &x)
 	if err != nil || len(string(data)) < 100 { // weird hack to catch 400s
-		return errors.New("request to get consts failed")
+		return x, errors.New("request to get consts failed")
+	}
+	return x, nil
+}
+
+// loadOpenxConsts parses consts by receiving consts from the openx API. The platform's seed that
+// comes with them is dropped, it's only fetched by platformSeed if the key manager needs it
+func loadOpenxConsts() error {
+	x, err := getOpenxConsts()
+	if err != nil {
+		return err
 	}
 
 	consts.PlatformPublicKey = x.PlatformPublicKey
-	consts.PlatformSeed = x.PlatformSeed
 	consts.PlatformEmail = x.PlatformEmail
 	consts.PlatformEmailPass = x.PlatformEmailPass
 	consts.StablecoinCode = x.StablecoinCode
@@ -126,10 +167,110 @@ func loadOpenxConsts() error {
 
 	stablecoin.SetConsts("STABLEUSD", consts.StablecoinPublicKey, "seed", "seedfile", openxconsts.StablecoinTrustLimit,
 		consts.AnchorUSDCode, consts.AnchorUSDAddress, consts.AnchorUSDTrustLimit, consts.Mainnet)
+	return nil
+}
+
+// platformSeed fetches the platform's seed from openx so that it can be imported into a key
+// manager that doesn't hold it yet
+func platformSeed() (string, error) {
+	x, err := getOpenxConsts()
+	if err != nil {
+		return "", err
+	}
+	return x.PlatformSeed, nil
+}
+
+// setupKeys sets up the key manager that holds the platform's and issuers' keys, imports the
+// platform's seed into it if it doesn't hold it yet and migrates issuer seeds and ciphertexts
+// stored by earlier versions
+func setupKeys() error {
+	var km keys.KeyManager
+	var err error
+	switch consts.KeyBackend {
+	case "local":
+		var local *keys.Local
+		local, err = keys.NewLocal(consts.KeystoreDir, consts.KeystorePassphrase)
+		if err == nil {
+			var resealed int
+			resealed, err = local.Migrate()
+			if resealed != 0 {
+				log.Println("resealed", resealed, "keys in the local keystore")
+			}
+		}
+		km = local
+	case "vault":
+		km, err = keys.NewVault(consts.VaultAddress, consts.VaultToken, consts.VaultMount)
+	case "pkcs11":
+		km, err = keys.NewPKCS11(consts.PKCS11Module, consts.PKCS11TokenLabel, consts.PKCS11Pin)
+	default:
+		return errors.New("unknown key backend: " + consts.KeyBackend)
+	}
+	if err != nil {
+		return errors.Wrap(err, "couldn't set up key manager")
+	}
+
+	var seed string
+	_, err = km.PublicKey(keys.Platform)
+	if errors.Cause(err) == keys.ErrNotFound {
+		seed, err = platformSeed()
+		if err != nil {
+			return errors.Wrap(err, "couldn't fetch platform seed")
+		}
+	}
+	err = keys.ImportPlatform(km, consts.PlatformPublicKey, seed)
+	if err != nil {
+		return err
+	}
+
+	migrated, err := keys.MigrateIssuers(km, consts.OpenSolarIssuerDir, keys.IssuerID)
+	if err != nil {
+		return errors.Wrap(err, "couldn't migrate project issuers")
+	}
+	recMigrated, err := keys.MigrateIssuers(km, consts.RECIssuerDir, keys.RECIssuerID)
+	if err != nil {
+		return errors.Wrap(err, "couldn't migrate rec issuers")
+	}
+	if migrated+recMigrated != 0 {
+		log.Println("migrated", migrated+recMigrated, "issuer seeds to the", consts.KeyBackend, "key backend")
+	}
 
+	keys.Manager = km
+
+	from, err := migrationSource(km)
+	if err != nil {
+		return err
+	}
+	reencrypted, err := core.MigrateCiphertexts(from)
+	if err != nil {
+		return errors.Wrap(err, "couldn't migrate ciphertexts")
+	}
+	if reencrypted != 0 {
+		log.Println("re-encrypted", reencrypted, "ciphertexts with the", consts.KeyBackend, "key backend")
+	}
 	return nil
 }
 
+// migrationSource returns the key manager that ciphertexts the platform's key manager didn't
+// encrypt were encrypted with. The local keystore decrypts its own older ciphertexts and, when
+// moving to another backend, is still opened with its passphrase to decrypt the ciphertexts it
+// encrypted. Returns nil if there's no local keystore to migrate from
+func migrationSource(km keys.KeyManager) (keys.KeyManager, error) {
+	if consts.KeyBackend == "local" {
+		return km, nil
+	}
+	if consts.KeystorePassphrase == "" {
+		return nil, nil
+	}
+	if _, err := os.Stat(consts.KeystoreDir); os.IsNotExist(err) {
+		return nil, nil
+	}
+	local, err := keys.NewLocal(consts.KeystoreDir, consts.KeystorePassphrase)
+	if err != nil {
+		return nil, errors.Wrap(err, "couldn't open local keystore to migrate from")
+	}
+	return local, nil
+}
+
 func main() {
 	var err error
 	//log.Fatal(sandbox.Test())
@@ -167,6 +308,11 @@ func main() {
 			log.Fatal(err)
 		}
 
+		err = setupKeys()
+		if err != nil {
+			log.Fatal(err)
+		}
+
 		project, err := core.RetrieveProject(1)
 		if err != nil {
 			log.Fatal(err)
@@ -192,6 +338,11 @@ func main() {
 			log.Fatal(err)
 		}
 
+		err = setupKeys()
+		if err != nil {
+			log.Fatal(err)
+		}
+
 		if opts.DemoData {
 			err = demoData()
 			if err != nil {
@@ -234,5 +385,14 @@ func main() {
 
 		//go core.MonitorPaybacks(7, 1) // montior test project payback
 	*/
+	go core.MonitorReconciliation() // report drift between the database and the ledger to admins
+	go core.MonitorStandingOrders() // execute scheduled paybacks authorized by recipients
+	go core.StartAllIngestion()     // subscribe to energy data published by project devices
+	go core.MonitorFleet()          // alert admins about tellers and iot hubs that stop reporting
+	go iot.StartAllIngestion()      // stream energy from the iot providers chosen by projects
+	go core.MonitorRECs()           // mint renewable energy certificates from metered generation
+	go core.MonitorPerformance()    // raise underperformance events when generation falls below its forecast
+	go core.MonitorBilling()        // issue monthly invoices to recipients and mark unpaid ones overdue
+	go core.MonitorMaintenance()    // remind contractors of expiring warranties and open due maintenance orders
 	rpc.StartServer(port, insecure)
 }
@@ -5,12 +5,46 @@ package oracle
 // this test function actually does nothing, since the oracle itself is a placeholder
 // until we arrive at a consensus on how it should be structured
 import (
+	"math"
 	"testing"
 )
 
 func TestOracle(t *testing.T) {
 	billF := MonthlyBill()
-	if billF != 120.0 {
+	if billF != 0.2 {
 		t.Fatalf("Oracle does not output constant value")
 	}
 }
+
+func TestMedian(t *testing.T) {
+	if median([]float64{}) != 0 {
+		t.Fatalf("median of empty set not zero")
+	}
+	if median([]float64{0.3, 0.1, 0.2}) != 0.2 {
+		t.Fatalf("median of odd set incorrect")
+	}
+	if median([]float64{0.4, 0.1, 0.2, 0.3}) != 0.25 {
+		t.Fatalf("median of even set incorrect")
+	}
+}
+
+func TestBuildReport(t *testing.T) {
+	priceCache = map[string]PriceSource{
+		"binance":  {Name: "binance", Price: 0.1, Updated: 1000},
+		"kraken":   {Name: "kraken", Price: 0.2, Updated: 1000},
+		"coinbase": {Name: "coinbase", Price: 5, Updated: 1},
+	}
+
+	report, err := buildReport(1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if math.Abs(report.Price-0.15) > 1e-9 {
+		t.Fatalf("stale source not ignored, got: %f", report.Price)
+	}
+
+	_, err = buildReport(1000000)
+	if err == nil {
+		t.Fatalf("all sources stale but oracle quoted a price")
+	}
+}
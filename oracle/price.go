@@ -0,0 +1,219 @@
+package oracle
+
+import (
+	"encoding/json"
+	"log"
+	"sort"
+	"sync"
+
+	"github.com/pkg/errors"
+
+	tickers "github.com/Varunram/essentials/exchangetickers"
+	erpc "github.com/Varunram/essentials/rpc"
+	utils "github.com/Varunram/essentials/utils"
+	consts "github.com/YaleOpenLab/opensolar/consts"
+)
+
+// the price oracle queries a set of independent XLM/USD sources and takes the median of
+// the sources that have reported recently. Prices are cached so that paybacks and dashboards
+// don't hit exchange APIs on every call, and a single source going down (or being rate limited)
+// doesn't block recipients from paying back.
+
+// PriceSource holds the last price reported by a given source
+type PriceSource struct {
+	// Name is the name of the price source
+	Name string
+	// Price is the last XLM/USD price reported by the source
+	Price float64
+	// Updated is the unix timestamp at which Price was last fetched successfully
+	Updated int64
+	// Error is the error returned on the most recent fetch, if any
+	Error string
+	// Stale is true if Updated is older than consts.OraclePriceStaleness
+	Stale bool
+}
+
+// PriceReport is the aggregated XLM/USD price along with the sources it was derived from
+type PriceReport struct {
+	// Price is the median of all fresh sources
+	Price float64
+	// Timestamp is the unix timestamp at which the report was generated
+	Timestamp int64
+	// LastRefresh is the unix timestamp at which sources were last queried
+	LastRefresh int64
+	// Sources contains the individual source prices
+	Sources []PriceSource
+}
+
+// priceFetchers maps each source to the function used to query it
+var priceFetchers = map[string]func() (float64, error){
+	"binance":    tickers.BinanceTicker,
+	"kraken":     tickers.KrakenTicker,
+	"coinbase":   tickers.CoinbaseTicker,
+	"stellardex": StellarDexTicker,
+}
+
+var (
+	priceLock   sync.Mutex
+	priceCache  = make(map[string]PriceSource)
+	lastRefresh int64
+)
+
+// horizonOrderbookResponse is the subset of horizon's order_book response that we need
+type horizonOrderbookResponse struct {
+	Bids []struct {
+		Price string `json:"price"`
+	} `json:"bids"`
+	Asks []struct {
+		Price string `json:"price"`
+	} `json:"asks"`
+}
+
+// StellarDexTicker returns the mid price of the XLM/AnchorUSD orderbook on the Stellar DEX
+func StellarDexTicker() (float64, error) {
+	if consts.AnchorUSDCode == "" || consts.AnchorUSDAddress == "" {
+		return -1, errors.New("anchor usd asset not set, can't query the stellar dex")
+	}
+
+	horizon := "https://horizon-testnet.stellar.org"
+	if consts.Mainnet {
+		horizon = "https://horizon.stellar.org"
+	}
+
+	body := horizon + "/order_book?selling_asset_type=native&buying_asset_type=credit_alphanum4" +
+		"&buying_asset_code=" + consts.AnchorUSDCode + "&buying_asset_issuer=" + consts.AnchorUSDAddress + "&limit=1"
+
+	data, err := erpc.GetRequest(body)
+	if err != nil {
+		return -1, errors.Wrap(err, "did not get response from horizon")
+	}
+
+	var response horizonOrderbookResponse
+	err = json.Unmarshal(data, &response)
+	if err != nil {
+		return -1, errors.Wrap(err, "could not unmarshal orderbook response")
+	}
+
+	if len(response.Bids) == 0 || len(response.Asks) == 0 {
+		return -1, errors.New("orderbook is one sided, can't compute mid price")
+	}
+
+	bid, err := utils.ToFloat(response.Bids[0].Price)
+	if err != nil {
+		return -1, errors.Wrap(err, "could not convert bid price to float")
+	}
+
+	ask, err := utils.ToFloat(response.Asks[0].Price)
+	if err != nil {
+		return -1, errors.Wrap(err, "could not convert ask price to float")
+	}
+
+	return (bid + ask) / 2, nil
+}
+
+// RefreshPrices queries all price sources in parallel and updates the cache. Sources that
+// fail retain their last good price so that staleness is decided by age alone.
+func RefreshPrices() {
+	var wg sync.WaitGroup
+	for name, fetch := range priceFetchers {
+		wg.Add(1)
+		go func(name string, fetch func() (float64, error)) {
+			defer wg.Done()
+			price, err := fetch()
+
+			priceLock.Lock()
+			defer priceLock.Unlock()
+
+			source := priceCache[name]
+			source.Name = name
+			if err != nil || price <= 0 {
+				if err == nil {
+					err = errors.New("source returned non positive price")
+				}
+				log.Println("could not fetch price from", name, err)
+				source.Error = err.Error()
+			} else {
+				source.Price = price
+				source.Updated = utils.Unix()
+				source.Error = ""
+			}
+			priceCache[name] = source
+		}(name, fetch)
+	}
+	wg.Wait()
+
+	priceLock.Lock()
+	lastRefresh = utils.Unix()
+	priceLock.Unlock()
+}
+
+// median returns the median of the passed prices
+func median(prices []float64) float64 {
+	if len(prices) == 0 {
+		return 0
+	}
+
+	sorted := make([]float64, len(prices))
+	copy(sorted, prices)
+	sort.Float64s(sorted)
+
+	mid := len(sorted) / 2
+	if len(sorted)%2 == 0 {
+		return (sorted[mid-1] + sorted[mid]) / 2
+	}
+	return sorted[mid]
+}
+
+// buildReport aggregates the cached source prices at time now
+func buildReport(now int64) (PriceReport, error) {
+	priceLock.Lock()
+	defer priceLock.Unlock()
+
+	var report PriceReport
+	var fresh []float64
+
+	report.Timestamp = now
+	report.LastRefresh = lastRefresh
+
+	for _, source := range priceCache {
+		source.Stale = source.Updated == 0 || now-source.Updated > consts.OraclePriceStaleness
+		if !source.Stale {
+			fresh = append(fresh, source.Price)
+		}
+		report.Sources = append(report.Sources, source)
+	}
+
+	sort.Slice(report.Sources, func(i, j int) bool {
+		return report.Sources[i].Name < report.Sources[j].Name
+	})
+
+	if len(fresh) == 0 {
+		return report, errors.New("all price sources are stale, refusing to quote a price")
+	}
+
+	report.Price = median(fresh)
+	return report, nil
+}
+
+// GetPriceReport returns the aggregated price report, refreshing sources if the cache is older
+// than consts.OracleRefreshInterval
+func GetPriceReport() (PriceReport, error) {
+	priceLock.Lock()
+	refresh := utils.Unix()-lastRefresh > consts.OracleRefreshInterval
+	priceLock.Unlock()
+
+	if refresh {
+		RefreshPrices()
+	}
+
+	return buildReport(utils.Unix())
+}
+
+// XLMUSD returns the cached median XLM/USD price. It errors out only when every source is stale
+func XLMUSD() (float64, error) {
+	report, err := GetPriceReport()
+	if err != nil {
+		return -1, err
+	}
+	return report.Price, nil
+}
@@ -3,6 +3,7 @@ package rpc
 import (
 	"log"
 	"net/http"
+	"strings"
 
 	"github.com/YaleOpenLab/opensolar/messages"
 
@@ -22,19 +23,63 @@ func setupAdminHandlers() {
 	retrieveAllRecipients()
 	projectComplete()
 	projectFeatured()
+	getStuckInvestments()
+	compensateInvestment()
+	reconcileProject()
+	repairProject()
+	sendTellerCommand()
+	getTellerCommandHistory()
+	getFleet()
+	mintRECs()
+	setEmissionFactor()
+	getEmissionFactors()
+	setIrradianceTable()
+	getIrradianceTables()
+	setBillingPlan()
+	runBilling()
+	setUtility()
+	getUtilities()
+	setProjectUtility()
+	settleDecommission()
+	closeDecommission()
+	setWithdrawalPolicy()
+	resetDevice()
+	receiveSettlement()
 }
 
 // AdminRPC is a list of all the endpoints that can be called by admins
 var AdminRPC = map[int][]string{
-	1: {"/admin/flag", "GET", "projIndex"},          // GET
-	2: {"/admin/getallprojects", "GET"},             // GET
-	3: {"/admin/getrecipient", "GET", "index"},      // GET
-	4: {"/admin/getinvestor", "GET", "index"},       // GET
-	5: {"/admin/getentity", "GET", "index"},         // GET
-	6: {"/admin/getallinvestors", "GET"},            // GET
-	7: {"/admin/getallrecipients", "GET"},           // GET
-	8: {"/admin/project/complete", "POST", "index"}, // POST
-	9: {"/admin/project/featured", "POST", "index"}, // POST
+	1:  {"/admin/flag", "GET", "projIndex"},                                       // GET
+	2:  {"/admin/getallprojects", "GET"},                                          // GET
+	3:  {"/admin/getrecipient", "GET", "index"},                                   // GET
+	4:  {"/admin/getinvestor", "GET", "index"},                                    // GET
+	5:  {"/admin/getentity", "GET", "index"},                                      // GET
+	6:  {"/admin/getallinvestors", "GET"},                                         // GET
+	7:  {"/admin/getallrecipients", "GET"},                                        // GET
+	8:  {"/admin/project/complete", "POST", "index"},                              // POST
+	9:  {"/admin/project/featured", "POST", "index"},                              // POST
+	10: {"/admin/investments/stuck", "GET"},                                       // GET
+	11: {"/admin/investments/compensate", "POST", "index"},                        // POST
+	12: {"/admin/reconcile", "GET", "projIndex"},                                  // GET
+	13: {"/admin/reconcile/repair", "POST", "projIndex"},                          // POST
+	14: {"/admin/teller/command", "POST", "projIndex", "kind", "name"},            // POST
+	15: {"/admin/teller/commands", "GET", "projIndex"},                            // GET
+	16: {"/admin/fleet", "GET"},                                                   // GET
+	17: {"/admin/rec/mint", "POST", "projIndex"},                                  // POST
+	18: {"/admin/carbon/factor", "POST", "country", "factor"},                     // POST
+	19: {"/admin/carbon/factors", "GET"},                                          // GET
+	20: {"/admin/irradiance", "POST", "country", "latitude", "monthly"},           // POST
+	21: {"/admin/irradiance/tables", "GET"},                                       // GET
+	22: {"/admin/billing/plan", "POST", "projIndex"},                              // POST
+	23: {"/admin/billing/run", "POST"},                                            // POST
+	24: {"/admin/utility", "POST", "name", "scheme", "importrate", "exportrate"},  // POST
+	25: {"/admin/utilities", "GET"},                                               // GET
+	26: {"/admin/project/utility", "POST", "projIndex", "utility", "beneficiary"}, // POST
+	27: {"/admin/decommission/settle", "POST", "index"},                           // POST
+	28: {"/admin/decommission/close", "POST", "index"},                            // POST
+	29: {"/admin/project/withdrawalpolicy", "POST", "projIndex", "guarantor"},     // POST
+	30: {"/admin/device/reset", "POST", "index"},                                  // POST
+	31: {"/admin/settlement/receive", "POST", "index", "amount", "reference"},     // POST
 }
 
 // validateAdmin validates whether a given user is an admin and returns a bool
@@ -273,3 +318,605 @@ func projectFeatured() {
 		erpc.ResponseHandler(w, erpc.StatusOK)
 	})
 }
+
+// getStuckInvestments returns a list of pending investments that have failed or stalled
+func getStuckInvestments() {
+	http.HandleFunc(AdminRPC[10][0], func(w http.ResponseWriter, r *http.Request) {
+		_, admin := validateAdmin(w, r, AdminRPC[10][2:], AdminRPC[10][1])
+		if !admin {
+			return
+		}
+
+		investments, err := core.RetrieveStuckInvestments()
+		if erpc.Err(w, err, erpc.StatusInternalServerError) {
+			return
+		}
+
+		erpc.MarshalSend(w, investments)
+	})
+}
+
+// compensateInvestment refunds a stuck investment whose investor assets haven't been sent out
+func compensateInvestment() {
+	http.HandleFunc(AdminRPC[11][0], func(w http.ResponseWriter, r *http.Request) {
+		_, admin := validateAdmin(w, r, AdminRPC[11][2:], AdminRPC[11][1])
+		if !admin {
+			return
+		}
+
+		index, err := utils.ToInt(r.FormValue("index"))
+		if erpc.Err(w, err, erpc.StatusBadRequest, "", messages.ParamError("index")) {
+			return
+		}
+
+		investment, err := core.RetrieveInvestment(index)
+		if erpc.Err(w, err, erpc.StatusInternalServerError) {
+			return
+		}
+
+		err = core.CompensateInvestment(&investment)
+		if erpc.Err(w, err, erpc.StatusInternalServerError) {
+			return
+		}
+
+		erpc.MarshalSend(w, investment)
+	})
+}
+
+// reconcileProject returns a report of discrepancies between a project's database fields and the ledger
+func reconcileProject() {
+	http.HandleFunc(AdminRPC[12][0], func(w http.ResponseWriter, r *http.Request) {
+		_, admin := validateAdmin(w, r, AdminRPC[12][2:], AdminRPC[12][1])
+		if !admin {
+			return
+		}
+
+		projIndex, err := utils.ToInt(r.URL.Query()["projIndex"][0])
+		if erpc.Err(w, err, erpc.StatusBadRequest, "", messages.ParamError("projIndex")) {
+			return
+		}
+
+		report, err := core.ReconcileProject(projIndex, false)
+		if erpc.Err(w, err, erpc.StatusInternalServerError) {
+			return
+		}
+
+		erpc.MarshalSend(w, report)
+	})
+}
+
+// repairProject reconciles a project and overwrites drifted database fields with ledger values
+func repairProject() {
+	http.HandleFunc(AdminRPC[13][0], func(w http.ResponseWriter, r *http.Request) {
+		_, admin := validateAdmin(w, r, AdminRPC[13][2:], AdminRPC[13][1])
+		if !admin {
+			return
+		}
+
+		projIndex, err := utils.ToInt(r.FormValue("projIndex"))
+		if erpc.Err(w, err, erpc.StatusBadRequest, "", messages.ParamError("projIndex")) {
+			return
+		}
+
+		report, err := core.ReconcileProject(projIndex, true)
+		if erpc.Err(w, err, erpc.StatusInternalServerError) {
+			return
+		}
+
+		erpc.MarshalSend(w, report)
+	})
+}
+
+// sendTellerCommand queues a config change (kind=config, name=key, value) or a one off command
+// (kind=command, name=command) for a project's teller
+func sendTellerCommand() {
+	http.HandleFunc(AdminRPC[14][0], func(w http.ResponseWriter, r *http.Request) {
+		user, admin := validateAdmin(w, r, AdminRPC[14][2:], AdminRPC[14][1])
+		if !admin {
+			return
+		}
+
+		projIndex, err := utils.ToInt(r.FormValue("projIndex"))
+		if erpc.Err(w, err, erpc.StatusBadRequest, "", messages.ParamError("projIndex")) {
+			return
+		}
+
+		cmd, err := core.NewTellerCommand(projIndex, r.FormValue("kind"), r.FormValue("name"),
+			r.FormValue("value"), user.Username)
+		if erpc.Err(w, err, erpc.StatusBadRequest, "could not queue teller command") {
+			return
+		}
+
+		erpc.MarshalSend(w, cmd)
+	})
+}
+
+// getTellerCommandHistory returns all commands sent to a project's teller along with their results
+func getTellerCommandHistory() {
+	http.HandleFunc(AdminRPC[15][0], func(w http.ResponseWriter, r *http.Request) {
+		_, admin := validateAdmin(w, r, AdminRPC[15][2:], AdminRPC[15][1])
+		if !admin {
+			return
+		}
+
+		projIndex, err := utils.ToInt(r.URL.Query()["projIndex"][0])
+		if erpc.Err(w, err, erpc.StatusBadRequest, "", messages.ParamError("projIndex")) {
+			return
+		}
+
+		cmds, err := core.RetrieveTellerCommands(projIndex)
+		if erpc.Err(w, err, erpc.StatusInternalServerError) {
+			return
+		}
+
+		erpc.MarshalSend(w, cmds)
+	})
+}
+
+// getFleet lists the tellers and IoT hubs that are unhealthy along with their uptime. Pass all=true
+// to list every device in the fleet
+func getFleet() {
+	http.HandleFunc(AdminRPC[16][0], func(w http.ResponseWriter, r *http.Request) {
+		_, admin := validateAdmin(w, r, AdminRPC[16][2:], AdminRPC[16][1])
+		if !admin {
+			return
+		}
+
+		all := r.URL.Query().Get("all") == "true"
+		fleet, err := core.FleetReport(!all)
+		if erpc.Err(w, err, erpc.StatusInternalServerError) {
+			return
+		}
+
+		erpc.MarshalSend(w, fleet)
+	})
+}
+
+// mintRECs mints a project's outstanding RECs without waiting for the next minting run
+func mintRECs() {
+	http.HandleFunc(AdminRPC[17][0], func(w http.ResponseWriter, r *http.Request) {
+		_, admin := validateAdmin(w, r, AdminRPC[17][2:], AdminRPC[17][1])
+		if !admin {
+			return
+		}
+
+		projIndex, err := utils.ToInt(r.FormValue("projIndex"))
+		if erpc.Err(w, err, erpc.StatusBadRequest, "", messages.ParamError("projIndex")) {
+			return
+		}
+
+		recs, err := core.MintRECs(projIndex)
+		if erpc.Err(w, err, erpc.StatusInternalServerError) {
+			return
+		}
+
+		erpc.MarshalSend(w, recs)
+	})
+}
+
+// setEmissionFactor sets the grid emission factor (kgCO2e/kWh) of a country, or of a state if the
+// optional state param is passed
+func setEmissionFactor() {
+	http.HandleFunc(AdminRPC[18][0], func(w http.ResponseWriter, r *http.Request) {
+		_, admin := validateAdmin(w, r, AdminRPC[18][2:], AdminRPC[18][1])
+		if !admin {
+			return
+		}
+
+		factor, err := utils.ToFloat(r.FormValue("factor"))
+		if erpc.Err(w, err, erpc.StatusBadRequest, "", messages.ConversionError) {
+			return
+		}
+
+		x, err := core.SetEmissionFactor(r.FormValue("country"), r.FormValue("state"), factor, r.FormValue("source"))
+		if erpc.Err(w, err, erpc.StatusBadRequest) {
+			return
+		}
+
+		erpc.MarshalSend(w, x)
+	})
+}
+
+// getEmissionFactors returns all configured grid emission factors
+func getEmissionFactors() {
+	http.HandleFunc(AdminRPC[19][0], func(w http.ResponseWriter, r *http.Request) {
+		_, admin := validateAdmin(w, r, AdminRPC[19][2:], AdminRPC[19][1])
+		if !admin {
+			return
+		}
+
+		factors, err := core.RetrieveEmissionFactors()
+		if erpc.Err(w, err, erpc.StatusInternalServerError) {
+			return
+		}
+
+		erpc.MarshalSend(w, factors)
+	})
+}
+
+// setIrradianceTable sets the irradiance table of a country, or of a state if the optional state
+// param is passed. monthly is a comma separated list of the average daily irradiance (kWh/m2) of
+// each month starting in January
+func setIrradianceTable() {
+	http.HandleFunc(AdminRPC[20][0], func(w http.ResponseWriter, r *http.Request) {
+		_, admin := validateAdmin(w, r, AdminRPC[20][2:], AdminRPC[20][1])
+		if !admin {
+			return
+		}
+
+		latitude, err := utils.ToFloat(r.FormValue("latitude"))
+		if erpc.Err(w, err, erpc.StatusBadRequest, "", messages.ConversionError) {
+			return
+		}
+
+		values := strings.Split(r.FormValue("monthly"), ",")
+		if len(values) != 12 {
+			erpc.ResponseHandler(w, erpc.StatusBadRequest, messages.ParamError("monthly"))
+			return
+		}
+
+		var monthly [12]float64
+		for i, value := range values {
+			monthly[i], err = utils.ToFloat(strings.TrimSpace(value))
+			if erpc.Err(w, err, erpc.StatusBadRequest, "", messages.ConversionError) {
+				return
+			}
+		}
+
+		x, err := core.SetIrradianceTable(r.FormValue("country"), r.FormValue("state"), latitude, monthly,
+			r.FormValue("source"))
+		if erpc.Err(w, err, erpc.StatusBadRequest) {
+			return
+		}
+
+		erpc.MarshalSend(w, x)
+	})
+}
+
+// getIrradianceTables returns all configured irradiance tables
+func getIrradianceTables() {
+	http.HandleFunc(AdminRPC[21][0], func(w http.ResponseWriter, r *http.Request) {
+		_, admin := validateAdmin(w, r, AdminRPC[21][2:], AdminRPC[21][1])
+		if !admin {
+			return
+		}
+
+		tables, err := core.RetrieveIrradianceTables()
+		if erpc.Err(w, err, erpc.StatusInternalServerError) {
+			return
+		}
+
+		erpc.MarshalSend(w, tables)
+	})
+}
+
+// setBillingPlan sets the tariff (USD/kWh) a project's recipient is invoiced at. Fixed fees can be
+// passed as fees=description:amount;description:amount and the days until invoices are due as duedays.
+// Time of use rates are passed as tou=start-end:rate;start-end:rate with hours in the project's local
+// time, given by utcoffset, and arbitrageshare is the fraction of battery arbitrage value invoiced.
+// Terms that aren't passed keep their current value
+func setBillingPlan() {
+	http.HandleFunc(AdminRPC[22][0], func(w http.ResponseWriter, r *http.Request) {
+		_, admin := validateAdmin(w, r, AdminRPC[22][2:], AdminRPC[22][1])
+		if !admin {
+			return
+		}
+
+		projIndex, err := utils.ToInt(r.FormValue("projIndex"))
+		if erpc.Err(w, err, erpc.StatusBadRequest, "", messages.ParamError("projIndex")) {
+			return
+		}
+
+		var plan core.BillingPlan
+		if r.FormValue("tariff") != "" {
+			plan.Tariff, err = utils.ToFloat(r.FormValue("tariff"))
+			if erpc.Err(w, err, erpc.StatusBadRequest, "", messages.ConversionError) {
+				return
+			}
+		}
+
+		if r.FormValue("duedays") != "" {
+			plan.DueDays, err = utils.ToInt(r.FormValue("duedays"))
+			if erpc.Err(w, err, erpc.StatusBadRequest, "", messages.ConversionError) {
+				return
+			}
+		}
+
+		if r.FormValue("fees") != "" {
+			for _, fee := range strings.Split(r.FormValue("fees"), ";") {
+				parts := strings.Split(fee, ":")
+				if len(parts) != 2 {
+					erpc.ResponseHandler(w, erpc.StatusBadRequest, messages.ParamError("fees"))
+					return
+				}
+				amount, err := utils.ToFloat(strings.TrimSpace(parts[1]))
+				if erpc.Err(w, err, erpc.StatusBadRequest, "", messages.ConversionError) {
+					return
+				}
+				plan.Fees = append(plan.Fees, core.BillingFee{Description: strings.TrimSpace(parts[0]), Amount: amount})
+			}
+		}
+
+		if r.FormValue("tou") != "" {
+			for _, rate := range strings.Split(r.FormValue("tou"), ";") {
+				var tou core.TimeOfUseRate
+				parts := strings.Split(rate, ":")
+				hours := strings.Split(parts[0], "-")
+				if len(parts) != 2 || len(hours) != 2 {
+					erpc.ResponseHandler(w, erpc.StatusBadRequest, messages.ParamError("tou"))
+					return
+				}
+				tou.StartHour, err = utils.ToInt(strings.TrimSpace(hours[0]))
+				if erpc.Err(w, err, erpc.StatusBadRequest, "", messages.ConversionError) {
+					return
+				}
+				tou.EndHour, err = utils.ToInt(strings.TrimSpace(hours[1]))
+				if erpc.Err(w, err, erpc.StatusBadRequest, "", messages.ConversionError) {
+					return
+				}
+				tou.Rate, err = utils.ToFloat(strings.TrimSpace(parts[1]))
+				if erpc.Err(w, err, erpc.StatusBadRequest, "", messages.ConversionError) {
+					return
+				}
+				plan.TimeOfUse = append(plan.TimeOfUse, tou)
+			}
+		}
+
+		if r.FormValue("utcoffset") != "" {
+			plan.UTCOffset, err = utils.ToInt(r.FormValue("utcoffset"))
+			if erpc.Err(w, err, erpc.StatusBadRequest, "", messages.ConversionError) {
+				return
+			}
+		}
+
+		if r.FormValue("arbitrageshare") != "" {
+			plan.ArbitrageShare, err = utils.ToFloat(r.FormValue("arbitrageshare"))
+			if erpc.Err(w, err, erpc.StatusBadRequest, "", messages.ConversionError) {
+				return
+			}
+		}
+
+		project, err := core.SetBillingPlan(projIndex, func(stored *core.BillingPlan) {
+			// only the terms that were passed replace the stored ones
+			if r.FormValue("tariff") != "" {
+				stored.Tariff = plan.Tariff
+			}
+			if r.FormValue("duedays") != "" {
+				stored.DueDays = plan.DueDays
+			}
+			if r.FormValue("fees") != "" {
+				stored.Fees = plan.Fees
+			}
+			if r.FormValue("tou") != "" {
+				stored.TimeOfUse = plan.TimeOfUse
+			}
+			if r.FormValue("utcoffset") != "" {
+				stored.UTCOffset = plan.UTCOffset
+			}
+			if r.FormValue("arbitrageshare") != "" {
+				stored.ArbitrageShare = plan.ArbitrageShare
+			}
+		})
+		if erpc.Err(w, err, erpc.StatusBadRequest) {
+			return
+		}
+
+		erpc.MarshalSend(w, project.Billing)
+	})
+}
+
+// runBilling issues all outstanding invoices without waiting for the next billing run
+func runBilling() {
+	http.HandleFunc(AdminRPC[23][0], func(w http.ResponseWriter, r *http.Request) {
+		_, admin := validateAdmin(w, r, AdminRPC[23][2:], AdminRPC[23][1])
+		if !admin {
+			return
+		}
+
+		invoices, err := core.GenerateInvoices(utils.Unix())
+		if erpc.Err(w, err, erpc.StatusInternalServerError) {
+			return
+		}
+
+		erpc.MarshalSend(w, invoices)
+	})
+}
+
+// setUtility creates a utility or updates an existing one if index is passed. Pass rollover=true
+// to carry net metering surplus over to the next month instead of paying it out
+func setUtility() {
+	http.HandleFunc(AdminRPC[24][0], func(w http.ResponseWriter, r *http.Request) {
+		_, admin := validateAdmin(w, r, AdminRPC[24][2:], AdminRPC[24][1])
+		if !admin {
+			return
+		}
+
+		var index int
+		var err error
+		if r.FormValue("index") != "" {
+			index, err = utils.ToInt(r.FormValue("index"))
+			if erpc.Err(w, err, erpc.StatusBadRequest, "", messages.ConversionError) {
+				return
+			}
+		}
+
+		importRate, err := utils.ToFloat(r.FormValue("importrate"))
+		if erpc.Err(w, err, erpc.StatusBadRequest, "", messages.ConversionError) {
+			return
+		}
+
+		exportRate, err := utils.ToFloat(r.FormValue("exportrate"))
+		if erpc.Err(w, err, erpc.StatusBadRequest, "", messages.ConversionError) {
+			return
+		}
+
+		utility, err := core.SetUtility(index, r.FormValue("name"), r.FormValue("scheme"), importRate, exportRate,
+			r.FormValue("rollover") == "true")
+		if erpc.Err(w, err, erpc.StatusBadRequest) {
+			return
+		}
+
+		erpc.MarshalSend(w, utility)
+	})
+}
+
+// getUtilities returns all utilities
+func getUtilities() {
+	http.HandleFunc(AdminRPC[25][0], func(w http.ResponseWriter, r *http.Request) {
+		_, admin := validateAdmin(w, r, AdminRPC[25][2:], AdminRPC[25][1])
+		if !admin {
+			return
+		}
+
+		utilities, err := core.RetrieveAllUtilities()
+		if erpc.Err(w, err, erpc.StatusInternalServerError) {
+			return
+		}
+
+		erpc.MarshalSend(w, utilities)
+	})
+}
+
+// setProjectUtility connects a project to a utility and sets whether its exports are settled to
+// the recipient or to investors
+func setProjectUtility() {
+	http.HandleFunc(AdminRPC[26][0], func(w http.ResponseWriter, r *http.Request) {
+		_, admin := validateAdmin(w, r, AdminRPC[26][2:], AdminRPC[26][1])
+		if !admin {
+			return
+		}
+
+		projIndex, err := utils.ToInt(r.FormValue("projIndex"))
+		if erpc.Err(w, err, erpc.StatusBadRequest, "", messages.ConversionError) {
+			return
+		}
+
+		utilityIndex, err := utils.ToInt(r.FormValue("utility"))
+		if erpc.Err(w, err, erpc.StatusBadRequest, "", messages.ConversionError) {
+			return
+		}
+
+		project, err := core.SetProjectUtility(projIndex, utilityIndex, r.FormValue("beneficiary"))
+		if erpc.Err(w, err, erpc.StatusBadRequest) {
+			return
+		}
+
+		erpc.MarshalSend(w, project)
+	})
+}
+
+// settleDecommission returns the remaining escrow balance of a certified project to its investors
+func settleDecommission() {
+	http.HandleFunc(AdminRPC[27][0], func(w http.ResponseWriter, r *http.Request) {
+		_, admin := validateAdmin(w, r, AdminRPC[27][2:], AdminRPC[27][1])
+		if !admin {
+			return
+		}
+
+		index, err := utils.ToInt(r.FormValue("index"))
+		if erpc.Err(w, err, erpc.StatusBadRequest, "", messages.ConversionError) {
+			return
+		}
+
+		decommission, err := core.SettleDecommission(index)
+		if erpc.Err(w, err, erpc.StatusBadRequest) {
+			return
+		}
+
+		erpc.MarshalSend(w, decommission)
+	})
+}
+
+// closeDecommission closes the escrow and issuer accounts of a settled project and terminates it
+func closeDecommission() {
+	http.HandleFunc(AdminRPC[28][0], func(w http.ResponseWriter, r *http.Request) {
+		_, admin := validateAdmin(w, r, AdminRPC[28][2:], AdminRPC[28][1])
+		if !admin {
+			return
+		}
+
+		index, err := utils.ToInt(r.FormValue("index"))
+		if erpc.Err(w, err, erpc.StatusBadRequest, "", messages.ConversionError) {
+			return
+		}
+
+		decommission, err := core.CloseProjectAccounts(index)
+		if erpc.Err(w, err, erpc.StatusBadRequest) {
+			return
+		}
+
+		erpc.MarshalSend(w, decommission)
+	})
+}
+
+// setWithdrawalPolicy sets whether the guarantor of a project must approve withdrawals from its escrow
+func setWithdrawalPolicy() {
+	http.HandleFunc(AdminRPC[29][0], func(w http.ResponseWriter, r *http.Request) {
+		_, admin := validateAdmin(w, r, AdminRPC[29][2:], AdminRPC[29][1])
+		if !admin {
+			return
+		}
+
+		projIndex, err := utils.ToInt(r.FormValue("projIndex"))
+		if erpc.Err(w, err, erpc.StatusBadRequest, "", messages.ConversionError) {
+			return
+		}
+
+		err = core.SetWithdrawalPolicy(projIndex, r.FormValue("guarantor") == "true")
+		if erpc.Err(w, err, erpc.StatusBadRequest) {
+			return
+		}
+
+		erpc.ResponseHandler(w, erpc.StatusOK)
+	})
+}
+
+// resetDevice removes the device key of a recipient who lost their device so that a replacement can register
+func resetDevice() {
+	http.HandleFunc(AdminRPC[30][0], func(w http.ResponseWriter, r *http.Request) {
+		_, admin := validateAdmin(w, r, AdminRPC[30][2:], AdminRPC[30][1])
+		if !admin {
+			return
+		}
+
+		index, err := utils.ToInt(r.FormValue("index"))
+		if erpc.Err(w, err, erpc.StatusBadRequest, "", messages.ConversionError) {
+			return
+		}
+
+		err = core.ResetDevice(index)
+		if erpc.Err(w, err, erpc.StatusBadRequest) {
+			return
+		}
+
+		erpc.ResponseHandler(w, erpc.StatusOK)
+	})
+}
+
+// receiveSettlement records the utility's payment for an export settlement and passes the amount
+// received on to the settlement's beneficiary
+func receiveSettlement() {
+	http.HandleFunc(AdminRPC[31][0], func(w http.ResponseWriter, r *http.Request) {
+		_, admin := validateAdmin(w, r, AdminRPC[31][2:], AdminRPC[31][1])
+		if !admin {
+			return
+		}
+
+		index, err := utils.ToInt(r.FormValue("index"))
+		if erpc.Err(w, err, erpc.StatusBadRequest, "", messages.ConversionError) {
+			return
+		}
+
+		amount, err := utils.ToFloat(r.FormValue("amount"))
+		if erpc.Err(w, err, erpc.StatusBadRequest, "", messages.ConversionError) {
+			return
+		}
+
+		settlement, err := core.RecordUtilityPayment(index, amount, r.FormValue("reference"))
+		if erpc.Err(w, err, erpc.StatusBadRequest) {
+			return
+		}
+
+		erpc.MarshalSend(w, settlement)
+	})
+}
@@ -19,6 +19,8 @@ func setupDeveloperRPCs() {
 	withdrawdeveloper()
 	developerDashboard()
 	requestWaterfall()
+	getDeveloperWithdrawals()
+	cancelWithdrawal()
 }
 
 // DevRPC contains a list of all the developer rpc endpoints
@@ -26,9 +28,12 @@ var DevRPC = map[int][]string{
 	1: {"/developer/withdraw", "POST", "amount", "projIndex"}, // POST
 	2: {"/developer/dashboard", "GET"},                        // GET
 	3: {"/developer/money/request", "GET", "index", "amount"}, // GET
+	4: {"/developer/withdrawals", "GET", "projIndex"},         // GET
+	5: {"/developer/withdrawal/cancel", "POST", "index"},      // POST
 }
 
-// withdrawdeveloper can be called by a developer wishing to withdraw funds from the platfomr
+// withdrawdeveloper can be called by a developer wishing to withdraw funds from the platfomr. The
+// withdrawal is proposed to the project's recipient and guarantor for approval
 func withdrawdeveloper() {
 	http.HandleFunc(DevRPC[1][0], func(w http.ResponseWriter, r *http.Request) {
 		prepEntity, err := entityValidateHelper(w, r, DevRPC[1][2:], DevRPC[1][1])
@@ -55,12 +60,12 @@ func withdrawdeveloper() {
 			return
 		}
 
-		err = core.RequestWaterfallWithdrawal(prepEntity.U.Index, projIndex, amount)
+		proposal, err := core.RequestWaterfallWithdrawal(prepEntity.U.Index, projIndex, amount)
 		if erpc.Err(w, err, erpc.StatusInternalServerError) {
 			return
 		}
 
-		erpc.ResponseHandler(w, erpc.StatusOK)
+		erpc.MarshalSend(w, proposal)
 		return
 	})
 }
@@ -242,7 +247,7 @@ func developerDashboard() {
 	})
 }
 
-// requestWaterfall requests that a developer be paid for their services
+// requestWaterfall proposes that a developer be paid for their services
 func requestWaterfall() {
 	http.HandleFunc(DevRPC[3][0], func(w http.ResponseWriter, r *http.Request) {
 		prepEntity, err := entityValidateHelper(w, r, DevRPC[3][2:], DevRPC[3][1])
@@ -270,11 +275,57 @@ func requestWaterfall() {
 			return
 		}
 
-		err = core.RequestWaterfallWithdrawal(prepEntity.U.Index, projIndex, amount)
+		proposal, err := core.RequestWaterfallWithdrawal(prepEntity.U.Index, projIndex, amount)
 		if erpc.Err(w, err, erpc.StatusInternalServerError) {
 			return
 		}
 
-		erpc.ResponseHandler(w, erpc.StatusOK)
+		erpc.MarshalSend(w, proposal)
+	})
+}
+
+// getDeveloperWithdrawals returns the withdrawal proposals of a project
+func getDeveloperWithdrawals() {
+	http.HandleFunc(DevRPC[4][0], func(w http.ResponseWriter, r *http.Request) {
+		prepEntity, err := entityValidateHelper(w, r, DevRPC[4][2:], DevRPC[4][1])
+		if err != nil {
+			log.Println("Error while validating entity", err)
+			return
+		}
+
+		project, err := projectEntity(w, prepEntity, r.URL.Query()["projIndex"][0])
+		if err != nil {
+			return
+		}
+
+		proposals, err := core.RetrieveWithdrawals(project.Index)
+		if erpc.Err(w, err, erpc.StatusInternalServerError) {
+			return
+		}
+
+		erpc.MarshalSend(w, proposals)
+	})
+}
+
+// cancelWithdrawal cancels a pending withdrawal proposal made by the developer
+func cancelWithdrawal() {
+	http.HandleFunc(DevRPC[5][0], func(w http.ResponseWriter, r *http.Request) {
+		prepEntity, err := entityValidateHelper(w, r, DevRPC[5][2:], DevRPC[5][1])
+		if err != nil {
+			log.Println("Error while validating entity", err)
+			return
+		}
+
+		index, err := utils.ToInt(r.FormValue("index"))
+		if erpc.Err(w, err, erpc.StatusBadRequest, "", messages.ConversionError) {
+			return
+		}
+
+		proposal, err := core.CancelWithdrawal(index, prepEntity.U.Index)
+		if erpc.Err(w, err, erpc.StatusBadRequest) {
+			return
+		}
+
+		erpc.MarshalSend(w, proposal)
 	})
 }
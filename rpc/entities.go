@@ -3,6 +3,8 @@ package rpc
 import (
 	"log"
 	"net/http"
+	"strconv"
+	"strings"
 
 	"github.com/YaleOpenLab/opensolar/messages"
 
@@ -23,18 +25,42 @@ func setupEntityRPCs() {
 	addCollateral()
 	proposeOpensolarProject()
 	registerEntity()
+	setPerformanceModel()
+	getPerformanceEvents()
+	addBattery()
+	registerEquipment()
+	getEquipment()
+	openWorkOrder()
+	closeWorkOrder()
+	getWorkOrders()
+	startDecommission()
+	recordCustody()
+	certifyRecycling()
+	getDecommission()
 }
 
 // EntityRPC is a list of endpoints that can be called by an entity
 var EntityRPC = map[int][]string{
-	1: {"/entity/validate", "GET"},                                                                  // GET
-	2: {"/entity/stage0", "GET"},                                                                    // GET
-	3: {"/entity/stage1", "GET"},                                                                    // GET
-	4: {"/entity/stage2", "GET"},                                                                    // GET
-	5: {"/entity/addcollateral", "POST", "amount", "collateral"},                                    // POST
-	6: {"/entity/proposeproject/opensolar", "POST", "projIndex", "fee"},                             // POST
-	7: {"/entity/register", "POST", "name", "username", "pwhash", "token", "seedpwd", "entityType"}, // POST
-	8: {"/entity/contractor/dashboard", "GET"},                                                      // GET
+	1:  {"/entity/validate", "GET"},                                                                    // GET
+	2:  {"/entity/stage0", "GET"},                                                                      // GET
+	3:  {"/entity/stage1", "GET"},                                                                      // GET
+	4:  {"/entity/stage2", "GET"},                                                                      // GET
+	5:  {"/entity/addcollateral", "POST", "amount", "collateral"},                                      // POST
+	6:  {"/entity/proposeproject/opensolar", "POST", "projIndex", "fee"},                               // POST
+	7:  {"/entity/register", "POST", "name", "username", "pwhash", "token", "seedpwd", "entityType"},   // POST
+	8:  {"/entity/contractor/dashboard", "GET"},                                                        // GET
+	9:  {"/entity/performance/model", "POST", "projIndex"},                                             // POST
+	10: {"/entity/performance/events", "GET", "projIndex"},                                             // GET
+	11: {"/entity/battery", "POST", "projIndex", "capacity"},                                           // POST
+	12: {"/entity/equipment/register", "POST", "projIndex", "kind", "manufacturer", "model", "serial"}, // POST
+	13: {"/entity/equipment", "GET", "projIndex"},                                                      // GET
+	14: {"/entity/workorder/open", "POST", "projIndex", "kind", "description"},                         // POST
+	15: {"/entity/workorder/close", "POST", "index", "resolution", "evidence"},                         // POST
+	16: {"/entity/workorders", "GET", "projIndex"},                                                     // GET
+	17: {"/entity/decommission/start", "POST", "projIndex", "recycler", "reason"},                      // POST
+	18: {"/entity/decommission/custody", "POST", "equipment", "event", "evidence"},                     // POST
+	19: {"/entity/decommission/certify", "POST", "index", "certificate"},                               // POST
+	20: {"/entity/decommission", "GET", "index"},                                                       // GET
 }
 
 // entityValidateHelper is a helper that helps validate an entity, and returns
@@ -276,6 +302,8 @@ func registerEntity() {
 				a.Guarantor = true
 			case "originator":
 				a.Originator = true
+			case "recycler":
+				a.Recycler = true
 			}
 
 			a.U = &user
@@ -297,6 +325,8 @@ func registerEntity() {
 			user, err = core.NewGuarantor(username, pwhash, seedpwd, name)
 		case "originator":
 			user, err = core.NewOriginator(username, pwhash, seedpwd, name)
+		case "recycler":
+			user, err = core.NewRecycler(username, pwhash, seedpwd, name)
 
 		}
 
@@ -307,3 +337,453 @@ func registerEntity() {
 		erpc.MarshalSend(w, user)
 	})
 }
+
+// projectEntity retrieves a project and checks that the entity is its contractor or one of its
+// developers
+func projectEntity(w http.ResponseWriter, entity core.Entity, projIndexx string) (core.Project, error) {
+	projIndex, err := utils.ToInt(projIndexx)
+	if erpc.Err(w, err, erpc.StatusBadRequest, "", messages.ConversionError) {
+		return core.Project{}, err
+	}
+
+	project, err := core.RetrieveProject(projIndex)
+	if erpc.Err(w, err, erpc.StatusInternalServerError) {
+		return project, err
+	}
+
+	if entity.U.Admin || entity.U.Index == project.ContractorIndex || entity.U.Index == project.MainDeveloperIndex {
+		return project, nil
+	}
+	for _, index := range project.DeveloperIndices {
+		if entity.U.Index == index {
+			return project, nil
+		}
+	}
+
+	erpc.ResponseHandler(w, erpc.StatusUnauthorized)
+	return project, errors.New("entity is not the contractor or a developer of the project")
+}
+
+// setPerformanceModel sets any of the panel tilt, capacity (kW), latitude, system losses and
+// underperformance threshold used to forecast a project's generation. Parameters that aren't
+// passed keep their current value
+func setPerformanceModel() {
+	http.HandleFunc(EntityRPC[9][0], func(w http.ResponseWriter, r *http.Request) {
+		prepEntity, err := entityValidateHelper(w, r, EntityRPC[9][2:], EntityRPC[9][1])
+		if err != nil {
+			log.Println("Error while validating entity", err)
+			return
+		}
+
+		project, err := projectEntity(w, prepEntity, r.FormValue("projIndex"))
+		if err != nil {
+			return
+		}
+
+		values := make(map[string]float64)
+		for _, param := range []string{"tilt", "capacity", "latitude", "losses", "threshold"} {
+			if r.FormValue(param) == "" {
+				continue
+			}
+			values[param], err = utils.ToFloat(r.FormValue(param))
+			if erpc.Err(w, err, erpc.StatusBadRequest, "", messages.ParamError(param)) {
+				return
+			}
+		}
+
+		project, err = core.SetPerformanceModel(project.Index, func(model *core.PerformanceModel) {
+			params := map[string]*float64{
+				"tilt":      &model.Tilt,
+				"capacity":  &model.CapacityKW,
+				"latitude":  &model.Latitude,
+				"losses":    &model.Losses,
+				"threshold": &model.Threshold,
+			}
+			for param, value := range values {
+				*params[param] = value
+			}
+		})
+		if erpc.Err(w, err, erpc.StatusBadRequest) {
+			return
+		}
+
+		erpc.MarshalSend(w, project.Performance)
+	})
+}
+
+// getPerformanceEvents returns the underperformance events raised for a project
+func getPerformanceEvents() {
+	http.HandleFunc(EntityRPC[10][0], func(w http.ResponseWriter, r *http.Request) {
+		prepEntity, err := entityValidateHelper(w, r, EntityRPC[10][2:], EntityRPC[10][1])
+		if err != nil {
+			log.Println("Error while validating entity", err)
+			return
+		}
+
+		project, err := projectEntity(w, prepEntity, r.URL.Query()["projIndex"][0])
+		if err != nil {
+			return
+		}
+
+		events, err := core.RetrievePerformanceEvents(project.Index)
+		if erpc.Err(w, err, erpc.StatusInternalServerError) {
+			return
+		}
+
+		erpc.MarshalSend(w, events)
+	})
+}
+
+// addBattery attaches a battery with the given usable capacity (kWh) to a project. The asset id,
+// manufacturer, model, chemistry, power (kW), rated cycles, end of life state of health and
+// install time can optionally be passed
+func addBattery() {
+	http.HandleFunc(EntityRPC[11][0], func(w http.ResponseWriter, r *http.Request) {
+		prepEntity, err := entityValidateHelper(w, r, EntityRPC[11][2:], EntityRPC[11][1])
+		if err != nil {
+			log.Println("Error while validating entity", err)
+			return
+		}
+
+		project, err := projectEntity(w, prepEntity, r.FormValue("projIndex"))
+		if err != nil {
+			return
+		}
+
+		spec := core.Battery{
+			AssetID:      r.FormValue("assetid"),
+			Manufacturer: r.FormValue("manufacturer"),
+			Model:        r.FormValue("model"),
+			Chemistry:    r.FormValue("chemistry"),
+		}
+		params := map[string]*float64{
+			"capacity":    &spec.CapacityKWh,
+			"power":       &spec.PowerKW,
+			"ratedcycles": &spec.RatedCycles,
+			"endoflife":   &spec.EndOfLife,
+		}
+		for param, value := range params {
+			if r.FormValue(param) == "" {
+				continue
+			}
+			*value, err = utils.ToFloat(r.FormValue(param))
+			if erpc.Err(w, err, erpc.StatusBadRequest, "", messages.ParamError(param)) {
+				return
+			}
+		}
+
+		if r.FormValue("installedat") != "" {
+			installedAt, err := utils.ToInt(r.FormValue("installedat"))
+			if erpc.Err(w, err, erpc.StatusBadRequest, "", messages.ParamError("installedat")) {
+				return
+			}
+			spec.InstalledAt = int64(installedAt)
+		}
+
+		battery, err := core.AddBattery(project.Index, spec)
+		if erpc.Err(w, err, erpc.StatusBadRequest) {
+			return
+		}
+
+		erpc.MarshalSend(w, battery)
+	})
+}
+
+// registerEquipment registers a serial numbered piece of equipment installed on a project. The
+// install time and warranty expiry (unix times) and the days between preventive maintenance can
+// optionally be passed
+func registerEquipment() {
+	http.HandleFunc(EntityRPC[12][0], func(w http.ResponseWriter, r *http.Request) {
+		prepEntity, err := entityValidateHelper(w, r, EntityRPC[12][2:], EntityRPC[12][1])
+		if err != nil {
+			log.Println("Error while validating entity", err)
+			return
+		}
+
+		project, err := projectEntity(w, prepEntity, r.FormValue("projIndex"))
+		if err != nil {
+			return
+		}
+
+		spec := core.Equipment{
+			Kind:         r.FormValue("kind"),
+			Manufacturer: r.FormValue("manufacturer"),
+			Model:        r.FormValue("model"),
+			Serial:       r.FormValue("serial"),
+		}
+		params := map[string]*int64{
+			"installedat": &spec.InstalledAt,
+			"warranty":    &spec.WarrantyExpiry,
+		}
+		for param, value := range params {
+			if r.FormValue(param) == "" {
+				continue
+			}
+			x, err := utils.ToInt(r.FormValue(param))
+			if erpc.Err(w, err, erpc.StatusBadRequest, "", messages.ParamError(param)) {
+				return
+			}
+			*value = int64(x)
+		}
+
+		if r.FormValue("maintenancedays") != "" {
+			spec.MaintenanceDays, err = utils.ToInt(r.FormValue("maintenancedays"))
+			if erpc.Err(w, err, erpc.StatusBadRequest, "", messages.ParamError("maintenancedays")) {
+				return
+			}
+		}
+
+		equipment, err := core.RegisterEquipment(project.Index, prepEntity.U.Index, spec)
+		if erpc.Err(w, err, erpc.StatusBadRequest) {
+			return
+		}
+
+		erpc.MarshalSend(w, equipment)
+	})
+}
+
+// getEquipment returns the equipment registered on a project
+func getEquipment() {
+	http.HandleFunc(EntityRPC[13][0], func(w http.ResponseWriter, r *http.Request) {
+		prepEntity, err := entityValidateHelper(w, r, EntityRPC[13][2:], EntityRPC[13][1])
+		if err != nil {
+			log.Println("Error while validating entity", err)
+			return
+		}
+
+		project, err := projectEntity(w, prepEntity, r.URL.Query()["projIndex"][0])
+		if err != nil {
+			return
+		}
+
+		equipment, err := core.RetrieveProjectEquipment(project.Index)
+		if erpc.Err(w, err, erpc.StatusInternalServerError) {
+			return
+		}
+
+		erpc.MarshalSend(w, equipment)
+	})
+}
+
+// openWorkOrder opens a preventive, corrective or warranty work order on a project. Pass equipment
+// to open it on a piece of the project's equipment and scheduledfor to schedule the work
+func openWorkOrder() {
+	http.HandleFunc(EntityRPC[14][0], func(w http.ResponseWriter, r *http.Request) {
+		prepEntity, err := entityValidateHelper(w, r, EntityRPC[14][2:], EntityRPC[14][1])
+		if err != nil {
+			log.Println("Error while validating entity", err)
+			return
+		}
+
+		project, err := projectEntity(w, prepEntity, r.FormValue("projIndex"))
+		if err != nil {
+			return
+		}
+
+		var equipmentIndex int
+		if r.FormValue("equipment") != "" {
+			equipmentIndex, err = utils.ToInt(r.FormValue("equipment"))
+			if erpc.Err(w, err, erpc.StatusBadRequest, "", messages.ParamError("equipment")) {
+				return
+			}
+		}
+
+		var scheduledFor int
+		if r.FormValue("scheduledfor") != "" {
+			scheduledFor, err = utils.ToInt(r.FormValue("scheduledfor"))
+			if erpc.Err(w, err, erpc.StatusBadRequest, "", messages.ParamError("scheduledfor")) {
+				return
+			}
+		}
+
+		order, err := core.OpenWorkOrder(project.Index, equipmentIndex, r.FormValue("kind"), r.FormValue("description"),
+			prepEntity.U.Index, int64(scheduledFor))
+		if erpc.Err(w, err, erpc.StatusBadRequest) {
+			return
+		}
+
+		erpc.MarshalSend(w, order)
+	})
+}
+
+// closeWorkOrder closes a work order with a description of the work done. evidence is a comma
+// separated list of ipfs hashes or urls of photos and reports of the work
+func closeWorkOrder() {
+	http.HandleFunc(EntityRPC[15][0], func(w http.ResponseWriter, r *http.Request) {
+		prepEntity, err := entityValidateHelper(w, r, EntityRPC[15][2:], EntityRPC[15][1])
+		if err != nil {
+			log.Println("Error while validating entity", err)
+			return
+		}
+
+		index, err := utils.ToInt(r.FormValue("index"))
+		if erpc.Err(w, err, erpc.StatusBadRequest, "", messages.ConversionError) {
+			return
+		}
+
+		order, err := core.RetrieveWorkOrder(index)
+		if erpc.Err(w, err, erpc.StatusNotFound) {
+			return
+		}
+
+		_, err = projectEntity(w, prepEntity, strconv.Itoa(order.ProjIndex))
+		if err != nil {
+			return
+		}
+
+		order, err = core.CloseWorkOrder(index, prepEntity.U.Index, r.FormValue("resolution"),
+			strings.Split(r.FormValue("evidence"), ","))
+		if erpc.Err(w, err, erpc.StatusBadRequest) {
+			return
+		}
+
+		erpc.MarshalSend(w, order)
+	})
+}
+
+// getWorkOrders returns the work orders of a project, newest first
+func getWorkOrders() {
+	http.HandleFunc(EntityRPC[16][0], func(w http.ResponseWriter, r *http.Request) {
+		prepEntity, err := entityValidateHelper(w, r, EntityRPC[16][2:], EntityRPC[16][1])
+		if err != nil {
+			log.Println("Error while validating entity", err)
+			return
+		}
+
+		project, err := projectEntity(w, prepEntity, r.URL.Query()["projIndex"][0])
+		if err != nil {
+			return
+		}
+
+		orders, err := core.RetrieveWorkOrders(project.Index)
+		if erpc.Err(w, err, erpc.StatusInternalServerError) {
+			return
+		}
+
+		erpc.MarshalSend(w, orders)
+	})
+}
+
+// startDecommission starts decommissioning a project and assigns its equipment to a recycler
+func startDecommission() {
+	http.HandleFunc(EntityRPC[17][0], func(w http.ResponseWriter, r *http.Request) {
+		prepEntity, err := entityValidateHelper(w, r, EntityRPC[17][2:], EntityRPC[17][1])
+		if err != nil {
+			log.Println("Error while validating entity", err)
+			return
+		}
+
+		project, err := projectEntity(w, prepEntity, r.FormValue("projIndex"))
+		if err != nil {
+			return
+		}
+
+		recyclerIndex, err := utils.ToInt(r.FormValue("recycler"))
+		if erpc.Err(w, err, erpc.StatusBadRequest, "", messages.ConversionError) {
+			return
+		}
+
+		decommission, err := core.StartDecommission(project.Index, prepEntity.U.Index, recyclerIndex, r.FormValue("reason"))
+		if erpc.Err(w, err, erpc.StatusBadRequest) {
+			return
+		}
+
+		erpc.MarshalSend(w, decommission)
+	})
+}
+
+// recordCustody records the next event (removed, shipped, received or recycled) in the chain of
+// custody of a piece of equipment being decommissioned. location can optionally be passed
+func recordCustody() {
+	http.HandleFunc(EntityRPC[18][0], func(w http.ResponseWriter, r *http.Request) {
+		prepEntity, err := entityValidateHelper(w, r, EntityRPC[18][2:], EntityRPC[18][1])
+		if err != nil {
+			log.Println("Error while validating entity", err)
+			return
+		}
+
+		equipmentIndex, err := utils.ToInt(r.FormValue("equipment"))
+		if erpc.Err(w, err, erpc.StatusBadRequest, "", messages.ConversionError) {
+			return
+		}
+
+		record, err := core.RecordCustody(equipmentIndex, prepEntity, r.FormValue("event"), r.FormValue("location"),
+			r.FormValue("evidence"))
+		if erpc.Err(w, err, erpc.StatusBadRequest) {
+			return
+		}
+
+		erpc.MarshalSend(w, record)
+	})
+}
+
+// certifyRecycling is called by a recycler to certify that all of a project's equipment has been
+// received and recycled
+func certifyRecycling() {
+	http.HandleFunc(EntityRPC[19][0], func(w http.ResponseWriter, r *http.Request) {
+		prepEntity, err := entityValidateHelper(w, r, EntityRPC[19][2:], EntityRPC[19][1])
+		if err != nil {
+			log.Println("Error while validating entity", err)
+			return
+		}
+
+		if !prepEntity.Recycler {
+			erpc.ResponseHandler(w, erpc.StatusUnauthorized)
+			return
+		}
+
+		index, err := utils.ToInt(r.FormValue("index"))
+		if erpc.Err(w, err, erpc.StatusBadRequest, "", messages.ConversionError) {
+			return
+		}
+
+		decommission, err := core.CertifyRecycling(index, prepEntity.U.Index, r.FormValue("certificate"))
+		if erpc.Err(w, err, erpc.StatusBadRequest) {
+			return
+		}
+
+		erpc.MarshalSend(w, decommission)
+	})
+}
+
+// getDecommission returns a decommissioning and the chain of custody of each piece of equipment
+// being decommissioned. Only the project's recycler, contractor and developers can call this
+func getDecommission() {
+	http.HandleFunc(EntityRPC[20][0], func(w http.ResponseWriter, r *http.Request) {
+		prepEntity, err := entityValidateHelper(w, r, EntityRPC[20][2:], EntityRPC[20][1])
+		if err != nil {
+			log.Println("Error while validating entity", err)
+			return
+		}
+
+		index, err := utils.ToInt(r.URL.Query()["index"][0])
+		if erpc.Err(w, err, erpc.StatusBadRequest, "", messages.ConversionError) {
+			return
+		}
+
+		decommission, err := core.RetrieveDecommission(index)
+		if erpc.Err(w, err, erpc.StatusNotFound) {
+			return
+		}
+
+		if prepEntity.U.Index != decommission.RecyclerIndex {
+			_, err = projectEntity(w, prepEntity, strconv.Itoa(decommission.ProjIndex))
+			if err != nil {
+				return
+			}
+		}
+
+		chains, err := core.RetrieveCustodyChains(decommission)
+		if erpc.Err(w, err, erpc.StatusInternalServerError) {
+			return
+		}
+
+		var x struct {
+			Decommission core.Decommission
+			Custody      []core.CustodyChain
+		}
+		x.Decommission = decommission
+		x.Custody = chains
+		erpc.MarshalSend(w, x)
+	})
+}
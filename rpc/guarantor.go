@@ -7,19 +7,25 @@ import (
 	erpc "github.com/Varunram/essentials/rpc"
 	utils "github.com/Varunram/essentials/utils"
 
+	core "github.com/YaleOpenLab/opensolar/core"
 	"github.com/YaleOpenLab/opensolar/messages"
-	// core "github.com/YaleOpenLab/opensolar/core"
 )
 
 func setupGuarantorRPCs() {
 	depositXLMGuarantor()
 	depositAssetGuarantor()
+	decideWithdrawalGuarantor()
+	getGuarantorWithdrawals()
+	depositIntent()
 }
 
 // GuaRPC contains a list of all guarantor related RPC endpoints
 var GuaRPC = map[int][]string{
 	1: {"/guarantor/deposit/xlm", "POST", "amount", "projIndex", "seedpwd"},                // POST
 	2: {"/guarantor/deposit/asset", "POST", "amount", "projIndex", "seedpwd", "assetCode"}, // POST
+	3: {"/guarantor/withdrawal/decide", "POST", "index", "approve"},                        // POST
+	4: {"/guarantor/withdrawals", "GET", "projIndex"},                                      // GET
+	5: {"/guarantor/deposit/xdr", "POST", "amount", "projIndex"},                           // POST
 }
 
 // depositXLMGuarantor is called by a guarantor when they wish to refill
@@ -93,3 +99,96 @@ func depositAssetGuarantor() {
 		erpc.ResponseHandler(w, erpc.StatusOK)
 	})
 }
+
+// decideWithdrawalGuarantor approves or rejects a withdrawal proposal from the escrow of a
+// project the guarantor guarantees. An approval carries signature, the guarantor's base64
+// signature of the payment's hash
+func decideWithdrawalGuarantor() {
+	http.HandleFunc(GuaRPC[3][0], func(w http.ResponseWriter, r *http.Request) {
+		prepEntity, err := entityValidateHelper(w, r, GuaRPC[3][2:], GuaRPC[3][1])
+		if err == nil {
+			if !prepEntity.Guarantor {
+				erpc.ResponseHandler(w, erpc.StatusUnauthorized, messages.NotGuarantorError)
+				return
+			}
+		} else {
+			log.Println("Error while validating entity", err)
+			return
+		}
+
+		index, err := utils.ToInt(r.FormValue("index"))
+		if erpc.Err(w, err, erpc.StatusBadRequest, "", messages.ConversionError) {
+			return
+		}
+
+		proposal, err := core.ApproveWithdrawalGuarantor(index, prepEntity.U.Index, r.FormValue("approve") == "true",
+			r.FormValue("signature"), r.FormValue("comment"))
+		if erpc.Err(w, err, erpc.StatusBadRequest) {
+			return
+		}
+
+		erpc.MarshalSend(w, proposal)
+	})
+}
+
+// getGuarantorWithdrawals returns the withdrawal proposals of a project the guarantor guarantees
+func getGuarantorWithdrawals() {
+	http.HandleFunc(GuaRPC[4][0], func(w http.ResponseWriter, r *http.Request) {
+		prepEntity, err := entityValidateHelper(w, r, GuaRPC[4][2:], GuaRPC[4][1])
+		if err != nil {
+			log.Println("Error while validating entity", err)
+			return
+		}
+
+		projIndex, err := utils.ToInt(r.URL.Query()["projIndex"][0])
+		if erpc.Err(w, err, erpc.StatusBadRequest, "", messages.ConversionError) {
+			return
+		}
+
+		project, err := core.RetrieveProject(projIndex)
+		if erpc.Err(w, err, erpc.StatusInternalServerError) {
+			return
+		}
+		if project.GuarantorIndex != prepEntity.U.Index {
+			erpc.ResponseHandler(w, erpc.StatusUnauthorized)
+			return
+		}
+
+		proposals, err := core.RetrieveWithdrawals(projIndex)
+		if erpc.Err(w, err, erpc.StatusInternalServerError) {
+			return
+		}
+
+		erpc.MarshalSend(w, proposals)
+	})
+}
+
+// depositIntent builds the transaction with which a guarantor deposits XLM or, if assetCode is
+// set, the stablecoin in a project's escrow for the guarantor to sign with their own wallet and
+// submit through /user/tx/submit
+func depositIntent() {
+	http.HandleFunc(GuaRPC[5][0], func(w http.ResponseWriter, r *http.Request) {
+		prepEntity, err := entityValidateHelper(w, r, GuaRPC[5][2:], GuaRPC[5][1])
+		if err != nil {
+			log.Println("Error while validating entity", err)
+			return
+		}
+
+		projIndex, err := utils.ToInt(r.FormValue("projIndex"))
+		if erpc.Err(w, err, erpc.StatusBadRequest, "", messages.ConversionError) {
+			return
+		}
+
+		amount, err := utils.ToFloat(r.FormValue("amount"))
+		if erpc.Err(w, err, erpc.StatusBadRequest, "", messages.ConversionError) {
+			return
+		}
+
+		intent, err := core.NewDepositIntent(prepEntity.U.Index, projIndex, r.FormValue("assetCode"), amount)
+		if erpc.Err(w, err, erpc.StatusBadRequest) {
+			return
+		}
+
+		erpc.MarshalSend(w, intent)
+	})
+}
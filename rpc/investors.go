@@ -1,6 +1,7 @@
 package rpc
 
 import (
+	"fmt"
 	"log"
 	"net/http"
 	"sync"
@@ -14,10 +15,10 @@ import (
 	assets "github.com/Varunram/essentials/xlm/assets"
 	wallet "github.com/Varunram/essentials/xlm/wallet"
 
-	tickers "github.com/Varunram/essentials/exchangetickers"
 	consts "github.com/YaleOpenLab/opensolar/consts"
 	core "github.com/YaleOpenLab/opensolar/core"
 	notif "github.com/YaleOpenLab/opensolar/notif"
+	oracle "github.com/YaleOpenLab/opensolar/oracle"
 )
 
 // setupInvestorRPCs sets up all investor related RPCs
@@ -33,6 +34,8 @@ func setupInvestorRPCs() {
 	invDashboard()
 	setCompanyBool()
 	setCompany()
+	getCarbonStatement()
+	investIntent()
 }
 
 // InvRPC contains a list of all investor related endpoints
@@ -49,6 +52,8 @@ var InvRPC = map[int][]string{
 	10: {"/investor/company/set", "POST"},                                                     // POST
 	11: {"/investor/company/details", "POST", "companytype",
 		"name", "legalname", "address", "country", "city", "zipcode", "role"}, // POST
+	12: {"/investor/carbon", "GET"},                             // GET
+	13: {"/investor/invest/xdr", "POST", "projIndex", "amount"}, // POST
 }
 
 // InvValidateHelper is a helper that validates an investor and returns the investor struct if successful
@@ -167,6 +172,7 @@ func invest() {
 		seedpwd := r.FormValue("seedpwd")
 		projIndexx := r.FormValue("projIndex")
 		amountx := r.FormValue("amount")
+		key := r.FormValue("idempotencyKey") // optional, retries with the same key resume the investment
 
 		investorSeed, err := wallet.DecryptSeed(investor.U.StellarWallet.EncryptedSeed, seedpwd)
 		if erpc.Err(w, err, erpc.StatusBadRequest, "did not decrypt seed") {
@@ -194,7 +200,7 @@ func invest() {
 			return
 		}
 
-		err = core.Invest(projIndex, investor.U.Index, amount, investorSeed)
+		err = core.InvestWithKey(projIndex, investor.U.Index, amount, investorSeed, key)
 		if erpc.Err(w, err, erpc.StatusBadRequest, "did not invest in order") {
 			return
 		}
@@ -344,6 +350,10 @@ type invDashboardStruct struct {
 		DirectContributions string `json:"My Direct Contributions"`
 		TotalContributions  string `json:"Total Contributions"`
 	} `json:"Energy You Facilitate"`
+	Carbon struct {
+		DirectAvoided string `json:"My Avoided Emissions"`
+		TotalAvoided  string `json:"Total Avoided Emissions"`
+	} `json:"Carbon Offset"`
 	PrimaryAddress   string       `json:"Main Wallet"`
 	SecondaryAddress string       `json:"Secondary Wallet"`
 	AccountBalance1  float64      `json:"Account Balance 1"`
@@ -423,13 +433,24 @@ func invDashboard() {
 
 		ret.YourReturns.NetReturns = "$0"
 		ret.YourReturns.RecsReceived = "10 MWh"
-		ret.EFacilitate.DirectContributions = "1000 KWh"
-		ret.EFacilitate.TotalContributions = "1000 KWh"
+		direct, total, err := core.InvestorEnergy(prepInvestor)
+		if erpc.Err(w, err, erpc.StatusInternalServerError) {
+			return
+		}
+		ret.EFacilitate.DirectContributions = fmt.Sprintf("%d Wh", direct)
+		ret.EFacilitate.TotalContributions = fmt.Sprintf("%d Wh", total)
+
+		statement, err := core.InvestorCarbon(prepInvestor, 0, utils.Unix())
+		if erpc.Err(w, err, erpc.StatusInternalServerError) {
+			return
+		}
+		ret.Carbon.DirectAvoided = fmt.Sprintf("%.3f tCO2e", statement.Avoided)
+		ret.Carbon.TotalAvoided = fmt.Sprintf("%.3f tCO2e", statement.ProjectsAvoided)
 
 		ret.PrimaryAddress = prepInvestor.U.StellarWallet.PublicKey
 		ret.SecondaryAddress = prepInvestor.U.SecondaryWallet.PublicKey
 
-		xlmUSD, err := tickers.BinanceTicker()
+		xlmUSD, err := oracle.XLMUSD()
 		if erpc.Err(w, err, erpc.StatusInternalServerError, "", messages.TickerError) {
 			return
 		}
@@ -599,3 +620,66 @@ func setCompany() {
 		erpc.ResponseHandler(w, erpc.StatusOK)
 	})
 }
+
+// getCarbonStatement returns a statement of the emissions avoided by the investor's projects in
+// the range [from, to), attributed to the investor pro rata. Pass format=csv to export it as CSV
+func getCarbonStatement() {
+	http.HandleFunc(InvRPC[12][0], func(w http.ResponseWriter, r *http.Request) {
+		prepInvestor, err := InvValidateHelper(w, r, InvRPC[12][2:], InvRPC[12][1])
+		if err != nil {
+			return
+		}
+
+		from, to, err := timeRange(w, r)
+		if err != nil {
+			return
+		}
+
+		statement, err := core.InvestorCarbon(prepInvestor, from, to)
+		if erpc.Err(w, err, erpc.StatusInternalServerError) {
+			return
+		}
+
+		if r.URL.Query().Get("format") != "csv" {
+			erpc.MarshalSend(w, statement)
+			return
+		}
+
+		data, err := statement.CSV()
+		if erpc.Err(w, err, erpc.StatusInternalServerError) {
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/csv")
+		w.Header().Set("Content-Disposition", "attachment; filename=carbon-statement.csv")
+		w.Write(data)
+	})
+}
+
+// investIntent builds the transaction with which an investor invests in a project for the
+// investor to sign with their own wallet and submit through /user/tx/submit
+func investIntent() {
+	http.HandleFunc(InvRPC[13][0], func(w http.ResponseWriter, r *http.Request) {
+		investor, err := InvValidateHelper(w, r, InvRPC[13][2:], InvRPC[13][1])
+		if err != nil {
+			return
+		}
+
+		projIndex, err := utils.ToInt(r.FormValue("projIndex"))
+		if erpc.Err(w, err, erpc.StatusBadRequest, "", messages.ConversionError) {
+			return
+		}
+
+		amount, err := utils.ToFloat(r.FormValue("amount"))
+		if erpc.Err(w, err, erpc.StatusBadRequest, "", messages.ConversionError) {
+			return
+		}
+
+		intent, err := core.NewInvestIntent(projIndex, investor.U.Index, amount)
+		if erpc.Err(w, err, erpc.StatusBadRequest) {
+			return
+		}
+
+		erpc.MarshalSend(w, intent)
+	})
+}
@@ -9,6 +9,7 @@ import (
 	erpc "github.com/Varunram/essentials/rpc"
 	utils "github.com/Varunram/essentials/utils"
 
+	consts "github.com/YaleOpenLab/opensolar/consts"
 	core "github.com/YaleOpenLab/opensolar/core"
 	notif "github.com/YaleOpenLab/opensolar/notif"
 )
@@ -26,6 +27,14 @@ func setupProjectRPCs() {
 	getActiveProjects()
 	getCompletedProjects()
 	getFeaturedProjects()
+	getProjectEnergy()
+	verifyHashChain()
+	getProjectRECs()
+	verifyRECRetirement()
+	getProjectCarbon()
+	getProjectPerformance()
+	getProjectBatteries()
+	getProjectHealth()
 }
 
 // ProjectRPC contains a list of all the project related RPC endpoints
@@ -42,6 +51,14 @@ var ProjectRPC = map[int][]string{
 	11: {"/project/active", "GET"},                                        // GET
 	12: {"/project/complete", "GET"},                                      // GET
 	13: {"/project/featured", "GET"},                                      // GET
+	14: {"/project/energy", "GET", "projIndex", "granularity"},            // GET
+	15: {"/project/hashchain", "GET", "projIndex"},                        // GET
+	16: {"/project/recs", "GET", "projIndex"},                             // GET
+	17: {"/project/rec/verify", "GET", "index"},                           // GET
+	18: {"/project/carbon", "GET", "projIndex"},                           // GET
+	19: {"/project/performance", "GET", "projIndex"},                      // GET
+	20: {"/project/batteries", "GET", "projIndex"},                        // GET
+	21: {"/project/health", "GET", "projIndex"},                           // GET
 }
 
 // getAllProjects gets a list of all projects
@@ -302,6 +319,7 @@ type ExplorePageStub struct {
 	Raised           float64
 	Total            float64
 	Backers          int
+	CarbonAvoided    float64
 }
 
 // explore is the endpoint called on the frontend to show a comprehensive
@@ -356,6 +374,13 @@ func explore() {
 			x.Raised = project.MoneyRaised
 			x.Total = project.TotalValue
 			x.Backers = len(project.InvestorMap)
+
+			carbon, err := core.CarbonAvoided(project.Index, 0, utils.Unix())
+			if err != nil {
+				log.Println("could not compute carbon avoided by project", project.Index, err)
+				continue
+			}
+			x.CarbonAvoided = carbon.Avoided
 			arr = append(arr, x)
 		}
 
@@ -436,3 +461,294 @@ func getFeaturedProjects() {
 		erpc.MarshalSend(w, activeProjects)
 	})
 }
+
+// timeRange parses the optional from and to params of a GET request. from defaults to 0 and to
+// defaults to now
+func timeRange(w http.ResponseWriter, r *http.Request) (int64, int64, error) {
+	from, to := int64(0), utils.Unix()
+	if r.URL.Query()["from"] != nil {
+		x, err := utils.ToInt(r.URL.Query()["from"][0])
+		if erpc.Err(w, err, erpc.StatusBadRequest, "", messages.ConversionError) {
+			return from, to, err
+		}
+		from = int64(x)
+	}
+	if r.URL.Query()["to"] != nil {
+		x, err := utils.ToInt(r.URL.Query()["to"][0])
+		if erpc.Err(w, err, erpc.StatusBadRequest, "", messages.ConversionError) {
+			return from, to, err
+		}
+		to = int64(x)
+	}
+	return from, to, nil
+}
+
+// getProjectEnergy gets the energy generated by a project in the range [from, to) at the given
+// granularity (raw, hour, day or month). from defaults to 0 and to defaults to now. Pass
+// channel=import or channel=export to get the energy exchanged with the grid instead.
+func getProjectEnergy() {
+	http.HandleFunc(ProjectRPC[14][0], func(w http.ResponseWriter, r *http.Request) {
+		err := erpc.CheckGet(w, r)
+		if err != nil {
+			log.Println(err)
+			return
+		}
+
+		for _, param := range ProjectRPC[14][2:] {
+			if r.URL.Query()[param] == nil {
+				log.Println(param, "not passed")
+				erpc.ResponseHandler(w, erpc.StatusBadRequest, messages.ParamError(param))
+				return
+			}
+		}
+
+		projIndex, err := utils.ToInt(r.URL.Query()["projIndex"][0])
+		if erpc.Err(w, err, erpc.StatusBadRequest, "", messages.ConversionError) {
+			return
+		}
+
+		from, to, err := timeRange(w, r)
+		if err != nil {
+			return
+		}
+
+		var channel string
+		if r.URL.Query()["channel"] != nil {
+			channel = r.URL.Query()["channel"][0]
+		}
+
+		rollups, err := core.RetrieveChannelRollups(projIndex, channel, r.URL.Query()["granularity"][0], from, to)
+		if erpc.Err(w, err, erpc.StatusBadRequest) {
+			return
+		}
+
+		erpc.MarshalSend(w, rollups)
+	})
+}
+
+// verifyHashChain verifies the hash chain of a project's teller against its on chain anchors
+func verifyHashChain() {
+	http.HandleFunc(ProjectRPC[15][0], func(w http.ResponseWriter, r *http.Request) {
+		err := erpc.CheckGet(w, r)
+		if err != nil {
+			log.Println(err)
+			return
+		}
+
+		if r.URL.Query()["projIndex"] == nil {
+			log.Println("projIndex not passed")
+			erpc.ResponseHandler(w, erpc.StatusBadRequest, messages.ParamError("projIndex"))
+			return
+		}
+
+		projIndex, err := utils.ToInt(r.URL.Query()["projIndex"][0])
+		if erpc.Err(w, err, erpc.StatusBadRequest, "", messages.ConversionError) {
+			return
+		}
+
+		report, err := core.VerifyHashChain(projIndex)
+		if erpc.Err(w, err, erpc.StatusInternalServerError, "could not verify hash chain") {
+			return
+		}
+
+		erpc.MarshalSend(w, report)
+	})
+}
+
+// getProjectRECs returns the renewable energy certificates minted from a project's generation
+func getProjectRECs() {
+	http.HandleFunc(ProjectRPC[16][0], func(w http.ResponseWriter, r *http.Request) {
+		err := erpc.CheckGet(w, r)
+		if err != nil {
+			log.Println(err)
+			return
+		}
+
+		if r.URL.Query()["projIndex"] == nil {
+			log.Println("projIndex not passed")
+			erpc.ResponseHandler(w, erpc.StatusBadRequest, messages.ParamError("projIndex"))
+			return
+		}
+
+		projIndex, err := utils.ToInt(r.URL.Query()["projIndex"][0])
+		if erpc.Err(w, err, erpc.StatusBadRequest, "", messages.ConversionError) {
+			return
+		}
+
+		recs, err := core.RetrieveRECs(func(a core.RECCertificate) bool {
+			return a.ProjIndex == projIndex
+		})
+		if erpc.Err(w, err, erpc.StatusInternalServerError) {
+			return
+		}
+
+		erpc.MarshalSend(w, recs)
+	})
+}
+
+// verifyRECRetirement checks that a retired certificate was burned on chain
+func verifyRECRetirement() {
+	http.HandleFunc(ProjectRPC[17][0], func(w http.ResponseWriter, r *http.Request) {
+		err := erpc.CheckGet(w, r)
+		if err != nil {
+			log.Println(err)
+			return
+		}
+
+		if r.URL.Query()["index"] == nil {
+			log.Println("index not passed")
+			erpc.ResponseHandler(w, erpc.StatusBadRequest, messages.ParamError("index"))
+			return
+		}
+
+		index, err := utils.ToInt(r.URL.Query()["index"][0])
+		if erpc.Err(w, err, erpc.StatusBadRequest, "", messages.ConversionError) {
+			return
+		}
+
+		verified, err := core.VerifyRECRetirement(index)
+		if erpc.Err(w, err, erpc.StatusInternalServerError) {
+			return
+		}
+
+		erpc.MarshalSend(w, verified)
+	})
+}
+
+// getProjectCarbon returns the emissions avoided by a project's generation in the range
+// [from, to). from defaults to 0 and to defaults to now
+func getProjectCarbon() {
+	http.HandleFunc(ProjectRPC[18][0], func(w http.ResponseWriter, r *http.Request) {
+		err := erpc.CheckGet(w, r)
+		if err != nil {
+			log.Println(err)
+			return
+		}
+
+		if r.URL.Query()["projIndex"] == nil {
+			log.Println("projIndex not passed")
+			erpc.ResponseHandler(w, erpc.StatusBadRequest, messages.ParamError("projIndex"))
+			return
+		}
+
+		projIndex, err := utils.ToInt(r.URL.Query()["projIndex"][0])
+		if erpc.Err(w, err, erpc.StatusBadRequest, "", messages.ConversionError) {
+			return
+		}
+
+		from, to, err := timeRange(w, r)
+		if err != nil {
+			return
+		}
+
+		carbon, err := core.CarbonAvoided(projIndex, from, to)
+		if erpc.Err(w, err, erpc.StatusInternalServerError) {
+			return
+		}
+
+		erpc.MarshalSend(w, carbon)
+	})
+}
+
+// getProjectPerformance compares a project's expected and actual generation over the whole days
+// in the range [from, to). from defaults to consts.PerformanceWindow days before to and to
+// defaults to now
+func getProjectPerformance() {
+	http.HandleFunc(ProjectRPC[19][0], func(w http.ResponseWriter, r *http.Request) {
+		err := erpc.CheckGet(w, r)
+		if err != nil {
+			log.Println(err)
+			return
+		}
+
+		if r.URL.Query()["projIndex"] == nil {
+			log.Println("projIndex not passed")
+			erpc.ResponseHandler(w, erpc.StatusBadRequest, messages.ParamError("projIndex"))
+			return
+		}
+
+		projIndex, err := utils.ToInt(r.URL.Query()["projIndex"][0])
+		if erpc.Err(w, err, erpc.StatusBadRequest, "", messages.ConversionError) {
+			return
+		}
+
+		from, to, err := timeRange(w, r)
+		if err != nil {
+			return
+		}
+		if r.URL.Query()["from"] == nil {
+			from = to - int64(consts.PerformanceWindow*24*3600)
+		}
+
+		report, err := core.ForecastPerformance(projIndex, from, to)
+		if erpc.Err(w, err, erpc.StatusBadRequest) {
+			return
+		}
+
+		erpc.MarshalSend(w, report)
+	})
+}
+
+// getProjectBatteries returns the state of charge, cycles and health of a project's batteries
+func getProjectBatteries() {
+	http.HandleFunc(ProjectRPC[20][0], func(w http.ResponseWriter, r *http.Request) {
+		err := erpc.CheckGet(w, r)
+		if err != nil {
+			log.Println(err)
+			return
+		}
+
+		if r.URL.Query()["projIndex"] == nil {
+			log.Println("projIndex not passed")
+			erpc.ResponseHandler(w, erpc.StatusBadRequest, messages.ParamError("projIndex"))
+			return
+		}
+
+		projIndex, err := utils.ToInt(r.URL.Query()["projIndex"][0])
+		if erpc.Err(w, err, erpc.StatusBadRequest, "", messages.ConversionError) {
+			return
+		}
+
+		batteries, err := core.RetrieveBatteries(projIndex)
+		if erpc.Err(w, err, erpc.StatusInternalServerError) {
+			return
+		}
+
+		now := utils.Unix()
+		var statuses []core.BatteryStatus
+		for _, battery := range batteries {
+			statuses = append(statuses, battery.Status(now))
+		}
+
+		erpc.MarshalSend(w, statuses)
+	})
+}
+
+// getProjectHealth returns the health of a project's devices, generation and batteries
+func getProjectHealth() {
+	http.HandleFunc(ProjectRPC[21][0], func(w http.ResponseWriter, r *http.Request) {
+		err := erpc.CheckGet(w, r)
+		if err != nil {
+			log.Println(err)
+			return
+		}
+
+		if r.URL.Query()["projIndex"] == nil {
+			log.Println("projIndex not passed")
+			erpc.ResponseHandler(w, erpc.StatusBadRequest, messages.ParamError("projIndex"))
+			return
+		}
+
+		projIndex, err := utils.ToInt(r.URL.Query()["projIndex"][0])
+		if erpc.Err(w, err, erpc.StatusBadRequest, "", messages.ConversionError) {
+			return
+		}
+
+		health, err := core.RetrieveProjectHealth(projIndex, utils.Unix())
+		if erpc.Err(w, err, erpc.StatusBadRequest) {
+			return
+		}
+
+		erpc.MarshalSend(w, health)
+	})
+}
@@ -0,0 +1,39 @@
+package rpc
+
+import (
+	"log"
+	"net/http"
+
+	"github.com/YaleOpenLab/opensolar/messages"
+
+	erpc "github.com/Varunram/essentials/rpc"
+	oracle "github.com/YaleOpenLab/opensolar/oracle"
+)
+
+// setupOracleRPCs sets up all price oracle related endpoints
+func setupOracleRPCs() {
+	getOraclePrice()
+}
+
+// OracleRPC is a list of all price oracle endpoints. These are public
+var OracleRPC = map[int][]string{
+	1: {"/oracle/price"}, // GET
+}
+
+// getOraclePrice returns the aggregated XLM/USD price along with the per source prices
+func getOraclePrice() {
+	http.HandleFunc(OracleRPC[1][0], func(w http.ResponseWriter, r *http.Request) {
+		err := erpc.CheckGet(w, r)
+		if err != nil {
+			log.Println(err)
+			return
+		}
+
+		report, err := oracle.GetPriceReport()
+		if erpc.Err(w, err, erpc.StatusInternalServerError, "", messages.TickerError) {
+			return
+		}
+
+		erpc.MarshalSend(w, report)
+	})
+}
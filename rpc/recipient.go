@@ -1,9 +1,6 @@
 package rpc
 
 import (
-	"bufio"
-	"bytes"
-	"encoding/json"
 	"errors"
 	"log"
 	"net/http"
@@ -14,7 +11,6 @@ import (
 	"github.com/YaleOpenLab/opensolar/messages"
 	"github.com/YaleOpenLab/opensolar/oracle"
 
-	tickers "github.com/Varunram/essentials/exchangetickers"
 	erpc "github.com/Varunram/essentials/rpc"
 	utils "github.com/Varunram/essentials/utils"
 	xlm "github.com/Varunram/essentials/xlm"
@@ -22,6 +18,7 @@ import (
 
 	"github.com/YaleOpenLab/opensolar/consts"
 	core "github.com/YaleOpenLab/opensolar/core"
+	iot "github.com/YaleOpenLab/opensolar/iot"
 )
 
 // setupRecipientRPCs sets up all RPCs related to the recipient
@@ -50,6 +47,25 @@ func setupRecipientRPCs() {
 	storeTellerEnergy()
 	setCompanyBoolRecp()
 	setCompanyRecp()
+	setAutoreload()
+	disableAutoreload()
+	getReloads()
+	authorizeStandingOrder()
+	cancelStandingOrder()
+	getStandingOrders()
+	getTellerCommands()
+	ackTellerCommand()
+	tellerHeartbeat()
+	setDeviceProvider()
+	getProviderDevices()
+	getProviderAttributions()
+	getInvoices()
+	getInvoice()
+	getSettlements()
+	decideWithdrawalRecipient()
+	getRecipientWithdrawals()
+	paybackIntent()
+	unlockIntent()
 }
 
 // RecpRPC is a collection of all recipient RPC endpoints and their required params
@@ -58,7 +74,7 @@ var RecpRPC = map[int][]string{
 	2:  {"/recipient/register", "POST", "name", "username", "pwhash", "seedpwd"},                                                    // POST
 	3:  {"/recipient/validate", "GET"},                                                                                              // GET
 	4:  {"/recipient/payback", "POST", "assetName", "amount", "seedpwd", "projIndex"},                                               // POST
-	5:  {"/recipient/deviceId", "POST", "deviceId"},                                                                                 // POST
+	5:  {"/recipient/deviceId", "POST", "deviceId", "pubkey", "signature"},                                                          // POST
 	6:  {"/recipient/startdevice", "POST", "start"},                                                                                 // POST
 	7:  {"/recipient/storelocation", "POST", "location"},                                                                            // POST
 	8:  {"/recipient/auction/choose/blind", "GET"},                                                                                  // GET
@@ -69,14 +85,33 @@ var RecpRPC = map[int][]string{
 	13: {"/recipient/finalize", "POST", "projIndex"},                                                                                // POST
 	14: {"/recipient/originate", "POST", "projIndex"},                                                                               // POST
 	15: {"/recipient/trustlimit", "GET", "assetName"},                                                                               // GET
-	16: {"/recipient/ssh", "POST", "hash"},                                                                                          // POST
+	16: {"/recipient/ssh", "POST", "hash", "counter", "signature"},                                                                  // POST
 	17: {"/recipient/onetimeunlock", "POST", "projIndex", "seedpwd"},                                                                // POST
 	18: {"/recipient/register/teller", "POST", "url", "projIndex"},                                                                  // POST
 	19: {"/recipient/teller/details", "POST", "projIndex", "url", "brokerurl", "topic"},                                             // POST
 	20: {"/recipient/dashboard", "GET"},                                                                                             // GET
 	21: {"/recipient/company/set", "POST"},                                                                                          // POST
 	22: {"/recipient/company/details", "POST", "companytype", "name", "legalname", "address", "country", "city", "zipcode", "role"}, // POST
-	23: {"/recipient/teller/energy", "POST", "energy"},                                                                              // POST
+	23: {"/recipient/teller/energy", "POST", "energy", "counter", "signature"},                                                      // POST
+	24: {"/recipient/autoreload", "POST", "mode", "threshold", "amount", "seedpwd"},                                                 // POST
+	25: {"/recipient/autoreload/disable", "POST"},                                                                                   // POST
+	26: {"/recipient/autoreload/history", "GET"},                                                                                    // GET
+	27: {"/recipient/payback/standing", "POST", "projIndex", "seedpwd"},                                                             // POST
+	28: {"/recipient/payback/standing/cancel", "POST", "index"},                                                                     // POST
+	29: {"/recipient/payback/standing/all", "GET"},                                                                                  // GET
+	30: {"/recipient/teller/commands", "GET", "projIndex"},                                                                          // GET
+	31: {"/recipient/teller/ack", "POST", "index", "projIndex", "success", "result"},                                                // POST
+	32: {"/recipient/teller/heartbeat", "POST", "projIndex", "firmware", "queuedepth"},                                              // POST
+	33: {"/recipient/provider", "POST", "projIndex", "provider", "deviceId"},                                                        // POST
+	34: {"/recipient/provider/devices", "GET", "projIndex"},                                                                         // GET
+	35: {"/recipient/provider/attributions", "GET", "projIndex"},                                                                    // GET
+	36: {"/recipient/invoices", "GET", "projIndex"},                                                                                 // GET
+	37: {"/recipient/invoice", "GET", "index"},                                                                                      // GET
+	38: {"/recipient/settlements", "GET", "projIndex"},                                                                              // GET
+	39: {"/recipient/withdrawal/decide", "POST", "index", "approve"},                                                                // POST
+	40: {"/recipient/withdrawals", "GET", "projIndex"},                                                                              // GET
+	41: {"/recipient/payback/xdr", "POST", "assetName", "amount", "projIndex"},                                                      // POST
+	42: {"/recipient/unlock/xdr", "POST", "projIndex"},                                                                              // POST
 }
 
 // recpValidateHelper is a helper that helps validates recipients in routes
@@ -222,7 +257,8 @@ func payback() {
 	})
 }
 
-// storeDeviceID stores the recipient's device id from the teller. Called by the teller
+// storeDeviceID stores the recipient's device id and the public key of the device's signing
+// keypair. Called by the teller
 func storeDeviceID() {
 	http.HandleFunc(RecpRPC[5][0], func(w http.ResponseWriter, r *http.Request) {
 		// first validate the recipient or anyone would be able to set device ids
@@ -232,10 +268,15 @@ func storeDeviceID() {
 		}
 
 		deviceID := r.FormValue("deviceId")
+		pubkey := r.FormValue("pubkey")
+		signature := r.FormValue("signature")
+
+		// oldsignature is only needed when rotating an already registered key
+		oldSignature := r.FormValue("oldsignature")
+
 		// we have the recipient ready. Now set the device id
-		prepRecipient.DeviceID = deviceID
-		err = prepRecipient.Save()
-		if erpc.Err(w, err, erpc.StatusInternalServerError, "did not save recipient") {
+		err = prepRecipient.RegisterDevice(deviceID, pubkey, signature, oldSignature)
+		if erpc.Err(w, err, erpc.StatusUnauthorized, "could not register device") {
 			return
 		}
 		erpc.ResponseHandler(w, erpc.StatusOK)
@@ -488,11 +529,23 @@ func storeStateHash() {
 
 		hash := r.FormValue("hash")
 
+		err = prepRecipient.VerifyDeviceReport(core.DeviceReportState, hash, r.FormValue("counter"), r.FormValue("signature"))
+		if erpc.Err(w, err, erpc.StatusUnauthorized, "could not verify state report") {
+			return
+		}
+
 		prepRecipient.StateHashes = append(prepRecipient.StateHashes, hash)
 		err = prepRecipient.Save()
 		if erpc.Err(w, err, erpc.StatusInternalServerError, "did not save recipient") {
 			return
 		}
+
+		for _, projIndex := range prepRecipient.ReceivedSolarProjectIndices {
+			err = core.RecordDeviceState(projIndex, core.FleetTeller, prepRecipient.DeviceID, hash)
+			if err != nil {
+				log.Println("could not record teller state in the fleet", err)
+			}
+		}
 		erpc.ResponseHandler(w, erpc.StatusOK)
 	})
 }
@@ -596,6 +649,15 @@ func storeTellerDetails() {
 			return
 		}
 
+		if brokerurl != "" && topic != "" {
+			go func() {
+				err := core.StartIngestion(projIndex)
+				if err != nil {
+					log.Println("could not start energy ingestion", err)
+				}
+			}()
+		}
+
 		erpc.ResponseHandler(w, erpc.StatusOK)
 	})
 }
@@ -671,56 +733,34 @@ func recpDashboard() {
 		}
 		ret.YourProfile.ActiveProjects = len(prepRecipient.ReceivedSolarProjectIndices)
 
-		data, err := erpc.GetRequest(consts.OpenxURL + "/user/tellerfile")
+		var allTime uint64
+		for _, elem := range prepRecipient.ReceivedSolarProjectIndices {
+			energy, err := core.TotalEnergy(elem, 0, utils.Unix())
+			if err != nil {
+				log.Println(err)
+				erpc.MarshalSend(w, erpc.StatusInternalServerError)
+				return
+			}
+			allTime += energy
+		}
+
+		// energy generated in the current payback period
+		EnergyValue := prepRecipient.TellerEnergy
+
+		ret.YourEnergy.AllTime, err = utils.ToString(int64(allTime))
 		if err != nil {
 			log.Println(err)
 			erpc.MarshalSend(w, erpc.StatusInternalServerError)
 			return
 		}
 
-		type energyStruct struct {
-			EnergyTimestamp string `json:"energy_timestamp"`
-			Unit            string `json:"unit"`
-			Value           uint32 `json:"value"`
-			OwnerID         string `json:"owner_id"`
-			AssetID         string `json:"asset_id"`
-		}
-
-		var EnergyValue uint32
-		EnergyValue = 0
-
-		reader := bufio.NewReader(bytes.NewReader(data))
-
-		for {
-			var data1 []byte
-
-			for i := 0; i < 7; i++ { // formatted according to the responses received from the lumen unit
-				// which is further read by the subscriber
-				line, _, err := reader.ReadLine()
-				if err != nil {
-					break
-				}
-				data1 = append(data1, line...)
-			}
-
-			var x energyStruct
-			err = json.Unmarshal(data1, &x)
-			if err != nil {
-				break
-			}
-
-			EnergyValue += x.Value
-		}
-
-		ret.YourEnergy.AllTime, err = utils.ToString(EnergyValue)
+		ret.YourEnergy.TiCP, err = utils.ToString(EnergyValue)
 		if err != nil {
 			log.Println(err)
 			erpc.MarshalSend(w, erpc.StatusInternalServerError)
 			return
 		}
 
-		ret.YourEnergy.TiCP = ret.YourEnergy.AllTime
-
 		ret.YourWallet.AutoReload = "On"
 		ret.NActions.Notification = "None"
 		ret.NActions.ActionsRequired = "None"
@@ -799,7 +839,7 @@ func recpDashboard() {
 
 			dlp = time.Unix(dlpI, 0).String()[0:10]
 
-			xlmUSD, err := tickers.BinanceTicker()
+			xlmUSD, err := oracle.XLMUSD()
 			if erpc.Err(w, err, erpc.StatusInternalServerError, "", messages.TickerError) {
 				return
 			}
@@ -961,10 +1001,99 @@ func storeTellerEnergy() {
 			return
 		}
 
-		recipient.TellerEnergy = uint32(energyInt)
-		recipient.PastTellerEnergy = append(recipient.PastTellerEnergy, uint32(energyInt))
+		err = recipient.VerifyDeviceReport(core.DeviceReportEnergy, energy, r.FormValue("counter"), r.FormValue("signature"))
+		if erpc.Err(w, err, erpc.StatusUnauthorized, "could not verify energy report") {
+			return
+		}
+
+		// store the advanced device counter without overwriting energy ingested since the
+		// recipient was retrieved
+		err = core.SaveDeviceCounter(recipient.U.Index, recipient.DeviceCounter)
+		if erpc.Err(w, err, erpc.StatusInternalServerError) {
+			return
+		}
+
+		for _, projIndex := range recipient.ReceivedSolarProjectIndices {
+			ignored, err := core.TellerPushesIgnored(projIndex, recipient)
+			if erpc.Err(w, err, erpc.StatusInternalServerError) {
+				return
+			}
+			if ignored {
+				// the platform ingests energy readings directly, don't double count
+				log.Println("energy for project", projIndex, "ingested by the platform, ignoring teller push")
+				erpc.ResponseHandler(w, erpc.StatusOK)
+				return
+			}
+		}
+
+		// each push is the energy generated since the teller's previous push, so it is added to
+		// the recipient's energy just like readings ingested by the platform
+		err = core.AddTellerEnergy(recipient.U.Index, uint32(energyInt))
+		if erpc.Err(w, err, erpc.StatusInternalServerError) {
+			return
+		}
+
+		// we can attribute a push to a project only if the recipient has a single one
+		if len(recipient.ReceivedSolarProjectIndices) == 1 {
+			err = core.SaveEnergyReading(recipient.ReceivedSolarProjectIndices[0], core.EnergyReading{
+				ID:        "teller-" + recipient.DeviceID + "-" + r.FormValue("counter"),
+				Timestamp: utils.Unix(),
+				Value:     uint32(energyInt),
+				Source:    "teller",
+			})
+			if erpc.Err(w, err, erpc.StatusInternalServerError) {
+				return
+			}
+
+			err = core.RecordDeviceEnergy(recipient.ReceivedSolarProjectIndices[0], core.FleetTeller, recipient.DeviceID, uint32(energyInt))
+			if err != nil {
+				log.Println("could not record teller energy in the fleet", err)
+			}
+		}
+
+		erpc.ResponseHandler(w, erpc.StatusOK)
+	})
+}
+
+// setAutoreload opts a recipient into automatic reloads from their secondary account
+func setAutoreload() {
+	http.HandleFunc(RecpRPC[24][0], func(w http.ResponseWriter, r *http.Request) {
+		prepRecipient, err := recpValidateHelper(w, r, RecpRPC[24][2:], RecpRPC[24][1])
+		if err != nil {
+			return
+		}
+
+		mode := r.FormValue("mode")
+		seedpwd := r.FormValue("seedpwd")
+
+		threshold, err := utils.ToFloat(r.FormValue("threshold"))
+		if erpc.Err(w, err, erpc.StatusBadRequest, "", messages.ConversionError) {
+			return
+		}
+
+		amount, err := utils.ToFloat(r.FormValue("amount"))
+		if erpc.Err(w, err, erpc.StatusBadRequest, "", messages.ConversionError) {
+			return
+		}
+
+		err = prepRecipient.SetAutoreload(mode, threshold, amount, seedpwd)
+		if erpc.Err(w, err, erpc.StatusBadRequest, "could not set autoreload") {
+			return
+		}
+
+		erpc.ResponseHandler(w, erpc.StatusOK)
+	})
+}
+
+// disableAutoreload opts a recipient out of automatic reloads
+func disableAutoreload() {
+	http.HandleFunc(RecpRPC[25][0], func(w http.ResponseWriter, r *http.Request) {
+		prepRecipient, err := recpValidateHelper(w, r, RecpRPC[25][2:], RecpRPC[25][1])
+		if err != nil {
+			return
+		}
 
-		err = recipient.Save()
+		err = prepRecipient.DisableAutoreload()
 		if erpc.Err(w, err, erpc.StatusInternalServerError) {
 			return
 		}
@@ -972,3 +1101,463 @@ func storeTellerEnergy() {
 		erpc.ResponseHandler(w, erpc.StatusOK)
 	})
 }
+
+// getReloads returns the list of reloads performed on behalf of the recipient
+func getReloads() {
+	http.HandleFunc(RecpRPC[26][0], func(w http.ResponseWriter, r *http.Request) {
+		prepRecipient, err := recpValidateHelper(w, r, RecpRPC[26][2:], RecpRPC[26][1])
+		if err != nil {
+			return
+		}
+
+		erpc.MarshalSend(w, prepRecipient.Reloads)
+	})
+}
+
+// authorizeStandingOrder authorizes the platform to pay back towards a project on the recipient's behalf
+func authorizeStandingOrder() {
+	http.HandleFunc(RecpRPC[27][0], func(w http.ResponseWriter, r *http.Request) {
+		prepRecipient, err := recpValidateHelper(w, r, RecpRPC[27][2:], RecpRPC[27][1])
+		if err != nil {
+			return
+		}
+
+		projIndex, err := utils.ToInt(r.FormValue("projIndex"))
+		if erpc.Err(w, err, erpc.StatusBadRequest, "", messages.ConversionError) {
+			return
+		}
+
+		order, err := prepRecipient.AuthorizeStandingOrder(projIndex, r.FormValue("seedpwd"))
+		if erpc.Err(w, err, erpc.StatusBadRequest, "could not authorize standing order") {
+			return
+		}
+
+		order.EncryptedSeed = nil
+		erpc.MarshalSend(w, order)
+	})
+}
+
+// cancelStandingOrder cancels a standing order authorized by the recipient
+func cancelStandingOrder() {
+	http.HandleFunc(RecpRPC[28][0], func(w http.ResponseWriter, r *http.Request) {
+		prepRecipient, err := recpValidateHelper(w, r, RecpRPC[28][2:], RecpRPC[28][1])
+		if err != nil {
+			return
+		}
+
+		index, err := utils.ToInt(r.FormValue("index"))
+		if erpc.Err(w, err, erpc.StatusBadRequest, "", messages.ConversionError) {
+			return
+		}
+
+		err = prepRecipient.CancelStandingOrder(index)
+		if erpc.Err(w, err, erpc.StatusBadRequest, "could not cancel standing order") {
+			return
+		}
+
+		erpc.ResponseHandler(w, erpc.StatusOK)
+	})
+}
+
+// getStandingOrders returns all standing orders authorized by the recipient
+func getStandingOrders() {
+	http.HandleFunc(RecpRPC[29][0], func(w http.ResponseWriter, r *http.Request) {
+		prepRecipient, err := recpValidateHelper(w, r, RecpRPC[29][2:], RecpRPC[29][1])
+		if err != nil {
+			return
+		}
+
+		orders, err := core.RetrieveRecipientStandingOrders(prepRecipient.U.Index)
+		if erpc.Err(w, err, erpc.StatusInternalServerError) {
+			return
+		}
+
+		for i := range orders {
+			orders[i].EncryptedSeed = nil
+		}
+
+		erpc.MarshalSend(w, orders)
+	})
+}
+
+// recipientProject checks that the recipient is associated with the project passed in the request
+func recipientProject(w http.ResponseWriter, prepRecipient core.Recipient, projIndexS string) (int, bool) {
+	projIndex, err := utils.ToInt(projIndexS)
+	if erpc.Err(w, err, erpc.StatusBadRequest, "", messages.ConversionError) {
+		return projIndex, false
+	}
+
+	project, err := core.RetrieveProject(projIndex)
+	if erpc.Err(w, err, erpc.StatusInternalServerError) {
+		return projIndex, false
+	}
+
+	if project.RecipientIndex != prepRecipient.U.Index {
+		erpc.ResponseHandler(w, erpc.StatusUnauthorized)
+		return projIndex, false
+	}
+	return projIndex, true
+}
+
+// getTellerCommands returns pending config changes and commands for the recipient's teller. Called by the teller
+func getTellerCommands() {
+	http.HandleFunc(RecpRPC[30][0], func(w http.ResponseWriter, r *http.Request) {
+		prepRecipient, err := recpValidateHelper(w, r, RecpRPC[30][2:], RecpRPC[30][1])
+		if err != nil {
+			return
+		}
+
+		projIndex, ok := recipientProject(w, prepRecipient, r.URL.Query()["projIndex"][0])
+		if !ok {
+			return
+		}
+
+		cmds, err := core.DeliverTellerCommands(projIndex)
+		if erpc.Err(w, err, erpc.StatusInternalServerError) {
+			return
+		}
+
+		erpc.MarshalSend(w, cmds)
+	})
+}
+
+// ackTellerCommand records the result of a command run by the recipient's teller. Called by the teller
+func ackTellerCommand() {
+	http.HandleFunc(RecpRPC[31][0], func(w http.ResponseWriter, r *http.Request) {
+		prepRecipient, err := recpValidateHelper(w, r, RecpRPC[31][2:], RecpRPC[31][1])
+		if err != nil {
+			return
+		}
+
+		projIndex, ok := recipientProject(w, prepRecipient, r.FormValue("projIndex"))
+		if !ok {
+			return
+		}
+
+		index, err := utils.ToInt(r.FormValue("index"))
+		if erpc.Err(w, err, erpc.StatusBadRequest, "", messages.ConversionError) {
+			return
+		}
+
+		_, err = core.AckTellerCommand(index, projIndex, r.FormValue("success") == "true", r.FormValue("result"))
+		if erpc.Err(w, err, erpc.StatusBadRequest, "could not acknowledge command") {
+			return
+		}
+
+		erpc.ResponseHandler(w, erpc.StatusOK)
+	})
+}
+
+// tellerHeartbeat records a heartbeat from one of the recipient's devices in the fleet registry.
+// Called by the teller. Heartbeats aren't signed since they'd consume device counters out of order
+// with queued reports
+func tellerHeartbeat() {
+	http.HandleFunc(RecpRPC[32][0], func(w http.ResponseWriter, r *http.Request) {
+		prepRecipient, err := recpValidateHelper(w, r, RecpRPC[32][2:], RecpRPC[32][1])
+		if err != nil {
+			return
+		}
+
+		projIndex, ok := recipientProject(w, prepRecipient, r.FormValue("projIndex"))
+		if !ok {
+			return
+		}
+
+		queueDepth, err := utils.ToInt(r.FormValue("queuedepth"))
+		if erpc.Err(w, err, erpc.StatusBadRequest, "", messages.ConversionError) {
+			return
+		}
+
+		// tellers report as the recipient's registered device, IoT hubs pass their own id
+		kind, deviceID := core.FleetTeller, prepRecipient.DeviceID
+		if r.FormValue("deviceId") != "" {
+			kind, deviceID = core.FleetIoTHub, r.FormValue("deviceId")
+		}
+
+		device, err := core.RecordHeartbeat(projIndex, kind, deviceID, r.FormValue("firmware"), queueDepth)
+		if erpc.Err(w, err, erpc.StatusBadRequest, "could not record heartbeat") {
+			return
+		}
+
+		erpc.MarshalSend(w, device.Status(utils.Unix()))
+	})
+}
+
+// setDeviceProvider sets the IoT provider that reports a project's energy. The provider's config
+// keys (see iot.ConfigKeys) are passed as params along with the id of the project's device
+func setDeviceProvider() {
+	http.HandleFunc(RecpRPC[33][0], func(w http.ResponseWriter, r *http.Request) {
+		prepRecipient, err := recpValidateHelper(w, r, RecpRPC[33][2:], RecpRPC[33][1])
+		if err != nil {
+			return
+		}
+
+		projIndex, ok := recipientProject(w, prepRecipient, r.FormValue("projIndex"))
+		if !ok {
+			return
+		}
+
+		provider := r.FormValue("provider")
+		required, optional, err := iot.ConfigKeys(provider)
+		if erpc.Err(w, err, erpc.StatusBadRequest, "", messages.ParamError("provider")) {
+			return
+		}
+
+		config := make(map[string]string)
+		for _, key := range append(required, optional...) {
+			if r.FormValue(key) != "" {
+				config[key] = r.FormValue(key)
+			}
+		}
+
+		err = iot.SetProjectProvider(projIndex, provider, r.FormValue("deviceId"), config)
+		if erpc.Err(w, err, erpc.StatusBadRequest, "could not set device provider") {
+			return
+		}
+
+		erpc.ResponseHandler(w, erpc.StatusOK)
+	})
+}
+
+// projectProvider returns the provider chosen by one of the recipient's projects
+func projectProvider(w http.ResponseWriter, prepRecipient core.Recipient, projIndexx string) (iot.DeviceProvider, core.Project, bool) {
+	projIndex, ok := recipientProject(w, prepRecipient, projIndexx)
+	if !ok {
+		return nil, core.Project{}, false
+	}
+
+	project, err := core.RetrieveProject(projIndex)
+	if erpc.Err(w, err, erpc.StatusInternalServerError) {
+		return nil, project, false
+	}
+
+	provider, err := iot.ProjectProvider(project)
+	if erpc.Err(w, err, erpc.StatusBadRequest) {
+		return nil, project, false
+	}
+	return provider, project, true
+}
+
+// getProviderDevices lists the devices the project's provider has access to along with their status
+func getProviderDevices() {
+	http.HandleFunc(RecpRPC[34][0], func(w http.ResponseWriter, r *http.Request) {
+		prepRecipient, err := recpValidateHelper(w, r, RecpRPC[34][2:], RecpRPC[34][1])
+		if err != nil {
+			return
+		}
+
+		provider, _, ok := projectProvider(w, prepRecipient, r.URL.Query()["projIndex"][0])
+		if !ok {
+			return
+		}
+
+		devices, err := provider.ListDevices()
+		if erpc.Err(w, err, erpc.StatusInternalServerError, "could not list devices") {
+			return
+		}
+
+		erpc.MarshalSend(w, devices)
+	})
+}
+
+// getProviderAttributions returns the energy attributions the project's provider has made for its device
+func getProviderAttributions() {
+	http.HandleFunc(RecpRPC[35][0], func(w http.ResponseWriter, r *http.Request) {
+		prepRecipient, err := recpValidateHelper(w, r, RecpRPC[35][2:], RecpRPC[35][1])
+		if err != nil {
+			return
+		}
+
+		provider, project, ok := projectProvider(w, prepRecipient, r.URL.Query()["projIndex"][0])
+		if !ok {
+			return
+		}
+
+		attributions, err := provider.FetchAttributions(project.ProviderDeviceID)
+		if err == iot.ErrUnsupported {
+			erpc.ResponseHandler(w, erpc.StatusNotFound, err.Error())
+			return
+		}
+		if erpc.Err(w, err, erpc.StatusInternalServerError, "could not fetch attributions") {
+			return
+		}
+
+		erpc.MarshalSend(w, attributions)
+	})
+}
+
+// getInvoices returns the invoices issued to the recipient for a project
+func getInvoices() {
+	http.HandleFunc(RecpRPC[36][0], func(w http.ResponseWriter, r *http.Request) {
+		prepRecipient, err := recpValidateHelper(w, r, RecpRPC[36][2:], RecpRPC[36][1])
+		if err != nil {
+			return
+		}
+
+		projIndex, ok := recipientProject(w, prepRecipient, r.URL.Query()["projIndex"][0])
+		if !ok {
+			return
+		}
+
+		invoices, err := core.RetrieveProjectInvoices(projIndex)
+		if erpc.Err(w, err, erpc.StatusInternalServerError) {
+			return
+		}
+
+		erpc.MarshalSend(w, invoices)
+	})
+}
+
+// getInvoice returns an invoice issued to the recipient. Pass format=pdf to render it as a PDF
+func getInvoice() {
+	http.HandleFunc(RecpRPC[37][0], func(w http.ResponseWriter, r *http.Request) {
+		prepRecipient, err := recpValidateHelper(w, r, RecpRPC[37][2:], RecpRPC[37][1])
+		if err != nil {
+			return
+		}
+
+		index, err := utils.ToInt(r.URL.Query()["index"][0])
+		if erpc.Err(w, err, erpc.StatusBadRequest, "", messages.ConversionError) {
+			return
+		}
+
+		invoice, err := core.RetrieveInvoice(index)
+		if erpc.Err(w, err, erpc.StatusNotFound) {
+			return
+		}
+
+		if invoice.RecpIndex != prepRecipient.U.Index {
+			erpc.ResponseHandler(w, erpc.StatusUnauthorized)
+			return
+		}
+
+		if r.URL.Query().Get("format") != "pdf" {
+			erpc.MarshalSend(w, invoice)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/pdf")
+		w.Header().Set("Content-Disposition", "attachment; filename="+invoice.Number+".pdf")
+		w.Write(invoice.PDF())
+	})
+}
+
+// getSettlements returns the monthly settlements of a project's grid exports
+func getSettlements() {
+	http.HandleFunc(RecpRPC[38][0], func(w http.ResponseWriter, r *http.Request) {
+		prepRecipient, err := recpValidateHelper(w, r, RecpRPC[38][2:], RecpRPC[38][1])
+		if err != nil {
+			return
+		}
+
+		projIndex, ok := recipientProject(w, prepRecipient, r.URL.Query()["projIndex"][0])
+		if !ok {
+			return
+		}
+
+		settlements, err := core.RetrieveSettlements(projIndex)
+		if erpc.Err(w, err, erpc.StatusInternalServerError) {
+			return
+		}
+
+		erpc.MarshalSend(w, settlements)
+	})
+}
+
+// decideWithdrawalRecipient approves or rejects a withdrawal proposal from the escrow of the
+// recipient's project. An approval is signed with either signedxdr, the client signed payment, or
+// signature, the base64 signature of the payment's hash
+func decideWithdrawalRecipient() {
+	http.HandleFunc(RecpRPC[39][0], func(w http.ResponseWriter, r *http.Request) {
+		prepRecipient, err := recpValidateHelper(w, r, RecpRPC[39][2:], RecpRPC[39][1])
+		if err != nil {
+			return
+		}
+
+		index, err := utils.ToInt(r.FormValue("index"))
+		if erpc.Err(w, err, erpc.StatusBadRequest, "", messages.ConversionError) {
+			return
+		}
+
+		proposal, err := core.ApproveWithdrawalRecipient(index, prepRecipient.U.Index, r.FormValue("approve") == "true",
+			r.FormValue("signedxdr"), r.FormValue("signature"), r.FormValue("comment"))
+		if erpc.Err(w, err, erpc.StatusBadRequest) {
+			return
+		}
+
+		erpc.MarshalSend(w, proposal)
+	})
+}
+
+// getRecipientWithdrawals returns the withdrawal proposals of the recipient's project
+func getRecipientWithdrawals() {
+	http.HandleFunc(RecpRPC[40][0], func(w http.ResponseWriter, r *http.Request) {
+		prepRecipient, err := recpValidateHelper(w, r, RecpRPC[40][2:], RecpRPC[40][1])
+		if err != nil {
+			return
+		}
+
+		projIndex, ok := recipientProject(w, prepRecipient, r.URL.Query()["projIndex"][0])
+		if !ok {
+			return
+		}
+
+		proposals, err := core.RetrieveWithdrawals(projIndex)
+		if erpc.Err(w, err, erpc.StatusInternalServerError) {
+			return
+		}
+
+		erpc.MarshalSend(w, proposals)
+	})
+}
+
+// paybackIntent builds the transaction with which a recipient pays back towards their project for
+// the recipient to sign with their own wallet and submit through /user/tx/submit
+func paybackIntent() {
+	http.HandleFunc(RecpRPC[41][0], func(w http.ResponseWriter, r *http.Request) {
+		prepRecipient, err := recpValidateHelper(w, r, RecpRPC[41][2:], RecpRPC[41][1])
+		if err != nil {
+			return
+		}
+
+		projIndex, err := utils.ToInt(r.FormValue("projIndex"))
+		if erpc.Err(w, err, erpc.StatusBadRequest, "", messages.ConversionError) {
+			return
+		}
+
+		amount, err := utils.ToFloat(r.FormValue("amount"))
+		if erpc.Err(w, err, erpc.StatusBadRequest, "", messages.ConversionError) {
+			return
+		}
+
+		intent, err := core.NewPaybackIntent(prepRecipient.U.Index, projIndex, r.FormValue("assetName"), amount)
+		if erpc.Err(w, err, erpc.StatusBadRequest) {
+			return
+		}
+
+		erpc.MarshalSend(w, intent)
+	})
+}
+
+// unlockIntent builds the transaction with which a recipient accepts the investment in their
+// project for the recipient to sign with their own wallet and submit through /user/tx/submit
+func unlockIntent() {
+	http.HandleFunc(RecpRPC[42][0], func(w http.ResponseWriter, r *http.Request) {
+		prepRecipient, err := recpValidateHelper(w, r, RecpRPC[42][2:], RecpRPC[42][1])
+		if err != nil {
+			return
+		}
+
+		projIndex, err := utils.ToInt(r.FormValue("projIndex"))
+		if erpc.Err(w, err, erpc.StatusBadRequest, "", messages.ConversionError) {
+			return
+		}
+
+		intent, err := core.NewUnlockIntent(prepRecipient.U.Index, projIndex)
+		if erpc.Err(w, err, erpc.StatusBadRequest) {
+			return
+		}
+
+		erpc.MarshalSend(w, intent)
+	})
+}
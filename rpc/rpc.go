@@ -154,6 +154,7 @@ func StartServer(portx int, insecure bool) {
 	setupAdminHandlers()
 	setupDeveloperRPCs()
 	setupGuarantorRPCs()
+	setupOracleRPCs()
 
 	erpc.SetConsts(60)
 	port, err := utils.ToString(portx)
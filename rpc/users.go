@@ -22,15 +22,27 @@ func setupUserRpcs() {
 	userInfo()
 	registerUser()
 	getUserRoles()
+	getUserRECs()
+	transferREC()
+	retireREC()
+	getIntent()
+	submitIntent()
+	completeIntent()
 }
 
 // UserRPC is a collection of all user RPC endpoints and their required params
 var UserRPC = map[int][]string{
-	1: {"/update", "POST"},                                                  // POST
-	2: {"/user/report", "POST", "projIndex"},                                // POST
-	3: {"/user/info", "GET"},                                                // GET
-	4: {"/user/register", "POST", "email", "username", "pwhash", "seedpwd"}, // POST
-	5: {"/user/roles", "GET"},                                               // GET
+	1:  {"/update", "POST"},                                                  // POST
+	2:  {"/user/report", "POST", "projIndex"},                                // POST
+	3:  {"/user/info", "GET"},                                                // GET
+	4:  {"/user/register", "POST", "email", "username", "pwhash", "seedpwd"}, // POST
+	5:  {"/user/roles", "GET"},                                               // GET
+	6:  {"/user/recs", "GET"},                                                // GET
+	7:  {"/user/rec/transfer", "POST", "index", "destination", "quantity"},   // POST
+	8:  {"/user/rec/retire", "POST", "index", "quantity", "beneficiary"},     // POST
+	9:  {"/user/tx", "GET", "index"},                                         // GET
+	10: {"/user/tx/submit", "POST", "index", "signedxdr"},                    // POST
+	11: {"/user/tx/complete", "POST", "index"},                               // POST
 }
 
 func userValidateHelper(w http.ResponseWriter, r *http.Request, options []string, method string) (openx.User, error) {
@@ -272,3 +284,147 @@ func getUserRoles() {
 		erpc.MarshalSend(w, ret)
 	})
 }
+
+// getUserRECs returns the renewable energy certificates held by the user
+func getUserRECs() {
+	http.HandleFunc(UserRPC[6][0], func(w http.ResponseWriter, r *http.Request) {
+		user, err := userValidateHelper(w, r, UserRPC[6][2:], UserRPC[6][1])
+		if err != nil {
+			return
+		}
+
+		recs, err := core.RetrieveRECs(func(a core.RECCertificate) bool {
+			return a.Holder == user.StellarWallet.PublicKey
+		})
+		if erpc.Err(w, err, erpc.StatusInternalServerError) {
+			return
+		}
+
+		erpc.MarshalSend(w, recs)
+	})
+}
+
+// transferREC transfers some or all of a certificate's RECs to another stellar account
+func transferREC() {
+	http.HandleFunc(UserRPC[7][0], func(w http.ResponseWriter, r *http.Request) {
+		user, err := userValidateHelper(w, r, UserRPC[7][2:], UserRPC[7][1])
+		if err != nil {
+			return
+		}
+
+		index, err := utils.ToInt(r.FormValue("index"))
+		if erpc.Err(w, err, erpc.StatusBadRequest, "", messages.ConversionError) {
+			return
+		}
+
+		quantity, err := utils.ToInt(r.FormValue("quantity"))
+		if erpc.Err(w, err, erpc.StatusBadRequest, "", messages.ConversionError) {
+			return
+		}
+
+		rec, err := core.TransferREC(index, user.StellarWallet.PublicKey, r.FormValue("destination"), quantity)
+		if erpc.Err(w, err, erpc.StatusBadRequest) {
+			return
+		}
+
+		erpc.MarshalSend(w, rec)
+	})
+}
+
+// retireREC retires some or all of a certificate's RECs on behalf of a beneficiary
+func retireREC() {
+	http.HandleFunc(UserRPC[8][0], func(w http.ResponseWriter, r *http.Request) {
+		user, err := userValidateHelper(w, r, UserRPC[8][2:], UserRPC[8][1])
+		if err != nil {
+			return
+		}
+
+		index, err := utils.ToInt(r.FormValue("index"))
+		if erpc.Err(w, err, erpc.StatusBadRequest, "", messages.ConversionError) {
+			return
+		}
+
+		quantity, err := utils.ToInt(r.FormValue("quantity"))
+		if erpc.Err(w, err, erpc.StatusBadRequest, "", messages.ConversionError) {
+			return
+		}
+
+		rec, err := core.RetireREC(index, user.StellarWallet.PublicKey, quantity, r.FormValue("beneficiary"))
+		if erpc.Err(w, err, erpc.StatusInternalServerError) {
+			return
+		}
+
+		erpc.MarshalSend(w, rec)
+	})
+}
+
+// getIntent returns a transaction built for the user to sign along with its summary and status
+func getIntent() {
+	http.HandleFunc(UserRPC[9][0], func(w http.ResponseWriter, r *http.Request) {
+		user, err := userValidateHelper(w, r, UserRPC[9][2:], UserRPC[9][1])
+		if err != nil {
+			return
+		}
+
+		index, err := utils.ToInt(r.URL.Query()["index"][0])
+		if erpc.Err(w, err, erpc.StatusBadRequest, "", messages.ConversionError) {
+			return
+		}
+
+		intent, err := core.RetrieveIntent(index)
+		if erpc.Err(w, err, erpc.StatusInternalServerError) {
+			return
+		}
+		if intent.UserIndex != user.Index {
+			erpc.ResponseHandler(w, erpc.StatusUnauthorized)
+			return
+		}
+
+		erpc.MarshalSend(w, intent)
+	})
+}
+
+// submitIntent submits a transaction the user signed with their own wallet. The signed envelope
+// must be the transaction the platform built for the intent
+func submitIntent() {
+	http.HandleFunc(UserRPC[10][0], func(w http.ResponseWriter, r *http.Request) {
+		user, err := userValidateHelper(w, r, UserRPC[10][2:], UserRPC[10][1])
+		if err != nil {
+			return
+		}
+
+		index, err := utils.ToInt(r.FormValue("index"))
+		if erpc.Err(w, err, erpc.StatusBadRequest, "", messages.ConversionError) {
+			return
+		}
+
+		intent, err := core.SubmitIntent(index, user.Index, r.FormValue("signedxdr"))
+		if erpc.Err(w, err, erpc.StatusBadRequest) {
+			return
+		}
+
+		erpc.MarshalSend(w, intent)
+	})
+}
+
+// completeIntent retries the platform's part of a submitted transaction that couldn't be completed
+func completeIntent() {
+	http.HandleFunc(UserRPC[11][0], func(w http.ResponseWriter, r *http.Request) {
+		user, err := userValidateHelper(w, r, UserRPC[11][2:], UserRPC[11][1])
+		if err != nil {
+			return
+		}
+
+		index, err := utils.ToInt(r.FormValue("index"))
+		if erpc.Err(w, err, erpc.StatusBadRequest, "", messages.ConversionError) {
+			return
+		}
+
+		intent, err := core.CompleteIntent(index, user.Index)
+		if erpc.Err(w, err, erpc.StatusBadRequest) {
+			return
+		}
+
+		erpc.MarshalSend(w, intent)
+	})
+}
@@ -211,7 +211,7 @@ func sandbox() error {
 	wg1.Add(1)
 	go func(wg *sync.WaitGroup) {
 		defer wg.Done()
-		txhash, err1 := assets.TrustAsset(consts.StablecoinCode, consts.StablecoinPublicKey, stablecoinTrustLimit, consts.PlatformSeed)
+		txhash, err1 := core.PlatformTrust(consts.StablecoinCode, consts.StablecoinPublicKey, stablecoinTrustLimit)
 		if err != nil {
 			log.Fatal(err1)
 		}
@@ -117,6 +117,13 @@ func ParseInput(input []string) {
 		fmt.Println("          Balance Left: ", LocalProject.BalLeft)
 		fmt.Println("          Date Initiated: ", 0)
 		fmt.Println("          Date Last Paid: ", time.Unix(LocalProject.DateLastPaid, 0))
+		pending, failed, err := queueDepth()
+		if err != nil {
+			log.Println(err)
+			return
+		}
+		fmt.Println("          Outbound Queue Depth: ", pending)
+		fmt.Println("          Dropped Operations: ", failed)
 	// end of display
 	case commands[6]:
 		if len(input) != 1 {
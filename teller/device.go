@@ -0,0 +1,163 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+	"github.com/stellar/go/keypair"
+
+	erpc "github.com/Varunram/essentials/rpc"
+	consts "github.com/YaleOpenLab/opensolar/consts"
+	core "github.com/YaleOpenLab/opensolar/core"
+	rpc "github.com/YaleOpenLab/opensolar/rpc"
+)
+
+// the teller signs every energy report and state hash with a device keypair generated on first
+// boot. The counter that goes into each signature is persisted before the report is sent so that
+// a reboot never reuses a counter the platform has already seen.
+
+var (
+	deviceKey     *keypair.Full
+	deviceCounter uint64
+	deviceLock    sync.Mutex
+)
+
+// loadDeviceKey loads the device keypair and report counter from storage, generating a new
+// keypair if none exists
+func loadDeviceKey() error {
+	keyPath := consts.TellerHomeDir + "/devicekey.seed"
+	counterPath := consts.TellerHomeDir + "/devicecounter"
+
+	data, err := ioutil.ReadFile(keyPath)
+	if os.IsNotExist(err) {
+		colorOutput(CyanColor, "generating device keypair")
+		deviceKey, err = keypair.Random()
+		if err != nil {
+			return errors.Wrap(err, "could not generate device keypair")
+		}
+		err = ioutil.WriteFile(keyPath, []byte(deviceKey.Seed()), 0600)
+		if err != nil {
+			return errors.Wrap(err, "could not write device keypair to file")
+		}
+	} else if err != nil {
+		return errors.Wrap(err, "could not read device keypair")
+	} else {
+		deviceKey, err = keypair.ParseFull(strings.TrimSpace(string(data)))
+		if err != nil {
+			return errors.Wrap(err, "could not parse device keypair")
+		}
+	}
+
+	data, err = ioutil.ReadFile(counterPath)
+	if os.IsNotExist(err) {
+		deviceCounter = 0
+		return nil
+	} else if err != nil {
+		return errors.Wrap(err, "could not read device counter")
+	}
+
+	deviceCounter, err = strconv.ParseUint(strings.TrimSpace(string(data)), 10, 64)
+	if err != nil {
+		return errors.Wrap(err, "could not parse device counter")
+	}
+	return nil
+}
+
+// signBase64 signs a message with the device keypair
+func signBase64(message []byte) (string, error) {
+	sig, err := deviceKey.Sign(message)
+	if err != nil {
+		return "", errors.Wrap(err, "could not sign message")
+	}
+	return base64.StdEncoding.EncodeToString(sig), nil
+}
+
+// signReport advances and persists the device counter and signs a report with it. It returns
+// the counter and the signature to send along with the report
+func signReport(kind string, payload string) (string, string, error) {
+	deviceLock.Lock()
+	defer deviceLock.Unlock()
+
+	if deviceKey == nil {
+		return "", "", errors.New("device keypair not loaded")
+	}
+
+	counter := deviceCounter + 1
+	err := ioutil.WriteFile(consts.TellerHomeDir+"/devicecounter", []byte(strconv.FormatUint(counter, 10)), 0600)
+	if err != nil {
+		return "", "", errors.Wrap(err, "could not persist device counter")
+	}
+	deviceCounter = counter
+
+	signature, err := signBase64(core.DeviceMessage(DeviceID, kind, counter, payload))
+	if err != nil {
+		return "", "", err
+	}
+	return strconv.FormatUint(counter, 10), signature, nil
+}
+
+// rotateDeviceKey generates a new device keypair and registers it with the platform. The new key
+// is signed by both the old and the new keypair so that the platform knows we held the old one.
+// Reports still in the outbound queue are signed again with the new key, since the platform
+// rejects the old one once the new key is registered
+func rotateDeviceKey() error {
+	queueRunLock.Lock()
+	defer queueRunLock.Unlock()
+	deviceLock.Lock()
+	defer deviceLock.Unlock()
+
+	newKey, err := keypair.Random()
+	if err != nil {
+		return errors.Wrap(err, "could not generate device keypair")
+	}
+
+	message := core.DeviceMessage(DeviceID, core.DeviceReportRegister, 0, newKey.Address())
+	oldSignature, err := signBase64(message)
+	if err != nil {
+		return err
+	}
+
+	sig, err := newKey.Sign(message)
+	if err != nil {
+		return errors.Wrap(err, "could not sign message")
+	}
+
+	postdata := basePostData()
+	postdata.Set("deviceId", DeviceID)
+	postdata.Set("pubkey", newKey.Address())
+	postdata.Set("signature", base64.StdEncoding.EncodeToString(sig))
+	postdata.Set("oldsignature", oldSignature)
+
+	data, err := erpc.PostForm(APIURL+rpc.RecpRPC[5][0], postdata)
+	if err != nil {
+		return err
+	}
+
+	var x erpc.StatusResponse
+	err = json.Unmarshal(data, &x)
+	if err != nil {
+		return errors.Wrap(err, "could not unmarshal response")
+	}
+	if x.Code != 200 {
+		return rejectedError{x.Code, "platform rejected the new device key"}
+	}
+
+	// the platform has the new key, persist it before using it
+	err = ioutil.WriteFile(consts.TellerHomeDir+"/devicekey.seed", []byte(newKey.Seed()), 0600)
+	if err != nil {
+		return errors.Wrap(err, "could not write device keypair to file")
+	}
+	deviceKey = newKey
+
+	err = resignQueue(newKey)
+	if err != nil {
+		return errors.Wrap(err, "could not sign queued reports with the new device key")
+	}
+	return nil
+}
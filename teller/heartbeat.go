@@ -0,0 +1,53 @@
+package main
+
+import (
+	"encoding/json"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+
+	erpc "github.com/Varunram/essentials/rpc"
+	consts "github.com/YaleOpenLab/opensolar/consts"
+	rpc "github.com/YaleOpenLab/opensolar/rpc"
+)
+
+// TellerVersion is the firmware version that the teller reports to the platform's fleet registry
+var TellerVersion = "1.1.0"
+
+// sendHeartbeat reports the teller's firmware and outbound queue depth to the platform. Heartbeats
+// aren't queued since a late heartbeat says nothing about the teller's health
+func sendHeartbeat() error {
+	pending, _, err := queueDepth()
+	if err != nil {
+		return errors.Wrap(err, "could not read queue depth")
+	}
+
+	postdata := basePostData()
+	postdata.Set("projIndex", strconv.Itoa(LocalProject.Index))
+	postdata.Set("firmware", TellerVersion)
+	postdata.Set("queuedepth", strconv.Itoa(pending))
+
+	data, err := erpc.PostForm(APIURL+rpc.RecpRPC[32][0], postdata)
+	if err != nil {
+		return err
+	}
+
+	var x erpc.StatusResponse
+	err = json.Unmarshal(data, &x)
+	if err == nil && x.Code != 0 && x.Code != 200 {
+		return errors.New("heartbeat not accepted, status: " + strconv.Itoa(x.Code))
+	}
+	return nil
+}
+
+// heartbeat sends a heartbeat to the platform every consts.TellerHeartbeatInterval
+func heartbeat() {
+	for {
+		err := sendHeartbeat()
+		if err != nil {
+			colorOutput(RedColor, "could not send heartbeat", err)
+		}
+		time.Sleep(consts.TellerHeartbeatInterval)
+	}
+}
@@ -9,6 +9,7 @@ import (
 	"io/ioutil"
 	"log"
 	"os"
+	"strconv"
 	"strings"
 	"time"
 
@@ -19,6 +20,7 @@ import (
 	//	rpc "github.com/YaleOpenLab/openx/rpc"
 	erpc "github.com/Varunram/essentials/rpc"
 	consts "github.com/YaleOpenLab/opensolar/consts"
+	core "github.com/YaleOpenLab/opensolar/core"
 	oracle "github.com/YaleOpenLab/opensolar/oracle"
 )
 
@@ -106,19 +108,20 @@ func splitAndSend2Tx(memo string) (string, string, error) {
 
 func checkPayback() {
 	for {
+		refreshLogin(loginUsername, loginPwhash)
+		standing, err := hasStandingOrder()
+		if err == nil && standing {
+			colorOutput(CyanColor, "Payback interval reached. Platform pays back via standing order, skipping")
+			time.Sleep(time.Duration(LocalProject.PaybackPeriod) * consts.OneWeekInSecond)
+			continue
+		}
+
 		colorOutput(CyanColor, "Payback interval reached. Paying back automatically")
 		assetName := LocalProject.DebtAssetCode
 		amount := float64(EnergyValue)*oracle.MonthlyBill()/1000000 + 1
-		refreshLogin(loginUsername, loginPwhash)
-		err := projectPayback(assetName, amount)
+		err = queuePayback(assetName, amount)
 		if err != nil {
-			colorOutput(RedColor, "Error while paying back", err, "trying again")
-			time.Sleep(5 * time.Second)
-			refreshLogin(loginUsername, loginPwhash)
-			err = projectPayback(assetName, amount)
-			if err != nil {
-				sendDevicePaybackFailedEmail()
-			}
+			colorOutput(RedColor, "Error while queueing payback", err)
 		}
 		time.Sleep(time.Duration(LocalProject.PaybackPeriod) * consts.OneWeekInSecond)
 	}
@@ -148,22 +151,17 @@ func updateState(trigger bool) {
 
 		// don't use platform RPCs for interacting with the blockchain
 
-		hash1, err := sendXLM(LocalRecipient.U.StellarWallet.PublicKey, float64(utils.Unix()), ipfsHash[:28])
+		err = queueMemo(LocalRecipient.U.StellarWallet.PublicKey, float64(utils.Unix()), ipfsHash[:28])
 		if err != nil {
 			colorOutput(RedColor, err)
 		}
 
-		log.Println(hash1)
-		time.Sleep(5 * time.Second)
-
-		hash2, err := sendXLM(LocalRecipient.U.StellarWallet.PublicKey, float64(utils.Unix()), ipfsHash[29:])
+		err = queueMemo(LocalRecipient.U.StellarWallet.PublicKey, float64(utils.Unix()), ipfsHash[28:])
 		if err != nil {
 			colorOutput(RedColor, err)
 		}
 
-		log.Println(hash2)
-		// we updated state as hash1 and hash2
-		colorOutput(MagentaColor, "Updated State: "+hash1+" "+hash2)
+		colorOutput(MagentaColor, "Queued State Update: "+ipfsHash)
 		if trigger {
 			break // we trigerred this manually, don't want to keep doing this
 		}
@@ -172,6 +170,50 @@ func updateState(trigger bool) {
 	}
 }
 
+// anchorHashChain commits a new hash chain header to the blockchain so that the platform can verify
+// the chain. The header is split across memos sent to ourselves, tagged with the anchor's sequence
+// number so that the platform can pair them
+func anchorHashChain(header string) {
+	seq, err := nextAnchorSeq()
+	if err != nil {
+		colorOutput(RedColor, "could not anchor hash chain header", err)
+		return
+	}
+
+	for _, memo := range core.HashChainMemos(seq, header) {
+		err = queueMemo(LocalRecipient.U.StellarWallet.PublicKey, 1, memo)
+		if err != nil {
+			colorOutput(RedColor, "could not anchor hash chain header", err)
+			return
+		}
+	}
+
+	colorOutput(MagentaColor, "Queued hash chain header anchor: "+header)
+}
+
+// nextAnchorSeq advances and persists the sequence number of hash chain anchors
+func nextAnchorSeq() (uint64, error) {
+	seqPath := consts.TellerHomeDir + "/anchorseq"
+
+	var seq uint64
+	data, err := ioutil.ReadFile(seqPath)
+	if err == nil {
+		seq, err = strconv.ParseUint(strings.TrimSpace(string(data)), 10, 64)
+		if err != nil {
+			return 0, errors.Wrap(err, "could not parse anchor sequence")
+		}
+	} else if !os.IsNotExist(err) {
+		return 0, errors.Wrap(err, "could not read anchor sequence")
+	}
+
+	seq++
+	err = ioutil.WriteFile(seqPath, []byte(strconv.FormatUint(seq, 10)), 0600)
+	if err != nil {
+		return 0, errors.Wrap(err, "could not persist anchor sequence")
+	}
+	return seq, nil
+}
+
 func storeDataInIpfs(data string) (string, error) {
 	form := url.Values{}
 	form.Add("username", LocalRecipient.U.Username)
@@ -226,9 +268,10 @@ func commitDataShutdown() {
 		log.Println("error while closing file: ", err)
 	}
 
-	err = storeStateHistory(fileHash)
+	// the queue persists across reboots, so the hash is stored even if we're offline
+	err = queueStateHistory(fileHash)
 	if err != nil {
-		return
+		colorOutput(RedColor, "could not queue state hash", err)
 	}
 }
 
@@ -266,10 +309,6 @@ func checkDeviceID() error {
 			return errors.Wrap(err, "could not write device id to file")
 		}
 		file.Close()
-		err = setDeviceID(LocalRecipient.U.Username, deviceID)
-		if err != nil {
-			return errors.Wrap(err, "could not store device id in remote platform")
-		}
 	}
 	return nil
 }
@@ -308,7 +347,7 @@ type energyStruct struct {
 	AssetID         string `json:"asset_id"`
 }
 
-func updateEnergyData() error {
+func updateEnergyData(flush bool) error {
 	EnergyValue = 0
 
 	origPath := "data.txt"
@@ -344,7 +383,7 @@ func updateEnergyData() error {
 			break
 		}
 		colorOutput(CyanColor, "File size is: ", size.Size())
-		if size.Size() >= int64(consts.TellerMaxLocalStorageSize) {
+		if size.Size() >= int64(consts.TellerMaxLocalStorageSize) || flush {
 			colorOutput(CyanColor, "flushing data to ipfs")
 			// close the file, store in ipfs, get hash, delete file and create same file again
 			// with the previous file's hash (so people can verify) as the first line
@@ -358,6 +397,7 @@ func updateEnergyData() error {
 				colorOutput(RedColor, "Couldn't hash file: ", err)
 			}
 			HashChainHeader = fileHash
+			anchorHashChain(fileHash)
 			fileHash = "IPFSHASHCHAIN: " + fileHash + "\n" // the header of the ipfs hashchain that we form
 			// colorOutput(CyanColor, "HashChainHeader: ", HashChainHeader)
 			os.Remove(hcPath)
@@ -429,29 +469,35 @@ func updateEnergyData() error {
 // readEnergyData reads energy data from a local file and stores it in the remote opensolar instance
 func readEnergyData() {
 	for {
-		time.Sleep(LocalProject.PaybackPeriod * consts.OneWeekInSecond / 2)
+		// flush requests from admins are run here so that only this loop touches the data files
+		var flushed chan string
+		select {
+		case <-time.After(LocalProject.PaybackPeriod * consts.OneWeekInSecond / 2):
+		case flushed = <-flushRequests:
+		}
+
+		// the login is refreshed by its own goroutine, refreshLogin never returns
 		colorOutput(CyanColor, "reading energy data from file")
-		refreshLogin(loginUsername, loginPwhash)
-		err := updateEnergyData()
+		err := updateEnergyData(flushed != nil)
 		if err != nil {
 			colorOutput(RedColor, "error while reading energy data: ", err)
-			err := updateEnergyData()
+			err := updateEnergyData(flushed != nil)
 			if err != nil {
+				if flushed != nil {
+					flushed <- ""
+				}
 				continue
 			}
 		}
+		if flushed != nil {
+			flushed <- HashChainHeader
+		}
 
 		// need to update remote with the energy data
 		colorOutput(CyanColor, "storing energy data on opensolar")
-		refreshLogin(loginUsername, loginPwhash)
-		data, err := putEnergy(EnergyValue)
+		err = queueEnergy(EnergyValue)
 		if err != nil {
-			colorOutput(RedColor, err)
-			data, err = putEnergy(EnergyValue)
-			if err != nil {
-				continue
-			}
+			colorOutput(RedColor, "could not queue energy data", err)
 		}
-		colorOutput(CyanColor, string(data))
 	}
 }
@@ -71,6 +71,28 @@ func StartTeller() error {
 		return errors.Wrap(err, "could not get device id from local storage")
 	}
 
+	err = loadDeviceKey()
+	if err != nil {
+		return errors.Wrap(err, "could not load device keypair")
+	}
+
+	err = openQueue()
+	if err != nil {
+		return errors.Wrap(err, "could not open outbound queue")
+	}
+	go runQueue() // replay operations queued before a reboot
+	go pollCommands()
+
+	// register the device id and key with the platform on first boot (or if the platform
+	// doesn't have our key yet)
+	if LocalRecipient.DeviceID != DeviceID || LocalRecipient.DevicePublicKey != deviceKey.Address() {
+		err = setDeviceID(LocalRecipient.U.Username, DeviceID)
+		if err != nil {
+			return errors.Wrap(err, "could not store device id in remote platform")
+		}
+	}
+	go heartbeat() // heartbeats are recorded against the registered device id
+
 	err = storeStartTime()
 	if err != nil {
 		return errors.Wrap(err, "could not store start time locally")
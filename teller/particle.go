@@ -9,6 +9,7 @@ import (
 	"time"
 
 	consts "github.com/YaleOpenLab/opensolar/consts"
+	"github.com/spf13/viper"
 )
 
 // storeParticleDataLocal stores the data we observe in real time to a file
@@ -23,7 +24,13 @@ func storeParticleDataLocal() {
 	}
 	client := &http.Client{Transport: transport}
 
-	body := "https://api.particle.io/v1/devices/events?access_token=3f7d69aa99956fd77c5466f3f52eb6132f500210"
+	accessToken := viper.GetString("particletoken")
+	if accessToken == "" {
+		log.Println("particletoken not set in config, not streaming particle data")
+		return
+	}
+
+	body := "https://api.particle.io/v1/devices/events?access_token=" + accessToken
 	resp, err := client.Get(body)
 	if err != nil {
 		log.Println("error while reading from streaming endpoint: ", err)
@@ -0,0 +1,427 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/pkg/errors"
+	"github.com/stellar/go/keypair"
+
+	utils "github.com/Varunram/essentials/utils"
+	consts "github.com/YaleOpenLab/opensolar/consts"
+	core "github.com/YaleOpenLab/opensolar/core"
+)
+
+// all outbound platform and ledger operations go through a durable queue stored under the
+// teller's home directory. Operations are replayed strictly in the order they were queued (signed
+// reports carry increasing counters and anchors are split across consecutive memos) and survive
+// reboots. Network errors are retried with exponential backoff, while operations the platform
+// rejects are dropped after consts.TellerQueueMaxRejections attempts. Operations that move funds
+// can't be sent twice, so before they're retried the recipient's account is checked for a
+// transaction with their memo sent since the first attempt, and they're dropped after
+// consts.TellerQueueMaxSendAttempts attempts.
+
+// Outbound operations
+const (
+	queueOpPayback = "payback" // pay back towards the project
+	queueOpEnergy  = "energy"  // store a signed energy report
+	queueOpState   = "state"   // store a signed state hash
+	queueOpXLM     = "xlm"     // send xlm to an account with a memo
+	queueOpAck     = "ack"     // acknowledge a remote command
+)
+
+var (
+	queuePending = []byte("Pending")
+	queueFailed  = []byte("Failed")
+)
+
+var (
+	queueDB     *bolt.DB
+	queueNotify = make(chan struct{}, 1)
+	// queueRunLock is held while an operation runs so that the device key can't be rotated while
+	// a report signed with the old key is being sent
+	queueRunLock sync.Mutex
+)
+
+// queueItem is a single outbound operation
+type queueItem struct {
+	// ID is the position of the item in the queue
+	ID uint64
+	// Op is the operation to be run
+	Op string
+	// Params are the operation's parameters
+	Params map[string]string
+	// Attempts is the number of times the operation has been tried
+	Attempts int
+	// Rejections is the number of times the platform rejected the operation
+	Rejections int
+	// NextAttempt is the unix time before which the operation must not be retried
+	NextAttempt int64
+	// FirstAttempt is the unix time at which the operation was first tried
+	FirstAttempt int64
+	// CreatedAt is the unix time at which the operation was queued
+	CreatedAt int64
+	// LastError is the error returned by the most recent attempt
+	LastError string
+}
+
+// rejectedError is returned when the platform responded but didn't accept an operation
+type rejectedError struct {
+	code int
+	msg  string
+}
+
+func (e rejectedError) Error() string {
+	return e.msg
+}
+
+// permanent returns true if retrying the operation can't succeed (eg a replayed report)
+func (e rejectedError) permanent() bool {
+	return e.code >= 400 && e.code < 500
+}
+
+// queueHandlers maps each operation to the function that runs it
+var queueHandlers = map[string]func(params map[string]string) error{
+	queueOpPayback: func(params map[string]string) error {
+		amount, err := utils.ToFloat(params["amount"])
+		if err != nil {
+			return rejectedError{400, "invalid payback amount"}
+		}
+		return projectPayback(params["assetName"], amount)
+	},
+	queueOpEnergy: func(params map[string]string) error {
+		return putEnergy(params["energy"], params["counter"], params["signature"])
+	},
+	queueOpState: func(params map[string]string) error {
+		return storeStateHistory(params["hash"], params["counter"], params["signature"])
+	},
+	queueOpAck: func(params map[string]string) error {
+		return ackCommand(params["index"], params["success"], params["result"])
+	},
+	queueOpXLM: func(params map[string]string) error {
+		amount, err := utils.ToFloat(params["amount"])
+		if err != nil {
+			return rejectedError{400, "invalid xlm amount"}
+		}
+		txhash, err := sendXLM(params["destination"], amount, params["memo"])
+		if err != nil {
+			return err
+		}
+		colorOutput(MagentaColor, "sent xlm with memo "+params["memo"]+": "+txhash)
+		return nil
+	},
+}
+
+// queueMemos returns the memo that the transaction sent by an operation that moves funds carries
+var queueMemos = map[string]func(params map[string]string) string{
+	queueOpPayback: func(params map[string]string) string {
+		return core.PaybackMemo(LocalProject.Index)
+	},
+	queueOpXLM: func(params map[string]string) string {
+		return params["memo"]
+	},
+}
+
+// landed checks whether an earlier attempt of an operation that moves funds made it on-chain even
+// though it returned an error. Returns the hash of the transaction if it did
+func landed(item queueItem) (string, error) {
+	memo, exists := queueMemos[item.Op]
+	if !exists || item.Attempts == 0 {
+		return "", nil
+	}
+	// leave some room for the difference between our clock and the ledger's
+	return core.FindMemoTx(LocalRecipient.U.StellarWallet.PublicKey, memo(item.Params), item.FirstAttempt-60)
+}
+
+// openQueue opens the outbound queue, creating it if it doesn't exist
+func openQueue() error {
+	var err error
+	queueDB, err = bolt.Open(consts.TellerHomeDir+"/queue.db", 0600, &bolt.Options{Timeout: 1 * time.Second})
+	if err != nil {
+		return errors.Wrap(err, "could not open outbound queue")
+	}
+
+	return queueDB.Update(func(tx *bolt.Tx) error {
+		for _, bucket := range [][]byte{queuePending, queueFailed} {
+			_, err := tx.CreateBucketIfNotExists(bucket)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// queueKey returns the key of an item in the queue
+func queueKey(id uint64) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, id)
+	return key
+}
+
+// enqueue adds an operation to the end of the queue
+func enqueue(op string, params map[string]string) error {
+	err := queueDB.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(queuePending)
+		id, err := b.NextSequence()
+		if err != nil {
+			return err
+		}
+
+		item := queueItem{ID: id, Op: op, Params: params, CreatedAt: utils.Unix()}
+		encoded, err := json.Marshal(item)
+		if err != nil {
+			return err
+		}
+		return b.Put(queueKey(id), encoded)
+	})
+	if err != nil {
+		return errors.Wrap(err, "could not queue operation")
+	}
+
+	select {
+	case queueNotify <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// queueDepth returns the number of pending and dropped operations
+func queueDepth() (int, int, error) {
+	var pending, failed int
+	err := queueDB.View(func(tx *bolt.Tx) error {
+		pending = tx.Bucket(queuePending).Stats().KeyN
+		failed = tx.Bucket(queueFailed).Stats().KeyN
+		return nil
+	})
+	return pending, failed, err
+}
+
+// queueHead returns the oldest pending operation
+func queueHead() (queueItem, bool, error) {
+	var item queueItem
+	var found bool
+	err := queueDB.View(func(tx *bolt.Tx) error {
+		_, v := tx.Bucket(queuePending).Cursor().First()
+		if v == nil {
+			return nil
+		}
+		found = true
+		return json.Unmarshal(v, &item)
+	})
+	return item, found, err
+}
+
+// backoff returns the delay before the next retry of an operation that failed attempts times
+func backoff(attempts int) time.Duration {
+	delay := consts.TellerQueueBaseBackoff
+	for i := 1; i < attempts && delay < consts.TellerQueueMaxBackoff; i++ {
+		delay *= 2
+	}
+	if delay > consts.TellerQueueMaxBackoff {
+		delay = consts.TellerQueueMaxBackoff
+	}
+	return delay
+}
+
+// settle records the result of running the head of the queue
+func settle(item queueItem, err error) error {
+	return queueDB.Update(func(tx *bolt.Tx) error {
+		pending := tx.Bucket(queuePending)
+		if err == nil {
+			return pending.Delete(queueKey(item.ID))
+		}
+
+		item.Attempts++
+		item.LastError = err.Error()
+
+		drop := false
+		if rerr, ok := err.(rejectedError); ok {
+			item.Rejections++
+			drop = rerr.permanent() || item.Rejections >= consts.TellerQueueMaxRejections
+		}
+		if _, sends := queueMemos[item.Op]; sends && item.Attempts >= consts.TellerQueueMaxSendAttempts {
+			drop = true
+		}
+
+		if !drop {
+			item.NextAttempt = time.Now().Add(backoff(item.Attempts)).Unix()
+		}
+
+		encoded, merr := json.Marshal(item)
+		if merr != nil {
+			return merr
+		}
+
+		if drop {
+			colorOutput(RedColor, "dropping queued operation", item.Op, item.ID, "after", item.Attempts, "attempts:", err)
+			err := tx.Bucket(queueFailed).Put(queueKey(item.ID), encoded)
+			if err != nil {
+				return err
+			}
+			return pending.Delete(queueKey(item.ID))
+		}
+
+		return pending.Put(queueKey(item.ID), encoded)
+	})
+}
+
+// runQueue replays queued operations in order, forever
+func runQueue() {
+	for {
+		item, found, err := queueHead()
+		if err != nil {
+			colorOutput(RedColor, "could not read outbound queue", err)
+			time.Sleep(consts.TellerQueueBaseBackoff)
+			continue
+		}
+
+		if !found {
+			<-queueNotify
+			continue
+		}
+
+		if wait := item.NextAttempt - utils.Unix(); wait > 0 {
+			select {
+			case <-time.After(time.Duration(wait) * time.Second):
+			case <-queueNotify:
+			}
+			continue
+		}
+
+		if item.FirstAttempt == 0 {
+			item.FirstAttempt = utils.Unix()
+		}
+
+		queueRunLock.Lock()
+		txhash, err := landed(item)
+		if err != nil {
+			err = errors.Wrap(err, "could not check whether the previous attempt went through")
+		} else if txhash != "" {
+			colorOutput(MagentaColor, "queued operation", item.Op, item.ID, "already on-chain in tx", txhash)
+		} else {
+			handler, exists := queueHandlers[item.Op]
+			if !exists {
+				err = rejectedError{400, "unknown operation " + item.Op}
+			} else {
+				err = handler(item.Params)
+			}
+		}
+		queueRunLock.Unlock()
+
+		if err != nil {
+			colorOutput(RedColor, "queued operation", item.Op, item.ID, "failed:", err)
+			if item.Op == queueOpPayback && item.Attempts == 2 {
+				// let the platform know that paybacks are failing, as we did before the queue
+				go sendDevicePaybackFailedEmail()
+			}
+		}
+
+		err = settle(item, err)
+		if err != nil {
+			colorOutput(RedColor, "could not update outbound queue", err)
+			time.Sleep(consts.TellerQueueBaseBackoff)
+		}
+	}
+}
+
+// resignQueue signs the pending reports again with a new device key, keeping their counters. The
+// caller holds queueRunLock
+func resignQueue(key *keypair.Full) error {
+	return queueDB.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(queuePending)
+
+		var items []queueItem
+		err := b.ForEach(func(k, v []byte) error {
+			var item queueItem
+			err := json.Unmarshal(v, &item)
+			if err != nil {
+				return err
+			}
+			items = append(items, item)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		for _, item := range items {
+			var kind, payload string
+			switch item.Op {
+			case queueOpEnergy:
+				kind, payload = core.DeviceReportEnergy, item.Params["energy"]
+			case queueOpState:
+				kind, payload = core.DeviceReportState, item.Params["hash"]
+			default:
+				continue
+			}
+
+			counter, err := strconv.ParseUint(item.Params["counter"], 10, 64)
+			if err != nil {
+				return errors.Wrap(err, "could not parse counter of queued report")
+			}
+			sig, err := key.Sign(core.DeviceMessage(DeviceID, kind, counter, payload))
+			if err != nil {
+				return errors.Wrap(err, "could not sign queued report")
+			}
+			item.Params["signature"] = base64.StdEncoding.EncodeToString(sig)
+
+			encoded, err := json.Marshal(item)
+			if err != nil {
+				return err
+			}
+			err = b.Put(queueKey(item.ID), encoded)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// queuePayback queues a payback towards the project
+func queuePayback(assetName string, amount float64) error {
+	amountS, err := utils.ToString(amount)
+	if err != nil {
+		return err
+	}
+	return enqueue(queueOpPayback, map[string]string{"assetName": assetName, "amount": amountS})
+}
+
+// queueEnergy signs and queues an energy report. Reports are signed when they're queued so that
+// a retried report keeps its counter and can't be double counted by the platform
+func queueEnergy(energy uint32) error {
+	energyS, err := utils.ToString(energy)
+	if err != nil {
+		return err
+	}
+
+	counter, signature, err := signReport(core.DeviceReportEnergy, energyS)
+	if err != nil {
+		return err
+	}
+	return enqueue(queueOpEnergy, map[string]string{"energy": energyS, "counter": counter, "signature": signature})
+}
+
+// queueStateHistory signs and queues a state hash
+func queueStateHistory(hash string) error {
+	counter, signature, err := signReport(core.DeviceReportState, hash)
+	if err != nil {
+		return err
+	}
+	return enqueue(queueOpState, map[string]string{"hash": hash, "counter": counter, "signature": signature})
+}
+
+// queueMemo queues an xlm payment carrying a memo
+func queueMemo(destination string, amount float64, memo string) error {
+	amountS, err := utils.ToString(amount)
+	if err != nil {
+		return err
+	}
+	return enqueue(queueOpXLM, map[string]string{"destination": destination, "amount": amountS, "memo": memo})
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/viper"
+
+	erpc "github.com/Varunram/essentials/rpc"
+	utils "github.com/Varunram/essentials/utils"
+	consts "github.com/YaleOpenLab/opensolar/consts"
+	core "github.com/YaleOpenLab/opensolar/core"
+	rpc "github.com/YaleOpenLab/opensolar/rpc"
+)
+
+// admins can change the teller's config and send it one off commands through the platform. The
+// teller polls for them, runs each one and acknowledges it with a result through the outbound
+// queue. Config changes are persisted locally so that they survive a reboot.
+
+// flushRequests asks the energy loop to flush the data file to ipfs regardless of its size. The
+// loop replies with the new hash chain header on the passed channel
+var flushRequests = make(chan chan string)
+
+// remoteConfigPath is the file where config pushed by admins is stored
+func remoteConfigPath() string {
+	return consts.TellerHomeDir + "/remoteconfig.json"
+}
+
+// applyConfig applies a single config change
+func applyConfig(key string, value string) error {
+	switch key {
+	case "pollinterval":
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return errors.Wrap(err, "could not parse poll interval")
+		}
+		consts.TellerPollInterval = d
+	case "loginrefresh":
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return errors.Wrap(err, "could not parse login refresh interval")
+		}
+		consts.LoginRefreshInterval = d
+	case "maxstorage":
+		size, err := strconv.Atoi(value)
+		if err != nil {
+			return errors.Wrap(err, "could not parse max storage size")
+		}
+		consts.TellerMaxLocalStorageSize = size
+	case "brokerurl":
+		// the subscriber is set up from config at start, so this takes effect on the next boot
+		viper.Set("mqttbroker", value)
+	case "apiurl":
+		viper.Set("apiurl", value)
+		APIURL = value
+	default:
+		return errors.New("config key not recognized")
+	}
+	return nil
+}
+
+// readRemoteConfig reads the config pushed by admins from storage
+func readRemoteConfig() (map[string]string, error) {
+	config := make(map[string]string)
+	data, err := ioutil.ReadFile(remoteConfigPath())
+	if os.IsNotExist(err) {
+		return config, nil
+	} else if err != nil {
+		return config, errors.Wrap(err, "could not read remote config")
+	}
+
+	err = json.Unmarshal(data, &config)
+	if err != nil {
+		return config, errors.Wrap(err, "could not unmarshal remote config")
+	}
+	return config, nil
+}
+
+// loadRemoteConfig applies the config pushed by admins before the last reboot
+func loadRemoteConfig() error {
+	config, err := readRemoteConfig()
+	if err != nil {
+		return err
+	}
+
+	for key, value := range config {
+		err = applyConfig(key, value)
+		if err != nil {
+			colorOutput(RedColor, "could not apply remote config", key, err)
+		}
+	}
+	return nil
+}
+
+// setRemoteConfig persists and applies a config change
+func setRemoteConfig(key string, value string) error {
+	config, err := readRemoteConfig()
+	if err != nil {
+		return err
+	}
+
+	err = applyConfig(key, value)
+	if err != nil {
+		return err
+	}
+
+	config[key] = value
+	data, err := json.Marshal(config)
+	if err != nil {
+		return errors.Wrap(err, "could not marshal remote config")
+	}
+	return ioutil.WriteFile(remoteConfigPath(), data, 0600)
+}
+
+// runRemoteCommand runs a config change or command and returns its result
+func runRemoteCommand(cmd core.TellerCommand) (string, error) {
+	if cmd.Kind == core.TellerKindConfig {
+		err := setRemoteConfig(cmd.Name, cmd.Value)
+		if err != nil {
+			return "", err
+		}
+		return "set " + cmd.Name + " to " + cmd.Value, nil
+	}
+
+	switch cmd.Name {
+	case "updatestate":
+		updateState(true)
+		return "state update queued", nil
+	case "flushchain":
+		// the energy loop owns the data files and EnergyValue, so the flush runs there
+		reply := make(chan string, 1)
+		select {
+		case flushRequests <- reply:
+		case <-time.After(consts.TellerCommandPollInterval):
+			return "", errors.New("energy loop busy, could not flush hash chain")
+		}
+		header := <-reply
+		if header == "" {
+			return "", errors.New("could not flush hash chain")
+		}
+		return "flushed hash chain, header: " + header, nil
+	case "rotatecredentials":
+		err := rotateDeviceKey()
+		if err != nil {
+			return "", err
+		}
+		return "rotated device key to " + deviceKey.Address(), nil
+	}
+	return "", errors.New("command not recognized")
+}
+
+// ackCommand acknowledges a command on the platform
+func ackCommand(index string, success string, result string) error {
+	postdata := basePostData()
+	postdata.Set("index", index)
+	postdata.Set("projIndex", strconv.Itoa(LocalProject.Index))
+	postdata.Set("success", success)
+	postdata.Set("result", result)
+
+	data, err := erpc.PostForm(APIURL+rpc.RecpRPC[31][0], postdata)
+	if err != nil {
+		return err
+	}
+
+	var x erpc.StatusResponse
+	err = json.Unmarshal(data, &x)
+	if err != nil {
+		return errors.Wrap(err, "could not unmarshal response")
+	}
+	if x.Code != 200 {
+		return rejectedError{x.Code, "command acknowledgement not accepted"}
+	}
+	return nil
+}
+
+// pollCommands polls the platform for config changes and commands every consts.TellerCommandPollInterval
+func pollCommands() {
+	for {
+		time.Sleep(consts.TellerCommandPollInterval)
+
+		data, err := httpsGet(rpc.RecpRPC[30], "&projIndex="+strconv.Itoa(LocalProject.Index))
+		if err != nil {
+			colorOutput(RedColor, "could not poll for commands", err)
+			continue
+		}
+
+		var cmds []core.TellerCommand
+		err = json.Unmarshal(data, &cmds)
+		if err != nil {
+			colorOutput(RedColor, "could not unmarshal commands", string(data), err)
+			continue
+		}
+
+		for _, cmd := range cmds {
+			index := strconv.Itoa(cmd.Index)
+			colorOutput(CyanColor, "received remote "+cmd.Kind+": "+cmd.Name+" "+cmd.Value)
+
+			if cmd.Kind == core.TellerKindCommand && cmd.Name == "shutdown" {
+				// acknowledge before going down since the queue won't run again until we're back
+				err = ackCommand(index, "true", "shutting down at "+utils.Timestamp())
+				if err != nil {
+					colorOutput(RedColor, "could not acknowledge shutdown", err)
+				}
+				err = endHandler()
+				if err != nil {
+					colorOutput(RedColor, err)
+				}
+				os.Exit(0)
+			}
+
+			success := "true"
+			result, err := runRemoteCommand(cmd)
+			if err != nil {
+				success, result = "false", err.Error()
+			}
+
+			err = enqueue(queueOpAck, map[string]string{"index": index, "success": success, "result": result})
+			if err != nil {
+				colorOutput(RedColor, "could not queue command acknowledgement", err)
+			}
+		}
+	}
+}
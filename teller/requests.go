@@ -204,7 +204,7 @@ func projectPayback(assetName string, amountx float64) error {
 		colorOutput(GreenColor, "PAID!")
 		return nil
 	}
-	return errors.New("Errored out")
+	return rejectedError{x.Code, "payback not accepted"}
 }
 
 // SetDeviceId sets the device id of the teller
@@ -218,6 +218,15 @@ func setDeviceID(username string, deviceID string) error {
 	log.Println("deviceid", deviceID)
 	postdata.Set("deviceId", deviceID)
 
+	// prove that we hold the device key we're registering
+	pubkey := deviceKey.Address()
+	signature, err := signBase64(core.DeviceMessage(deviceID, core.DeviceReportRegister, 0, pubkey))
+	if err != nil {
+		return err
+	}
+	postdata.Set("pubkey", pubkey)
+	postdata.Set("signature", signature)
+
 	data, err := erpc.PostForm(APIURL+rpc.RecpRPC[5][0], postdata)
 	if err != nil {
 		return err
@@ -369,6 +378,28 @@ func getLocalProjectDetails(projIndexx int) (opensolar.Project, error) {
 	return x, nil
 }
 
+// hasStandingOrder checks whether the platform pays back towards the local project on the
+// recipient's behalf, in which case the teller shouldn't pay back itself
+func hasStandingOrder() (bool, error) {
+	data, err := httpsGet(rpc.RecpRPC[29])
+	if err != nil {
+		return false, err
+	}
+
+	var x []opensolar.StandingOrder
+	err = json.Unmarshal(data, &x)
+	if err != nil {
+		return false, err
+	}
+
+	for _, order := range x {
+		if order.ProjIndex == LocalProject.Index && order.Active {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
 // sendDevicePaybackFailedEmail sends a notification if the payback routine breaks in its execution
 func sendDevicePaybackFailedEmail() error {
 
@@ -396,10 +427,12 @@ func sendDevicePaybackFailedEmail() error {
 	return errors.New("Errored out, didn't receive 200")
 }
 
-// storeStateHistory stores state history in the data file
-func storeStateHistory(hash string) error {
+// storeStateHistory stores a signed state hash in the recipient's list of state hashes
+func storeStateHistory(hash string, counter string, signature string) error {
 	postdata := basePostData()
 	postdata.Set("hash", hash)
+	postdata.Set("counter", counter)
+	postdata.Set("signature", signature)
 
 	data, err := erpc.PostForm(APIURL+rpc.RecpRPC[16][0], postdata)
 	if err != nil {
@@ -415,10 +448,10 @@ func storeStateHistory(hash string) error {
 	}
 
 	if x.Code == 200 {
-		colorOutput(GreenColor, "SENT FAILED PAYBACK EMAIL")
+		colorOutput(GreenColor, "STORED STATE HASH")
 		return nil
 	}
-	return errors.New("Errored out, didn't receive 200")
+	return rejectedError{x.Code, "state hash not accepted"}
 }
 
 // testSwytch tests whether the swytch workflow works correctly
@@ -527,8 +560,9 @@ func sendXLM(publickey string, amountx float64, memo string) (string, error) {
 		return "", err
 	}
 
+	// memo is an optional param, so we pass it along with the last required param
 	data, err := httpsGet(orpc.UserRPC[7], "&destination="+
-		publickey, "&amount="+amount, "&seedpwd="+LocalSeedPwd)
+		publickey, "&amount="+amount, "&seedpwd="+LocalSeedPwd+"&memo="+url.QueryEscape(memo))
 
 	if err != nil {
 		colorOutput(RedColor, err)
@@ -544,7 +578,7 @@ func sendXLM(publickey string, amountx float64, memo string) (string, error) {
 
 	if len(txhash) != 66 { // include the quotes at the start and end
 		data, err := httpsGet(orpc.UserRPC[7], "&destination="+
-			publickey, "&amount="+amount, "&seedpwd="+LocalSeedPwd)
+			publickey, "&amount="+amount, "&seedpwd="+LocalSeedPwd+"&memo="+url.QueryEscape(memo))
 
 		if err != nil {
 			colorOutput(RedColor, err)
@@ -559,7 +593,7 @@ func sendXLM(publickey string, amountx float64, memo string) (string, error) {
 		}
 
 		if len(txhash) != 66 { // include the quotes at the start and end
-			return txhash, errors.New("xlm transaction not broadcast")
+			return txhash, rejectedError{0, "xlm transaction not broadcast"}
 		}
 	}
 	return txhash, err
@@ -640,21 +674,28 @@ func getIpfsData(hash string) (string, error) {
 	return string(data), err
 }
 
-func putEnergy(energyx uint32) ([]byte, error) {
-
-	energy, err := utils.ToString(energyx)
-	if err != nil {
-		colorOutput(RedColor, err)
-		return nil, err
-	}
-
+// putEnergy stores a signed energy report on the platform
+func putEnergy(energy string, counter string, signature string) error {
 	postdata := basePostData()
 	postdata.Set("energy", energy)
+	postdata.Set("counter", counter)
+	postdata.Set("signature", signature)
 
 	data, err := erpc.PostForm(APIURL+rpc.RecpRPC[23][0], postdata)
 	if err != nil {
-		return nil, err
+		return err
+	}
+
+	var x erpc.StatusResponse
+	err = json.Unmarshal(data, &x)
+	if err != nil {
+		colorOutput(RedColor, string(data), err)
+		return err
 	}
 
-	return data, err
+	colorOutput(CyanColor, string(data))
+	if x.Code == 200 {
+		return nil
+	}
+	return rejectedError{x.Code, "energy report not accepted"}
 }
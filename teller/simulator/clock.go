@@ -0,0 +1,31 @@
+package main
+
+import (
+	"time"
+)
+
+// clock runs simulated time faster than real time so that weeks of generation, paybacks and
+// state updates can be exercised in minutes
+type clock struct {
+	start   time.Time
+	real    time.Time
+	speedup float64
+}
+
+func newClock(start time.Time, speedup float64) *clock {
+	if speedup <= 0 {
+		speedup = 1
+	}
+	return &clock{start: start, real: time.Now(), speedup: speedup}
+}
+
+// now returns the current simulated time
+func (c *clock) now() time.Time {
+	elapsed := float64(time.Since(c.real)) * c.speedup
+	return c.start.Add(time.Duration(elapsed))
+}
+
+// sleep sleeps for a simulated duration
+func (c *clock) sleep(d time.Duration) {
+	time.Sleep(time.Duration(float64(d) / c.speedup))
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"log"
+	"os"
+	"time"
+
+	flags "github.com/jessevdk/go-flags"
+
+	erpc "github.com/Varunram/essentials/rpc"
+)
+
+var opts struct {
+	Num           int           `short:"n" long:"num" description:"Number of virtual tellers" default:"1"`
+	API           string        `long:"api" description:"URL of the opensolar server" default:"http://localhost:8081"`
+	Broker        string        `long:"broker" description:"The MQTT broker url" default:"localhost:1883"`
+	MqttUser      string        `long:"mqttuser" description:"The MQTT username"`
+	MqttPassword  string        `long:"mqttpassword" description:"The MQTT password"`
+	Topic         string        `long:"topic" description:"Topic prefix, teller i publishes on <topic>/<project index>" default:"opensolar"`
+	Qos           int           `long:"qos" description:"MQTT quality of service" default:"1"`
+	Username      string        `long:"username" description:"Recipient username prefix, teller i logs in as <username><i>" default:"recipient"`
+	Pwhash        string        `long:"pwhash" description:"Password hash shared by all simulated recipients" required:"true"`
+	Seedpwd       string        `long:"seedpwd" description:"Seed password shared by all simulated recipients. Paybacks are skipped if empty"`
+	FirstProject  int           `long:"firstproject" description:"Teller i is installed for project <firstproject>+i" default:"1"`
+	Profile       string        `long:"profile" description:"Generation profile: solar, cloudy or outage" default:"solar"`
+	Capacity      float64       `long:"capacity" description:"Peak capacity of each installation in watts" default:"5000"`
+	Interval      time.Duration `long:"interval" description:"Simulated time between two readings" default:"15m"`
+	PaybackPeriod time.Duration `long:"payback" description:"Simulated time between two paybacks" default:"168h"`
+	StatePeriod   time.Duration `long:"state" description:"Simulated time between two state updates" default:"24h"`
+	Speedup       float64       `long:"speedup" description:"How many times faster than real time the clock runs" default:"3600"`
+	Duration      time.Duration `long:"duration" description:"Simulated time to run for, 0 runs forever" default:"0"`
+	Seed          int64         `long:"seed" description:"Random seed for generation profiles" default:"1"`
+}
+
+// ./simulator -n 10 --pwhash <hash> --seedpwd x --profile cloudy --speedup 7200
+// starts 10 tellers for projects 1-10 where every real second is two simulated hours
+
+func main() {
+	_, err := flags.ParseArgs(&opts, os.Args)
+	if err != nil {
+		log.Fatal("Failed to parse arguments / Help command")
+	}
+
+	erpc.SetConsts(60)
+
+	// all tellers share the same simulated clock, starting at midnight today
+	now := time.Now()
+	c := newClock(time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.Local), opts.Speedup)
+
+	var tellers []*virtualTeller
+	for i := 0; i < opts.Num; i++ {
+		t, err := newVirtualTeller(i, c)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		err = t.start()
+		if err != nil {
+			log.Println("could not start teller", i, err)
+			continue
+		}
+		tellers = append(tellers, t)
+	}
+
+	if len(tellers) == 0 {
+		log.Fatal("no tellers started, quitting")
+	}
+
+	start := c.now()
+	for {
+		c.sleep(24 * time.Hour)
+		log.Println("SIMULATED TIME:", c.now().Format(time.RFC1123))
+		for _, t := range tellers {
+			t.lock.Lock()
+			t.logf("published: %d pushed: %d paid back: %d state updates: %d errors: %d",
+				t.stats.published, t.stats.pushed, t.stats.paid, t.stats.states, t.stats.errors)
+			t.lock.Unlock()
+		}
+
+		if opts.Duration != 0 && c.now().Sub(start) >= opts.Duration {
+			for _, t := range tellers {
+				t.client.Disconnect(250)
+			}
+			return
+		}
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"math"
+	"math/rand"
+	"time"
+)
+
+// a generation profile returns the average power (in watts) a panel of the given capacity
+// generates at a given time. Profiles may keep state between calls (clouds persist for a while,
+// outages last a few hours) so each virtual teller has its own instance.
+
+// profile models the generation of a single installation
+type profile interface {
+	// power returns the power generated at t in watts, and false if the device is offline
+	power(t time.Time) (float64, bool)
+}
+
+// newProfile returns the profile with the given name
+func newProfile(name string, capacity float64, rng *rand.Rand) profile {
+	switch name {
+	case "cloudy":
+		return &cloudyProfile{solar: solarProfile{capacity}, rng: rng, cover: 0.5}
+	case "outage":
+		return &outageProfile{cloudy: cloudyProfile{solar: solarProfile{capacity}, rng: rng, cover: 0.2}, rng: rng}
+	default:
+		return solarProfile{capacity}
+	}
+}
+
+// solarProfile is a clear sky bell curve between 6am and 6pm
+type solarProfile struct {
+	capacity float64
+}
+
+func (p solarProfile) power(t time.Time) (float64, bool) {
+	hour := float64(t.Hour()) + float64(t.Minute())/60
+	if hour < 6 || hour > 18 {
+		return 0, true
+	}
+	return p.capacity * math.Sin(math.Pi*(hour-6)/12), true
+}
+
+// cloudyProfile attenuates the solar curve with cloud cover that drifts over time
+type cloudyProfile struct {
+	solar solarProfile
+	rng   *rand.Rand
+	cover float64 // fraction of the sky covered, between 0 and 1
+}
+
+func (p *cloudyProfile) power(t time.Time) (float64, bool) {
+	p.cover += (p.rng.Float64() - 0.5) / 5
+	if p.cover < 0 {
+		p.cover = 0
+	} else if p.cover > 1 {
+		p.cover = 1
+	}
+
+	power, _ := p.solar.power(t)
+	// heavy clouds still let through some diffuse light
+	return power * (1 - 0.75*p.cover), true
+}
+
+// outageProfile is a cloudy profile where the device occasionally goes offline for a few hours
+type outageProfile struct {
+	cloudy cloudyProfile
+	rng    *rand.Rand
+	until  time.Time
+}
+
+func (p *outageProfile) power(t time.Time) (float64, bool) {
+	if t.Before(p.until) {
+		return 0, false
+	}
+	if p.rng.Float64() < 0.01 {
+		p.until = t.Add(time.Duration(1+p.rng.Intn(12)) * time.Hour)
+		return 0, false
+	}
+	return p.cloudy.power(t)
+}
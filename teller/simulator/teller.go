@@ -0,0 +1,338 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math/rand"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stellar/go/keypair"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+
+	erpc "github.com/Varunram/essentials/rpc"
+	consts "github.com/YaleOpenLab/opensolar/consts"
+	core "github.com/YaleOpenLab/opensolar/core"
+	oracle "github.com/YaleOpenLab/opensolar/oracle"
+	rpc "github.com/YaleOpenLab/opensolar/rpc"
+	orpc "github.com/YaleOpenLab/openx/rpc"
+)
+
+// energyStruct is the message published by the teller on its MQTT topic
+type energyStruct struct {
+	ID              string `json:"id"`
+	EnergyTimestamp string `json:"energy_timestamp"`
+	Unit            string `json:"unit"`
+	Value           uint32 `json:"value"`
+	OwnerID         string `json:"owner_id"`
+	AssetID         string `json:"asset_id"`
+	Signature       string `json:"signature"`
+}
+
+// virtualTeller is a simulated teller installed for a single project
+type virtualTeller struct {
+	index     int
+	username  string
+	projIndex int
+	topic     string
+	deviceID  string
+	token     string
+	assetName string
+
+	key     *keypair.Full
+	counter uint64
+
+	profile profile
+	clock   *clock
+	client  mqtt.Client
+
+	reportLock  sync.Mutex // keeps signed reports in counter order while they're sent
+	lock        sync.Mutex // guards the fields below, never held while calling the platform
+	pushEnergy  uint32     // energy generated since the last push to the platform
+	cycleEnergy uint32     // energy generated since the last payback
+	readings    []string
+
+	stats struct {
+		published, pushed, paid, states, errors int
+	}
+}
+
+func newVirtualTeller(index int, c *clock) (*virtualTeller, error) {
+	var err error
+	t := &virtualTeller{
+		index:     index,
+		username:  opts.Username + strconv.Itoa(index),
+		projIndex: opts.FirstProject + index,
+		topic:     opts.Topic + "/" + strconv.Itoa(opts.FirstProject+index),
+		clock:     c,
+	}
+
+	// the platform only accepts the key a recipient first registered, so the device id and key are
+	// derived from the username to stay the same across runs. The counter starts from the current
+	// time so that it is always above the last counter the platform accepted
+	seed := sha256.Sum256([]byte("opensolar-simulator-device:" + t.username))
+	t.deviceID = strings.ToUpper(hex.EncodeToString(seed[:]))[:consts.TellerDeviceIDLen]
+	t.key, err = keypair.FromRawSeed(seed)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not derive device keypair")
+	}
+	t.counter = uint64(time.Now().UnixNano())
+
+	rng := rand.New(rand.NewSource(opts.Seed + int64(index)))
+	t.profile = newProfile(opts.Profile, opts.Capacity, rng)
+	return t, nil
+}
+
+func (t *virtualTeller) logf(format string, args ...interface{}) {
+	log.Printf("[teller %d] "+format, append([]interface{}{t.index}, args...)...)
+}
+
+// post sends a form to the platform and checks that it returned 200
+func (t *virtualTeller) post(endpoint string, form url.Values) error {
+	form.Set("username", t.username)
+	form.Set("token", t.token)
+
+	data, err := erpc.PostForm(opts.API+endpoint, form)
+	if err != nil {
+		return err
+	}
+
+	var x erpc.StatusResponse
+	err = json.Unmarshal(data, &x)
+	if err != nil {
+		return errors.Wrap(err, "could not unmarshal response: "+string(data))
+	}
+	if x.Code != 200 {
+		return errors.New("platform returned " + strconv.Itoa(x.Code) + " for " + endpoint)
+	}
+	return nil
+}
+
+// sign advances the device counter and signs a report. The caller holds both locks
+func (t *virtualTeller) sign(kind string, payload string) (string, string, error) {
+	t.counter++
+	sig, err := t.key.Sign(core.DeviceMessage(t.deviceID, kind, t.counter, payload))
+	if err != nil {
+		return "", "", err
+	}
+	return strconv.FormatUint(t.counter, 10), base64.StdEncoding.EncodeToString(sig), nil
+}
+
+// start logs in, registers the device, connects to the broker and runs all loops
+func (t *virtualTeller) start() error {
+	form := url.Values{}
+	form.Set("username", t.username)
+	form.Set("pwhash", opts.Pwhash)
+	data, err := erpc.PostForm(opts.API+orpc.UserRPC[0][0], form)
+	if err != nil {
+		return errors.Wrap(err, "could not log in")
+	}
+
+	var login struct {
+		Token string
+	}
+	err = json.Unmarshal(data, &login)
+	if err != nil || login.Token == "" {
+		return errors.New("could not log in: " + string(data))
+	}
+	t.token = login.Token
+
+	data, err = erpc.GetRequest(opts.API + rpc.ProjectRPC[3][0] + "?index=" + strconv.Itoa(t.projIndex))
+	if err != nil {
+		return errors.Wrap(err, "could not retrieve project")
+	}
+	var project core.Project
+	err = json.Unmarshal(data, &project)
+	if err != nil {
+		return errors.Wrap(err, "could not unmarshal project")
+	}
+	t.assetName = project.DebtAssetCode
+
+	pubkey := t.key.Address()
+	sig, err := t.key.Sign(core.DeviceMessage(t.deviceID, core.DeviceReportRegister, 0, pubkey))
+	if err != nil {
+		return err
+	}
+	form = url.Values{}
+	form.Set("deviceId", t.deviceID)
+	form.Set("pubkey", pubkey)
+	form.Set("signature", base64.StdEncoding.EncodeToString(sig))
+	err = t.post(rpc.RecpRPC[5][0], form)
+	if err != nil {
+		return errors.Wrap(err, "could not register device")
+	}
+
+	mqttopts := mqtt.NewClientOptions()
+	mqttopts.AddBroker(opts.Broker)
+	mqttopts.SetClientID("simulator-" + t.deviceID)
+	mqttopts.SetUsername(opts.MqttUser)
+	mqttopts.SetPassword(opts.MqttPassword)
+	t.client = mqtt.NewClient(mqttopts)
+	if token := t.client.Connect(); token.Wait() && token.Error() != nil {
+		return errors.Wrap(token.Error(), "could not connect to broker")
+	}
+
+	t.logf("registered device %s for project %d, publishing on %s", t.deviceID, t.projIndex, t.topic)
+
+	go t.generate()
+	go t.every(opts.PaybackPeriod/2, t.push)
+	go t.every(opts.PaybackPeriod, t.payback)
+	go t.every(opts.StatePeriod, t.updateState)
+	return nil
+}
+
+// every runs fn once every simulated period
+func (t *virtualTeller) every(period time.Duration, fn func() error) {
+	for {
+		t.clock.sleep(period)
+		err := fn()
+		if err != nil {
+			t.lock.Lock()
+			t.stats.errors++
+			t.lock.Unlock()
+			t.logf("%v", err)
+		}
+	}
+}
+
+// generate publishes a reading every simulated reading interval
+func (t *virtualTeller) generate() {
+	for {
+		now := t.clock.now()
+		power, online := t.profile.power(now)
+		if online {
+			value := uint32(power * opts.Interval.Hours())
+			x := energyStruct{
+				ID:              fmt.Sprintf("%s-%d", t.deviceID, now.UnixNano()),
+				EnergyTimestamp: strconv.FormatInt(now.Unix(), 10),
+				Unit:            "Wh",
+				Value:           value,
+				OwnerID:         t.deviceID,
+				AssetID:         fmt.Sprintf("SIM-%d", t.index),
+			}
+			sig, err := t.key.Sign(core.DeviceMessage(t.deviceID, core.DeviceReportReading, 0,
+				core.ReadingMessage(x.ID, x.EnergyTimestamp, "", x.Value, x.Unit)))
+			if err != nil {
+				log.Fatal(err)
+			}
+			x.Signature = base64.StdEncoding.EncodeToString(sig)
+			payload, err := json.Marshal(x)
+			if err != nil {
+				log.Fatal(err)
+			}
+
+			token := t.client.Publish(t.topic, byte(opts.Qos), false, payload)
+			token.Wait()
+
+			t.lock.Lock()
+			if token.Error() != nil {
+				t.stats.errors++
+			} else {
+				t.stats.published++
+				t.pushEnergy += value
+				t.cycleEnergy += value
+				t.readings = append(t.readings, string(payload))
+			}
+			t.lock.Unlock()
+		}
+		t.clock.sleep(opts.Interval)
+	}
+}
+
+// push stores the energy generated since the last push on the platform
+func (t *virtualTeller) push() error {
+	t.reportLock.Lock()
+	defer t.reportLock.Unlock()
+
+	t.lock.Lock()
+	pushed := t.pushEnergy
+	energy := strconv.FormatUint(uint64(pushed), 10)
+	counter, signature, err := t.sign(core.DeviceReportEnergy, energy)
+	t.lock.Unlock()
+	if err != nil {
+		return err
+	}
+
+	form := url.Values{}
+	form.Set("energy", energy)
+	form.Set("counter", counter)
+	form.Set("signature", signature)
+	err = t.post(rpc.RecpRPC[23][0], form)
+	if err != nil {
+		return errors.Wrap(err, "could not push energy")
+	}
+
+	t.lock.Lock()
+	t.stats.pushed++
+	t.pushEnergy -= pushed
+	t.lock.Unlock()
+	return nil
+}
+
+// payback pays back for the energy generated since the last payback
+func (t *virtualTeller) payback() error {
+	if t.assetName == "" || opts.Seedpwd == "" {
+		return nil
+	}
+
+	t.lock.Lock()
+	paid := t.cycleEnergy
+	t.lock.Unlock()
+
+	amount := float64(paid)*oracle.MonthlyBill()/1000000 + 1
+	form := url.Values{}
+	form.Set("assetName", t.assetName)
+	form.Set("amount", strconv.FormatFloat(amount, 'f', 7, 64))
+	form.Set("seedpwd", opts.Seedpwd)
+	form.Set("projIndex", strconv.Itoa(t.projIndex))
+	err := t.post(rpc.RecpRPC[4][0], form)
+	if err != nil {
+		return errors.Wrap(err, "could not pay back")
+	}
+
+	t.lock.Lock()
+	t.stats.paid++
+	t.cycleEnergy -= paid
+	t.lock.Unlock()
+	return nil
+}
+
+// updateState stores a hash of the readings published since the last state update
+func (t *virtualTeller) updateState() error {
+	t.reportLock.Lock()
+	defer t.reportLock.Unlock()
+
+	t.lock.Lock()
+	hashed := len(t.readings)
+	sum := sha256.Sum256([]byte(strings.Join(t.readings, "\n")))
+	hash := hex.EncodeToString(sum[:])
+	counter, signature, err := t.sign(core.DeviceReportState, hash)
+	t.lock.Unlock()
+	if err != nil {
+		return err
+	}
+
+	form := url.Values{}
+	form.Set("hash", hash)
+	form.Set("counter", counter)
+	form.Set("signature", signature)
+	err = t.post(rpc.RecpRPC[16][0], form)
+	if err != nil {
+		return errors.Wrap(err, "could not update state")
+	}
+
+	t.lock.Lock()
+	t.stats.states++
+	t.readings = t.readings[hashed:]
+	t.lock.Unlock()
+	return nil
+}
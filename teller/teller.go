@@ -183,6 +183,12 @@ func parseConfig() error {
 		}
 	}
 
+	// apply config pushed by admins before reading it
+	err = loadRemoteConfig()
+	if err != nil {
+		return errors.Wrap(err, "Error while loading remote config")
+	}
+
 	LocalSeedPwd = viper.GetString("seedpwd")
 	loginUsername = viper.GetString("username")
 	loginPwhash = utils.SHA3hash(viper.GetString("password"))
@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"log"
 	"net/smtp"
+	"net/url"
 	"strings"
 	"time"
 
@@ -13,8 +14,13 @@ import (
 
 	erpc "github.com/Varunram/essentials/rpc"
 	utils "github.com/Varunram/essentials/utils"
+
+	consts "github.com/YaleOpenLab/opensolar/consts"
 )
 
+// alertInterval is the minimum time between two IoT hub down emails
+var alertInterval = 2 * 24 * time.Hour
+
 // ParticlePingResponse is a structure to parse returned particle.io data
 type ParticlePingResponse struct {
 	Online bool `json:"online"`
@@ -38,8 +44,14 @@ func main() {
 	accessToken := viper.Get("accessToken").(string) // the access token to access the particle io interface
 	deviceID := viper.Get("deviceId").(string)       // the device id associated with the IoT hub
 
+	location := "S.U.Pasto School, Puerto Rico"
+	if viper.IsSet("location") {
+		location = viper.GetString("location") // where the IoT hub is installed, used in alert emails
+	}
+
 	body := "https://api.particle.io/v1/devices/" + deviceID + "/ping"
 
+	var lastAlert time.Time
 	for {
 		payload := strings.NewReader("access_token=" + accessToken)
 		data, err := erpc.PutRequest(body, payload)
@@ -54,21 +66,47 @@ func main() {
 			return
 		}
 		if !x.Ok || !x.Online {
+			if time.Since(lastAlert) < alertInterval {
+				time.Sleep(consts.TellerHeartbeatInterval)
+				continue
+			}
 			// the platform is not online, so we need to send an email to the platform admins alerting them of the same
 			// read config from the config file
 			// read from config.yaml in the working directory
 			log.Println("SENDING ALERT EMAIL TO: ", email1, "AND:", email2)
 
-			err = SendIoTHubDownEmail("S.U.Pasto School, Puerto Rico", email1, email2)
+			err = SendIoTHubDownEmail(location, email1, email2)
 			if err != nil {
 				log.Println("Failed to send notification, quitting!")
 				return
 			}
+			lastAlert = time.Now()
+		} else if viper.IsSet("apiurl") {
+			err = sendHeartbeat(deviceID)
+			if err != nil {
+				log.Println("could not report heartbeat to the platform", err)
+			}
 		}
-		time.Sleep(2 * 24 * time.Hour) // check every hour whether the IoT Hub is up or not
+		// ping at the heartbeat interval so the fleet registry sees the hub well within FleetHeartbeatTimeout
+		time.Sleep(consts.TellerHeartbeatInterval)
 	}
 }
 
+// sendHeartbeat reports the IoT hub as online to the platform's fleet registry. Needs the apiurl,
+// username, token and projIndex of the recipient the hub is installed for in the config file
+func sendHeartbeat(deviceID string) error {
+	postdata := url.Values{}
+	postdata.Set("username", viper.GetString("username"))
+	postdata.Set("token", viper.GetString("token"))
+	postdata.Set("projIndex", viper.GetString("projIndex"))
+	postdata.Set("deviceId", deviceID)
+	postdata.Set("firmware", "particle")
+	postdata.Set("queuedepth", "0")
+
+	_, err := erpc.PostForm(viper.GetString("apiurl")+"/recipient/teller/heartbeat", postdata)
+	return err
+}
+
 // SendIoTHubDownEmail is an email to the platform notifying that the IoT device for a particular project is down.
 func SendIoTHubDownEmail(location string, email1 string, email2 string) error {
 	body := "Greetings from your remote notifier! \n\nWe're writing to let you know that your remote IoT Hub in: " + location +